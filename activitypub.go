@@ -0,0 +1,1369 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//activitypub federation: the users are Person actors, their blobs are Notes. The remote servers find
+//the actors with webfinger, follow them through the inbox and receive the new blobs (Create) and the
+//likes (Like, Undo) in their inboxes. The local users can follow remote actors from the settings.
+//Every request between the servers is signed with the key of the user (http signatures, rsa-sha256
+//like mastodon), the activities are queued in the database and sent in background with retries
+type FederationConfig struct {
+	//the federation is off by default, the ids of the actors use the base url of the config
+	Enabled bool `yaml:"enabled"`
+	//allows the remote servers on loopback and private addresses, meant for testing with a second local instance
+	AllowPrivate bool `yaml:"allow_private"`
+}
+
+const (
+	activityStreamsContext = "https://www.w3.org/ns/activitystreams"
+	securityContext        = "https://w3id.org/security/v1"
+	publicCollection       = "https://www.w3.org/ns/activitystreams#Public"
+	activityContentType    = "application/activity+json"
+	ldContentType          = `application/ld+json; profile="https://www.w3.org/ns/activitystreams"`
+)
+
+const (
+	//the documents and activities of the remote servers are small
+	apMaxBodySize = 1 << 20
+	//how far the Date of a signed request can be from now, a captured request can be replayed only within it
+	apMaxClockSkew = time.Minute * time.Duration(5)
+	//the remote actors are fetched again after this time, their keys can change
+	apActorRefresh    = time.Hour * time.Duration(24)
+	apOutboxPageSize  = 20
+	apDeliveryBatch   = 20
+	apMaxAttempts     = 8
+	apRequestTimeout  = time.Second * time.Duration(10)
+	apDeliveryPending = "pending"
+	apDeliveryFailed  = "failed"
+)
+
+//Federation sends the queued activities and verifies the requests of the remote servers
+type Federation struct {
+	baseURL string
+	host    string
+	client  *http.Client
+
+	interval time.Duration
+	wake     chan struct{}
+}
+
+//nil when the federation is disabled
+var federation *Federation
+
+//RemoteActor is an actor of another server known by blobber
+type RemoteActor struct {
+	ID          int    `json:"id"`
+	ActorID     string `json:"actor_id"`
+	Username    string `json:"username"`
+	Host        string `json:"host"`
+	Handle      string `json:"handle"`
+	inbox       string
+	sharedInbox string
+	keyID       string
+	publicKey   string
+	fetchedAt   time.Time
+}
+
+//RemoteFollowing is a remote actor followed by a local user, accepted when the remote server answered
+type RemoteFollowing struct {
+	ID        int         `json:"id"`
+	Actor     RemoteActor `json:"actor"`
+	Accepted  bool        `json:"accepted"`
+	CreatedAt time.Time   `json:"created_at"`
+}
+
+type apPublicKey struct {
+	ID           string `json:"id"`
+	Owner        string `json:"owner"`
+	PublicKeyPem string `json:"publicKeyPem"`
+}
+
+type apEndpoints struct {
+	SharedInbox string `json:"sharedInbox,omitempty"`
+}
+
+type apActor struct {
+	Context           interface{}  `json:"@context,omitempty"`
+	ID                string       `json:"id"`
+	Type              string       `json:"type"`
+	PreferredUsername string       `json:"preferredUsername"`
+	Name              string       `json:"name,omitempty"`
+	Summary           string       `json:"summary,omitempty"`
+	Inbox             string       `json:"inbox"`
+	Outbox            string       `json:"outbox,omitempty"`
+	Followers         string       `json:"followers,omitempty"`
+	Following         string       `json:"following,omitempty"`
+	URL               interface{}  `json:"url,omitempty"`
+	PublicKey         apPublicKey  `json:"publicKey"`
+	Endpoints         *apEndpoints `json:"endpoints,omitempty"`
+}
+
+type apNote struct {
+	Context      interface{} `json:"@context,omitempty"`
+	ID           string      `json:"id"`
+	Type         string      `json:"type"`
+	AttributedTo string      `json:"attributedTo"`
+	Content      string      `json:"content"`
+	Published    string      `json:"published"`
+	To           []string    `json:"to"`
+	Cc           []string    `json:"cc"`
+	URL          string      `json:"url"`
+}
+
+type apActivity struct {
+	Context   interface{} `json:"@context,omitempty"`
+	ID        string      `json:"id"`
+	Type      string      `json:"type"`
+	Actor     string      `json:"actor"`
+	Object    interface{} `json:"object"`
+	Published string      `json:"published,omitempty"`
+	To        []string    `json:"to,omitempty"`
+	Cc        []string    `json:"cc,omitempty"`
+}
+
+type apCollection struct {
+	Context      interface{}   `json:"@context,omitempty"`
+	ID           string        `json:"id"`
+	Type         string        `json:"type"`
+	TotalItems   int           `json:"totalItems"`
+	OrderedItems []interface{} `json:"orderedItems,omitempty"`
+}
+
+//an activity received in the inbox, the object can be an id or an embedded object
+type apIncomingActivity struct {
+	ID     string          `json:"id"`
+	Type   string          `json:"type"`
+	Actor  string          `json:"actor"`
+	Object json.RawMessage `json:"object"`
+}
+
+type apWebFinger struct {
+	Subject string            `json:"subject"`
+	Aliases []string          `json:"aliases,omitempty"`
+	Links   []apWebFingerLink `json:"links"`
+}
+
+type apWebFingerLink struct {
+	Rel  string `json:"rel"`
+	Type string `json:"type,omitempty"`
+	Href string `json:"href,omitempty"`
+}
+
+func NewFederation(c FederationConfig, baseURL string) (*Federation, error) {
+	if !c.Enabled {
+		return nil, nil
+	}
+	u, err := parseBaseURL(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	return &Federation{
+		baseURL:  strings.TrimSuffix(baseURL, "/"),
+		host:     strings.ToLower(u.Host),
+		client:   newOutgoingClient(apRequestTimeout, c.AllowPrivate),
+		interval: time.Second * time.Duration(5),
+		wake:     make(chan struct{}, 1),
+	}, nil
+}
+
+//* urls of the local objects
+
+func (f *Federation) actorURL(userID int) string {
+	return f.baseURL + activityActor.Path(userID)
+}
+
+func (f *Federation) keyID(userID int) string {
+	return f.actorURL(userID) + "#main-key"
+}
+
+func (f *Federation) noteURL(blobID int) string {
+	return f.baseURL + activityNote.Path(blobID)
+}
+
+func (f *Federation) profileURL(userID int) string {
+	return f.baseURL + strings.Replace(getUserPage.String(), "{id}", strconv.Itoa(userID), 1)
+}
+
+//localUserID returns the id of the user if the url is one of the local actors
+func (f *Federation) localUserID(actorURL string) (int, bool) {
+	prefix := f.baseURL + strings.Split(activityActor.String(), "{")[0]
+	if !strings.HasPrefix(actorURL, prefix) {
+		return 0, false
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(actorURL, prefix))
+	return id, err == nil
+}
+
+//* keys
+
+//userKey returns the key of the user, it's created the first time the user federates
+func userKey(userID int) (*rsa.PrivateKey, string, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return nil, "", err
+	}
+	defer db.Close()
+
+	var privatePem, publicPem string
+	err = db.QueryRow("SELECT private_key, public_key FROM activitypub_keys WHERE ID_user = ?", userID).Scan(&privatePem, &publicPem)
+	if err == sql.ErrNoRows {
+		var key *rsa.PrivateKey
+		var publicDer []byte
+		if key, err = rsa.GenerateKey(rand.Reader, 2048); err != nil {
+			return nil, "", err
+		}
+		if publicDer, err = x509.MarshalPKIXPublicKey(&key.PublicKey); err != nil {
+			return nil, "", err
+		}
+		privatePem = string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+		publicPem = string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDer}))
+		//two replicas can create it at the same time, the first one wins
+		if _, err = db.Exec("INSERT IGNORE INTO activitypub_keys (ID_user, private_key, public_key) VALUES (?, ?, ?)", userID, privatePem, publicPem); err != nil {
+			return nil, "", err
+		}
+		err = db.QueryRow("SELECT private_key, public_key FROM activitypub_keys WHERE ID_user = ?", userID).Scan(&privatePem, &publicPem)
+	}
+	if err != nil {
+		return nil, "", err
+	}
+
+	block, _ := pem.Decode([]byte(privatePem))
+	if block == nil {
+		return nil, "", fmt.Errorf("invalid private key of user %d", userID)
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, "", err
+	}
+	return key, publicPem, nil
+}
+
+func parsePublicKey(publicPem string) (*rsa.PublicKey, error) {
+	block, _ := pem.Decode([]byte(publicPem))
+	if block == nil {
+		return nil, fmt.Errorf("invalid public key")
+	}
+	//mastodon uses pkix, some servers pkcs1
+	if key, err := x509.ParsePKIXPublicKey(block.Bytes); err == nil {
+		if rsaKey, ok := key.(*rsa.PublicKey); ok {
+			return rsaKey, nil
+		}
+		return nil, fmt.Errorf("the public key is not rsa")
+	}
+	return x509.ParsePKCS1PublicKey(block.Bytes)
+}
+
+//* http signatures
+
+func apDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func signingString(r *http.Request, headers []string) string {
+	lines := make([]string, len(headers))
+	for i, h := range headers {
+		var value string
+		switch h {
+		case "(request-target)":
+			value = strings.ToLower(r.Method) + " " + r.URL.RequestURI()
+		case "host":
+			value = r.Host
+			if value == "" {
+				value = r.URL.Host
+			}
+		default:
+			value = r.Header.Get(h)
+		}
+		lines[i] = h + ": " + value
+	}
+	return strings.Join(lines, "\n")
+}
+
+//signRequest adds the Date, Digest (with a body) and Signature headers
+func signRequest(r *http.Request, keyID string, key *rsa.PrivateKey, body []byte) error {
+	r.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	headers := []string{"(request-target)", "host", "date"}
+	if body != nil {
+		r.Header.Set("Digest", apDigest(body))
+		headers = append(headers, "digest")
+	}
+
+	hashed := sha256.Sum256([]byte(signingString(r, headers)))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		keyID, strings.Join(headers, " "), base64.StdEncoding.EncodeToString(signature)))
+	return nil
+}
+
+//parseSignature splits the Signature header, es: keyId="...",headers="...",signature="..."
+func parseSignature(header string) map[string]string {
+	params := make(map[string]string)
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(strings.TrimSpace(part), "=", 2)
+		if len(kv) == 2 {
+			params[kv[0]] = strings.Trim(kv[1], `"`)
+		}
+	}
+	return params
+}
+
+//verifyRequest checks the signature of a request of a remote server and returns the actor that signed it,
+//signer is the local user whose key signs the fetch of the actor
+func (f *Federation) verifyRequest(r *http.Request, body []byte, signer int) (RemoteActor, error) {
+	params := parseSignature(r.Header.Get("Signature"))
+	keyID, signature := params["keyId"], params["signature"]
+	if keyID == "" || signature == "" {
+		return RemoteActor{}, fmt.Errorf("missing signature")
+	}
+	headers := strings.Fields(strings.ToLower(params["headers"]))
+	required := map[string]bool{"(request-target)": false, "host": false, "date": false, "digest": body == nil}
+	for _, h := range headers {
+		if _, ok := required[h]; ok {
+			required[h] = true
+		}
+	}
+	for h, signed := range required {
+		if !signed {
+			return RemoteActor{}, fmt.Errorf("the signature must cover %s", h)
+		}
+	}
+
+	if body != nil && r.Header.Get("Digest") != apDigest(body) {
+		return RemoteActor{}, fmt.Errorf("the digest doesn't match the body")
+	}
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil || time.Since(date) > apMaxClockSkew || time.Until(date) > apMaxClockSkew {
+		return RemoteActor{}, fmt.Errorf("invalid or expired date")
+	}
+	rawSignature, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return RemoteActor{}, fmt.Errorf("invalid signature encoding")
+	}
+	hashed := sha256.Sum256([]byte(signingString(r, headers)))
+
+	actor, err := f.remoteActorByKeyID(keyID, signer, false)
+	if err != nil {
+		return RemoteActor{}, err
+	}
+	verify := func(actor RemoteActor) error {
+		key, err := parsePublicKey(actor.publicKey)
+		if err != nil {
+			return err
+		}
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, hashed[:], rawSignature)
+	}
+	if err = verify(actor); err != nil {
+		//the key could have changed since the actor was saved
+		if actor, err = f.remoteActorByKeyID(keyID, signer, true); err != nil {
+			return RemoteActor{}, err
+		}
+		if err = verify(actor); err != nil {
+			return RemoteActor{}, fmt.Errorf("invalid signature")
+		}
+	}
+	return actor, nil
+}
+
+//* remote actors
+
+const remoteActorColumnsQuery = "SELECT ID, actor_id, username, host, inbox, IFNULL(shared_inbox, ''), key_id, public_key, fetched_at FROM remote_actors"
+
+func scanRemoteActor(row rowScanner) (RemoteActor, error) {
+	var a RemoteActor
+	err := row.Scan(&a.ID, &a.ActorID, &a.Username, &a.Host, &a.inbox, &a.sharedInbox, &a.keyID, &a.publicKey, &a.fetchedAt)
+	if err != nil {
+		return RemoteActor{}, err
+	}
+	a.Handle = a.Username + "@" + a.Host
+	return a, nil
+}
+
+//fetch gets a json document of a remote server, signed with the key of the user
+func (f *Federation) fetch(uri, accept string, signer int, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, uri, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", accept)
+	req.Header.Set("User-Agent", "Blobber (+"+f.baseURL+")")
+	key, _, err := userKey(signer)
+	if err != nil {
+		return err
+	}
+	if err = signRequest(req, f.keyID(signer), key, nil); err != nil {
+		return err
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", uri, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, apMaxBodySize)).Decode(v)
+}
+
+//remoteActor returns the actor, fetched from its server if it's not saved or refresh is true
+func (f *Federation) remoteActor(actorID string, signer int, refresh bool) (RemoteActor, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return RemoteActor{}, err
+	}
+	defer db.Close()
+
+	actor, err := scanRemoteActor(db.QueryRow(remoteActorColumnsQuery+" WHERE actor_id = ?", actorID))
+	if err == nil && !refresh && time.Since(actor.fetchedAt) < apActorRefresh {
+		return actor, nil
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return RemoteActor{}, err
+	}
+
+	if _, local := f.localUserID(actorID); local {
+		return RemoteActor{}, fmt.Errorf("%s is a local actor", actorID)
+	}
+	var doc apActor
+	if err = f.fetch(actorID, activityContentType, signer, &doc); err != nil {
+		return RemoteActor{}, err
+	}
+	//the document must describe the actor that was asked, the key must belong to it
+	u, err := url.Parse(actorID)
+	if err != nil || doc.ID != actorID || doc.Inbox == "" || doc.PublicKey.Owner != actorID || doc.PublicKey.PublicKeyPem == "" {
+		return RemoteActor{}, fmt.Errorf("invalid actor document %s", actorID)
+	}
+	sharedInbox := sql.NullString{}
+	if doc.Endpoints != nil && doc.Endpoints.SharedInbox != "" {
+		sharedInbox = sql.NullString{String: doc.Endpoints.SharedInbox, Valid: true}
+	}
+
+	_, err = db.Exec(`INSERT INTO remote_actors (actor_id, username, host, inbox, shared_inbox, key_id, public_key, fetched_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE username = VALUES(username), inbox = VALUES(inbox),
+		shared_inbox = VALUES(shared_inbox), key_id = VALUES(key_id), public_key = VALUES(public_key), fetched_at = VALUES(fetched_at)`,
+		actorID, doc.PreferredUsername, strings.ToLower(u.Host), doc.Inbox, sharedInbox, doc.PublicKey.ID, doc.PublicKey.PublicKeyPem, time.Now())
+	if err != nil {
+		return RemoteActor{}, err
+	}
+	return scanRemoteActor(db.QueryRow(remoteActorColumnsQuery+" WHERE actor_id = ?", actorID))
+}
+
+//remoteActorByKeyID returns the owner of the key, the key id is the actor id with a fragment
+func (f *Federation) remoteActorByKeyID(keyID string, signer int, refresh bool) (RemoteActor, error) {
+	actorID := strings.SplitN(keyID, "#", 2)[0]
+	actor, err := f.remoteActor(actorID, signer, refresh)
+	if err != nil {
+		return RemoteActor{}, err
+	}
+	if actor.keyID != keyID {
+		return RemoteActor{}, fmt.Errorf("the key %s doesn't belong to %s", keyID, actorID)
+	}
+	return actor, nil
+}
+
+//resolveHandle finds the actor of a handle (user@host) with webfinger, an actor url is used as is
+func (f *Federation) resolveHandle(handle string, signer int) (RemoteActor, error) {
+	handle = strings.TrimPrefix(strings.TrimSpace(handle), "@")
+	if strings.HasPrefix(handle, "https://") || strings.HasPrefix(handle, "http://") {
+		return f.remoteActor(handle, signer, false)
+	}
+	parts := strings.Split(handle, "@")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return RemoteActor{}, fmt.Errorf("%w: invalid handle, es: user@example.com", errBadRequest)
+	}
+	if strings.EqualFold(parts[1], f.host) {
+		return RemoteActor{}, fmt.Errorf("%w: %s is a local user, follow it from the profile", errBadRequest, handle)
+	}
+
+	//the remote server uses the same scheme, http only in the local tests
+	scheme := strings.SplitN(f.baseURL, "://", 2)[0]
+	webFingerURL := scheme + "://" + parts[1] + webFinger.String() + "?resource=" + url.QueryEscape("acct:"+handle)
+	var jrd apWebFinger
+	if err := f.fetch(webFingerURL, "application/jrd+json", signer, &jrd); err != nil {
+		return RemoteActor{}, fmt.Errorf("%w: %s not found: %v", errBadRequest, handle, err)
+	}
+	for _, link := range jrd.Links {
+		if link.Rel == "self" && (link.Type == activityContentType || strings.HasPrefix(link.Type, "application/ld+json")) {
+			actor, err := f.remoteActor(link.Href, signer, false)
+			if err != nil {
+				return RemoteActor{}, fmt.Errorf("%w: %s not available: %v", errBadRequest, handle, err)
+			}
+			return actor, nil
+		}
+	}
+	return RemoteActor{}, fmt.Errorf("%w: %s is not an activitypub actor", errBadRequest, handle)
+}
+
+//* documents of the local objects
+
+func (f *Federation) actorDocument(user User, publicPem string) apActor {
+	actorURL := f.actorURL(user.ID)
+	return apActor{
+		Context:           []string{activityStreamsContext, securityContext},
+		ID:                actorURL,
+		Type:              "Person",
+		PreferredUsername: user.Username,
+		Name:              user.Username,
+		Summary:           html.EscapeString(user.Description),
+		Inbox:             f.baseURL + activityInbox.Path(user.ID),
+		Outbox:            f.baseURL + activityOutbox.Path(user.ID),
+		Followers:         f.baseURL + activityFollowers.Path(user.ID),
+		Following:         f.baseURL + activityFollowing.Path(user.ID),
+		URL:               f.profileURL(user.ID),
+		PublicKey: apPublicKey{
+			ID:           f.keyID(user.ID),
+			Owner:        actorURL,
+			PublicKeyPem: publicPem,
+		},
+	}
+}
+
+func (f *Federation) noteDocument(blob Blob) apNote {
+	content := strings.Replace(html.EscapeString(blob.Content), "\n", "<br>", -1)
+	return apNote{
+		ID:           f.noteURL(blob.ID),
+		Type:         "Note",
+		AttributedTo: f.actorURL(blob.UserID),
+		Content:      "<p>" + content + "</p>",
+		Published:    blob.AddedDate.UTC().Format(time.RFC3339),
+		To:           []string{publicCollection},
+		Cc:           []string{f.baseURL + activityFollowers.Path(blob.UserID)},
+		URL:          f.profileURL(blob.UserID),
+	}
+}
+
+func (f *Federation) createActivity(blob Blob) apActivity {
+	note := f.noteDocument(blob)
+	return apActivity{
+		Context:   activityStreamsContext,
+		ID:        note.ID + "/activity",
+		Type:      "Create",
+		Actor:     note.AttributedTo,
+		Object:    note,
+		Published: note.Published,
+		To:        note.To,
+		Cc:        note.Cc,
+	}
+}
+
+//likeActivity has a fixed id so the Undo can point to it
+func (f *Federation) likeActivity(blobID, likerID int) apActivity {
+	actorURL := f.actorURL(likerID)
+	return apActivity{
+		Context: activityStreamsContext,
+		ID:      actorURL + "#likes/" + strconv.Itoa(blobID),
+		Type:    "Like",
+		Actor:   actorURL,
+		Object:  f.noteURL(blobID),
+	}
+}
+
+func (f *Federation) followActivity(userID int, actor RemoteActor) apActivity {
+	actorURL := f.actorURL(userID)
+	return apActivity{
+		Context: activityStreamsContext,
+		ID:      actorURL + "#follows/" + strconv.Itoa(actor.ID),
+		Type:    "Follow",
+		Actor:   actorURL,
+		Object:  actor.ActorID,
+	}
+}
+
+func (f *Federation) undoActivity(activity apActivity) apActivity {
+	activity.Context = nil
+	return apActivity{
+		Context: activityStreamsContext,
+		ID:      activity.ID + "/undo/" + strconv.FormatInt(time.Now().Unix(), 10),
+		Type:    "Undo",
+		Actor:   activity.Actor,
+		Object:  activity,
+	}
+}
+
+//* followers and followings
+
+//remoteFollowerInboxes returns the inboxes of the remote followers of the user, the shared inboxes
+//are used once for all the followers of the same server
+func remoteFollowerInboxes(userID int) ([]string, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT DISTINCT IFNULL(a.shared_inbox, a.inbox) FROM remote_followers f
+		JOIN remote_actors a ON a.ID = f.ID_actor WHERE f.ID_user = ?`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var inboxes []string
+	for rows.Next() {
+		var inbox string
+		if err = rows.Scan(&inbox); err != nil {
+			return nil, err
+		}
+		inboxes = append(inboxes, inbox)
+	}
+	return inboxes, rows.Err()
+}
+
+func countRemoteFollowers(userID int) (int, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM remote_followers WHERE ID_user = ?", userID).Scan(&count)
+	return count, err
+}
+
+//GetRemoteFollowers returns the remote actors following the user
+func (u User) GetRemoteFollowers() ([]RemoteActor, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return []RemoteActor{}, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT a.ID, a.actor_id, a.username, a.host, a.inbox, IFNULL(a.shared_inbox, ''), a.key_id, a.public_key, a.fetched_at
+		FROM remote_followers f JOIN remote_actors a ON a.ID = f.ID_actor WHERE f.ID_user = ? ORDER BY f.created_at DESC`, u.ID)
+	if err != nil {
+		return []RemoteActor{}, err
+	}
+	defer rows.Close()
+
+	var actors []RemoteActor
+	for rows.Next() {
+		a, err := scanRemoteActor(rows)
+		if err != nil {
+			return []RemoteActor{}, err
+		}
+		actors = append(actors, a)
+	}
+	return actors, rows.Err()
+}
+
+//GetRemoteFollowings returns the remote actors the user follows or asked to follow
+func (u User) GetRemoteFollowings() ([]RemoteFollowing, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return []RemoteFollowing{}, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT f.ID, f.accepted, f.created_at, a.ID, a.actor_id, a.username, a.host, a.inbox, IFNULL(a.shared_inbox, ''),
+		a.key_id, a.public_key, a.fetched_at FROM remote_followings f JOIN remote_actors a ON a.ID = f.ID_actor
+		WHERE f.ID_user = ? ORDER BY f.created_at DESC`, u.ID)
+	if err != nil {
+		return []RemoteFollowing{}, err
+	}
+	defer rows.Close()
+
+	var followings []RemoteFollowing
+	for rows.Next() {
+		var f RemoteFollowing
+		a := &f.Actor
+		err = rows.Scan(&f.ID, &f.Accepted, &f.CreatedAt, &a.ID, &a.ActorID, &a.Username, &a.Host, &a.inbox, &a.sharedInbox,
+			&a.keyID, &a.publicKey, &a.fetchedAt)
+		if err != nil {
+			return []RemoteFollowing{}, err
+		}
+		a.Handle = a.Username + "@" + a.Host
+		followings = append(followings, f)
+	}
+	return followings, rows.Err()
+}
+
+//FollowRemote sends a Follow to the remote actor, the following is accepted when the server answers
+func (u User) FollowRemote(handle string) (RemoteFollowing, error) {
+	actor, err := federation.resolveHandle(handle, u.ID)
+	if err != nil {
+		if errors.Is(err, errBadRequest) {
+			return RemoteFollowing{}, err
+		}
+		return RemoteFollowing{}, fmt.Errorf("%w: %s not available: %v", errBadRequest, handle, err)
+	}
+
+	db, err := connectToDB()
+	if err != nil {
+		return RemoteFollowing{}, fmt.Errorf("internal server error: %v", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec(`INSERT INTO remote_followings (ID_user, ID_actor) VALUES (?, ?)
+		ON DUPLICATE KEY UPDATE ID_actor = ID_actor`, u.ID, actor.ID)
+	if err != nil {
+		return RemoteFollowing{}, fmt.Errorf("internal server error: %v", err)
+	}
+	var following RemoteFollowing
+	err = db.QueryRow("SELECT ID, accepted, created_at FROM remote_followings WHERE ID_user = ? AND ID_actor = ?", u.ID, actor.ID).
+		Scan(&following.ID, &following.Accepted, &following.CreatedAt)
+	if err != nil {
+		return RemoteFollowing{}, fmt.Errorf("internal server error: %v", err)
+	}
+	following.Actor = actor
+
+	//sent again even if already accepted, the remote server ignores the duplicates
+	if err = enqueueActivity(u.ID, []string{actor.inbox}, federation.followActivity(u.ID, actor)); err != nil {
+		return RemoteFollowing{}, fmt.Errorf("internal server error: %v", err)
+	}
+	return following, nil
+}
+
+//UnfollowRemote sends the Undo of the Follow and forgets the following
+func (u User) UnfollowRemote(id int) error {
+	db, err := connectToDB()
+	if err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	defer db.Close()
+
+	actor, err := scanRemoteActor(db.QueryRow(`SELECT a.ID, a.actor_id, a.username, a.host, a.inbox, IFNULL(a.shared_inbox, ''), a.key_id,
+		a.public_key, a.fetched_at FROM remote_followings f JOIN remote_actors a ON a.ID = f.ID_actor WHERE f.ID = ? AND f.ID_user = ?`, id, u.ID))
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w: following not found", errBadRequest)
+	}
+	if err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+
+	if _, err = db.Exec("DELETE FROM remote_followings WHERE ID = ?", id); err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	undo := federation.undoActivity(federation.followActivity(u.ID, actor))
+	if err = enqueueActivity(u.ID, []string{actor.inbox}, undo); err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	return nil
+}
+
+//* delivery
+
+//enqueueActivity saves a delivery of the activity for every inbox, signed later with the key of the user
+func enqueueActivity(userID int, inboxes []string, activity apActivity) error {
+	if len(inboxes) == 0 {
+		return nil
+	}
+	payload, err := json.Marshal(activity)
+	if err != nil {
+		return err
+	}
+
+	db, err := connectToDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	now := time.Now()
+	values := make([]string, len(inboxes))
+	args := make([]interface{}, 0, len(inboxes)*5)
+	for i, inbox := range inboxes {
+		values[i] = "(?, ?, ?, ?, ?)"
+		args = append(args, userID, inbox, payload, apDeliveryPending, now)
+	}
+	_, err = db.Exec("INSERT INTO activitypub_deliveries (ID_user, inbox, activity, status, next_attempt_at) VALUES "+
+		strings.Join(values, ", "), args...)
+	if err != nil {
+		return err
+	}
+	federation.Wake()
+	return nil
+}
+
+//subscribeFederation sends the activities of the domain events to the remote followers
+func subscribeFederation(bus *EventBus) {
+	bus.Subscribe(EventBlobCreated, func(e Event) error {
+		created := e.(BlobCreated)
+		blob := Blob{ID: created.BlobID, UserID: created.UserID, Content: created.Content, AddedDate: created.At}
+		return federation.deliverToFollowers(blob.UserID, blob.UserID, federation.createActivity(blob))
+	})
+	bus.Subscribe(EventBlobLiked, func(e Event) error {
+		liked := e.(BlobLiked)
+		return federation.deliverToFollowers(liked.OwnerID, liked.LikerID, federation.likeActivity(liked.BlobID, liked.LikerID))
+	})
+	bus.Subscribe(EventBlobUnliked, func(e Event) error {
+		unliked := e.(BlobUnliked)
+		undo := federation.undoActivity(federation.likeActivity(unliked.BlobID, unliked.LikerID))
+		return federation.deliverToFollowers(unliked.OwnerID, unliked.LikerID, undo)
+	})
+	bus.Subscribe(EventUserDeleted, func(e Event) error {
+		if err := deleteUserFederation(e.(UserDeleted).UserID); err != nil {
+			return fmt.Errorf("activitypub: federation of the deleted user not removed: %v", err)
+		}
+		return nil
+	})
+}
+
+//deliverToFollowers queues the activity of the signer for the remote followers of the user
+func (f *Federation) deliverToFollowers(userID, signer int, activity apActivity) error {
+	inboxes, err := remoteFollowerInboxes(userID)
+	if err == nil {
+		err = enqueueActivity(signer, inboxes, activity)
+	}
+	if err != nil {
+		return fmt.Errorf("activitypub: %s %s not queued: %v", activity.Type, activity.ID, err)
+	}
+	return nil
+}
+
+func deleteUserFederation(userID int) error {
+	db, err := connectToDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	for _, query := range []string{
+		"DELETE FROM remote_followers WHERE ID_user = ?",
+		"DELETE FROM remote_followings WHERE ID_user = ?",
+		"DELETE FROM activitypub_deliveries WHERE ID_user = ?",
+		"DELETE FROM activitypub_keys WHERE ID_user = ?",
+	} {
+		if _, err = db.Exec(query, userID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//Wake makes the federation send the queued activities now instead of waiting for the next tick
+func (f *Federation) Wake() {
+	if f == nil {
+		return
+	}
+	select {
+	case f.wake <- struct{}{}:
+	default:
+	}
+}
+
+//Run sends the queued activities every f.interval or when woken, it never returns so it should be called in a goroutine
+func (f *Federation) Run() {
+	ticker := time.NewTicker(f.interval)
+	defer ticker.Stop()
+	for {
+		for {
+			sent, err := f.deliverBatch()
+			if err != nil {
+				log.Printf("activitypub: delivery failed: %v", err)
+			}
+			if err != nil || sent < apDeliveryBatch {
+				break
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-f.wake:
+		}
+	}
+}
+
+//deliverBatch claims the deliveries due like the webhook dispatcher and sends them
+func (f *Federation) deliverBatch() (int, error) {
+	claim, err := randomToken()
+	if err != nil {
+		return 0, err
+	}
+
+	db, err := connectToDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	now := time.Now()
+	_, err = db.Exec(`UPDATE activitypub_deliveries SET claim = ?, claimed_until = ?
+		WHERE status = ? AND next_attempt_at <= ? AND (claimed_until IS NULL OR claimed_until < ?)
+		ORDER BY next_attempt_at LIMIT ?`, claim, now.Add(webhookClaimDuration), apDeliveryPending, now, now, apDeliveryBatch)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := db.Query("SELECT ID, ID_user, inbox, activity, attempts FROM activitypub_deliveries WHERE claim = ?", claim)
+	if err != nil {
+		return 0, err
+	}
+	type delivery struct {
+		id, userID, attempts int
+		inbox                string
+		activity             []byte
+	}
+	var deliveries []delivery
+	for rows.Next() {
+		var d delivery
+		if err = rows.Scan(&d.id, &d.userID, &d.inbox, &d.activity, &d.attempts); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	var wg sync.WaitGroup
+	for _, d := range deliveries {
+		wg.Add(1)
+		go func(d delivery) {
+			defer wg.Done()
+			err := f.post(d.inbox, d.userID, d.activity)
+			if err == nil {
+				_, err = db.Exec("DELETE FROM activitypub_deliveries WHERE ID = ?", d.id)
+			} else {
+				attempts := d.attempts + 1
+				status := apDeliveryPending
+				if attempts >= apMaxAttempts {
+					status = apDeliveryFailed
+				}
+				log.Printf("activitypub: delivery %d to %s failed (attempt %d): %v", d.id, d.inbox, attempts, err)
+				_, err = db.Exec(`UPDATE activitypub_deliveries SET status = ?, attempts = ?, error = ?, next_attempt_at = ?,
+					claim = NULL, claimed_until = NULL WHERE ID = ?`, status, attempts, err.Error(), time.Now().Add(webhookBackoff(attempts)), d.id)
+			}
+			if err != nil {
+				log.Printf("activitypub: result of delivery %d not saved: %v", d.id, err)
+			}
+		}(d)
+	}
+	wg.Wait()
+	return len(deliveries), nil
+}
+
+//post sends a signed activity to an inbox
+func (f *Federation) post(inbox string, signer int, activity []byte) error {
+	key, _, err := userKey(signer)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, inbox, bytes.NewReader(activity))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", ldContentType)
+	req.Header.Set("User-Agent", "Blobber (+"+f.baseURL+")")
+	if err = signRequest(req, f.keyID(signer), key, activity); err != nil {
+		return err
+	}
+
+	resp, err := f.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("the inbox answered %s", resp.Status)
+	}
+	return nil
+}
+
+//* inbox
+
+//apObject reads the id and the type of the object of an activity
+func apObject(raw json.RawMessage) (string, string) {
+	var id string
+	if json.Unmarshal(raw, &id) == nil {
+		return id, ""
+	}
+	var object struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+	}
+	json.Unmarshal(raw, &object)
+	return object.ID, object.Type
+}
+
+//receive applies an activity of a remote actor to the local user, the unsupported ones are ignored
+func (f *Federation) receive(user User, actor RemoteActor, activity apIncomingActivity) error {
+	db, err := connectToDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	objectID, objectType := apObject(activity.Object)
+	switch activity.Type {
+	case "Follow":
+		if objectID != f.actorURL(user.ID) {
+			return fmt.Errorf("%w: the follow is not for this actor", errBadRequest)
+		}
+		_, err = db.Exec(`INSERT INTO remote_followers (ID_user, ID_actor, activity_id) VALUES (?, ?, ?)
+			ON DUPLICATE KEY UPDATE activity_id = VALUES(activity_id)`, user.ID, actor.ID, activity.ID)
+		if err != nil {
+			return err
+		}
+		//blobber has no locked accounts, every follow is accepted
+		accept := apActivity{
+			Context: activityStreamsContext,
+			ID:      f.actorURL(user.ID) + "#accepts/" + strconv.Itoa(actor.ID) + "/" + strconv.FormatInt(time.Now().Unix(), 10),
+			Type:    "Accept",
+			Actor:   f.actorURL(user.ID),
+			Object: apIncomingActivity{
+				ID:     activity.ID,
+				Type:   activity.Type,
+				Actor:  activity.Actor,
+				Object: activity.Object,
+			},
+		}
+		return enqueueActivity(user.ID, []string{actor.inbox}, accept)
+	case "Undo":
+		if objectType == "Follow" {
+			_, err = db.Exec("DELETE FROM remote_followers WHERE ID_user = ? AND ID_actor = ?", user.ID, actor.ID)
+		} else {
+			//some servers undo with the id of the follow only
+			_, err = db.Exec("DELETE FROM remote_followers WHERE ID_user = ? AND ID_actor = ? AND activity_id = ?", user.ID, actor.ID, objectID)
+		}
+		return err
+	case "Accept":
+		_, err = db.Exec("UPDATE remote_followings SET accepted = TRUE WHERE ID_user = ? AND ID_actor = ?", user.ID, actor.ID)
+		return err
+	case "Reject":
+		_, err = db.Exec("DELETE FROM remote_followings WHERE ID_user = ? AND ID_actor = ?", user.ID, actor.ID)
+		return err
+	}
+	log.Printf("activitypub: %s from %s ignored", activity.Type, actor.ActorID)
+	return nil
+}
+
+//* handlers
+
+type federationKey struct{}
+
+//requestFederation returns the instance that serves the request: the global one, unless the context
+//has another (the tests serve two instances from the same process)
+func requestFederation(r *http.Request) *Federation {
+	if f, ok := r.Context().Value(federationKey{}).(*Federation); ok {
+		return f
+	}
+	return federation
+}
+
+//federationUser returns the federation and the user of the path, it answers 404 if the federation is
+//disabled or the user doesn't exist
+func federationUser(w http.ResponseWriter, r *http.Request) (*Federation, User, bool) {
+	f := requestFederation(r)
+	if f == nil {
+		returnError(w, http.StatusNotFound, "Federation is disabled")
+		return nil, User{}, false
+	}
+	id, ok := v2ResourceID(w, r)
+	if !ok {
+		return nil, User{}, false
+	}
+	user, err := QueryUserByID(id, 0)
+	if err != nil {
+		returnError(w, http.StatusNotFound, "User not found")
+		return nil, User{}, false
+	}
+	return f, user, true
+}
+
+func returnActivityJson(w http.ResponseWriter, contentType string, data interface{}) {
+	body, err := json.Marshal(data)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(body)
+}
+
+func webFingerHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	f := requestFederation(r)
+	if f == nil {
+		returnError(w, http.StatusNotFound, "Federation is disabled")
+		return
+	}
+
+	resource := r.URL.Query().Get("resource")
+	var id int
+	var err error
+	if local, ok := f.localUserID(resource); ok {
+		id = local
+	} else {
+		account := strings.TrimPrefix(resource, "acct:")
+		parts := strings.Split(account, "@")
+		if !strings.HasPrefix(resource, "acct:") || len(parts) != 2 || !strings.EqualFold(parts[1], f.host) {
+			returnError(w, http.StatusNotFound, "Resource not found")
+			return
+		}
+		if id, err = ResolveUsername(parts[0]); err != nil {
+			returnError(w, http.StatusNotFound, "Resource not found")
+			return
+		}
+	}
+	user, err := QueryUserByID(id, 0)
+	if err != nil {
+		returnError(w, http.StatusNotFound, "Resource not found")
+		return
+	}
+
+	actorURL := f.actorURL(user.ID)
+	returnActivityJson(w, "application/jrd+json", apWebFinger{
+		Subject: "acct:" + user.Username + "@" + f.host,
+		Aliases: []string{actorURL, f.profileURL(user.ID)},
+		Links: []apWebFingerLink{
+			{Rel: "self", Type: activityContentType, Href: actorURL},
+			{Rel: "http://webfinger.net/rel/profile-page", Type: "text/html", Href: f.profileURL(user.ID)},
+		},
+	})
+}
+
+func apActorHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	f, user, ok := federationUser(w, r)
+	if !ok {
+		return
+	}
+	_, publicPem, err := userKey(user.ID)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+	returnActivityJson(w, activityContentType, f.actorDocument(user, publicPem))
+}
+
+func apOutboxHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	f, user, ok := federationUser(w, r)
+	if !ok {
+		return
+	}
+	blobs, err := user.GetBlobs(true, 0)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	//only the newest blobs, the remote servers use the outbox to show the recent activity
+	outbox := apCollection{
+		Context:    activityStreamsContext,
+		ID:         f.baseURL + activityOutbox.Path(user.ID),
+		Type:       "OrderedCollection",
+		TotalItems: len(blobs),
+	}
+	for i, blob := range blobs {
+		if i == apOutboxPageSize {
+			break
+		}
+		create := f.createActivity(blob)
+		create.Context = nil
+		outbox.OrderedItems = append(outbox.OrderedItems, create)
+	}
+	returnActivityJson(w, activityContentType, outbox)
+}
+
+//the collections of the follows only show the count
+func apFollowersHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	f, user, ok := federationUser(w, r)
+	if !ok {
+		return
+	}
+	remote, err := countRemoteFollowers(user.ID)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+	returnActivityJson(w, activityContentType, apCollection{
+		Context:    activityStreamsContext,
+		ID:         f.baseURL + activityFollowers.Path(user.ID),
+		Type:       "OrderedCollection",
+		TotalItems: user.FollowersCount + remote,
+	})
+}
+
+func apFollowingHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	f, user, ok := federationUser(w, r)
+	if !ok {
+		return
+	}
+	returnActivityJson(w, activityContentType, apCollection{
+		Context:    activityStreamsContext,
+		ID:         f.baseURL + activityFollowing.Path(user.ID),
+		Type:       "OrderedCollection",
+		TotalItems: user.FollowingCount,
+	})
+}
+
+func apNoteHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	f := requestFederation(r)
+	if f == nil {
+		returnError(w, http.StatusNotFound, "Federation is disabled")
+		return
+	}
+	id, ok := v2ResourceID(w, r)
+	if !ok {
+		return
+	}
+	blob, err := QueryBlobByID(id, 0)
+	if err != nil {
+		returnError(w, http.StatusNotFound, "Blob not found")
+		return
+	}
+	note := f.noteDocument(blob)
+	note.Context = activityStreamsContext
+	returnActivityJson(w, activityContentType, note)
+}
+
+func apInboxHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	f, user, ok := federationUser(w, r)
+	if !ok {
+		return
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, apMaxBodySize))
+	if err != nil {
+		returnError(w, http.StatusBadRequest, "Invalid body")
+		return
+	}
+	actor, err := f.verifyRequest(r, body, user.ID)
+	if err != nil {
+		//the reason can contain the errors of the fetch of the remote actor, it's only logged
+		log.Printf("[%s] inbox signature refused: %v", w.Header().Get(requestIDHeader), err)
+		returnError(w, http.StatusUnauthorized, "Invalid signature")
+		return
+	}
+
+	var activity apIncomingActivity
+	if err = json.Unmarshal(body, &activity); err != nil {
+		returnError(w, http.StatusBadRequest, "Invalid activity")
+		return
+	}
+	if activity.Actor != actor.ActorID {
+		returnError(w, http.StatusUnauthorized, "The activity was not signed by its actor")
+		return
+	}
+
+	if err = f.receive(user, actor, activity); err != nil {
+		returnDomainError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func getRemoteFollowersHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	user := User{ID: jwtContent.UserID}
+	followers, err := user.GetRemoteFollowers()
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+	followersJson, _ := json.Marshal(followers)
+	returnSuccessJson(w, http.StatusOK, "Remote followers found", "followers", followersJson)
+}
+
+func getRemoteFollowingsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	user := User{ID: jwtContent.UserID}
+	followings, err := user.GetRemoteFollowings()
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+	followingsJson, _ := json.Marshal(followings)
+	returnSuccessJson(w, http.StatusOK, "Remote followings found", "followings", followingsJson)
+}
+
+func followRemoteHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+	if federation == nil {
+		returnError(w, http.StatusNotFound, "Federation is disabled")
+		return
+	}
+
+	var post struct {
+		Handle string `json:"handle"`
+	}
+	if err = json.NewDecoder(r.Body).Decode(&post); err != nil {
+		returnError(w, http.StatusBadRequest, "Invalid json")
+		return
+	}
+
+	user := User{ID: jwtContent.UserID}
+	following, err := user.FollowRemote(post.Handle)
+	if err != nil {
+		returnDomainError(w, err)
+		return
+	}
+	followingJson, _ := json.Marshal(following)
+	returnSuccessJson(w, http.StatusOK, "Follow request sent", "following", followingJson)
+}
+
+func unfollowRemoteHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+	if federation == nil {
+		returnError(w, http.StatusNotFound, "Federation is disabled")
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		returnError(w, http.StatusBadRequest, "Invalid id")
+		return
+	}
+
+	user := User{ID: jwtContent.UserID}
+	if err = user.UnfollowRemote(id); err != nil {
+		returnDomainError(w, err)
+		return
+	}
+	returnSuccess(w, http.StatusOK, "Unfollowed")
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//apInstance is a blobber server on a local port, the instances of a test share the database
+//but each one has its own base url so they see the users of the other as remote actors
+type apInstance struct {
+	*httptest.Server
+	fed *Federation
+}
+
+func newAPInstance(t *testing.T) *apInstance {
+	t.Helper()
+	requireDB(t)
+	inst := &apInstance{}
+	router := newRouter()
+	inst.Server = httptest.NewServer(RequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		router.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), federationKey{}, inst.fed)))
+	})))
+	t.Cleanup(func() {
+		inst.Close()
+		//the activities to the closed server can't be delivered anymore
+		db, err := connectToDB()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer db.Close()
+		if _, err = db.Exec("DELETE FROM activitypub_deliveries WHERE inbox LIKE ?", inst.URL+"/%"); err != nil {
+			t.Error(err)
+		}
+	})
+
+	var err error
+	if inst.fed, err = NewFederation(FederationConfig{Enabled: true, AllowPrivate: true}, inst.URL); err != nil {
+		t.Fatal(err)
+	}
+	return inst
+}
+
+//deliver sends the activities queued on the instance to the other one, the deliveries aren't
+//tied to an instance so only one of them has to have pending deliveries at a time
+func (inst *apInstance) deliver(t *testing.T, to *apInstance) {
+	t.Helper()
+	db, err := connectToDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	//the dates are saved with a precision of a second, the new deliveries can be due in the future
+	if _, err = db.Exec("UPDATE activitypub_deliveries SET next_attempt_at = ? WHERE status = ? AND inbox LIKE ?",
+		time.Now().Add(-time.Minute), apDeliveryPending, to.URL+"/%"); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		sent, err := inst.fed.deliverBatch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sent < apDeliveryBatch {
+			return
+		}
+	}
+}
+
+func (inst *apInstance) inbox(user User) string {
+	return inst.fed.baseURL + activityInbox.Path(user.ID)
+}
+
+//signAt signs the request like signRequest but with the given date
+func signAt(t *testing.T, r *http.Request, keyID string, key *rsa.PrivateKey, body []byte, date time.Time) {
+	t.Helper()
+	r.Header.Set("Date", date.UTC().Format(http.TimeFormat))
+	r.Header.Set("Digest", apDigest(body))
+	headers := []string{"(request-target)", "host", "date", "digest"}
+	hashed := sha256.Sum256([]byte(signingString(r, headers)))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Signature", fmt.Sprintf(`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		keyID, strings.Join(headers, " "), base64.StdEncoding.EncodeToString(signature)))
+}
+
+//postInbox posts the activity to the inbox, sign prepares the request
+func postInbox(t *testing.T, inbox string, body []byte, sign func(r *http.Request)) int {
+	t.Helper()
+	r, err := http.NewRequest(http.MethodPost, inbox, bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.Header.Set("Content-Type", ldContentType)
+	sign(r)
+	resp, err := http.DefaultClient.Do(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+//useFederation makes the instance the global one, used by the settings of the local users
+func useFederation(t *testing.T, inst *apInstance) {
+	previous := federation
+	federation = inst.fed
+	t.Cleanup(func() { federation = previous })
+}
+
+func TestFederationFollow(t *testing.T) {
+	local := newAPInstance(t)
+	remote := newAPInstance(t)
+	useFederation(t, local)
+	alice := newTestUser(t)
+	bob := newTestUser(t)
+
+	//alice follows bob of the other instance: webfinger, actor and Follow to the inbox of bob
+	handle := bob.Username + "@" + remote.fed.host
+	following, err := alice.FollowRemote(handle)
+	if err != nil {
+		t.Fatalf("follow of %s: %v", handle, err)
+	}
+	if following.Accepted || following.Actor.ActorID != remote.fed.actorURL(bob.ID) {
+		t.Fatalf("following %+v, want the actor of bob not accepted yet", following)
+	}
+	local.deliver(t, remote)
+
+	//the remote instance verified the signature of alice and saved her as a follower
+	followers, err := bob.GetRemoteFollowers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(followers) != 1 || followers[0].ActorID != local.fed.actorURL(alice.ID) {
+		t.Fatalf("remote followers of bob %+v, want alice", followers)
+	}
+
+	//the Accept of bob arrives to alice
+	remote.deliver(t, local)
+	followings, err := alice.GetRemoteFollowings()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(followings) != 1 || !followings[0].Accepted {
+		t.Fatalf("followings of alice %+v, want accepted", followings)
+	}
+
+	//Undo of the Follow
+	if err = alice.UnfollowRemote(followings[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	local.deliver(t, remote)
+	if followers, err = bob.GetRemoteFollowers(); err != nil || len(followers) != 0 {
+		t.Errorf("remote followers of bob after the undo %+v, %v, want none", followers, err)
+	}
+}
+
+func TestFederationInboxSignature(t *testing.T) {
+	local := newAPInstance(t)
+	remote := newAPInstance(t)
+	alice := newTestUser(t)
+	bob := newTestUser(t)
+
+	aliceKey, _, err := userKey(alice.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID := local.fed.keyID(alice.ID)
+	follow, err := json.Marshal(local.fed.followActivity(alice.ID, RemoteActor{ID: 1, ActorID: remote.fed.actorURL(bob.ID)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	carol := newTestUser(t)
+
+	tests := []struct {
+		name   string
+		body   []byte
+		sign   func(r *http.Request)
+		status int
+	}{
+		{"unsigned", follow, func(r *http.Request) {}, http.StatusUnauthorized},
+		{"signed by another key", follow, func(r *http.Request) {
+			signAt(t, r, keyID, otherKey, follow, time.Now())
+		}, http.StatusUnauthorized},
+		{"digest of another body", follow, func(r *http.Request) {
+			signAt(t, r, keyID, aliceKey, []byte(`{"type": "Follow"}`), time.Now())
+		}, http.StatusUnauthorized},
+		{"stale date", follow, func(r *http.Request) {
+			signAt(t, r, keyID, aliceKey, follow, time.Now().Add(-apMaxClockSkew-time.Minute))
+		}, http.StatusUnauthorized},
+		{"date in the future", follow, func(r *http.Request) {
+			signAt(t, r, keyID, aliceKey, follow, time.Now().Add(apMaxClockSkew+time.Minute))
+		}, http.StatusUnauthorized},
+		{"signed by another actor", follow, func(r *http.Request) {
+			key, _, err := userKey(carol.ID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			signAt(t, r, local.fed.keyID(carol.ID), key, follow, time.Now())
+		}, http.StatusUnauthorized},
+		{"valid within the clock skew", follow, func(r *http.Request) {
+			signAt(t, r, keyID, aliceKey, follow, time.Now().Add(-apMaxClockSkew/2))
+		}, http.StatusAccepted},
+	}
+	for _, tt := range tests {
+		if status := postInbox(t, remote.inbox(bob), tt.body, tt.sign); status != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, status, tt.status)
+		}
+	}
+
+	//only the valid request was applied
+	followers, err := bob.GetRemoteFollowers()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(followers) != 1 || followers[0].ActorID != local.fed.actorURL(alice.ID) {
+		t.Errorf("remote followers of bob %+v, want only alice", followers)
+	}
+}
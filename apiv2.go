@@ -0,0 +1,444 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+//the api v2 uses the http verbs on resources instead of verbs in the paths, the status codes are:
+//200 reads and updates, 201 creations (with the Location header), 204 when there is nothing to return,
+//400 invalid input, 401 not logged, 403 not the owner, 404 missing resource, 429 rate limited.
+//Following and liking are idempotent: doing them twice is not an error
+
+//the body of the writes of the api v2
+type v2Body struct {
+	Content     *string `json:"content,omitempty"`
+	Description *string `json:"description,omitempty"`
+}
+
+//registerAPIV2 adds the api v2 routes to the router, they answer 401 instead of redirecting to the login
+func registerAPIV2(r *mux.Router) {
+	api := r.PathPrefix(apiV2.String()).Subrouter()
+
+	//users, /users/me is registered before /users/{id} even if the id only matches numbers
+	api.HandleFunc(v2Me.String(), v2GetMeHandler).Methods("GET")
+	api.HandleFunc(v2Me.String(), rateLimiter.Limit("settings_change", v2UpdateMeHandler)).Methods("PUT")
+	api.HandleFunc(v2Me.String(), v2DeleteMeHandler).Methods("DELETE")
+	api.HandleFunc(v2Users.String(), v2SearchUsersHandler).Methods("GET")
+	api.HandleFunc(v2Recommended.String(), recommendedUsersHandler).Methods("GET")
+	api.HandleFunc(v2User.String(), v2GetUserHandler).Methods("GET")
+	api.HandleFunc(v2UserBlobs.String(), v2GetUserBlobsHandler).Methods("GET")
+	api.HandleFunc(v2UserFollowers.String(), getUserFollowersHandler).Methods("GET")
+	api.HandleFunc(v2UserFollowing.String(), getUserFollowingHandler).Methods("GET")
+	api.HandleFunc(v2UserFollowersMe.String(), rateLimiter.Limit("follow", v2FollowHandler)).Methods("POST")
+	api.HandleFunc(v2UserFollowersMe.String(), rateLimiter.Limit("follow", v2UnfollowHandler)).Methods("DELETE")
+
+	//feed and trends
+	api.HandleFunc(v2Feed.String(), overviewHandler).Methods("GET")
+	api.HandleFunc(v2Trending.String(), trendingHandler).Methods("GET")
+
+	//blobs
+	api.HandleFunc(v2Blobs.String(), rateLimiter.Limit("blob_write", v2AddBlobHandler)).Methods("POST")
+	api.HandleFunc(v2Blob.String(), v2GetBlobHandler).Methods("GET")
+	api.HandleFunc(v2Blob.String(), rateLimiter.Limit("blob_write", v2ModifyBlobHandler)).Methods("PUT")
+	api.HandleFunc(v2Blob.String(), rateLimiter.Limit("blob_write", v2DeleteBlobHandler)).Methods("DELETE")
+	api.HandleFunc(v2BlobLikesMe.String(), rateLimiter.Limit("like", v2LikeHandler)).Methods("POST")
+	api.HandleFunc(v2BlobLikesMe.String(), rateLimiter.Limit("like", v2UnlikeHandler)).Methods("DELETE")
+
+	api.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		returnError(w, http.StatusNotFound, "Resource not found")
+	})
+	api.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		returnError(w, http.StatusMethodNotAllowed, "Method not allowed on this resource")
+	})
+}
+
+//legacyRoute keeps an old endpoint working and points the clients to the api v2 route that replaces it
+func legacyRoute(successor Endpoint, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+successor.V2Path(mux.Vars(r)["id"])+`>; rel="successor-version"`)
+		next(w, r)
+	}
+}
+
+//v2ResourceID reads the id of the path, the routes only match numbers so it fails only on overflow
+func v2ResourceID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		returnError(w, http.StatusBadRequest, "Invalid id")
+		return 0, false
+	}
+	return id, true
+}
+
+//v2QueryUser answers 404 if the user doesn't exist, the password is never returned
+func v2QueryUser(w http.ResponseWriter, id, requesterID int) (User, bool) {
+	user, err := QueryUserByID(id, requesterID)
+	if err == sql.ErrNoRows {
+		returnError(w, http.StatusNotFound, "User not found")
+		return User{}, false
+	}
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return User{}, false
+	}
+	user.Password = "-hidden-"
+	return user, true
+}
+
+//v2QueryBlob answers 404 if the blob doesn't exist
+func v2QueryBlob(w http.ResponseWriter, r *http.Request, requesterID int) (Blob, bool) {
+	id, ok := v2ResourceID(w, r)
+	if !ok {
+		return Blob{}, false
+	}
+	blob, err := QueryBlobByID(id, requesterID)
+	if err != nil {
+		returnError(w, http.StatusNotFound, "Blob not found")
+		return Blob{}, false
+	}
+	return blob, true
+}
+
+func v2DecodeBody(w http.ResponseWriter, r *http.Request) (v2Body, bool) {
+	var body v2Body
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		returnError(w, http.StatusBadRequest, "Invalid request body")
+		return v2Body{}, false
+	}
+	return body, true
+}
+
+//* users
+func v2GetMeHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	user, ok := v2QueryUser(w, jwtContent.UserID, 0)
+	if !ok {
+		return
+	}
+	userJSON, _ := json.Marshal(user)
+	returnSuccessJson(w, http.StatusOK, "Successfully retrieved user", "user", userJSON)
+}
+
+func v2UpdateMeHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	body, ok := v2DecodeBody(w, r)
+	if !ok {
+		return
+	}
+	if body.Description == nil {
+		returnError(w, http.StatusBadRequest, "Nothing to update, the description is missing")
+		return
+	}
+
+	user, ok := v2QueryUser(w, jwtContent.UserID, 0)
+	if !ok {
+		return
+	}
+	if err = user.ModifyDescription(*body.Description); err != nil {
+		returnDomainError(w, err)
+		return
+	}
+
+	user.Description = *body.Description
+	userJSON, _ := json.Marshal(user)
+	returnSuccessJson(w, http.StatusOK, "Successfully updated user", "user", userJSON)
+}
+
+func v2DeleteMeHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	user, ok := v2QueryUser(w, jwtContent.UserID, 0)
+	if !ok {
+		return
+	}
+	if err = user.Delete(); err != nil {
+		returnDomainError(w, err)
+		return
+	}
+
+	setCookie(w, r, &http.Cookie{Name: "JWT", Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	returnNoContent(w)
+}
+
+func v2SearchUsersHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	query := strings.TrimSpace(r.URL.Query().Get("q"))
+	if query == "" {
+		returnError(w, http.StatusBadRequest, "The q parameter is required")
+		return
+	}
+
+	users, err := QueryUsersBySubstring(query, jwtContent.UserID)
+	if err != nil {
+		returnDomainError(w, err)
+		return
+	}
+	//no results is an empty list, not a 404
+	if users == nil {
+		users = []User{}
+	}
+	usersJSON, _ := json.Marshal(users)
+	returnSuccessJson(w, http.StatusOK, "Successfully retrieved users", "users", usersJSON)
+}
+
+func v2GetUserHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	id, ok := v2ResourceID(w, r)
+	if !ok {
+		return
+	}
+	user, ok := v2QueryUser(w, id, jwtContent.UserID)
+	if !ok {
+		return
+	}
+	userJSON, _ := json.Marshal(user)
+	returnSuccessJson(w, http.StatusOK, "Successfully retrieved user", "user", userJSON)
+}
+
+func v2GetUserBlobsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	id, ok := v2ResourceID(w, r)
+	if !ok {
+		return
+	}
+	user, ok := v2QueryUser(w, id, jwtContent.UserID)
+	if !ok {
+		return
+	}
+
+	blobs, err := user.GetBlobs(true, jwtContent.UserID)
+	if err != nil {
+		returnDomainError(w, err)
+		return
+	}
+	if blobs == nil {
+		blobs = []Blob{}
+	}
+	blobsJSON, _ := json.Marshal(blobs)
+	returnSuccessJson(w, http.StatusOK, "Successfully retrieved blobs", "blobs", blobsJSON)
+}
+
+func v2FollowHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	id, ok := v2ResourceID(w, r)
+	if !ok {
+		return
+	}
+	if _, ok = v2QueryUser(w, id, 0); !ok {
+		return
+	}
+
+	user := User{ID: jwtContent.UserID}
+	if err = user.Follow(id); err != nil {
+		returnDomainError(w, err)
+		return
+	}
+	returnNoContent(w)
+}
+
+func v2UnfollowHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	id, ok := v2ResourceID(w, r)
+	if !ok {
+		return
+	}
+	if _, ok = v2QueryUser(w, id, 0); !ok {
+		return
+	}
+
+	user := User{ID: jwtContent.UserID}
+	if err = user.Unfollow(id); err != nil {
+		returnDomainError(w, err)
+		return
+	}
+	returnNoContent(w)
+}
+
+//* blobs
+func v2AddBlobHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	body, ok := v2DecodeBody(w, r)
+	if !ok {
+		return
+	}
+	if body.Content == nil {
+		returnError(w, http.StatusBadRequest, "The content is required")
+		return
+	}
+
+	id, err := AddBlob(jwtContent.UserID, *body.Content)
+	if err != nil {
+		returnDomainError(w, err)
+		return
+	}
+	blob, err := QueryBlobByID(id, jwtContent.UserID)
+	if err != nil {
+		returnDomainError(w, err)
+		return
+	}
+
+	w.Header().Set("Location", v2Blob.V2Path(strconv.Itoa(id)))
+	blobJSON, _ := json.Marshal(blob)
+	returnSuccessJson(w, http.StatusCreated, "Successfully added blob", "blob", blobJSON)
+}
+
+func v2GetBlobHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	//the blobs are public, the session only fills liked and is_owner
+	blob, ok := v2QueryBlob(w, r, requestUserID(r))
+	if !ok {
+		return
+	}
+	blobJSON, _ := json.Marshal(blob)
+	returnSuccessJson(w, http.StatusOK, "Successfully retrieved blob", "blob", blobJSON)
+}
+
+func v2ModifyBlobHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	body, ok := v2DecodeBody(w, r)
+	if !ok {
+		return
+	}
+	if body.Content == nil {
+		returnError(w, http.StatusBadRequest, "The content is required")
+		return
+	}
+
+	blob, ok := v2QueryBlob(w, r, jwtContent.UserID)
+	if !ok {
+		return
+	}
+	if blob.UserID != jwtContent.UserID {
+		returnError(w, http.StatusForbidden, "Only the owner can modify the blob")
+		return
+	}
+
+	//putting the same content again is not an error
+	content := strings.Trim(*body.Content, " ")
+	if content != blob.Content {
+		if err = blob.Modify(content); err != nil {
+			returnDomainError(w, err)
+			return
+		}
+		blob.Content = content
+	}
+
+	blobJSON, _ := json.Marshal(blob)
+	returnSuccessJson(w, http.StatusOK, "Successfully modified blob", "blob", blobJSON)
+}
+
+func v2DeleteBlobHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	blob, ok := v2QueryBlob(w, r, jwtContent.UserID)
+	if !ok {
+		return
+	}
+	if blob.UserID != jwtContent.UserID {
+		returnError(w, http.StatusForbidden, "Only the owner can delete the blob")
+		return
+	}
+
+	if err = blob.Delete(); err != nil {
+		returnDomainError(w, err)
+		return
+	}
+	returnNoContent(w)
+}
+
+func v2LikeHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	blob, ok := v2QueryBlob(w, r, jwtContent.UserID)
+	if !ok {
+		return
+	}
+	if err = blob.Like(jwtContent.UserID); err != nil {
+		returnDomainError(w, err)
+		return
+	}
+	returnNoContent(w)
+}
+
+func v2UnlikeHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	blob, ok := v2QueryBlob(w, r, jwtContent.UserID)
+	if !ok {
+		return
+	}
+	if err = blob.Unlike(jwtContent.UserID); err != nil {
+		returnDomainError(w, err)
+		return
+	}
+	returnNoContent(w)
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestAPIV2Blobs(t *testing.T) {
+	owner := newTestUser(t)
+	other := newTestUser(t)
+	c := newContractClient(t)
+
+	c.expect("POST", v2Blobs.V2(), `{"content": "api v2"}`, 401)
+
+	c.login(owner)
+	w := c.expect("POST", v2Blobs.V2(), `{"content": "api v2"}`, 201)
+	var created struct {
+		Blob Blob `json:"blob"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &created); err != nil || created.Blob.ID == 0 {
+		t.Fatalf("blob not created: %v %s", err, w.Body.String())
+	}
+	blobPath := v2Blob.V2Path(strconv.Itoa(created.Blob.ID))
+	if location := w.Header().Get("Location"); location != blobPath {
+		t.Errorf("Location %q, want %q", location, blobPath)
+	}
+	c.expect("GET", blobPath, "", 200)
+	c.expect("PUT", blobPath, `{}`, 400)
+	//the errors of the decoder aren't shown to the client
+	if w := c.expect("PUT", blobPath, `{"content": 1}`, 400); !strings.Contains(w.Body.String(), `"msg":"Invalid request body"`) {
+		t.Errorf("invalid body: %s, want the fixed message", w.Body.String())
+	}
+	c.expect("PUT", blobPath, `{"content": "api v2"}`, 200)
+
+	//only the owner can change the blob
+	c.login(other)
+	c.expect("PUT", blobPath, `{"content": "not mine"}`, 403)
+	c.expect("DELETE", blobPath, "", 403)
+	blob, err := QueryBlobByID(created.Blob.ID, 0)
+	if err != nil || blob.Content != "api v2" {
+		t.Errorf("blob after the changes of another user %+v, %v, want unchanged", blob, err)
+	}
+
+	//liking twice is not an error and counts once
+	likesPath := v2BlobLikesMe.V2Path(strconv.Itoa(created.Blob.ID))
+	c.expect("POST", likesPath, "", 204)
+	c.expect("POST", likesPath, "", 204)
+	if blob, err = QueryBlobByID(created.Blob.ID, other.ID); err != nil || blob.LikesCounts != 1 || !blob.Liked {
+		t.Errorf("blob liked twice %+v, %v, want 1 like", blob, err)
+	}
+	c.expect("DELETE", likesPath, "", 204)
+	c.expect("DELETE", likesPath, "", 204)
+	if blob, err = QueryBlobByID(created.Blob.ID, other.ID); err != nil || blob.LikesCounts != 0 {
+		t.Errorf("blob unliked twice %+v, %v, want no likes", blob, err)
+	}
+
+	c.login(owner)
+	c.expect("DELETE", blobPath, "", 204)
+	c.expect("GET", blobPath, "", 404)
+	c.expect("DELETE", blobPath, "", 404)
+	c.expect("POST", likesPath, "", 404)
+}
+
+func TestAPIV2Follow(t *testing.T) {
+	user := newTestUser(t)
+	followed := newTestUser(t)
+	c := newContractClient(t)
+	c.login(user)
+
+	followersPath := v2UserFollowersMe.V2Path(strconv.Itoa(followed.ID))
+	for i := 0; i < 2; i++ {
+		c.expect("POST", followersPath, "", 204)
+	}
+	if got, err := QueryUserByID(followed.ID, user.ID); err != nil || got.FollowersCount != 1 || !got.Follows {
+		t.Errorf("user followed twice %+v, %v, want 1 follower", got, err)
+	}
+	for i := 0; i < 2; i++ {
+		c.expect("DELETE", followersPath, "", 204)
+	}
+	if got, err := QueryUserByID(followed.ID, user.ID); err != nil || got.FollowersCount != 0 {
+		t.Errorf("user unfollowed twice %+v, %v, want no followers", got, err)
+	}
+	c.expect("POST", v2UserFollowersMe.V2Path("999999999"), "", 404)
+}
+
+func TestLegacyRouteHeaders(t *testing.T) {
+	user := newTestUser(t)
+	other := newTestUser(t)
+	c := newContractClient(t)
+	c.login(user)
+
+	tests := []struct {
+		method, path, successor string
+	}{
+		{"GET", fmt.Sprintf("/users/%d", other.ID), v2User.V2Path(strconv.Itoa(other.ID))},
+		{"GET", fmt.Sprintf("/users/%d/blobs", other.ID), v2UserBlobs.V2Path(strconv.Itoa(other.ID))},
+		{"GET", overview.String(), v2Feed.V2()},
+		{"POST", fmt.Sprintf("/users/%d/follow", other.ID), v2UserFollowersMe.V2Path(strconv.Itoa(other.ID))},
+	}
+	for _, tt := range tests {
+		w := c.expect(tt.method, tt.path, "", 200)
+		want := "<" + tt.successor + `>; rel="successor-version"`
+		if w.Header().Get("Deprecation") != "true" || w.Header().Get("Link") != want {
+			t.Errorf("%s %s: Deprecation %q Link %q, want true and %q", tt.method, tt.path, w.Header().Get("Deprecation"), w.Header().Get("Link"), want)
+		}
+	}
+
+	//the api v2 routes aren't deprecated
+	if w := c.expect("GET", v2User.V2Path(strconv.Itoa(other.ID)), "", 200); w.Header().Get("Deprecation") != "" {
+		t.Error("api v2 route marked as deprecated")
+	}
+}
@@ -2,6 +2,7 @@ CREATE TABLE IF NOT EXIST likes (
     ID INT auto_increment NOT NULL,
     ID_user INT NOT NULL,
     ID_blob INT NOT NULL,
+    added_date DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
     PRIMARY KEY (ID)
 );
 -- ENGINE=InnoDB
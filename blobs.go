@@ -1,6 +1,7 @@
 package main
 
 import (
+	"database/sql"
 	"fmt"
 	"strings"
 	"time"
@@ -47,7 +48,15 @@ func (b Blob) Like(LikerID int) error {
 	}
 	defer db.Close()
 
-	_, err = db.Query("INSERT INTO likes (ID_user, ID_blob) VALUES (?, ?)", LikerID, b.ID)
+	//liking twice doesn't add a second like
+	_, err = writeWithEvent(db, func(sql.Result) (Event, error) {
+		liker, err := queryUsername(db, LikerID)
+		if err != nil {
+			return nil, err
+		}
+		return BlobLiked{BlobID: b.ID, OwnerID: b.UserID, LikerID: LikerID, Liker: liker, At: time.Now()}, nil
+	}, `INSERT INTO likes (ID_user, ID_blob) SELECT ?, ? FROM DUAL
+		WHERE NOT EXISTS (SELECT 1 FROM likes WHERE ID_user = ? AND ID_blob = ?)`, LikerID, b.ID, LikerID, b.ID)
 	return err
 }
 
@@ -58,7 +67,9 @@ func (b Blob) Unlike(LikerID int) error {
 	}
 	defer db.Close()
 
-	_, err = db.Query("DELETE FROM likes WHERE ID_user = ? AND ID_blob = ?", LikerID, b.ID)
+	_, err = writeWithEvent(db, func(sql.Result) (Event, error) {
+		return BlobUnliked{BlobID: b.ID, OwnerID: b.UserID, LikerID: LikerID, At: time.Now()}, nil
+	}, "DELETE FROM likes WHERE ID_user = ? AND ID_blob = ?", LikerID, b.ID)
 	return err
 }
 
@@ -84,18 +95,20 @@ func (b Blob) Delete() error {
 	}
 	defer db.Close()
 
-	_, err = db.Query("DELETE FROM blobs WHERE ID = ?", b.ID)
+	_, err = writeWithEvent(db, func(sql.Result) (Event, error) {
+		return BlobDeleted{BlobID: b.ID, At: time.Now()}, nil
+	}, "DELETE FROM blobs WHERE ID = ?", b.ID)
 	return err
 }
 
 func (b *Blob) Modify(content string) error {
 	content = strings.Trim(content, " ")
 	if content == "" {
-		return fmt.Errorf("bad request: content can't be empty")
+		return fmt.Errorf("%w: content can't be empty", errBadRequest)
 	}
 
 	if b.Content == content {
-		return fmt.Errorf("bad request: nothing to change")
+		return fmt.Errorf("%w: nothing to change", errBadRequest)
 	}
 
 	db, err := connectToDB()
@@ -104,30 +117,81 @@ func (b *Blob) Modify(content string) error {
 	}
 	defer db.Close()
 
-	_, err = db.Query("UPDATE blobs SET content = ? WHERE ID = ?", content, b.ID)
+	_, err = writeWithEvent(db, func(sql.Result) (Event, error) {
+		return BlobModified{BlobID: b.ID, Content: content, At: time.Now()}, nil
+	}, "UPDATE blobs SET content = ? WHERE ID = ?", content, b.ID)
 	if err != nil {
 		return fmt.Errorf("internal server error: %v", err)
 	}
 	return nil
 }
 
-func AddBlob(userID int, content string) error {
+//AddBlob returns the id of the new blob
+func AddBlob(userID int, content string) (int, error) {
 	content = strings.Trim(content, " ")
 	if content == "" {
-		return fmt.Errorf("bad request: content can't be empty")
+		return 0, fmt.Errorf("%w: content can't be empty", errBadRequest)
 	}
 
 	db, err := connectToDB()
 	if err != nil {
-		return fmt.Errorf("internal server error: %v", err)
+		return 0, fmt.Errorf("internal server error: %v", err)
 	}
 	defer db.Close()
 
-	_, err = db.Query("INSERT INTO blobs (ID_user, content) VALUES (?, ?)", userID, content)
+	var id int64
+	_, err = writeWithEvent(db, func(res sql.Result) (Event, error) {
+		var err error
+		if id, err = res.LastInsertId(); err != nil {
+			return nil, err
+		}
+		username, err := queryUsername(db, userID)
+		if err != nil {
+			return nil, err
+		}
+		return BlobCreated{BlobID: int(id), UserID: userID, Username: username, Content: content, At: time.Now()}, nil
+	}, "INSERT INTO blobs (ID_user, content) VALUES (?, ?)", userID, content)
 	if err != nil {
-		return fmt.Errorf("internal server error: %v", err)
+		return 0, fmt.Errorf("internal server error: %v", err)
 	}
-	return nil
+	return int(id), nil
+}
+
+//ImportBlob adds a blob of another archive keeping its date, a blob of the user with the same content
+//and date is a duplicate and it's not added again (0, nil). The imported blobs are history, not new
+//posts: no event is published so the webhooks and the followers are not notified
+func ImportBlob(userID int, content string, addedDate time.Time) (int, error) {
+	content = strings.Trim(content, " ")
+	if content == "" {
+		return 0, fmt.Errorf("%w: content can't be empty", errBadRequest)
+	}
+	//the column has no fractions of second
+	addedDate = addedDate.Truncate(time.Second)
+
+	db, err := connectToDB()
+	if err != nil {
+		return 0, fmt.Errorf("internal server error: %v", err)
+	}
+	defer db.Close()
+
+	var duplicates int
+	err = db.QueryRow("SELECT COUNT(*) FROM blobs WHERE ID_user = ? AND added_date = ? AND content = ?", userID, addedDate, content).Scan(&duplicates)
+	if err != nil {
+		return 0, fmt.Errorf("internal server error: %v", err)
+	}
+	if duplicates > 0 {
+		return 0, nil
+	}
+
+	res, err := db.Exec("INSERT INTO blobs (ID_user, content, added_date) VALUES (?, ?, ?)", userID, content, addedDate)
+	if err != nil {
+		return 0, fmt.Errorf("internal server error: %v", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("internal server error: %v", err)
+	}
+	return int(id), nil
 }
 
 func QueryBlobByID(id, requesterID int) (Blob, error) {
@@ -0,0 +1,438 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+//commands to manage the instance from the command line, es: docker compose exec go ./blobber user list.
+//They use the same functions of the handlers, so a user deleted here publishes its event in the outbox
+//and the server does the cleanups like for a user deleted from the settings
+type cliCommand struct {
+	usage       string
+	description string
+	run         func(args []string, in io.Reader, out io.Writer) int
+}
+
+const (
+	//length of the passwords generated by user create and reset-password
+	cliPasswordLength = 16
+	cliListLimit      = 50
+)
+
+var cliCommands map[string]cliCommand
+
+func init() {
+	//assigned in init because help reads the map
+	cliCommands = map[string]cliCommand{
+		"serve":               {"serve", "run the server (the default without a command)", nil},
+		"user create":         {"user create [-password-stdin] [-description <text>] <username>", "create a user, without -password-stdin a random password is printed", runUserCreate},
+		"user delete":         {"user delete [-yes] -id <id> | -username <username>", "delete a user with its blobs, likes and follows", runUserDelete},
+		"user reset-password": {"user reset-password [-password-stdin] -id <id> | -username <username>", "set a new password and log out the user everywhere", runUserResetPassword},
+		"user list":           {"user list [-limit <n>] [-offset <n>]", "list the users from the oldest", runUserList},
+		"blob show":           {"blob show <id>", "show a blob with its author and likes", runBlobShow},
+		"blob delete":         {"blob delete [-yes] <id>", "delete a blob", runBlobDelete},
+		"stats":               {"stats", "counters of the instance", runStats},
+		"import":              {"import -user <username> [-quiet] <archive.zip | tweets.js>", "import a blobber export or a twitter archive", runImportCommand},
+		"help":                {"help", "show this list", runHelp},
+	}
+}
+
+//findCommand returns the name of the command of the arguments and the arguments after it
+func findCommand(args []string) (string, []string, bool) {
+	//the commands of two words first: user create, blob show, ...
+	for _, n := range []int{2, 1} {
+		if len(args) < n {
+			continue
+		}
+		name := strings.Join(args[:n], " ")
+		if command, ok := cliCommands[name]; ok && command.run != nil {
+			return name, args[n:], true
+		}
+	}
+	return "", nil, false
+}
+
+//runCommand runs the command of the arguments (without the name of the binary) and returns the exit code
+func runCommand(args []string, in io.Reader, out io.Writer) int {
+	name, rest, ok := findCommand(args)
+	if ok {
+		return cliCommands[name].run(rest, in, out)
+	}
+	fmt.Fprintf(out, "unknown command %s\n\n", strings.Join(args, " "))
+	runHelp(nil, in, out)
+	return 2
+}
+
+//commandNeedsDB is false for help and the unknown commands, they only print so they work without
+//the configuration and the database
+func commandNeedsDB(args []string) bool {
+	name, _, ok := findCommand(args)
+	return ok && name != "help"
+}
+
+func runHelp(args []string, in io.Reader, out io.Writer) int {
+	names := make([]string, 0, len(cliCommands))
+	for name := range cliCommands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fmt.Fprintln(out, "usage: blobber <command>")
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	for _, name := range names {
+		fmt.Fprintf(w, "  %s\t%s\n", cliCommands[name].usage, cliCommands[name].description)
+	}
+	w.Flush()
+	return 0
+}
+
+//* helpers
+
+//newCommandFlags creates the flags of a command, its usage is the one of cliCommands
+func newCommandFlags(name string, out io.Writer) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(out)
+	flags.Usage = func() {
+		fmt.Fprintln(out, "usage: blobber "+cliCommands[name].usage)
+		flags.PrintDefaults()
+	}
+	return flags
+}
+
+//parseCommand parses the flags and checks that there are exactly positional arguments after them
+func parseCommand(flags *flag.FlagSet, args []string, positional int) bool {
+	if err := flags.Parse(args); err != nil {
+		return false
+	}
+	if flags.NArg() != positional {
+		flags.Usage()
+		return false
+	}
+	return true
+}
+
+//cliUserRef are the flags that choose the user of a command. A username can be only digits,
+//so the id has its own flag instead of being guessed from a single argument
+type cliUserRef struct {
+	id       *int
+	username *string
+}
+
+func addUserFlags(flags *flag.FlagSet) cliUserRef {
+	return cliUserRef{
+		id:       flags.Int("id", 0, "id of the user"),
+		username: flags.String("username", "", "username of the user (also an old one still reserved)"),
+	}
+}
+
+//find returns the user of the flags, the exit code is not 0 if it can't
+func (ref cliUserRef) find(flags *flag.FlagSet, out io.Writer) (User, int) {
+	if (*ref.id == 0) == (*ref.username == "") {
+		fmt.Fprintln(out, "use one of -id and -username")
+		flags.Usage()
+		return User{}, 2
+	}
+	id := *ref.id
+	if *ref.username != "" {
+		var err error
+		if id, err = ResolveUsername(*ref.username); err != nil {
+			fmt.Fprintf(out, "user %s not found\n", *ref.username)
+			return User{}, 1
+		}
+	}
+	user, err := QueryUserByID(id, 0)
+	if err != nil {
+		fmt.Fprintf(out, "user %d not found\n", id)
+		return User{}, 1
+	}
+	return user, 0
+}
+
+//confirm asks a yes/no question on the terminal, anything but y is a no
+func confirm(in io.Reader, out io.Writer, question string) bool {
+	fmt.Fprint(out, question+" [y/N] ")
+	answer, _ := bufio.NewReader(in).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+func generatePassword() (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	return token[:cliPasswordLength], nil
+}
+
+//newPassword reads the password from the first line of in with -password-stdin, so it doesn't end up in
+//the shell history or in the process list, otherwise it generates one. generated tells to print it
+func newPassword(fromStdin bool, in io.Reader) (password string, generated bool, err error) {
+	if !fromStdin {
+		password, err = generatePassword()
+		return password, true, err
+	}
+	line, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", false, err
+	}
+	password = strings.TrimRight(line, "\r\n")
+	if password == "" {
+		return "", false, errors.New("empty password on stdin")
+	}
+	return password, false, nil
+}
+
+//* users
+
+func runUserCreate(args []string, in io.Reader, out io.Writer) int {
+	flags := newCommandFlags("user create", out)
+	passwordStdin := flags.Bool("password-stdin", false, "read the password from the first line of stdin instead of generating it")
+	description := flags.String("description", "", "description of the profile")
+	if !parseCommand(flags, args, 1) {
+		return 2
+	}
+	username := flags.Arg(0)
+	if !usernameRegex.MatchString(username) {
+		fmt.Fprintln(out, "invalid username, use from 3 to 20 letters, numbers, _ or .")
+		return 1
+	}
+
+	password, generated, err := newPassword(*passwordStdin, in)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	if err = AddUser(username, hashPassword(password), *description); err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	user, err := QueryUserByUsername(username, 0)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+
+	fmt.Fprintf(out, "user %s created with id %d\n", user.Username, user.ID)
+	if generated {
+		fmt.Fprintf(out, "password: %s\n", password)
+	}
+	return 0
+}
+
+func runUserDelete(args []string, in io.Reader, out io.Writer) int {
+	flags := newCommandFlags("user delete", out)
+	yes := flags.Bool("yes", false, "don't ask for confirmation")
+	ref := addUserFlags(flags)
+	if !parseCommand(flags, args, 0) {
+		return 2
+	}
+	user, code := ref.find(flags, out)
+	if code != 0 {
+		return code
+	}
+
+	question := fmt.Sprintf("delete user %s (id %d) with %d followers?", user.Username, user.ID, user.FollowersCount)
+	if !*yes && !confirm(in, out, question) {
+		fmt.Fprintln(out, "nothing deleted")
+		return 1
+	}
+	if err := user.Delete(); err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	fmt.Fprintf(out, "user %s deleted\n", user.Username)
+	return 0
+}
+
+func runUserResetPassword(args []string, in io.Reader, out io.Writer) int {
+	flags := newCommandFlags("user reset-password", out)
+	passwordStdin := flags.Bool("password-stdin", false, "read the new password from the first line of stdin instead of generating it")
+	ref := addUserFlags(flags)
+	if !parseCommand(flags, args, 0) {
+		return 2
+	}
+	user, code := ref.find(flags, out)
+	if code != 0 {
+		return code
+	}
+
+	password, generated, err := newPassword(*passwordStdin, in)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	//SetPassword also revokes the sessions
+	if err = user.SetPassword(password); err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+
+	fmt.Fprintf(out, "password of %s changed, the user has been logged out\n", user.Username)
+	if generated {
+		fmt.Fprintf(out, "password: %s\n", password)
+	}
+	return 0
+}
+
+func runUserList(args []string, in io.Reader, out io.Writer) int {
+	flags := newCommandFlags("user list", out)
+	limit := flags.Int("limit", cliListLimit, "users to show")
+	offset := flags.Int("offset", 0, "users to skip")
+	if !parseCommand(flags, args, 0) {
+		return 2
+	}
+
+	users, err := QueryUsers(*limit, *offset)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tUSERNAME\tEMAIL\t2FA\tFOLLOWERS\tLIKES")
+	for _, u := range users {
+		email := u.Email
+		if email != "" && !u.EmailVerified {
+			email += " (not verified)"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%t\t%d\t%d\n", u.ID, u.Username, email, u.TOTPEnabled, u.FollowersCount, u.LikesCount)
+	}
+	w.Flush()
+	return 0
+}
+
+//* blobs
+
+func runBlobShow(args []string, in io.Reader, out io.Writer) int {
+	flags := newCommandFlags("blob show", out)
+	if !parseCommand(flags, args, 1) {
+		return 2
+	}
+	blob, code := cliBlob(flags.Arg(0), out)
+	if code != 0 {
+		return code
+	}
+
+	fmt.Fprintf(out, "blob %d of %s (id %d)\n", blob.ID, blob.Username, blob.UserID)
+	fmt.Fprintf(out, "added: %s\n", blob.AddedDate.Format(time.RFC3339))
+	fmt.Fprintf(out, "likes: %d\n\n", blob.LikesCounts)
+	fmt.Fprintln(out, blob.Content)
+	return 0
+}
+
+func runBlobDelete(args []string, in io.Reader, out io.Writer) int {
+	flags := newCommandFlags("blob delete", out)
+	yes := flags.Bool("yes", false, "don't ask for confirmation")
+	if !parseCommand(flags, args, 1) {
+		return 2
+	}
+	blob, code := cliBlob(flags.Arg(0), out)
+	if code != 0 {
+		return code
+	}
+
+	if !*yes && !confirm(in, out, fmt.Sprintf("delete blob %d of %s: %q?", blob.ID, blob.Username, feedItemTitle(blob.Content))) {
+		fmt.Fprintln(out, "nothing deleted")
+		return 1
+	}
+	if err := blob.Delete(); err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	fmt.Fprintf(out, "blob %d deleted\n", blob.ID)
+	return 0
+}
+
+func cliBlob(ref string, out io.Writer) (Blob, int) {
+	id, err := strconv.Atoi(ref)
+	if err != nil {
+		fmt.Fprintln(out, "invalid blob id")
+		return Blob{}, 2
+	}
+	blob, err := QueryBlobByID(id, 0)
+	if err != nil {
+		fmt.Fprintf(out, "blob %d not found\n", id)
+		return Blob{}, 1
+	}
+	return blob, 0
+}
+
+//* stats
+
+//InstanceStats are the counters of the whole instance
+type InstanceStats struct {
+	Users             int
+	Blobs             int
+	BlobsLastDay      int
+	Likes             int
+	Follows           int
+	RemoteFollowers   int
+	PendingWebhooks   int
+	PendingDeliveries int
+	PendingExports    int
+	UnpublishedEvents int
+}
+
+func QueryInstanceStats() (InstanceStats, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return InstanceStats{}, err
+	}
+	defer db.Close()
+
+	var stats InstanceStats
+	counters := []struct {
+		value *int
+		query string
+		args  []interface{}
+	}{
+		{&stats.Users, "SELECT COUNT(*) FROM users", nil},
+		{&stats.Blobs, "SELECT COUNT(*) FROM blobs", nil},
+		{&stats.BlobsLastDay, "SELECT COUNT(*) FROM blobs WHERE added_date > ?", []interface{}{time.Now().Add(-24 * time.Hour)}},
+		{&stats.Likes, "SELECT COUNT(*) FROM likes", nil},
+		{&stats.Follows, "SELECT COUNT(*) FROM follows", nil},
+		{&stats.RemoteFollowers, "SELECT COUNT(*) FROM remote_followers", nil},
+		{&stats.PendingWebhooks, "SELECT COUNT(*) FROM webhook_deliveries WHERE status = ?", []interface{}{webhookStatusPending}},
+		{&stats.PendingDeliveries, "SELECT COUNT(*) FROM activitypub_deliveries WHERE status = ?", []interface{}{apDeliveryPending}},
+		{&stats.PendingExports, "SELECT COUNT(*) FROM exports WHERE status = ?", []interface{}{exportStatusPending}},
+		{&stats.UnpublishedEvents, "SELECT COUNT(*) FROM outbox WHERE published_at IS NULL", nil},
+	}
+	for _, c := range counters {
+		if err = db.QueryRow(c.query, c.args...).Scan(c.value); err != nil {
+			return InstanceStats{}, err
+		}
+	}
+	return stats, nil
+}
+
+func runStats(args []string, in io.Reader, out io.Writer) int {
+	flags := newCommandFlags("stats", out)
+	if !parseCommand(flags, args, 0) {
+		return 2
+	}
+	stats, err := QueryInstanceStats()
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintf(w, "users\t%d\n", stats.Users)
+	fmt.Fprintf(w, "blobs\t%d (%d in the last 24h)\n", stats.Blobs, stats.BlobsLastDay)
+	fmt.Fprintf(w, "likes\t%d\n", stats.Likes)
+	fmt.Fprintf(w, "follows\t%d (%d remote followers)\n", stats.Follows, stats.RemoteFollowers)
+	fmt.Fprintf(w, "pending webhook deliveries\t%d\n", stats.PendingWebhooks)
+	fmt.Fprintf(w, "pending activitypub deliveries\t%d\n", stats.PendingDeliveries)
+	fmt.Fprintf(w, "pending exports\t%d\n", stats.PendingExports)
+	fmt.Fprintf(w, "events not relayed\t%d\n", stats.UnpublishedEvents)
+	w.Flush()
+	return 0
+}
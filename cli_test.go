@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+//runTestCommand runs the command with the input and returns its exit code and output
+func runTestCommand(input string, args ...string) (int, string) {
+	var out bytes.Buffer
+	code := runCommand(args, strings.NewReader(input), &out)
+	return code, out.String()
+}
+
+func TestCLIUserFlags(t *testing.T) {
+	user := newTestUser(t)
+	token, err := randomToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//a username of only digits isn't taken for an id
+	digits := strconv.Itoa(user.ID) + strings.Map(func(r rune) rune { return '0' + r%10 }, token[:10])
+	if err = AddUser(digits, hashPassword("password"), ""); err != nil {
+		t.Fatal(err)
+	}
+	numeric, err := QueryUserByUsername(digits, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, args := range [][]string{
+		{"user", "reset-password"},
+		{"user", "reset-password", "-id", strconv.Itoa(user.ID), "-username", digits},
+		{"user", "reset-password", strconv.Itoa(user.ID)},
+	} {
+		if code, out := runTestCommand("", args...); code != 2 {
+			t.Errorf("%v: exit code %d, want 2: %s", args, code, out)
+		}
+	}
+
+	if code, out := runTestCommand("new numeric password\n", "user", "reset-password", "-password-stdin", "-username", digits); code != 0 {
+		t.Fatalf("reset of %s: exit code %d: %s", digits, code, out)
+	}
+	if numeric, err = QueryUserByID(numeric.ID, 0); err != nil || numeric.Password != hashPassword("new numeric password") {
+		t.Errorf("password of %s not read from stdin: %v", digits, err)
+	}
+	if user, err = QueryUserByID(user.ID, 0); err != nil || user.Password != hashPassword("password") {
+		t.Errorf("the reset of %s changed user %d: %v", digits, user.ID, err)
+	}
+	if code, out := runTestCommand("", "user", "reset-password", "-id", strconv.Itoa(user.ID)); code != 0 || !strings.Contains(out, "password: ") {
+		t.Fatalf("reset of user %d: exit code %d, want a generated password: %s", user.ID, code, out)
+	}
+
+	if code, out := runTestCommand("\n", "user", "reset-password", "-password-stdin", "-id", strconv.Itoa(user.ID)); code != 1 {
+		t.Errorf("empty password on stdin: exit code %d, want 1: %s", code, out)
+	}
+	if code, out := runTestCommand("n\n", "user", "delete", "-username", digits); code != 1 {
+		t.Errorf("delete not confirmed: exit code %d, want 1: %s", code, out)
+	}
+	if code, out := runTestCommand("", "user", "delete", "-yes", "-id", strconv.Itoa(numeric.ID)); code != 0 {
+		t.Fatalf("delete of %s: exit code %d: %s", digits, code, out)
+	}
+	if _, err = QueryUserByID(user.ID, 0); err != nil {
+		t.Errorf("user %d deleted with %s: %v", user.ID, digits, err)
+	}
+}
+
+func TestCommandNeedsDB(t *testing.T) {
+	tests := []struct {
+		args []string
+		want bool
+	}{
+		{[]string{"help"}, false},
+		{[]string{"unknown"}, false},
+		{[]string{"user"}, false},
+		{[]string{"user", "list"}, true},
+		{[]string{"import", "-user", "gopher", "archive.zip"}, true},
+	}
+	for _, tt := range tests {
+		if got := commandNeedsDB(tt.args); got != tt.want {
+			t.Errorf("%v: %t, want %t", tt.args, got, tt.want)
+		}
+	}
+
+	//the usage of import is the one of the list of the commands
+	code, out := runTestCommand("", "import", "archive.zip")
+	if code != 2 || !strings.Contains(out, "usage: blobber "+cliCommands["import"].usage) {
+		t.Errorf("import without -user: exit code %d, want 2 and the usage: %s", code, out)
+	}
+}
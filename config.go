@@ -4,12 +4,34 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"strconv"
+	"strings"
 
 	"github.com/go-yaml/yaml"
 )
 
 type Config struct {
 	Secret string `yaml:"secret"`
+	//public url of the instance, es: https://blobber.example.com. The absolute links (emails, feeds,
+	//federation) are built from it and never from the Host of the request, that the client can set
+	BaseURL    string           `yaml:"base_url"`
+	Trending   TrendingConfig   `yaml:"trending"`
+	Mailer     MailerConfig     `yaml:"mailer"`
+	WebAuthn   WebAuthnConfig   `yaml:"webauthn"`
+	OIDC       OIDCConfig       `yaml:"oidc"`
+	RateLimit  RateLimitConfig  `yaml:"rate_limit"`
+	GRPC       GRPCConfig       `yaml:"grpc"`
+	Webhooks   WebhookConfig    `yaml:"webhooks"`
+	Federation FederationConfig `yaml:"federation"`
+}
+
+type TrendingConfig struct {
+	//windows are durations like 1h, 30m or days like 7d
+	Windows []string `yaml:"windows"`
+	//how often the trends are recomputed
+	Refresh string `yaml:"refresh"`
+	//how many blobs and terms are returned for every window
+	Limit int `yaml:"limit"`
 }
 
 var conf Config
@@ -38,9 +60,19 @@ var (
 		ID INT auto_increment NOT NULL,
 		ID_user INT NOT NULL,
 		ID_blob INT NOT NULL,
+		added_date DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
 		PRIMARY KEY (ID)
 	);
 	`
+	//likes created before the trending were saved without a date, they get the epoch so they never
+	//fall in a trending window (with CURRENT_TIMESTAMP they would all look liked at the migration),
+	//then the new likes get the current time
+	likesAddedDateQuery string = `
+	ALTER TABLE likes ADD COLUMN IF NOT EXISTS added_date DATETIME DEFAULT '1970-01-01 00:00:00' NOT NULL;
+	`
+	likesAddedDateDefaultQuery string = `
+	ALTER TABLE likes ALTER COLUMN added_date SET DEFAULT CURRENT_TIMESTAMP;
+	`
 	followsTableQuery string = `
 	CREATE TABLE IF NOT EXISTS follows (
 		ID INT auto_increment NOT NULL,
@@ -49,9 +81,369 @@ var (
 		PRIMARY KEY (ID)
 	);
 	`
+	//email and session version (incremented to revoke all the jwt of the user) added with the settings
+	usersSettingsQuery string = `
+	ALTER TABLE users
+		ADD COLUMN IF NOT EXISTS email VARCHAR(255) NULL,
+		ADD COLUMN IF NOT EXISTS email_verified BOOL DEFAULT FALSE NOT NULL,
+		ADD COLUMN IF NOT EXISTS session_version INT DEFAULT 0 NOT NULL;
+	`
+	//two factor authentication, the secret is pending until totp_enabled is true
+	usersTOTPQuery string = `
+	ALTER TABLE users
+		ADD COLUMN IF NOT EXISTS totp_secret VARCHAR(64) NULL,
+		ADD COLUMN IF NOT EXISTS totp_enabled BOOL DEFAULT FALSE NOT NULL,
+		ADD COLUMN IF NOT EXISTS totp_last_counter BIGINT DEFAULT 0 NOT NULL;
+	`
+	//random handle that identifies the user to the authenticators
+	usersWebAuthnQuery string = `
+	ALTER TABLE users ADD COLUMN IF NOT EXISTS webauthn_handle CHAR(64) NULL;
+	`
+	webAuthnCredentialsTableQuery string = `
+	CREATE TABLE IF NOT EXISTS webauthn_credentials (
+		ID INT auto_increment NOT NULL,
+		ID_user INT NOT NULL,
+		name VARCHAR(64) NOT NULL,
+		credential_id VARBINARY(1023) NOT NULL,
+		public_key BLOB NOT NULL,
+		attestation_type VARCHAR(32) NOT NULL,
+		aaguid VARBINARY(16) NULL,
+		sign_count INT UNSIGNED DEFAULT 0 NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+		last_used DATETIME NULL,
+		PRIMARY KEY (ID)
+	);
+	`
+	//state of the started webauthn ceremonies, the row is deleted when the ceremony is finished so a challenge is used once
+	webAuthnCeremoniesTableQuery string = `
+	CREATE TABLE IF NOT EXISTS webauthn_ceremonies (
+		ID INT auto_increment NOT NULL,
+		token CHAR(64) NOT NULL,
+		purpose VARCHAR(32) NOT NULL,
+		data TEXT NOT NULL,
+		expires_at DATETIME NOT NULL,
+		PRIMARY KEY (ID),
+		UNIQUE KEY (token)
+	);
+	`
+	recoveryCodesTableQuery string = `
+	CREATE TABLE IF NOT EXISTS recovery_codes (
+		ID INT auto_increment NOT NULL,
+		ID_user INT NOT NULL,
+		code CHAR(64) NOT NULL,
+		used BOOL DEFAULT FALSE NOT NULL,
+		PRIMARY KEY (ID)
+	);
+	`
+	//old usernames keep pointing to the user until they expire
+	//the usernames are checked before the insert, the unique key stops two users registered or renamed at the same time
+	usersUsernameUniqueQuery string = `
+	ALTER TABLE users ADD UNIQUE KEY IF NOT EXISTS username (username);
+	`
+	usernameAliasesTableQuery string = `
+	CREATE TABLE IF NOT EXISTS username_aliases (
+		ID INT auto_increment NOT NULL,
+		ID_user INT NOT NULL,
+		username VARCHAR(20) NOT NULL,
+		expires_at DATETIME NOT NULL,
+		PRIMARY KEY (ID)
+	);
+	`
+	passwordResetsTableQuery string = `
+	CREATE TABLE IF NOT EXISTS password_resets (
+		ID INT auto_increment NOT NULL,
+		ID_user INT NOT NULL,
+		token CHAR(64) NOT NULL,
+		expires_at DATETIME NOT NULL,
+		used BOOL DEFAULT FALSE NOT NULL,
+		PRIMARY KEY (ID)
+	);
+	`
+	//accounts of the identity provider linked to the users, a subject is unique for its issuer
+	oidcIdentitiesTableQuery string = `
+	CREATE TABLE IF NOT EXISTS oidc_identities (
+		ID INT auto_increment NOT NULL,
+		ID_user INT NOT NULL,
+		issuer VARCHAR(255) NOT NULL,
+		subject VARCHAR(255) NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+		PRIMARY KEY (ID),
+		UNIQUE KEY (issuer, subject)
+	);
+	`
+	//apps of the oauth2 server, the secret is hashed and null for the public apps
+	oauthAppsTableQuery string = `
+	CREATE TABLE IF NOT EXISTS oauth_apps (
+		ID INT auto_increment NOT NULL,
+		ID_user INT NOT NULL,
+		name VARCHAR(64) NOT NULL,
+		client_id CHAR(32) NOT NULL,
+		client_secret CHAR(64) NULL,
+		redirect_uris TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+		PRIMARY KEY (ID),
+		UNIQUE KEY (client_id)
+	);
+	`
+	//consent of a user to an app, the access tokens carry the id of the grant
+	oauthGrantsTableQuery string = `
+	CREATE TABLE IF NOT EXISTS oauth_grants (
+		ID INT auto_increment NOT NULL,
+		ID_app INT NOT NULL,
+		ID_user INT NOT NULL,
+		scope VARCHAR(255) NOT NULL,
+		revoked BOOL DEFAULT FALSE NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+		PRIMARY KEY (ID),
+		UNIQUE KEY (ID_app, ID_user)
+	);
+	`
+	//every authorization of the app has its own chain of refresh tokens (the family), a token is replaced
+	//by the next one when used and kept as used to notice if it's used again
+	oauthRefreshTokensTableQuery string = `
+	CREATE TABLE IF NOT EXISTS oauth_refresh_tokens (
+		ID INT auto_increment NOT NULL,
+		ID_grant INT NOT NULL,
+		family CHAR(64) NOT NULL,
+		token CHAR(64) NOT NULL,
+		scope VARCHAR(255) NOT NULL,
+		used BOOL DEFAULT FALSE NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+		PRIMARY KEY (ID),
+		UNIQUE KEY (token),
+		KEY (family)
+	);
+	`
+	//the grants had a single refresh token column, the tokens still valid are moved to their table
+	oauthGrantsRefreshTokenQuery string = `
+	SELECT COUNT(*) FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = 'oauth_grants' AND COLUMN_NAME = 'refresh_token';
+	`
+	oauthRefreshTokensMigrationQuery string = `
+	INSERT INTO oauth_refresh_tokens (ID_grant, family, token, scope)
+	SELECT ID, refresh_token, refresh_token, scope FROM oauth_grants WHERE refresh_token IS NOT NULL AND NOT revoked;
+	`
+	oauthGrantsDropRefreshTokenQuery string = `
+	ALTER TABLE oauth_grants DROP COLUMN IF EXISTS refresh_token;
+	`
+	oauthCodesTableQuery string = `
+	CREATE TABLE IF NOT EXISTS oauth_codes (
+		ID INT auto_increment NOT NULL,
+		ID_grant INT NOT NULL,
+		code CHAR(64) NOT NULL,
+		redirect_uri TEXT NOT NULL,
+		code_challenge VARCHAR(128) NOT NULL,
+		scope VARCHAR(255) NOT NULL,
+		expires_at DATETIME NOT NULL,
+		used BOOL DEFAULT FALSE NOT NULL,
+		PRIMARY KEY (ID)
+	);
+	`
+	//token buckets of the rate limiter shared by the replicas
+	rateLimitsTableQuery string = `
+	CREATE TABLE IF NOT EXISTS rate_limits (
+		bucket VARCHAR(191) NOT NULL,
+		tokens DOUBLE NOT NULL,
+		updated_at DATETIME(6) NOT NULL,
+		PRIMARY KEY (bucket)
+	);
+	`
+	//every login attempt, the failures are used for the lockout and the successes are the login history
+	loginAttemptsTableQuery string = `
+	CREATE TABLE IF NOT EXISTS login_attempts (
+		ID INT auto_increment NOT NULL,
+		ID_user INT NULL,
+		username VARCHAR(255) NOT NULL,
+		ip VARCHAR(45) NOT NULL,
+		user_agent VARCHAR(255) NOT NULL,
+		method VARCHAR(16) NOT NULL,
+		success BOOL NOT NULL,
+		new_device BOOL DEFAULT FALSE NOT NULL,
+		added_date DATETIME NOT NULL,
+		PRIMARY KEY (ID),
+		KEY (ID_user, added_date),
+		KEY (ip, added_date)
+	);
+	`
+	//browsers the users already logged in from, the device is the hash of the DEVICE cookie
+	knownDevicesTableQuery string = `
+	CREATE TABLE IF NOT EXISTS known_devices (
+		ID INT auto_increment NOT NULL,
+		ID_user INT NOT NULL,
+		device CHAR(64) NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+		last_used DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+		PRIMARY KEY (ID)
+	);
+	`
+	//webhooks of the users, the events are space separated like the scopes
+	webhooksTableQuery string = `
+	CREATE TABLE IF NOT EXISTS webhooks (
+		ID INT auto_increment NOT NULL,
+		ID_user INT NOT NULL,
+		url VARCHAR(2048) NOT NULL,
+		secret CHAR(64) NOT NULL,
+		events VARCHAR(255) NOT NULL,
+		global BOOL DEFAULT FALSE NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+		PRIMARY KEY (ID),
+		KEY (ID_user)
+	);
+	`
+	//queue and log of the webhooks, a replica sets claim and claimed_until while it sends the delivery
+	webhookDeliveriesTableQuery string = `
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		ID INT auto_increment NOT NULL,
+		ID_webhook INT NOT NULL,
+		event VARCHAR(64) NOT NULL,
+		payload MEDIUMTEXT NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		attempts INT DEFAULT 0 NOT NULL,
+		response_code INT NULL,
+		error TEXT NULL,
+		next_attempt_at DATETIME NOT NULL,
+		claim CHAR(64) NULL,
+		claimed_until DATETIME NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+		delivered_at DATETIME NULL,
+		PRIMARY KEY (ID),
+		KEY (status, next_attempt_at),
+		KEY (ID_webhook, ID),
+		KEY (claim)
+	);
+	`
+	//activitypub keys of the local users, created the first time the user federates
+	activityPubKeysTableQuery string = `
+	CREATE TABLE IF NOT EXISTS activitypub_keys (
+		ID_user INT NOT NULL,
+		private_key TEXT NOT NULL,
+		public_key TEXT NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+		PRIMARY KEY (ID_user)
+	);
+	`
+	//actors of the other servers, fetched again when they are older than a day
+	remoteActorsTableQuery string = `
+	CREATE TABLE IF NOT EXISTS remote_actors (
+		ID INT auto_increment NOT NULL,
+		actor_id VARCHAR(512) NOT NULL,
+		username VARCHAR(255) NOT NULL,
+		host VARCHAR(255) NOT NULL,
+		inbox VARCHAR(2048) NOT NULL,
+		shared_inbox VARCHAR(2048) NULL,
+		key_id VARCHAR(512) NOT NULL,
+		public_key TEXT NOT NULL,
+		fetched_at DATETIME NOT NULL,
+		PRIMARY KEY (ID),
+		UNIQUE KEY (actor_id)
+	);
+	`
+	remoteFollowersTableQuery string = `
+	CREATE TABLE IF NOT EXISTS remote_followers (
+		ID INT auto_increment NOT NULL,
+		ID_user INT NOT NULL,
+		ID_actor INT NOT NULL,
+		activity_id VARCHAR(512) NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+		PRIMARY KEY (ID),
+		UNIQUE KEY (ID_user, ID_actor)
+	);
+	`
+	//accepted is set when the remote server answers the follow
+	remoteFollowingsTableQuery string = `
+	CREATE TABLE IF NOT EXISTS remote_followings (
+		ID INT auto_increment NOT NULL,
+		ID_user INT NOT NULL,
+		ID_actor INT NOT NULL,
+		accepted BOOL DEFAULT FALSE NOT NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+		PRIMARY KEY (ID),
+		UNIQUE KEY (ID_user, ID_actor)
+	);
+	`
+	//queue of the activities for the remote inboxes, claimed like webhook_deliveries and deleted when sent
+	activityPubDeliveriesTableQuery string = `
+	CREATE TABLE IF NOT EXISTS activitypub_deliveries (
+		ID INT auto_increment NOT NULL,
+		ID_user INT NOT NULL,
+		inbox VARCHAR(2048) NOT NULL,
+		activity MEDIUMTEXT NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		attempts INT DEFAULT 0 NOT NULL,
+		error TEXT NULL,
+		next_attempt_at DATETIME NOT NULL,
+		claim CHAR(64) NULL,
+		claimed_until DATETIME NULL,
+		created_at DATETIME DEFAULT CURRENT_TIMESTAMP NOT NULL,
+		PRIMARY KEY (ID),
+		KEY (status, next_attempt_at),
+		KEY (claim)
+	);
+	`
+	//data exports of the users, the archive is saved with the export and deleted when it expires
+	exportsTableQuery string = `
+	CREATE TABLE IF NOT EXISTS exports (
+		ID INT auto_increment NOT NULL,
+		ID_user INT NOT NULL,
+		token CHAR(64) NOT NULL,
+		status VARCHAR(16) NOT NULL,
+		attempts INT DEFAULT 0 NOT NULL,
+		error TEXT NULL,
+		archive LONGBLOB NULL,
+		size INT DEFAULT 0 NOT NULL,
+		claim CHAR(64) NULL,
+		claimed_until DATETIME NULL,
+		created_at DATETIME NOT NULL,
+		completed_at DATETIME NULL,
+		expires_at DATETIME NULL,
+		PRIMARY KEY (ID),
+		UNIQUE KEY (token),
+		KEY (ID_user),
+		KEY (status)
+	);
+	`
+	//dates of the edits of the blobs, recorded from the blob.modified events
+	blobEditsTableQuery string = `
+	CREATE TABLE IF NOT EXISTS blob_edits (
+		ID INT auto_increment NOT NULL,
+		ID_blob INT NOT NULL,
+		edited_at DATETIME(6) NOT NULL,
+		PRIMARY KEY (ID),
+		UNIQUE KEY (ID_blob, edited_at)
+	);
+	`
+	//events saved with the changes that caused them, published by the relay (outbox.go)
+	outboxTableQuery string = `
+	CREATE TABLE IF NOT EXISTS outbox (
+		ID BIGINT auto_increment NOT NULL,
+		event VARCHAR(64) NOT NULL,
+		payload TEXT NOT NULL,
+		created_at DATETIME(6) NOT NULL,
+		published_at DATETIME(6) NULL,
+		PRIMARY KEY (ID),
+		KEY (published_at, ID)
+	);
+	`
+	//the failed publications of an entry, the relay retries it until outboxMaxAttempts
+	outboxAttemptsQuery string = `
+	ALTER TABLE outbox
+		ADD COLUMN IF NOT EXISTS attempts INT DEFAULT 0 NOT NULL,
+		ADD COLUMN IF NOT EXISTS last_error TEXT NULL,
+		ADD COLUMN IF NOT EXISTS retry_at DATETIME(6) NULL;
+	`
+	emailVerificationsTableQuery string = `
+	CREATE TABLE IF NOT EXISTS email_verifications (
+		ID INT auto_increment NOT NULL,
+		ID_user INT NOT NULL,
+		email VARCHAR(255) NOT NULL,
+		token CHAR(64) NOT NULL,
+		expires_at DATETIME NOT NULL,
+		PRIMARY KEY (ID)
+	);
+	`
 )
 
-func init() {
+//loadConfig reads the config.yaml (only the secret from the env if it's set) and applies the env overrides
+func loadConfig() {
 	//read the config.yaml, parse it and load the config struct
 	secret := os.Getenv("secret")
 	// log.Println(secret
@@ -68,6 +460,99 @@ func init() {
 		conf.Secret = secret
 	}
 
+	//the trending windows can be overridden by env, es: TRENDING_WINDOWS=1h,24h,7d
+	if windows := os.Getenv("TRENDING_WINDOWS"); windows != "" {
+		conf.Trending.Windows = strings.Split(windows, ",")
+	}
+	if refresh := os.Getenv("TRENDING_REFRESH"); refresh != "" {
+		conf.Trending.Refresh = refresh
+	}
+
+	//passkeys, es: WEBAUTHN_RP_ID=blobber.example.com WEBAUTHN_ORIGIN=https://blobber.example.com
+	if rpID := os.Getenv("WEBAUTHN_RP_ID"); rpID != "" {
+		conf.WebAuthn.RPID = rpID
+	}
+	if origin := os.Getenv("WEBAUTHN_ORIGIN"); origin != "" {
+		conf.WebAuthn.Origin = origin
+	}
+
+	//single sign-on, es: OIDC_ISSUER=https://sso.example.com OIDC_CLIENT_ID=blobber OIDC_REDIRECT_URL=https://blobber.example.com/oidc/callback
+	if issuer := os.Getenv("OIDC_ISSUER"); issuer != "" {
+		conf.OIDC = OIDCConfig{
+			Issuer:        issuer,
+			ClientID:      os.Getenv("OIDC_CLIENT_ID"),
+			ClientSecret:  os.Getenv("OIDC_CLIENT_SECRET"),
+			RedirectURL:   os.Getenv("OIDC_REDIRECT_URL"),
+			Name:          os.Getenv("OIDC_NAME"),
+			DisableSignup: os.Getenv("OIDC_DISABLE_SIGNUP") == "true",
+		}
+	}
+
+	//rate limiting, es: RATE_LIMIT_BACKEND=memory for a single node, RATE_LIMIT_TRUSTED_PROXIES=172.28.0.10
+	//(the addresses or the cidrs of nginx, comma separated) to read the ip of the clients from X-Real-IP
+	if backend := os.Getenv("RATE_LIMIT_BACKEND"); backend != "" {
+		conf.RateLimit.Backend = backend
+	}
+	if proxies := os.Getenv("RATE_LIMIT_TRUSTED_PROXIES"); proxies != "" {
+		conf.RateLimit.TrustedProxies = strings.Split(proxies, ",")
+	}
+	if os.Getenv("RATE_LIMIT_DISABLED") == "true" {
+		conf.RateLimit.Disabled = true
+	}
+
+	//grpc api for the internal services, es: GRPC_ADDR=:9090, GRPC_DISABLED=true to turn it off
+	if address := os.Getenv("GRPC_ADDR"); address != "" {
+		conf.GRPC.Address = address
+	}
+	if os.Getenv("GRPC_DISABLED") == "true" {
+		conf.GRPC.Disabled = true
+	}
+
+	//webhooks, es: WEBHOOK_ADMINS=1,42 (ids of the users), WEBHOOK_ALLOW_PRIVATE=true to deliver to a local receiver
+	if admins := os.Getenv("WEBHOOK_ADMINS"); admins != "" {
+		conf.Webhooks.Admins = nil
+		for _, admin := range strings.Split(admins, ",") {
+			id, err := strconv.Atoi(strings.TrimSpace(admin))
+			if err != nil {
+				log.Fatalf("invalid WEBHOOK_ADMINS, the admins are the ids of the users: %s", admin)
+			}
+			conf.Webhooks.Admins = append(conf.Webhooks.Admins, id)
+		}
+	}
+	if os.Getenv("WEBHOOK_ALLOW_PRIVATE") == "true" {
+		conf.Webhooks.AllowPrivate = true
+	}
+
+	//public url of the instance, es: BASE_URL=https://blobber.example.com
+	if baseURL := os.Getenv("BASE_URL"); baseURL != "" {
+		conf.BaseURL = baseURL
+	}
+
+	//activitypub federation, es: FEDERATION_ENABLED=true, FEDERATION_ALLOW_PRIVATE=true
+	//to federate with a second local instance
+	if os.Getenv("FEDERATION_ENABLED") == "true" {
+		conf.Federation.Enabled = true
+	}
+	if os.Getenv("FEDERATION_ALLOW_PRIVATE") == "true" {
+		conf.Federation.AllowPrivate = true
+	}
+
+	//mailer, es: MAILER=smtp SMTP_HOST=smtp.example.com SMTP_PORT=587
+	if mailerType := os.Getenv("MAILER"); mailerType != "" {
+		conf.Mailer = MailerConfig{
+			Type:     mailerType,
+			Host:     os.Getenv("SMTP_HOST"),
+			Port:     os.Getenv("SMTP_PORT"),
+			Username: os.Getenv("SMTP_USERNAME"),
+			Password: os.Getenv("SMTP_PASSWORD"),
+			From:     os.Getenv("MAIL_FROM"),
+			Path:     os.Getenv("MAILER_PATH"),
+		}
+	}
+}
+
+//migrateDB creates the tables that don't exist and runs the migrations, blobber stops if they fail
+func migrateDB() {
 	db, err := connectToDB()
 	if err != nil {
 		log.Println("connection to db failed")
@@ -85,11 +570,182 @@ func init() {
 		log.Fatalf("users table creation failed: %s", err.Error())
 	}
 
+	_, err = db.Exec(usersSettingsQuery)
+	if err != nil {
+		log.Fatalf("users table migration failed: %s", err.Error())
+	}
+
+	_, err = db.Exec(usersTOTPQuery)
+	if err != nil {
+		log.Fatalf("users table migration failed: %s", err.Error())
+	}
+
+	_, err = db.Exec(usersWebAuthnQuery)
+	if err != nil {
+		log.Fatalf("users table migration failed: %s", err.Error())
+	}
+
+	_, err = db.Exec(webAuthnCredentialsTableQuery)
+	if err != nil {
+		log.Fatalf("webauthn_credentials table creation failed: %s", err.Error())
+	}
+
+	_, err = db.Exec(webAuthnCeremoniesTableQuery)
+	if err != nil {
+		log.Fatalf("webauthn_ceremonies table creation failed: %s", err.Error())
+	}
+
+	_, err = db.Exec(recoveryCodesTableQuery)
+	if err != nil {
+		log.Fatalf("recovery_codes table creation failed: %s", err.Error())
+	}
+
+	_, err = db.Exec(oidcIdentitiesTableQuery)
+	if err != nil {
+		log.Fatalf("oidc_identities table creation failed: %s", err.Error())
+	}
+
+	_, err = db.Exec(oauthAppsTableQuery)
+	if err != nil {
+		log.Fatalf("oauth_apps table creation failed: %s", err.Error())
+	}
+
+	_, err = db.Exec(oauthGrantsTableQuery)
+	if err != nil {
+		log.Fatalf("oauth_grants table creation failed: %s", err.Error())
+	}
+
+	_, err = db.Exec(oauthRefreshTokensTableQuery)
+	if err != nil {
+		log.Fatalf("oauth_refresh_tokens table creation failed: %s", err.Error())
+	}
+
+	var oldRefreshTokens int
+	err = db.QueryRow(oauthGrantsRefreshTokenQuery).Scan(&oldRefreshTokens)
+	if err != nil {
+		log.Fatalf("oauth_grants table migration failed: %s", err.Error())
+	}
+	if oldRefreshTokens > 0 {
+		_, err = db.Exec(oauthRefreshTokensMigrationQuery)
+		if err != nil {
+			log.Fatalf("oauth_refresh_tokens table migration failed: %s", err.Error())
+		}
+		_, err = db.Exec(oauthGrantsDropRefreshTokenQuery)
+		if err != nil {
+			log.Fatalf("oauth_grants table migration failed: %s", err.Error())
+		}
+	}
+
+	_, err = db.Exec(oauthCodesTableQuery)
+	if err != nil {
+		log.Fatalf("oauth_codes table creation failed: %s", err.Error())
+	}
+
+	_, err = db.Exec(rateLimitsTableQuery)
+	if err != nil {
+		log.Fatalf("rate_limits table creation failed: %s", err.Error())
+	}
+
+	_, err = db.Exec(loginAttemptsTableQuery)
+	if err != nil {
+		log.Fatalf("login_attempts table creation failed: %s", err.Error())
+	}
+
+	_, err = db.Exec(knownDevicesTableQuery)
+	if err != nil {
+		log.Fatalf("known_devices table creation failed: %s", err.Error())
+	}
+
+	_, err = db.Exec(usersUsernameUniqueQuery)
+	if err != nil {
+		log.Fatalf("users table migration failed, remove the duplicated usernames: %s", err.Error())
+	}
+
+	_, err = db.Exec(usernameAliasesTableQuery)
+	if err != nil {
+		log.Fatalf("username_aliases table creation failed: %s", err.Error())
+	}
+
+	_, err = db.Exec(webhooksTableQuery)
+	if err != nil {
+		log.Fatalf("webhooks table creation failed: %s", err.Error())
+	}
+
+	_, err = db.Exec(webhookDeliveriesTableQuery)
+	if err != nil {
+		log.Fatalf("webhook_deliveries table creation failed: %s", err.Error())
+	}
+
+	_, err = db.Exec(activityPubKeysTableQuery)
+	if err != nil {
+		log.Fatalf("activitypub_keys table creation failed: %s", err.Error())
+	}
+
+	_, err = db.Exec(remoteActorsTableQuery)
+	if err != nil {
+		log.Fatalf("remote_actors table creation failed: %s", err.Error())
+	}
+
+	_, err = db.Exec(remoteFollowersTableQuery)
+	if err != nil {
+		log.Fatalf("remote_followers table creation failed: %s", err.Error())
+	}
+
+	_, err = db.Exec(remoteFollowingsTableQuery)
+	if err != nil {
+		log.Fatalf("remote_followings table creation failed: %s", err.Error())
+	}
+
+	_, err = db.Exec(activityPubDeliveriesTableQuery)
+	if err != nil {
+		log.Fatalf("activitypub_deliveries table creation failed: %s", err.Error())
+	}
+
+	_, err = db.Exec(exportsTableQuery)
+	if err != nil {
+		log.Fatalf("exports table creation failed: %s", err.Error())
+	}
+
+	_, err = db.Exec(blobEditsTableQuery)
+	if err != nil {
+		log.Fatalf("blob_edits table creation failed: %s", err.Error())
+	}
+
+	_, err = db.Exec(outboxTableQuery)
+	if err != nil {
+		log.Fatalf("outbox table creation failed: %s", err.Error())
+	}
+
+	_, err = db.Exec(outboxAttemptsQuery)
+	if err != nil {
+		log.Fatalf("outbox table migration failed: %s", err.Error())
+	}
+
+	_, err = db.Exec(emailVerificationsTableQuery)
+	if err != nil {
+		log.Fatalf("email_verifications table creation failed: %s", err.Error())
+	}
+
+	_, err = db.Exec(passwordResetsTableQuery)
+	if err != nil {
+		log.Fatalf("password_resets table creation failed: %s", err.Error())
+	}
+
 	_, err = db.Exec(likesTableQuery)
 	if err != nil {
 		log.Fatalf("likes table creation failed: %s", err.Error())
 	}
 
+	_, err = db.Exec(likesAddedDateQuery)
+	if err != nil {
+		log.Fatalf("likes table migration failed: %s", err.Error())
+	}
+
+	_, err = db.Exec(likesAddedDateDefaultQuery)
+	if err != nil {
+		log.Fatalf("likes table migration failed: %s", err.Error())
+	}
+
 	_, err = db.Exec(followsTableQuery)
 	if err != nil {
 		log.Fatalf("follows table creation failed: %s", err.Error())
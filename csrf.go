@@ -0,0 +1,69 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+)
+
+//csrf protection with the double submit cookie: the CSRF cookie can be read only by the scripts of
+//blobber, they copy it in the X-CSRF-Token header (pages/scripts/csrf.js) and the middleware checks
+//that the two match. Another site can make the browser send the cookie but can't read it to set the header
+const (
+	csrfCookieName     = "CSRF"
+	csrfHeaderName     = "X-CSRF-Token"
+	csrfCookieDuration = time.Hour * 24 * 365
+)
+
+//the routes called by the oauth apps without cookies
+var csrfExemptRoutes = map[string]bool{
+	oauthToken.String(): true,
+}
+
+func csrfSafeMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+//CSRFMiddleware gives a csrf token to every client and rejects the state changing requests without it
+func CSRFMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := ""
+		if cookie, err := r.Cookie(csrfCookieName); err == nil {
+			token = cookie.Value
+		}
+		if token == "" {
+			var err error
+			if token, err = randomToken(); err != nil {
+				returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+				return
+			}
+			setCookie(w, r, &http.Cookie{
+				Name:     csrfCookieName,
+				Value:    token,
+				Path:     "/",
+				Expires:  time.Now().Add(csrfCookieDuration),
+				SameSite: http.SameSiteStrictMode,
+			})
+		}
+
+		//the remote servers post to the activitypub inboxes, the requests are signed instead
+		if csrfSafeMethod(r.Method) || csrfExemptRoutes[r.URL.Path] || strings.HasPrefix(r.URL.Path, activityPubPrefix.String()) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		//the apps authenticate with the Authorization header, another site can't make the browser add it
+		if r.Header.Get("Authorization") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		header := r.Header.Get(csrfHeaderName)
+		if header == "" || subtle.ConstantTimeCompare([]byte(header), []byte(token)) != 1 {
+			returnErrorCode(w, http.StatusForbidden, CodeInvalidCSRF, "Invalid CSRF token, reload the page and try again")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCSRFMiddleware(t *testing.T) {
+	handler := CSRFMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	inbox := activityPubPrefix.String() + "/users/1/inbox"
+
+	tests := []struct {
+		name          string
+		method, path  string
+		cookie        string
+		header        string
+		authorization string
+		status        int
+	}{
+		{"get without token", "GET", "/", "", "", "", http.StatusNoContent},
+		{"head without token", "HEAD", "/", "", "", "", http.StatusNoContent},
+		{"options without token", "OPTIONS", "/", "", "", "", http.StatusNoContent},
+		{"post with the token", "POST", addBlob.String(), "token", "token", "", http.StatusNoContent},
+		{"post without cookie", "POST", addBlob.String(), "", "token", "", http.StatusForbidden},
+		{"post without header", "POST", addBlob.String(), "token", "", "", http.StatusForbidden},
+		{"post with another token", "POST", addBlob.String(), "token", "other", "", http.StatusForbidden},
+		{"delete without header", "DELETE", "/api/v2/blobs/1", "token", "", "", http.StatusForbidden},
+		{"post of an app", "POST", addBlob.String(), "", "", "Bearer access", http.StatusNoContent},
+		{"token of an oauth app", "POST", oauthToken.String(), "", "", "", http.StatusNoContent},
+		{"activitypub inbox", "POST", inbox, "", "", "", http.StatusNoContent},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		if tt.cookie != "" {
+			r.AddCookie(&http.Cookie{Name: csrfCookieName, Value: tt.cookie})
+		}
+		if tt.header != "" {
+			r.Header.Set(csrfHeaderName, tt.header)
+		}
+		if tt.authorization != "" {
+			r.Header.Set("Authorization", tt.authorization)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body.String())
+		}
+	}
+}
+
+func TestCSRFCookie(t *testing.T) {
+	handler := CSRFMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	csrfCookie := func(w *httptest.ResponseRecorder) *http.Cookie {
+		for _, cookie := range w.Result().Cookies() {
+			if cookie.Name == csrfCookieName {
+				return cookie
+			}
+		}
+		return nil
+	}
+
+	//the first page gives the token, the scripts read it so it's not http only
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	cookie := csrfCookie(w)
+	if cookie == nil || cookie.Value == "" || cookie.HttpOnly || cookie.SameSite != http.SameSiteStrictMode || cookie.Path != "/" {
+		t.Fatalf("csrf cookie %+v, want a token readable by the scripts", cookie)
+	}
+
+	//the token is kept by the next requests and it's accepted in the header
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookie)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if csrfCookie(w) != nil {
+		t.Error("the csrf cookie was issued again")
+	}
+
+	r = httptest.NewRequest("POST", addBlob.String(), nil)
+	r.AddCookie(cookie)
+	r.Header.Set(csrfHeaderName, cookie.Value)
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Errorf("post with the issued token: status %d, want 200: %s", w.Code, w.Body.String())
+	}
+}
@@ -1,25 +1,119 @@
 package main
 
+import (
+	"strconv"
+	"strings"
+)
+
 type Endpoint string
 
 const (
 	//generics
 	login      Endpoint = "/login"
+	logout     Endpoint = "/logout"
 	register   Endpoint = "/register"
 	home       Endpoint = "/"
 	overview   Endpoint = "/overview"
 	searchPage Endpoint = "/search"
+	trending   Endpoint = "/trending"
+
+	//openapi document of the api and graphql endpoint
+	openAPI    Endpoint = "/openapi.json"
+	graphqlAPI Endpoint = "/graphql"
+
+	//password reset, the same paths serve the page (GET) and the api (POST)
+	forgotPassword Endpoint = "/password/forgot"
+	resetPassword  Endpoint = "/password/reset"
+
+	//second step of the login when the two factor authentication is enabled
+	loginSecondFactor Endpoint = "/login/2fa"
 
 	//users
 	getUser      Endpoint = "/users/{id}"
 	getUserBlobs Endpoint = "/users/{id}/blobs"
+	getFollowers Endpoint = "/users/{id}/followers"
+	getFollowing Endpoint = "/users/{id}/following"
 	followUser   Endpoint = "/users/{id}/follow"
 	unfollowUser Endpoint = "/users/{id}/unfollow"
 	searchUsers  Endpoint = "/users/search/{query}"
+	recommended  Endpoint = "/users/recommended"
 	modifyUser   Endpoint = "/users/modify"
 	deleteUser   Endpoint = "/users/delete"
 	//TODO
-	getUserPage Endpoint = "/users/page/{id}"
+	getUserPage    Endpoint = "/users/page/{id}"
+	userByUsername Endpoint = "/u/{username}"
+
+	//public feeds of the blobs, readable without an account
+	userFeedRSS  Endpoint = "/users/{id:[0-9]+}/feed.rss"
+	userFeedAtom Endpoint = "/users/{id:[0-9]+}/feed.atom"
+	tagFeedRSS   Endpoint = "/tags/{tag}/feed.rss"
+	tagFeedAtom  Endpoint = "/tags/{tag}/feed.atom"
+
+	//settings
+	settingsPage   Endpoint = "/settings"
+	changeUsername Endpoint = "/settings/username"
+	changePassword Endpoint = "/settings/password"
+	changeEmail    Endpoint = "/settings/email"
+	verifyEmail    Endpoint = "/settings/email/verify/{token}"
+	enrollTOTP     Endpoint = "/settings/2fa/enroll"
+	confirmTOTP    Endpoint = "/settings/2fa/confirm"
+	disableTOTP    Endpoint = "/settings/2fa/disable"
+	getPasskeys    Endpoint = "/settings/passkeys"
+	deletePasskey  Endpoint = "/settings/passkeys/{id}/delete"
+	unlinkOIDC     Endpoint = "/settings/oidc/unlink"
+	loginHistory   Endpoint = "/settings/logins"
+
+	//oauth apps registered by the user (GET lists, POST creates) and the apps he authorized
+	getOAuthApps     Endpoint = "/settings/apps"
+	deleteOAuthApp   Endpoint = "/settings/apps/{id}/delete"
+	getOAuthGrants   Endpoint = "/settings/grants"
+	revokeOAuthGrant Endpoint = "/settings/grants/{id}/revoke"
+
+	//webhooks of the user (GET lists, POST creates), the test sends a ping right away
+	getWebhooks          Endpoint = "/settings/webhooks"
+	deleteWebhook        Endpoint = "/settings/webhooks/{id}/delete"
+	testWebhook          Endpoint = "/settings/webhooks/{id}/test"
+	getWebhookDeliveries Endpoint = "/settings/webhooks/{id}/deliveries"
+
+	//data exports of the user (GET lists, POST requests a new one), the download link works without login until it expires
+	getExports     Endpoint = "/settings/export"
+	downloadExport Endpoint = "/exports/{token}"
+	//import of a blobber export or a twitter archive, the progress is streamed
+	importArchive Endpoint = "/settings/import"
+
+	//remote actors followed by the user (GET lists, POST follows a handle) and following the user
+	remoteFollowings Endpoint = "/settings/federation/following"
+	unfollowRemote   Endpoint = "/settings/federation/following/{id}/delete"
+	remoteFollowers  Endpoint = "/settings/federation/followers"
+
+	//oauth2 authorization server, the consent page (GET) and its answer (POST) share the path
+	oauthAuthorize Endpoint = "/oauth/authorize"
+	oauthToken     Endpoint = "/oauth/token"
+
+	//passkeys (webauthn), the ceremony cookie is scoped to /webauthn
+	beginPasskeyRegistration  Endpoint = "/webauthn/register/begin"
+	finishPasskeyRegistration Endpoint = "/webauthn/register/finish"
+	beginPasskeySignup        Endpoint = "/webauthn/signup/begin"
+	finishPasskeySignup       Endpoint = "/webauthn/signup/finish"
+	beginPasskeyLogin         Endpoint = "/webauthn/login/begin"
+	finishPasskeyLogin        Endpoint = "/webauthn/login/finish"
+
+	//single sign-on with the oidc identity provider, the state cookie is scoped to /oidc
+	loginOIDC    Endpoint = "/oidc/login"
+	oidcCallback Endpoint = "/oidc/callback"
+
+	//activitypub federation, the routes under activityPubPrefix are called by the remote servers
+	webFinger         Endpoint = "/.well-known/webfinger"
+	activityPubPrefix Endpoint = "/ap/"
+	activityActor     Endpoint = "/ap/users/{id:[0-9]+}"
+	activityInbox     Endpoint = "/ap/users/{id:[0-9]+}/inbox"
+	activityOutbox    Endpoint = "/ap/users/{id:[0-9]+}/outbox"
+	activityFollowers Endpoint = "/ap/users/{id:[0-9]+}/followers"
+	activityFollowing Endpoint = "/ap/users/{id:[0-9]+}/following"
+	activityNote      Endpoint = "/ap/blobs/{id:[0-9]+}"
+
+	//static scripts shared by the pages
+	scripts Endpoint = "/scripts/{name}"
 
 	//blobs
 	addBlob    Endpoint = "/blob/add"
@@ -30,8 +124,39 @@ const (
 	addLikeBlob    Endpoint = "/blob/{id}/like/add"
 	removeLikeBlob Endpoint = "/blob/{id}/like/remove"
 	toggleLikeBlob Endpoint = "/blob/{id}/like/toggle"
+
+	//api v2, resource oriented routes relative to apiV2, "me" is the logged user
+	apiV2             Endpoint = "/api/v2"
+	v2Me              Endpoint = "/users/me"
+	v2Users           Endpoint = "/users"
+	v2Recommended     Endpoint = "/users/recommended"
+	v2User            Endpoint = "/users/{id:[0-9]+}"
+	v2UserBlobs       Endpoint = "/users/{id:[0-9]+}/blobs"
+	v2UserFollowers   Endpoint = "/users/{id:[0-9]+}/followers"
+	v2UserFollowing   Endpoint = "/users/{id:[0-9]+}/following"
+	v2UserFollowersMe Endpoint = "/users/{id:[0-9]+}/followers/me"
+	v2Feed            Endpoint = "/feed"
+	v2Trending        Endpoint = "/trending"
+	v2Blobs           Endpoint = "/blobs"
+	v2Blob            Endpoint = "/blobs/{id:[0-9]+}"
+	v2BlobLikesMe     Endpoint = "/blobs/{id:[0-9]+}/likes/me"
 )
 
 func (e Endpoint) String() string {
 	return string(e)
 }
+
+//V2 returns the full path of an api v2 endpoint
+func (e Endpoint) V2() string {
+	return apiV2.String() + e.String()
+}
+
+//V2Path returns the path of an api v2 endpoint with the id of the resource
+func (e Endpoint) V2Path(id string) string {
+	return strings.Replace(e.V2(), "{id:[0-9]+}", id, 1)
+}
+
+//Path returns the path of the endpoint with the id of the resource
+func (e Endpoint) Path(id int) string {
+	return strings.Replace(e.String(), "{id:[0-9]+}", strconv.Itoa(id), 1)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+//the domain functions save an event in the outbox with every write and the relay publishes it on the
+//bus (outbox.go), the side effects (webhooks, cleanups, ...) subscribe to the bus instead of being
+//called by the handlers. The synchronous subscribers run before Publish returns, so before the relay
+//marks the event as published: if one of them fails the relay publishes the event again, to all of them.
+//The asynchronous ones run in the goroutine of Run and can be lost
+type Event interface {
+	//EventName is the name the subscribers use, es: blob.created
+	EventName() string
+}
+
+const (
+	EventBlobCreated    = "blob.created"
+	EventBlobModified   = "blob.modified"
+	EventBlobDeleted    = "blob.deleted"
+	EventBlobLiked      = "blob.liked"
+	EventBlobUnliked    = "blob.unliked"
+	EventUserFollowed   = "user.followed"
+	EventUserUnfollowed = "user.unfollowed"
+	EventUserDeleted    = "user.deleted"
+)
+
+//the events carry what the subscribers send out (es: the webhooks), so they don't read rows that
+//can be changed or deleted before the relay publishes the event
+type BlobCreated struct {
+	BlobID   int
+	UserID   int
+	Username string
+	Content  string
+	At       time.Time
+}
+
+type BlobModified struct {
+	BlobID  int
+	Content string
+	At      time.Time
+}
+
+type BlobDeleted struct {
+	BlobID int
+	At     time.Time
+}
+
+type BlobLiked struct {
+	BlobID  int
+	OwnerID int
+	LikerID int
+	Liker   string
+	At      time.Time
+}
+
+type BlobUnliked struct {
+	BlobID  int
+	OwnerID int
+	LikerID int
+	At      time.Time
+}
+
+type UserFollowed struct {
+	FollowerID int
+	Follower   string
+	FollowedID int
+	Followed   string
+	At         time.Time
+}
+
+type UserUnfollowed struct {
+	FollowerID int
+	FollowedID int
+	At         time.Time
+}
+
+type UserDeleted struct {
+	UserID int
+	At     time.Time
+}
+
+func (BlobCreated) EventName() string    { return EventBlobCreated }
+func (BlobModified) EventName() string   { return EventBlobModified }
+func (BlobDeleted) EventName() string    { return EventBlobDeleted }
+func (BlobLiked) EventName() string      { return EventBlobLiked }
+func (BlobUnliked) EventName() string    { return EventBlobUnliked }
+func (UserFollowed) EventName() string   { return EventUserFollowed }
+func (UserUnfollowed) EventName() string { return EventUserUnfollowed }
+func (UserDeleted) EventName() string    { return EventUserDeleted }
+
+//EventHandler returns an error to have the event published again, the synchronous ones only
+type EventHandler func(Event) error
+
+//EventBus is an in process publish/subscribe of the domain events
+type EventBus struct {
+	mu    sync.RWMutex
+	sync  map[string][]EventHandler
+	async map[string][]EventHandler
+	queue chan Event
+}
+
+//how many events wait for the asynchronous subscribers before new ones are dropped
+const eventQueueSize = 1024
+
+var eventBus = NewEventBus(eventQueueSize)
+
+func NewEventBus(queueSize int) *EventBus {
+	return &EventBus{
+		sync:  make(map[string][]EventHandler),
+		async: make(map[string][]EventHandler),
+		queue: make(chan Event, queueSize),
+	}
+}
+
+//Subscribe adds a synchronous subscriber, it runs in the goroutine of the publisher (the relay) so it slows the others
+func (b *EventBus) Subscribe(name string, handler EventHandler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sync[name] = append(b.sync[name], handler)
+}
+
+//SubscribeAsync adds a subscriber that runs in background, the publisher doesn't wait for it
+func (b *EventBus) SubscribeAsync(name string, handler EventHandler) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.async[name] = append(b.async[name], handler)
+}
+
+//Publish runs the synchronous subscribers and queues the event for the asynchronous ones. A failure
+//(or a panic) of a subscriber doesn't stop the others, the first one is returned and the event isn't
+//queued since it will be published again
+func (b *EventBus) Publish(e Event) error {
+	b.mu.RLock()
+	handlers := b.sync[e.EventName()]
+	hasAsync := len(b.async[e.EventName()]) > 0
+	b.mu.RUnlock()
+
+	var failed error
+	for _, handler := range handlers {
+		if err := runEventHandler(handler, e); err != nil && failed == nil {
+			failed = err
+		}
+	}
+	if failed != nil || !hasAsync {
+		return failed
+	}
+	select {
+	case b.queue <- e:
+	default:
+		log.Printf("events: queue full, %s event dropped", e.EventName())
+	}
+	return nil
+}
+
+//Run delivers the queued events to the asynchronous subscribers, it never returns so it should be called in a goroutine
+func (b *EventBus) Run() {
+	for e := range b.queue {
+		b.mu.RLock()
+		handlers := b.async[e.EventName()]
+		b.mu.RUnlock()
+		for _, handler := range handlers {
+			if err := runEventHandler(handler, e); err != nil {
+				log.Printf("events: asynchronous subscriber of %s failed: %v", e.EventName(), err)
+			}
+		}
+	}
+}
+
+func runEventHandler(handler EventHandler, e Event) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("events: subscriber of %s panicked: %v\n%s", e.EventName(), r, debug.Stack())
+			err = fmt.Errorf("subscriber panicked: %v", r)
+		}
+	}()
+	return handler(e)
+}
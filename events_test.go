@@ -0,0 +1,37 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEventBusPublish(t *testing.T) {
+	bus := NewEventBus(1)
+	var ran int
+	bus.Subscribe(EventBlobDeleted, func(e Event) error {
+		if e.(BlobDeleted).BlobID == 1 {
+			panic("broken subscriber")
+		}
+		return nil
+	})
+	bus.Subscribe(EventBlobDeleted, func(Event) error {
+		ran++
+		return nil
+	})
+	bus.SubscribeAsync(EventBlobDeleted, func(Event) error { return nil })
+
+	//the failure of a subscriber doesn't stop the others, the event isn't queued since it will be published again
+	if err := bus.Publish(BlobDeleted{BlobID: 1, At: time.Now()}); err == nil {
+		t.Error("the panic of a subscriber wasn't returned")
+	}
+	if ran != 1 || len(bus.queue) != 0 {
+		t.Errorf("after a failure: %d subscribers ran and %d events queued, want 1 and 0", ran, len(bus.queue))
+	}
+
+	if err := bus.Publish(BlobDeleted{BlobID: 2, At: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	if ran != 2 || len(bus.queue) != 1 {
+		t.Errorf("after a success: %d subscribers ran and %d events queued, want 2 and 1", ran, len(bus.queue))
+	}
+}
@@ -0,0 +1,591 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//data export (gdpr takeout): the user asks for an export from the settings, the worker builds a zip with
+//the data of the account in json and an html index to read it, the zip is saved in the database so every
+//replica can serve it. The download link contains a random token and expires after exportExpiration.
+//Blobber has no attachments, the blobs are only text
+const (
+	exportStatusPending = "pending"
+	exportStatusReady   = "ready"
+	exportStatusFailed  = "failed"
+
+	exportExpiration    = time.Hour * time.Duration(24*7)
+	exportClaimDuration = time.Minute * time.Duration(10)
+	//the login history kept in the archive
+	exportLoginsLimit = 10000
+	//a failed export is tried again at most this many times
+	exportMaxAttempts = 3
+
+	//format of the archive, read by the import
+	exportFormat  = "blobber-export"
+	exportVersion = 1
+)
+
+//Export is a request of the user, the download url is set when the archive is ready
+type Export struct {
+	ID          int        `json:"id"`
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	Size        int        `json:"size"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+	DownloadURL string     `json:"download_url,omitempty"`
+}
+
+//ExportWorker builds the pending exports, the replicas claim them like the webhook deliveries
+type ExportWorker struct {
+	interval time.Duration
+	wake     chan struct{}
+}
+
+var exportWorker *ExportWorker
+
+//* content of the archive
+
+type exportManifest struct {
+	Format    string    `json:"format"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	UserID    int       `json:"user_id"`
+	Username  string    `json:"username"`
+}
+
+type exportProfile struct {
+	ID            int    `json:"id"`
+	Username      string `json:"username"`
+	Description   string `json:"description"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	TwoFactor     bool   `json:"two_factor"`
+	LikesReceived int    `json:"likes_received"`
+	Followers     int    `json:"followers"`
+	Following     int    `json:"following"`
+}
+
+//exportBlob is a blob of the user with the dates of its edits, the oldest first
+type exportBlob struct {
+	ID        int         `json:"id"`
+	Content   string      `json:"content"`
+	AddedDate time.Time   `json:"added_date"`
+	Likes     int         `json:"likes"`
+	EditedAt  []time.Time `json:"edited_at"`
+}
+
+//exportLike is a blob liked by the user
+type exportLike struct {
+	LikedAt  time.Time `json:"liked_at"`
+	BlobID   int       `json:"blob_id"`
+	AuthorID int       `json:"author_id"`
+	Author   string    `json:"author"`
+	Content  string    `json:"content"`
+}
+
+type exportUser struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+}
+
+type exportData struct {
+	Manifest  exportManifest
+	Profile   exportProfile
+	Blobs     []exportBlob
+	Likes     []exportLike
+	Followers []exportUser
+	Following []exportUser
+	Logins    []LoginAttempt
+}
+
+//* requests
+
+func scanExport(row rowScanner) (Export, error) {
+	var e Export
+	var completedAt, expiresAt sql.NullTime
+	var token string
+	err := row.Scan(&e.ID, &e.Status, &e.Error, &e.Size, &e.CreatedAt, &completedAt, &expiresAt, &token)
+	if err != nil {
+		return Export{}, err
+	}
+	if completedAt.Valid {
+		e.CompletedAt = &completedAt.Time
+	}
+	if expiresAt.Valid {
+		e.ExpiresAt = &expiresAt.Time
+	}
+	if e.Status == exportStatusReady {
+		e.DownloadURL = strings.Replace(downloadExport.String(), "{token}", token, 1)
+	}
+	return e, nil
+}
+
+const exportColumnsQuery = "SELECT ID, status, IFNULL(error, ''), size, created_at, completed_at, expires_at, token FROM exports"
+
+//RequestExport queues a new export, only one can be pending at a time
+func (u User) RequestExport() (Export, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return Export{}, fmt.Errorf("internal server error: %v", err)
+	}
+	defer db.Close()
+
+	token, err := randomToken()
+	if err != nil {
+		return Export{}, fmt.Errorf("internal server error: %v", err)
+	}
+
+	//the check and the insert are one statement, so two requests at the same time can't both find no pending export
+	res, err := db.Exec(`INSERT INTO exports (ID_user, token, status, created_at) SELECT ?, ?, ?, ? FROM DUAL
+		WHERE NOT EXISTS (SELECT 1 FROM exports WHERE ID_user = ? AND status = ?)`,
+		u.ID, token, exportStatusPending, time.Now(), u.ID, exportStatusPending)
+	if err != nil {
+		return Export{}, fmt.Errorf("internal server error: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return Export{}, fmt.Errorf("%w: an export is already in progress", errConflict)
+	}
+	id, _ := res.LastInsertId()
+	exportWorker.Wake()
+
+	export, err := scanExport(db.QueryRow(exportColumnsQuery+" WHERE ID = ?", id))
+	if err != nil {
+		return Export{}, fmt.Errorf("internal server error: %v", err)
+	}
+	return export, nil
+}
+
+//GetExports returns the exports of the user not expired yet, the newest first
+func (u User) GetExports() ([]Export, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return []Export{}, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(exportColumnsQuery+" WHERE ID_user = ? AND (expires_at IS NULL OR expires_at > ?) ORDER BY ID DESC", u.ID, time.Now())
+	if err != nil {
+		return []Export{}, err
+	}
+	defer rows.Close()
+
+	var exports []Export
+	for rows.Next() {
+		e, err := scanExport(rows)
+		if err != nil {
+			return []Export{}, err
+		}
+		exports = append(exports, e)
+	}
+	return exports, rows.Err()
+}
+
+//queryExportArchive returns the archive of the token and the username of its owner, sql.ErrNoRows
+//if the export doesn't exist, is not ready or is expired
+func queryExportArchive(token string) ([]byte, string, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return nil, "", err
+	}
+	defer db.Close()
+
+	var archive []byte
+	var username string
+	err = db.QueryRow(`SELECT e.archive, u.username FROM exports e JOIN users u ON u.ID = e.ID_user
+		WHERE e.token = ? AND e.status = ? AND e.expires_at > ?`, token, exportStatusReady, time.Now()).Scan(&archive, &username)
+	return archive, username, err
+}
+
+//* blob edits
+
+//the blobs table only has the creation date, the edits are recorded from the events for the exports
+func subscribeExports(bus *EventBus) {
+	bus.Subscribe(EventBlobModified, func(e Event) error {
+		modified := e.(BlobModified)
+		if err := recordBlobEdit(modified.BlobID, modified.At); err != nil {
+			return fmt.Errorf("exports: edit of blob %d not recorded: %v", modified.BlobID, err)
+		}
+		return nil
+	})
+	bus.Subscribe(EventBlobDeleted, func(e Event) error {
+		if err := deleteBlobEdits(e.(BlobDeleted).BlobID); err != nil {
+			return fmt.Errorf("exports: edits of the deleted blob not removed: %v", err)
+		}
+		return nil
+	})
+	bus.Subscribe(EventUserDeleted, func(e Event) error {
+		if err := deleteUserExports(e.(UserDeleted).UserID); err != nil {
+			return fmt.Errorf("exports: exports of the deleted user not removed: %v", err)
+		}
+		return nil
+	})
+}
+
+//recordBlobEdit is idempotent, the relay can publish an event twice
+func recordBlobEdit(blobID int, at time.Time) error {
+	db, err := connectToDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec("INSERT IGNORE INTO blob_edits (ID_blob, edited_at) VALUES (?, ?)", blobID, at)
+	return err
+}
+
+func deleteBlobEdits(blobID int) error {
+	db, err := connectToDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec("DELETE FROM blob_edits WHERE ID_blob = ?", blobID)
+	return err
+}
+
+func deleteUserExports(userID int) error {
+	db, err := connectToDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec("DELETE FROM exports WHERE ID_user = ?", userID)
+	return err
+}
+
+//* archive
+
+//collectExportData reads all the data of the user saved in the archive
+func collectExportData(userID int) (exportData, error) {
+	user, err := QueryUserByID(userID, 0)
+	if err != nil {
+		return exportData{}, err
+	}
+	data := exportData{
+		Manifest: exportManifest{Format: exportFormat, Version: exportVersion, CreatedAt: time.Now().UTC(), UserID: user.ID, Username: user.Username},
+		Profile: exportProfile{
+			ID:            user.ID,
+			Username:      user.Username,
+			Description:   user.Description,
+			Email:         user.Email,
+			EmailVerified: user.EmailVerified,
+			TwoFactor:     user.TOTPEnabled,
+			LikesReceived: user.LikesCount,
+			Followers:     user.FollowersCount,
+			Following:     user.FollowingCount,
+		},
+	}
+
+	db, err := connectToDB()
+	if err != nil {
+		return exportData{}, err
+	}
+	defer db.Close()
+
+	edits := make(map[int][]time.Time)
+	rows, err := db.Query(`SELECT e.ID_blob, e.edited_at FROM blob_edits e JOIN blobs b ON b.ID = e.ID_blob
+		WHERE b.ID_user = ? ORDER BY e.edited_at`, user.ID)
+	if err != nil {
+		return exportData{}, err
+	}
+	for rows.Next() {
+		var blobID int
+		var at time.Time
+		if err = rows.Scan(&blobID, &at); err != nil {
+			rows.Close()
+			return exportData{}, err
+		}
+		edits[blobID] = append(edits[blobID], at)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return exportData{}, err
+	}
+
+	blobs, err := user.GetBlobs(true, 0)
+	if err != nil {
+		return exportData{}, err
+	}
+	data.Blobs = make([]exportBlob, 0, len(blobs))
+	for _, blob := range blobs {
+		data.Blobs = append(data.Blobs, exportBlob{
+			ID:        blob.ID,
+			Content:   blob.Content,
+			AddedDate: blob.AddedDate,
+			Likes:     blob.LikesCounts,
+			EditedAt:  append([]time.Time{}, edits[blob.ID]...),
+		})
+	}
+
+	rows, err = db.Query(`SELECT l.added_date, b.ID, b.ID_user, u.username, b.content FROM likes l JOIN blobs b ON b.ID = l.ID_blob
+		JOIN users u ON u.ID = b.ID_user WHERE l.ID_user = ? ORDER BY l.added_date DESC`, user.ID)
+	if err != nil {
+		return exportData{}, err
+	}
+	data.Likes = []exportLike{}
+	for rows.Next() {
+		var like exportLike
+		if err = rows.Scan(&like.LikedAt, &like.BlobID, &like.AuthorID, &like.Author, &like.Content); err != nil {
+			rows.Close()
+			return exportData{}, err
+		}
+		data.Likes = append(data.Likes, like)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return exportData{}, err
+	}
+
+	followers, _, err := user.GetFollowers(0, user.FollowersCount, 0)
+	if err != nil {
+		return exportData{}, err
+	}
+	following, _, err := user.GetFollowings(0, user.FollowingCount, 0)
+	if err != nil {
+		return exportData{}, err
+	}
+	data.Followers, data.Following = exportUsers(followers), exportUsers(following)
+
+	if data.Logins, err = user.GetLoginHistory(exportLoginsLimit); err != nil {
+		return exportData{}, err
+	}
+	if data.Logins == nil {
+		data.Logins = []LoginAttempt{}
+	}
+	return data, nil
+}
+
+func exportUsers(users []User) []exportUser {
+	list := make([]exportUser, 0, len(users))
+	for _, u := range users {
+		list = append(list, exportUser{ID: u.ID, Username: u.Username})
+	}
+	return list
+}
+
+//buildExportArchive writes the zip: a json file for every kind of data and index.html to read them
+func buildExportArchive(data exportData) ([]byte, error) {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+
+	files := []struct {
+		name    string
+		content interface{}
+	}{
+		{"manifest.json", data.Manifest},
+		{"profile.json", data.Profile},
+		{"blobs.json", data.Blobs},
+		{"likes.json", data.Likes},
+		{"followers.json", data.Followers},
+		{"following.json", data.Following},
+		{"logins.json", data.Logins},
+	}
+	for _, file := range files {
+		content, err := json.MarshalIndent(file.content, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		w, err := archive.CreateHeader(&zip.FileHeader{Name: file.name, Method: zip.Deflate, Modified: data.Manifest.CreatedAt})
+		if err != nil {
+			return nil, err
+		}
+		if _, err = w.Write(content); err != nil {
+			return nil, err
+		}
+	}
+
+	tmpl, err := template.ParseFiles("pages/export.html")
+	if err != nil {
+		return nil, err
+	}
+	w, err := archive.CreateHeader(&zip.FileHeader{Name: "index.html", Method: zip.Deflate, Modified: data.Manifest.CreatedAt})
+	if err != nil {
+		return nil, err
+	}
+	if err = tmpl.Execute(w, data); err != nil {
+		return nil, err
+	}
+
+	if err = archive.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+//* worker
+
+func NewExportWorker() *ExportWorker {
+	return &ExportWorker{
+		interval: time.Second * time.Duration(10),
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+//Wake makes the worker look for pending exports now instead of waiting for the next tick
+func (x *ExportWorker) Wake() {
+	if x == nil {
+		return
+	}
+	select {
+	case x.wake <- struct{}{}:
+	default:
+	}
+}
+
+//Run builds the pending exports and deletes the expired ones, it never returns so it should be called in a goroutine
+func (x *ExportWorker) Run() {
+	ticker := time.NewTicker(x.interval)
+	defer ticker.Stop()
+	for {
+		for {
+			built, err := x.buildNext()
+			if err != nil {
+				log.Printf("exports: build failed: %v", err)
+			}
+			if err != nil || !built {
+				break
+			}
+		}
+		x.cleanup()
+		select {
+		case <-ticker.C:
+		case <-x.wake:
+		}
+	}
+}
+
+//buildNext claims the oldest pending export and builds it, it returns false if there was nothing to do
+func (x *ExportWorker) buildNext() (bool, error) {
+	claim, err := randomToken()
+	if err != nil {
+		return false, err
+	}
+
+	db, err := connectToDB()
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	now := time.Now()
+	res, err := db.Exec(`UPDATE exports SET claim = ?, claimed_until = ?, attempts = attempts + 1
+		WHERE status = ? AND (claimed_until IS NULL OR claimed_until < ?) ORDER BY ID LIMIT 1`,
+		claim, now.Add(exportClaimDuration), exportStatusPending, now)
+	if err != nil {
+		return false, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return false, nil
+	}
+
+	var id, userID, attempts int
+	err = db.QueryRow("SELECT ID, ID_user, attempts FROM exports WHERE claim = ?", claim).Scan(&id, &userID, &attempts)
+	if err != nil {
+		return false, err
+	}
+
+	data, err := collectExportData(userID)
+	var archive []byte
+	if err == nil {
+		archive, err = buildExportArchive(data)
+	}
+	if err != nil {
+		//the claim expires and the export is tried again, the last attempt fails it
+		log.Printf("exports: export %d of user %d failed (attempt %d): %v", id, userID, attempts, err)
+		if attempts < exportMaxAttempts {
+			return true, nil
+		}
+		_, err = db.Exec("UPDATE exports SET status = ?, error = ?, completed_at = ?, expires_at = ?, claim = NULL WHERE ID = ?",
+			exportStatusFailed, err.Error(), time.Now(), time.Now().Add(exportExpiration), id)
+		return true, err
+	}
+
+	completed := time.Now()
+	_, err = db.Exec(`UPDATE exports SET status = ?, archive = ?, size = ?, completed_at = ?, expires_at = ?, claim = NULL
+		WHERE ID = ? AND claim = ?`, exportStatusReady, archive, len(archive), completed, completed.Add(exportExpiration), id, claim)
+	return true, err
+}
+
+//cleanup deletes the expired exports with their archives
+func (x *ExportWorker) cleanup() {
+	db, err := connectToDB()
+	if err != nil {
+		log.Printf("exports: cleanup failed: %v", err)
+		return
+	}
+	defer db.Close()
+
+	if _, err = db.Exec("DELETE FROM exports WHERE expires_at < ?", time.Now()); err != nil {
+		log.Printf("exports: cleanup failed: %v", err)
+	}
+}
+
+//* handlers
+
+func getExportsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	user := User{ID: jwtContent.UserID}
+	exports, err := user.GetExports()
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+	exportsJson, _ := json.Marshal(exports)
+	returnSuccessJson(w, http.StatusOK, "Exports found", "exports", exportsJson)
+}
+
+func requestExportHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	user := User{ID: jwtContent.UserID}
+	export, err := user.RequestExport()
+	if err != nil {
+		returnDomainError(w, err)
+		return
+	}
+	exportJson, _ := json.Marshal(export)
+	returnSuccessJson(w, http.StatusAccepted, "Export requested, the archive will be ready in a few minutes", "export", exportJson)
+}
+
+//downloadExportHandler serves the archive to whoever has the link, the token is the secret
+func downloadExportHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	archive, username, err := queryExportArchive(mux.Vars(r)["token"])
+	if err == sql.ErrNoRows {
+		returnError(w, http.StatusNotFound, "Export not found or expired")
+		return
+	}
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="blobber-%s.zip"`, username))
+	w.Header().Set("Cache-Control", "private, no-store")
+	w.Write(archive)
+}
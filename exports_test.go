@@ -0,0 +1,269 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+//readExportArchive returns the files of the zip by name
+func readExportArchive(t *testing.T, archive []byte) map[string][]byte {
+	t.Helper()
+	r, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string][]byte)
+	for _, f := range r.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := ioutil.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[f.Name] = content
+	}
+	return files
+}
+
+func TestBuildExportArchive(t *testing.T) {
+	created := time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+	data := exportData{
+		Manifest:  exportManifest{Format: exportFormat, Version: exportVersion, CreatedAt: created, UserID: 1, Username: "gopher"},
+		Profile:   exportProfile{ID: 1, Username: "gopher", Description: "<b>ciao</b>"},
+		Blobs:     []exportBlob{{ID: 2, Content: "first blob", AddedDate: created, EditedAt: []time.Time{}}},
+		Likes:     []exportLike{},
+		Followers: []exportUser{{ID: 3, Username: "follower"}},
+		Following: []exportUser{},
+		Logins:    []LoginAttempt{},
+	}
+	archive, err := buildExportArchive(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := readExportArchive(t, archive)
+
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	want := []string{"blobs.json", "followers.json", "following.json", "index.html", "likes.json", "logins.json", "manifest.json", "profile.json"}
+	if strings.Join(names, " ") != strings.Join(want, " ") {
+		t.Fatalf("files of the archive %v, want %v", names, want)
+	}
+
+	var manifest exportManifest
+	if err = json.Unmarshal(files["manifest.json"], &manifest); err != nil || manifest != data.Manifest {
+		t.Errorf("manifest %+v, %v, want %+v", manifest, err, data.Manifest)
+	}
+	var blobs []exportBlob
+	if err = json.Unmarshal(files["blobs.json"], &blobs); err != nil || len(blobs) != 1 || blobs[0].Content != "first blob" {
+		t.Errorf("blobs %+v, %v, want the blob of the data", blobs, err)
+	}
+	var followers []exportUser
+	if err = json.Unmarshal(files["followers.json"], &followers); err != nil || len(followers) != 1 || followers[0].Username != "follower" {
+		t.Errorf("followers %+v, %v, want the follower of the data", followers, err)
+	}
+	//the index is html, the data is escaped
+	index := string(files["index.html"])
+	if !strings.Contains(index, "first blob") || strings.Contains(index, "<b>ciao</b>") {
+		t.Errorf("index.html without the blob or with the description not escaped: %s", index)
+	}
+}
+
+func TestRequestExport(t *testing.T) {
+	user := newTestUser(t)
+
+	//the requests at the same time don't create two pending exports
+	var wg sync.WaitGroup
+	errs := make([]error, 4)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = user.RequestExport()
+		}(i)
+	}
+	wg.Wait()
+	var requested int
+	for _, err := range errs {
+		if err == nil {
+			requested++
+		} else if !errors.Is(err, errConflict) {
+			t.Errorf("request of an export: %v, want a conflict", err)
+		}
+	}
+	exports, err := user.GetExports()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if requested != 1 || len(exports) != 1 || exports[0].Status != exportStatusPending {
+		t.Errorf("%d exports requested, exports %+v, want 1 pending", requested, exports)
+	}
+}
+
+//buildAllExports builds the pending exports, es: the ones left by the other tests
+func buildAllExports(t *testing.T, x *ExportWorker) {
+	t.Helper()
+	for {
+		built, err := x.buildNext()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !built {
+			return
+		}
+	}
+}
+
+func TestExportWorker(t *testing.T) {
+	user := newTestUser(t)
+	if _, err := AddBlob(user.ID, "blob to export"); err != nil {
+		t.Fatal(err)
+	}
+	db, err := connectToDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	x := NewExportWorker()
+	buildAllExports(t, x)
+
+	export, err := user.RequestExport()
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the workers of the replicas claim the export at the same time, only one builds it
+	var wg sync.WaitGroup
+	built := make([]bool, 4)
+	for i := range built {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var err error
+			if built[i], err = x.buildNext(); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	var builds int
+	for _, b := range built {
+		if b {
+			builds++
+		}
+	}
+	var attempts int
+	if err = db.QueryRow("SELECT attempts FROM exports WHERE ID = ?", export.ID).Scan(&attempts); err != nil {
+		t.Fatal(err)
+	}
+	if builds != 1 || attempts != 1 {
+		t.Errorf("export built %d times in %d attempts, want once", builds, attempts)
+	}
+	if again, err := x.buildNext(); err != nil || again {
+		t.Errorf("build after the export is ready: %t %v, want nothing to do", again, err)
+	}
+
+	exports, err := user.GetExports()
+	if err != nil || len(exports) != 1 || exports[0].Status != exportStatusReady || exports[0].DownloadURL == "" {
+		t.Fatalf("exports %+v, %v, want 1 ready", exports, err)
+	}
+	download := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		newRouter().ServeHTTP(w, httptest.NewRequest("GET", exports[0].DownloadURL, nil))
+		return w
+	}
+	w := download()
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/zip" {
+		t.Fatalf("download: status %d, content type %q, want a zip", w.Code, w.Header().Get("Content-Type"))
+	}
+	if files := readExportArchive(t, w.Body.Bytes()); !bytes.Contains(files["blobs.json"], []byte("blob to export")) {
+		t.Errorf("blobs.json of the export: %s, want the blob of the user", files["blobs.json"])
+	}
+
+	//after the expiration the link doesn't work and the cleanup deletes the export
+	if _, err = db.Exec("UPDATE exports SET expires_at = ? WHERE ID = ?", time.Now().Add(-time.Minute), export.ID); err != nil {
+		t.Fatal(err)
+	}
+	token := strings.TrimPrefix(exports[0].DownloadURL, strings.Replace(downloadExport.String(), "{token}", "", 1))
+	if _, _, err = queryExportArchive(token); err != sql.ErrNoRows {
+		t.Errorf("archive of an expired export: %v, want no rows", err)
+	}
+	if w = download(); w.Code != http.StatusNotFound {
+		t.Errorf("download of an expired export: status %d, want 404", w.Code)
+	}
+	x.cleanup()
+	if exports, err = user.GetExports(); err != nil || len(exports) != 0 {
+		t.Errorf("exports after the cleanup %+v, %v, want none", exports, err)
+	}
+}
+
+func TestExportWorkerFailure(t *testing.T) {
+	requireDB(t)
+	db, err := connectToDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	x := NewExportWorker()
+	buildAllExports(t, x)
+
+	//the export of a user that doesn't exist can't be built
+	token, err := randomToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := db.Exec("INSERT INTO exports (ID_user, token, status, created_at) VALUES (0, ?, ?, ?)", token, exportStatusPending, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, _ := res.LastInsertId()
+	defer db.Exec("DELETE FROM exports WHERE ID = ?", id)
+
+	state := func() (string, int, string) {
+		t.Helper()
+		var status, message string
+		var attempts int
+		if err := db.QueryRow("SELECT status, attempts, IFNULL(error, '') FROM exports WHERE ID = ?", id).Scan(&status, &attempts, &message); err != nil {
+			t.Fatal(err)
+		}
+		return status, attempts, message
+	}
+	for attempt := 1; attempt <= exportMaxAttempts; attempt++ {
+		if built, err := x.buildNext(); err != nil || !built {
+			t.Fatalf("attempt %d: %t %v, want the export taken", attempt, built, err)
+		}
+		status, attempts, message := state()
+		if attempt < exportMaxAttempts && (status != exportStatusPending || attempts != attempt) {
+			t.Errorf("after %d attempts: %s with %d attempts, want pending", attempt, status, attempts)
+		}
+		if attempt == exportMaxAttempts && (status != exportStatusFailed || message == "") {
+			t.Errorf("after the last attempt: %s %q, want failed with the error", status, message)
+		}
+
+		//the export isn't taken again while it's claimed, only when the claim expires
+		if built, err := x.buildNext(); err != nil || built {
+			t.Errorf("attempt %d: export taken again while claimed: %t %v", attempt, built, err)
+		}
+		if _, err = db.Exec("UPDATE exports SET claimed_until = ? WHERE ID = ?", time.Now().Add(-time.Minute), id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if built, err := x.buildNext(); err != nil || built {
+		t.Errorf("failed export taken again: %t %v", built, err)
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/xml"
+	"html"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/mux"
+)
+
+//public rss 2.0 and atom feeds of the blobs of a user or with a hashtag, for the people without an account.
+//The blobs have no visibility yet so every blob is public: the feeds show what an anonymous requester
+//sees (requesterID 0). The ETag and Last-Modified headers let the feed readers poll with a 304
+const (
+	//newest blobs in a feed
+	feedSize = 50
+	//characters of the content used as title of the items
+	feedTitleLength = 80
+	feedCacheMaxAge = 300
+
+	rssContentType  = "application/rss+xml; charset=utf-8"
+	atomContentType = "application/atom+xml; charset=utf-8"
+	atomNamespace   = "http://www.w3.org/2005/Atom"
+)
+
+var feedTagRegex = regexp.MustCompile(`^[\p{L}\p{N}_]+$`)
+
+//feed is the content shared by the two formats
+type feed struct {
+	title       string
+	description string
+	//page of the feed on blobber and absolute url of the feed itself
+	link  string
+	self  string
+	id    string
+	blobs []Blob
+}
+
+type rssDocument struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	AtomNS  string     `xml:"xmlns:atom,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	AtomLink      rssSelf   `xml:"atom:link"`
+	LastBuildDate string    `xml:"lastBuildDate,omitempty"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssSelf struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr"`
+	Type string `xml:"type,attr"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Link        string  `xml:"link"`
+	Description string  `xml:"description"`
+	GUID        rssGUID `xml:"guid"`
+	PubDate     string  `xml:"pubDate"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type atomFeed struct {
+	XMLName  xml.Name    `xml:"feed"`
+	NS       string      `xml:"xmlns,attr"`
+	ID       string      `xml:"id"`
+	Title    string      `xml:"title"`
+	Subtitle string      `xml:"subtitle,omitempty"`
+	Updated  string      `xml:"updated"`
+	Links    []atomLink  `xml:"link"`
+	Entries  []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Href string `xml:"href,attr"`
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+}
+
+type atomEntry struct {
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Updated   string      `xml:"updated"`
+	Published string      `xml:"published"`
+	Author    atomAuthor  `xml:"author"`
+	Link      atomLink    `xml:"link"`
+	Content   atomContent `xml:"content"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+	URI  string `xml:"uri,omitempty"`
+}
+
+type atomContent struct {
+	Type  string `xml:"type,attr"`
+	Value string `xml:",chardata"`
+}
+
+//feedState are the validators of a feed, computed with one aggregate query before loading the blobs:
+//a new or deleted blob changes the count and the date, an edit changes the checksum of the contents
+type feedState struct {
+	count        int
+	lastModified time.Time
+	checksum     uint64
+}
+
+//the conditions of the feeds on the blobs b, the tag one is a superset of the blobs with the hashtag
+const (
+	userFeedCondition = "b.ID_user = ?"
+	tagFeedCondition  = "b.content LIKE CONCAT('%#', ?, '%')"
+)
+
+func queryFeedState(condition string, arg interface{}) (feedState, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return feedState{}, err
+	}
+	defer db.Close()
+
+	var state feedState
+	var lastModified sql.NullTime
+	err = db.QueryRow("SELECT COUNT(*), MAX(b.added_date), COALESCE(BIT_XOR(CRC32(b.content)), 0) FROM blobs b WHERE "+condition, arg).
+		Scan(&state.count, &lastModified, &state.checksum)
+	if lastModified.Valid {
+		state.lastModified = lastModified.Time.UTC()
+	}
+	return state, err
+}
+
+//queryFeedBlobs returns a page of the blobs of the condition from the newest, with the username of the author.
+//The feeds are anonymous and don't show the likes, so the blobs don't need Info
+func queryFeedBlobs(db *sql.DB, condition string, arg interface{}, limit, offset int) ([]Blob, error) {
+	rows, err := db.Query("SELECT b.*, u.username FROM blobs b JOIN users u ON b.ID_user = u.ID WHERE "+condition+
+		" ORDER BY b.added_date DESC, b.ID DESC LIMIT ? OFFSET ?", arg, limit, offset)
+	if err != nil {
+		return []Blob{}, err
+	}
+	defer rows.Close()
+
+	var blobs []Blob
+	for rows.Next() {
+		var blob Blob
+		if err = rows.Scan(&blob.ID, &blob.UserID, &blob.Content, &blob.AddedDate, &blob.Username); err != nil {
+			return []Blob{}, err
+		}
+		blobs = append(blobs, blob)
+	}
+	return blobs, rows.Err()
+}
+
+//QueryFeedBlobsByUser returns the newest blobs of the user
+func QueryFeedBlobsByUser(userID int, limit int) ([]Blob, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return []Blob{}, err
+	}
+	defer db.Close()
+	return queryFeedBlobs(db, userFeedCondition, userID, limit, 0)
+}
+
+//QueryBlobsByTag returns the newest blobs with the hashtag, es: tag "golang" matches #golang and #GoLang
+func QueryBlobsByTag(tag string, limit int) ([]Blob, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return []Blob{}, err
+	}
+	defer db.Close()
+
+	//the like finds the candidates, the regex of the trends keeps only the whole hashtags (not #golanger).
+	//The candidates are read a page at a time until there are enough blobs with the hashtag
+	var blobs []Blob
+	for offset := 0; len(blobs) < limit; offset += limit {
+		candidates, err := queryFeedBlobs(db, tagFeedCondition, tag, limit, offset)
+		if err != nil {
+			return []Blob{}, err
+		}
+		for _, blob := range candidates {
+			if len(blobs) < limit && hasHashtag(blob.Content, tag) {
+				blobs = append(blobs, blob)
+			}
+		}
+		if len(candidates) < limit {
+			break
+		}
+	}
+	return blobs, nil
+}
+
+func hasHashtag(content, tag string) bool {
+	for _, hashtag := range hashtagRegex.FindAllString(content, -1) {
+		if strings.EqualFold(hashtag[1:], tag) {
+			return true
+		}
+	}
+	return false
+}
+
+//feedItemTitle is the first line of the blob, cut at feedTitleLength characters
+func feedItemTitle(content string) string {
+	title := strings.TrimSpace(strings.SplitN(content, "\n", 2)[0])
+	if utf8.RuneCountInString(title) > feedTitleLength {
+		title = string([]rune(title)[:feedTitleLength]) + "…"
+	}
+	return title
+}
+
+//lastModified is the date of the newest blob, the blobs are sorted from the newest
+func (f feed) lastModified() time.Time {
+	if len(f.blobs) == 0 {
+		return time.Time{}
+	}
+	return f.blobs[0].AddedDate.UTC()
+}
+
+//blobFeedID is the id of the item (a tag uri), it doesn't change when the blob is modified
+func blobFeedID(base string, blob Blob) string {
+	//the authority of a tag uri is a domain without the port
+	host := strings.SplitN(strings.SplitN(base, "://", 2)[1], ":", 2)[0]
+	return "tag:" + host + "," + blob.AddedDate.UTC().Format("2006-01-02") + ":blob:" + strconv.Itoa(blob.ID)
+}
+
+func (f feed) rss(base string) ([]byte, error) {
+	doc := rssDocument{
+		Version: "2.0",
+		AtomNS:  atomNamespace,
+		Channel: rssChannel{
+			Title:       f.title,
+			Link:        f.link,
+			Description: f.description,
+			AtomLink:    rssSelf{Href: f.self, Rel: "self", Type: strings.Split(rssContentType, ";")[0]},
+		},
+	}
+	if len(f.blobs) > 0 {
+		doc.Channel.LastBuildDate = f.lastModified().Format(time.RFC1123Z)
+	}
+	for _, blob := range f.blobs {
+		doc.Channel.Items = append(doc.Channel.Items, rssItem{
+			Title: feedItemTitle(blob.Content),
+			Link:  base + strings.Replace(getUserPage.String(), "{id}", strconv.Itoa(blob.UserID), 1),
+			//the readers show the description as html, the blobs are plain text
+			Description: strings.Replace(html.EscapeString(blob.Content), "\n", "<br>", -1),
+			GUID:        rssGUID{Value: blobFeedID(base, blob)},
+			PubDate:     blob.AddedDate.UTC().Format(time.RFC1123Z),
+		})
+	}
+	return marshalFeed(doc)
+}
+
+func (f feed) atom(base string) ([]byte, error) {
+	updated := f.lastModified()
+	//atom requires the date even without entries
+	if updated.IsZero() {
+		updated = time.Unix(0, 0).UTC()
+	}
+	doc := atomFeed{
+		NS:       atomNamespace,
+		ID:       f.id,
+		Title:    f.title,
+		Subtitle: f.description,
+		Updated:  updated.Format(time.RFC3339),
+		Links: []atomLink{
+			{Href: f.self, Rel: "self", Type: strings.Split(atomContentType, ";")[0]},
+			{Href: f.link, Rel: "alternate", Type: "text/html"},
+		},
+	}
+	for _, blob := range f.blobs {
+		profile := base + strings.Replace(getUserPage.String(), "{id}", strconv.Itoa(blob.UserID), 1)
+		date := blob.AddedDate.UTC().Format(time.RFC3339)
+		doc.Entries = append(doc.Entries, atomEntry{
+			ID:        blobFeedID(base, blob),
+			Title:     feedItemTitle(blob.Content),
+			Updated:   date,
+			Published: date,
+			Author:    atomAuthor{Name: blob.Username, URI: profile},
+			Link:      atomLink{Href: profile, Rel: "alternate", Type: "text/html"},
+			Content:   atomContent{Type: "text", Value: blob.Content},
+		})
+	}
+	return marshalFeed(doc)
+}
+
+func marshalFeed(doc interface{}) ([]byte, error) {
+	body, err := xml.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), body...), nil
+}
+
+//notModified answers 304 if the client has the current version of the feed. If-None-Match wins
+//over If-Modified-Since, the edits of the blobs change the etag but not the date
+func notModified(r *http.Request, etag string, lastModified time.Time) bool {
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, candidate := range strings.Split(match, ",") {
+			candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+			if candidate == etag || candidate == "*" {
+				return true
+			}
+		}
+		return false
+	}
+	if since, err := http.ParseTime(r.Header.Get("If-Modified-Since")); err == nil && !lastModified.IsZero() {
+		return !lastModified.Truncate(time.Second).After(since)
+	}
+	return false
+}
+
+//etag changes with the blobs and with everything else shown by the feed: the format, the title and the description
+func (s feedState) etag(f feed, atom bool) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		strconv.FormatBool(atom), f.title, f.description, strconv.Itoa(s.count),
+		strconv.FormatInt(s.lastModified.Unix(), 10), strconv.FormatUint(s.checksum, 10),
+	}, "\n")))
+	return `"` + hex.EncodeToString(sum[:16]) + `"`
+}
+
+//writeFeed answers 304 when the client is up to date, otherwise it loads the blobs and renders the
+//feed in the format of the path
+func writeFeed(w http.ResponseWriter, r *http.Request, f feed, state feedState, atom bool, load func() ([]Blob, error)) {
+	etag := state.etag(f, atom)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(feedCacheMaxAge))
+	if !state.lastModified.IsZero() {
+		w.Header().Set("Last-Modified", state.lastModified.Format(http.TimeFormat))
+	}
+	if notModified(r, etag, state.lastModified) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	var err error
+	if f.blobs, err = load(); err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+	render, contentType := f.rss, rssContentType
+	if atom {
+		render, contentType = f.atom, atomContentType
+	}
+	body, err := render(publicURL(""))
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(body)
+}
+
+func userFeedHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	id, ok := v2ResourceID(w, r)
+	if !ok {
+		return
+	}
+	user, err := QueryUserByID(id, 0)
+	if err == sql.ErrNoRows {
+		returnError(w, http.StatusNotFound, "User not found")
+		return
+	}
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+	state, err := queryFeedState(userFeedCondition, user.ID)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	atom := strings.HasSuffix(r.URL.Path, ".atom")
+	base := publicURL("")
+	self := base + userFeedRSS.Path(user.ID)
+	if atom {
+		self = base + userFeedAtom.Path(user.ID)
+	}
+	description := user.Description
+	if description == "" {
+		description = "Blob di " + user.Username + " su blobber"
+	}
+	writeFeed(w, r, feed{
+		title:       user.Username + " - blobber",
+		description: description,
+		link:        base + strings.Replace(getUserPage.String(), "{id}", strconv.Itoa(user.ID), 1),
+		self:        self,
+		id:          base + userFeedAtom.Path(user.ID),
+	}, state, atom, func() ([]Blob, error) {
+		return QueryFeedBlobsByUser(user.ID, feedSize)
+	})
+}
+
+func tagFeedHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	tag := strings.TrimPrefix(mux.Vars(r)["tag"], "#")
+	if !feedTagRegex.MatchString(tag) {
+		returnError(w, http.StatusBadRequest, "Invalid tag, only letters, numbers and _")
+		return
+	}
+	//the validators are of the candidates of the like, they can change for a blob that isn't in the
+	//feed (es: #golanger) but never miss a change of one that is
+	state, err := queryFeedState(tagFeedCondition, tag)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	atom := strings.HasSuffix(r.URL.Path, ".atom")
+	base := publicURL("")
+	escaped := url.PathEscape(strings.ToLower(tag))
+	self := base + strings.Replace(tagFeedRSS.String(), "{tag}", escaped, 1)
+	if atom {
+		self = base + strings.Replace(tagFeedAtom.String(), "{tag}", escaped, 1)
+	}
+	writeFeed(w, r, feed{
+		title:       "#" + tag + " - blobber",
+		description: "Blob con #" + tag + " su blobber",
+		link:        base + searchPage.String(),
+		self:        self,
+		id:          base + strings.Replace(tagFeedAtom.String(), "{tag}", escaped, 1),
+	}, state, atom, func() ([]Blob, error) {
+		return QueryBlobsByTag(tag, feedSize)
+	})
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNotModified(t *testing.T) {
+	lastModified := time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name, ifNoneMatch, ifModifiedSince string
+		want                               bool
+	}{
+		{"no validators", "", "", false},
+		{"same etag", `"abc"`, "", true},
+		{"weak etag", `W/"abc"`, "", true},
+		{"etag in a list", `"old", "abc"`, "", true},
+		{"any etag", "*", "", true},
+		{"another etag", `"old"`, "", false},
+		{"same date", "", lastModified.Format(http.TimeFormat), true},
+		{"later date", "", lastModified.Add(time.Hour).Format(http.TimeFormat), true},
+		{"earlier date", "", lastModified.Add(-time.Second).Format(http.TimeFormat), false},
+		{"invalid date", "", "yesterday", false},
+		//the etag wins over the date
+		{"another etag with the same date", `"old"`, lastModified.Format(http.TimeFormat), false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		if tt.ifNoneMatch != "" {
+			r.Header.Set("If-None-Match", tt.ifNoneMatch)
+		}
+		if tt.ifModifiedSince != "" {
+			r.Header.Set("If-Modified-Since", tt.ifModifiedSince)
+		}
+		if got := notModified(r, `"abc"`, lastModified); got != tt.want {
+			t.Errorf("%s: %t, want %t", tt.name, got, tt.want)
+		}
+	}
+}
+
+//getFeed requests the feed with the validators of the previous response, if any
+func getFeed(t *testing.T, path string, previous *httptest.ResponseRecorder, useDate bool) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest("GET", path, nil)
+	if previous != nil && useDate {
+		r.Header.Set("If-Modified-Since", previous.Header().Get("Last-Modified"))
+	} else if previous != nil {
+		r.Header.Set("If-None-Match", previous.Header().Get("ETag"))
+	}
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, r)
+	return w
+}
+
+func TestUserFeedConditional(t *testing.T) {
+	user := newTestUser(t)
+	conf.BaseURL = "https://blobber.example.com"
+	first, err := ImportBlob(user.ID, "first blob", time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = ImportBlob(user.ID, "second blob", time.Now().Add(-time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{userFeedRSS.Path(user.ID), userFeedAtom.Path(user.ID)} {
+		w := getFeed(t, path, nil, false)
+		if w.Code != http.StatusOK || w.Header().Get("ETag") == "" || w.Header().Get("Last-Modified") == "" {
+			t.Fatalf("%s: status %d, headers %v, want 200 with the validators", path, w.Code, w.Header())
+		}
+		if body := w.Body.String(); strings.Index(body, "second blob") > strings.Index(body, "first blob") {
+			t.Errorf("%s: the blobs aren't from the newest: %s", path, body)
+		}
+
+		for _, useDate := range []bool{false, true} {
+			if got := getFeed(t, path, w, useDate); got.Code != http.StatusNotModified || got.Body.Len() != 0 {
+				t.Errorf("%s with the validators (date %t): status %d, want 304", path, useDate, got.Code)
+			}
+		}
+	}
+
+	//the formats have different etags
+	rss, atom := getFeed(t, userFeedRSS.Path(user.ID), nil, false), getFeed(t, userFeedAtom.Path(user.ID), nil, false)
+	if rss.Header().Get("ETag") == atom.Header().Get("ETag") {
+		t.Error("rss and atom have the same etag")
+	}
+
+	//an edit keeps the date but changes the etag
+	blob, err := QueryBlobByID(first, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = blob.Modify("first blob, edited"); err != nil {
+		t.Fatal(err)
+	}
+	if w := getFeed(t, userFeedRSS.Path(user.ID), rss, false); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "edited") {
+		t.Errorf("feed after an edit: status %d, want 200 with the new content", w.Code)
+	}
+	if w := getFeed(t, userFeedRSS.Path(user.ID), rss, true); w.Code != http.StatusNotModified {
+		t.Errorf("feed after an edit with the date: status %d, want 304", w.Code)
+	}
+
+	//a new blob changes both
+	if _, err = AddBlob(user.ID, "third blob"); err != nil {
+		t.Fatal(err)
+	}
+	for _, useDate := range []bool{false, true} {
+		if w := getFeed(t, userFeedRSS.Path(user.ID), rss, useDate); w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "third blob") {
+			t.Errorf("feed after a new blob (date %t): status %d, want 200 with the new blob", useDate, w.Code)
+		}
+	}
+
+	if w := getFeed(t, userFeedRSS.Path(999999999), nil, false); w.Code != http.StatusNotFound {
+		t.Errorf("feed of a missing user: status %d, want 404", w.Code)
+	}
+}
+
+func TestTagFeed(t *testing.T) {
+	user := newTestUser(t)
+	conf.BaseURL = "https://blobber.example.com"
+	token, err := randomToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tag := "t" + token[:12]
+
+	//the candidates of the like that aren't the hashtag are newer than the blobs with it, more than a page
+	start := time.Now().Add(-time.Hour)
+	for i, content := range []string{"#" + tag + " old", "#" + tag + " new", "#" + tag + "ger 1", "#" + tag + "ger 2", "#" + tag + "ger 3"} {
+		if _, err = ImportBlob(user.ID, content, start.Add(time.Duration(i)*time.Minute)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	blobs, err := QueryBlobsByTag(tag, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blobs) != 2 || blobs[0].Content != "#"+tag+" new" || blobs[1].Username != user.Username {
+		t.Errorf("blobs with #%s: %+v, want the 2 with the hashtag from the newest", tag, blobs)
+	}
+
+	path := strings.Replace(tagFeedRSS.String(), "{tag}", tag, 1)
+	w := getFeed(t, path, nil, false)
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), tag+"ger") || !strings.Contains(w.Body.String(), tag+" old") {
+		t.Errorf("feed of #%s: status %d, want 200 with only the whole hashtags: %s", tag, w.Code, w.Body.String())
+	}
+	if got := getFeed(t, path, w, false); got.Code != http.StatusNotModified {
+		t.Errorf("feed of #%s with the etag: status %d, want 304", tag, got.Code)
+	}
+}
@@ -0,0 +1,1266 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	graphql "github.com/graph-gophers/graphql-go"
+	graphqlerrors "github.com/graph-gophers/graphql-go/errors"
+	"github.com/graph-gophers/graphql-go/types"
+)
+
+//graphql api over users, blobs, likes and follows. The lists register the ids they return in the
+//loaders of the request, the first field that needs the counters loads them for every registered
+//id with a single query instead of a query for every object (like Blob.Info and User.Info do)
+const graphqlSchemaString = `
+schema {
+	query: Query
+	mutation: Mutation
+}
+
+scalar Time
+
+type Query {
+	me: User!
+	user(id: ID, username: String): User
+	blob(id: ID!): Blob
+	feed(first: Int = 20, offset: Int = 0): [Blob!]!
+	searchUsers(query: String!, first: Int = 20): [User!]!
+}
+
+type Mutation {
+	postBlob(content: String!): Blob!
+	editBlob(id: ID!, content: String!): Blob!
+	deleteBlob(id: ID!): Boolean!
+	like(blobId: ID!): Blob!
+	unlike(blobId: ID!): Blob!
+	follow(userId: ID!): User!
+	unfollow(userId: ID!): User!
+}
+
+type User {
+	id: ID!
+	username: String!
+	description: String!
+	likesCount: Int!
+	followersCount: Int!
+	followingCount: Int!
+	follows: Boolean!
+	followsYou: Boolean!
+	blobs(first: Int = 20, offset: Int = 0): [Blob!]!
+	followers(first: Int = 20, offset: Int = 0): [User!]!
+	following(first: Int = 20, offset: Int = 0): [User!]!
+}
+
+type Blob {
+	id: ID!
+	content: String!
+	addedDate: Time!
+	author: User!
+	likesCount: Int!
+	liked: Boolean!
+	isOwner: Boolean!
+	likers(first: Int = 20, offset: Int = 0): [User!]!
+}
+`
+
+//limits of the queries: the depth of the selections, the length of the query, the size of a page
+//and the objects that a single query can return (its cost, computed before running it)
+const (
+	graphqlMaxDepth       = 8
+	graphqlMaxQueryLength = 10000
+	graphqlMaxPage        = 50
+	graphqlMaxObjects     = 500
+)
+
+var graphqlSchema = graphql.MustParseSchema(graphqlSchemaString, &graphqlRoot{},
+	graphql.MaxDepth(graphqlMaxDepth), graphql.MaxParallelism(10))
+
+//* loaders
+//batchLoader loads the values of the registered ids all together the first time one of them is needed
+type batchLoader struct {
+	mu      sync.Mutex
+	fetch   func(ids []int) (map[int]interface{}, error)
+	pending map[int]bool
+	cache   map[int]interface{}
+}
+
+func newBatchLoader(fetch func(ids []int) (map[int]interface{}, error)) *batchLoader {
+	return &batchLoader{fetch: fetch, pending: make(map[int]bool), cache: make(map[int]interface{})}
+}
+
+//prime registers the ids that will probably be loaded, it doesn't query anything
+func (l *batchLoader) prime(ids ...int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, id := range ids {
+		if _, ok := l.cache[id]; !ok {
+			l.pending[id] = true
+		}
+	}
+}
+
+//load returns the value of the id, sql.ErrNoRows if it doesn't exist
+func (l *batchLoader) load(id int) (interface{}, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if v, ok := l.cache[id]; ok {
+		if v == nil {
+			return nil, sql.ErrNoRows
+		}
+		return v, nil
+	}
+
+	l.pending[id] = true
+	ids := make([]int, 0, len(l.pending))
+	for pendingID := range l.pending {
+		ids = append(ids, pendingID)
+	}
+	l.pending = make(map[int]bool)
+
+	values, err := l.fetch(ids)
+	if err != nil {
+		return nil, err
+	}
+	for _, pendingID := range ids {
+		l.cache[pendingID] = values[pendingID]
+	}
+	if values[id] == nil {
+		return nil, sql.ErrNoRows
+	}
+	return values[id], nil
+}
+
+//forget removes the cached value after a mutation
+func (l *batchLoader) forget(id int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.cache, id)
+}
+
+//inPlaceholders returns the placeholders and the arguments of an IN (...) with the ids
+func inPlaceholders(ids []int) (string, []interface{}) {
+	args := make([]interface{}, len(ids))
+	for i, id := range ids {
+		args[i] = id
+	}
+	return strings.TrimSuffix(strings.Repeat("?, ", len(ids)), ", "), args
+}
+
+type userStats struct {
+	likes, followers, following int
+	follows, followsYou         bool
+}
+
+type blobStats struct {
+	likes int
+	liked bool
+}
+
+func fetchGraphqlUsers(ids []int) (map[int]interface{}, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	placeholders, args := inPlaceholders(ids)
+	rows, err := db.Query("SELECT ID, username, IFNULL(description, '') FROM users WHERE ID IN ("+placeholders+")", args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := make(map[int]interface{})
+	for rows.Next() {
+		var u User
+		if err = rows.Scan(&u.ID, &u.Username, &u.Description); err != nil {
+			return nil, err
+		}
+		users[u.ID] = u
+	}
+	return users, rows.Err()
+}
+
+func fetchGraphqlUserStats(viewerID int) func(ids []int) (map[int]interface{}, error) {
+	return func(ids []int) (map[int]interface{}, error) {
+		db, err := connectToDB()
+		if err != nil {
+			return nil, err
+		}
+		defer db.Close()
+
+		placeholders, args := inPlaceholders(ids)
+		rows, err := db.Query(`SELECT u.ID,
+			(SELECT COUNT(*) FROM likes l JOIN blobs b ON l.ID_blob = b.ID WHERE b.ID_user = u.ID),
+			(SELECT COUNT(*) FROM follows WHERE ID_user_followed = u.ID),
+			(SELECT COUNT(*) FROM follows WHERE ID_user_follower = u.ID),
+			EXISTS (SELECT 1 FROM follows WHERE ID_user_followed = u.ID AND ID_user_follower = ?),
+			EXISTS (SELECT 1 FROM follows WHERE ID_user_followed = ? AND ID_user_follower = u.ID)
+			FROM users u WHERE u.ID IN (`+placeholders+")", append([]interface{}{viewerID, viewerID}, args...)...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		stats := make(map[int]interface{})
+		for rows.Next() {
+			var id int
+			var s userStats
+			if err = rows.Scan(&id, &s.likes, &s.followers, &s.following, &s.follows, &s.followsYou); err != nil {
+				return nil, err
+			}
+			stats[id] = s
+		}
+		return stats, rows.Err()
+	}
+}
+
+func fetchGraphqlBlobStats(viewerID int) func(ids []int) (map[int]interface{}, error) {
+	return func(ids []int) (map[int]interface{}, error) {
+		db, err := connectToDB()
+		if err != nil {
+			return nil, err
+		}
+		defer db.Close()
+
+		placeholders, args := inPlaceholders(ids)
+		rows, err := db.Query(`SELECT b.ID, COUNT(l.ID), IFNULL(SUM(l.ID_user = ?), 0) > 0
+			FROM blobs b LEFT JOIN likes l ON l.ID_blob = b.ID WHERE b.ID IN (`+placeholders+") GROUP BY b.ID",
+			append([]interface{}{viewerID}, args...)...)
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+
+		stats := make(map[int]interface{})
+		for rows.Next() {
+			var id int
+			var s blobStats
+			if err = rows.Scan(&id, &s.likes, &s.liked); err != nil {
+				return nil, err
+			}
+			stats[id] = s
+		}
+		return stats, rows.Err()
+	}
+}
+
+//* request
+//graphqlRequest is the state of a single query: the user and the loaders
+type graphqlRequest struct {
+	claims    CustomClaims
+	requestID string
+
+	users     *batchLoader
+	userStats *batchLoader
+	blobStats *batchLoader
+}
+
+type graphqlContextKey struct{}
+
+func newGraphqlRequest(claims CustomClaims, requestID string) *graphqlRequest {
+	return &graphqlRequest{
+		claims:    claims,
+		requestID: requestID,
+		users:     newBatchLoader(fetchGraphqlUsers),
+		userStats: newBatchLoader(fetchGraphqlUserStats(claims.UserID)),
+		blobStats: newBatchLoader(fetchGraphqlBlobStats(claims.UserID)),
+	}
+}
+
+func graphqlRequestFrom(ctx context.Context) *graphqlRequest {
+	return ctx.Value(graphqlContextKey{}).(*graphqlRequest)
+}
+
+//canWrite checks the scope of the oauth apps, the sessions of the user can always write
+func (q *graphqlRequest) canWrite() error {
+	if q.claims.GrantID != 0 && !scopeAllows(q.claims.Scope, "write") {
+		return fmt.Errorf("%w: the token needs the write scope", errForbidden)
+	}
+	return nil
+}
+
+//fail hides the internal errors like returnDomainError does
+func (q *graphqlRequest) fail(err error) error {
+	switch {
+	case errors.Is(err, errBadRequest), errors.Is(err, errConflict), errors.Is(err, errForbidden):
+		return err
+	case errors.Is(err, sql.ErrNoRows):
+		return errors.New("not found")
+	}
+	log.Printf("[%s] graphql internal error: %v", q.requestID, err)
+	return fmt.Errorf("internal server error, if the problem persists report the request id %s", q.requestID)
+}
+
+type pageArgs struct {
+	First  int32
+	Offset int32
+}
+
+func (p pageArgs) check() error {
+	if p.First < 1 || p.First > graphqlMaxPage {
+		return fmt.Errorf("%w: first must be between 1 and %d", errBadRequest, graphqlMaxPage)
+	}
+	if p.Offset < 0 {
+		return fmt.Errorf("%w: offset can't be negative", errBadRequest)
+	}
+	return nil
+}
+
+func parseGraphqlID(id graphql.ID) (int, error) {
+	n, err := strconv.Atoi(string(id))
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid id %s", errBadRequest, id)
+	}
+	return n, nil
+}
+
+//queryGraphqlUsers runs a query that selects id, username and description of the users
+func (q *graphqlRequest) queryUsers(query string, args ...interface{}) ([]*userResolver, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return nil, q.fail(err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, q.fail(err)
+	}
+	defer rows.Close()
+
+	resolvers := []*userResolver{}
+	var ids []int
+	for rows.Next() {
+		var u User
+		if err = rows.Scan(&u.ID, &u.Username, &u.Description); err != nil {
+			return nil, q.fail(err)
+		}
+		ids = append(ids, u.ID)
+		resolvers = append(resolvers, &userResolver{q: q, user: u})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, q.fail(err)
+	}
+	q.userStats.prime(ids...)
+	return resolvers, nil
+}
+
+//queryBlobs runs a query that selects id, author, content and date of the blobs
+func (q *graphqlRequest) queryBlobs(query string, args ...interface{}) ([]*blobResolver, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return nil, q.fail(err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, q.fail(err)
+	}
+	defer rows.Close()
+
+	resolvers := []*blobResolver{}
+	var ids, authors []int
+	for rows.Next() {
+		var b Blob
+		if err = rows.Scan(&b.ID, &b.UserID, &b.Content, &b.AddedDate); err != nil {
+			return nil, q.fail(err)
+		}
+		ids = append(ids, b.ID)
+		authors = append(authors, b.UserID)
+		resolvers = append(resolvers, &blobResolver{q: q, blob: b})
+	}
+	if err = rows.Err(); err != nil {
+		return nil, q.fail(err)
+	}
+	q.blobStats.prime(ids...)
+	q.users.prime(authors...)
+	return resolvers, nil
+}
+
+const graphqlBlobColumns = "SELECT b.ID, b.ID_user, IFNULL(b.content, ''), b.added_date FROM blobs b"
+
+func (q *graphqlRequest) user(id int) (*userResolver, error) {
+	v, err := q.users.load(id)
+	if err != nil {
+		return nil, q.fail(err)
+	}
+	return &userResolver{q: q, user: v.(User)}, nil
+}
+
+func (q *graphqlRequest) blob(id int) (*blobResolver, error) {
+	blobs, err := q.queryBlobs(graphqlBlobColumns+" WHERE b.ID = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	if len(blobs) == 0 {
+		return nil, errors.New("not found")
+	}
+	return blobs[0], nil
+}
+
+//* root
+type graphqlRoot struct{}
+
+func (graphqlRoot) Me(ctx context.Context) (*userResolver, error) {
+	q := graphqlRequestFrom(ctx)
+	return q.user(q.claims.UserID)
+}
+
+func (graphqlRoot) User(ctx context.Context, args struct {
+	ID       *graphql.ID
+	Username *string
+}) (*userResolver, error) {
+	q := graphqlRequestFrom(ctx)
+	if args.ID != nil {
+		id, err := parseGraphqlID(*args.ID)
+		if err != nil {
+			return nil, err
+		}
+		return q.user(id)
+	}
+	if args.Username != nil {
+		users, err := q.queryUsers("SELECT ID, username, IFNULL(description, '') FROM users WHERE username = ?", *args.Username)
+		if err != nil || len(users) == 0 {
+			return nil, err
+		}
+		return users[0], nil
+	}
+	return nil, fmt.Errorf("%w: id or username is required", errBadRequest)
+}
+
+func (graphqlRoot) Blob(ctx context.Context, args struct{ ID graphql.ID }) (*blobResolver, error) {
+	id, err := parseGraphqlID(args.ID)
+	if err != nil {
+		return nil, err
+	}
+	return graphqlRequestFrom(ctx).blob(id)
+}
+
+func (graphqlRoot) Feed(ctx context.Context, args pageArgs) ([]*blobResolver, error) {
+	if err := args.check(); err != nil {
+		return nil, err
+	}
+	q := graphqlRequestFrom(ctx)
+	return q.queryBlobs(graphqlBlobColumns+" JOIN follows f ON f.ID_user_followed = b.ID_user WHERE f.ID_user_follower = ? ORDER BY b.added_date DESC LIMIT ? OFFSET ?",
+		q.claims.UserID, args.First, args.Offset)
+}
+
+func (graphqlRoot) SearchUsers(ctx context.Context, args struct {
+	Query string
+	First int32
+}) ([]*userResolver, error) {
+	if err := (pageArgs{First: args.First}).check(); err != nil {
+		return nil, err
+	}
+	return graphqlRequestFrom(ctx).queryUsers("SELECT ID, username, IFNULL(description, '') FROM users WHERE username LIKE CONCAT('%', ?, '%') ORDER BY username LIMIT ?",
+		args.Query, args.First)
+}
+
+//* mutations
+func (graphqlRoot) PostBlob(ctx context.Context, args struct{ Content string }) (*blobResolver, error) {
+	q := graphqlRequestFrom(ctx)
+	if err := q.canWrite(); err != nil {
+		return nil, err
+	}
+	id, err := AddBlob(q.claims.UserID, args.Content)
+	if err != nil {
+		return nil, q.fail(err)
+	}
+	q.userStats.forget(q.claims.UserID)
+	return q.blob(id)
+}
+
+//ownBlob returns the blob if the user of the request is its owner
+func (q *graphqlRequest) ownBlob(id graphql.ID) (Blob, error) {
+	blobID, err := parseGraphqlID(id)
+	if err != nil {
+		return Blob{}, err
+	}
+	blob, err := QueryBlobByID(blobID, 0)
+	if err != nil {
+		return Blob{}, errors.New("not found")
+	}
+	if blob.UserID != q.claims.UserID {
+		return Blob{}, fmt.Errorf("%w: only the owner can change the blob", errForbidden)
+	}
+	return blob, nil
+}
+
+func (graphqlRoot) EditBlob(ctx context.Context, args struct {
+	ID      graphql.ID
+	Content string
+}) (*blobResolver, error) {
+	q := graphqlRequestFrom(ctx)
+	if err := q.canWrite(); err != nil {
+		return nil, err
+	}
+	blob, err := q.ownBlob(args.ID)
+	if err != nil {
+		return nil, err
+	}
+	if strings.Trim(args.Content, " ") != blob.Content {
+		if err = blob.Modify(args.Content); err != nil {
+			return nil, q.fail(err)
+		}
+	}
+	return q.blob(blob.ID)
+}
+
+func (graphqlRoot) DeleteBlob(ctx context.Context, args struct{ ID graphql.ID }) (bool, error) {
+	q := graphqlRequestFrom(ctx)
+	if err := q.canWrite(); err != nil {
+		return false, err
+	}
+	blob, err := q.ownBlob(args.ID)
+	if err != nil {
+		return false, err
+	}
+	if err = blob.Delete(); err != nil {
+		return false, q.fail(err)
+	}
+	q.blobStats.forget(blob.ID)
+	return true, nil
+}
+
+func (graphqlRoot) like(ctx context.Context, id graphql.ID, like bool) (*blobResolver, error) {
+	q := graphqlRequestFrom(ctx)
+	if err := q.canWrite(); err != nil {
+		return nil, err
+	}
+	blobID, err := parseGraphqlID(id)
+	if err != nil {
+		return nil, err
+	}
+	blob, err := QueryBlobByID(blobID, 0)
+	if err != nil {
+		return nil, errors.New("not found")
+	}
+	if like {
+		err = blob.Like(q.claims.UserID)
+	} else {
+		err = blob.Unlike(q.claims.UserID)
+	}
+	if err != nil {
+		return nil, q.fail(err)
+	}
+	q.blobStats.forget(blob.ID)
+	q.userStats.forget(blob.UserID)
+	return q.blob(blob.ID)
+}
+
+func (r graphqlRoot) Like(ctx context.Context, args struct{ BlobID graphql.ID }) (*blobResolver, error) {
+	return r.like(ctx, args.BlobID, true)
+}
+
+func (r graphqlRoot) Unlike(ctx context.Context, args struct{ BlobID graphql.ID }) (*blobResolver, error) {
+	return r.like(ctx, args.BlobID, false)
+}
+
+func (graphqlRoot) follow(ctx context.Context, id graphql.ID, follow bool) (*userResolver, error) {
+	q := graphqlRequestFrom(ctx)
+	if err := q.canWrite(); err != nil {
+		return nil, err
+	}
+	userID, err := parseGraphqlID(id)
+	if err != nil {
+		return nil, err
+	}
+	followed, err := q.user(userID)
+	if err != nil {
+		return nil, err
+	}
+	me := User{ID: q.claims.UserID}
+	if follow {
+		err = me.Follow(userID)
+	} else {
+		err = me.Unfollow(userID)
+	}
+	if err != nil {
+		return nil, q.fail(err)
+	}
+	q.userStats.forget(userID)
+	q.userStats.forget(me.ID)
+	return followed, nil
+}
+
+func (r graphqlRoot) Follow(ctx context.Context, args struct{ UserID graphql.ID }) (*userResolver, error) {
+	return r.follow(ctx, args.UserID, true)
+}
+
+func (r graphqlRoot) Unfollow(ctx context.Context, args struct{ UserID graphql.ID }) (*userResolver, error) {
+	return r.follow(ctx, args.UserID, false)
+}
+
+//* user
+type userResolver struct {
+	q    *graphqlRequest
+	user User
+}
+
+func (u *userResolver) stats() (userStats, error) {
+	v, err := u.q.userStats.load(u.user.ID)
+	if err != nil {
+		return userStats{}, u.q.fail(err)
+	}
+	return v.(userStats), nil
+}
+
+func (u *userResolver) ID() graphql.ID {
+	return graphql.ID(strconv.Itoa(u.user.ID))
+}
+
+func (u *userResolver) Username() string {
+	return u.user.Username
+}
+
+func (u *userResolver) Description() string {
+	return u.user.Description
+}
+
+func (u *userResolver) LikesCount() (int32, error) {
+	s, err := u.stats()
+	return int32(s.likes), err
+}
+
+func (u *userResolver) FollowersCount() (int32, error) {
+	s, err := u.stats()
+	return int32(s.followers), err
+}
+
+func (u *userResolver) FollowingCount() (int32, error) {
+	s, err := u.stats()
+	return int32(s.following), err
+}
+
+func (u *userResolver) Follows() (bool, error) {
+	s, err := u.stats()
+	return s.follows, err
+}
+
+func (u *userResolver) FollowsYou() (bool, error) {
+	s, err := u.stats()
+	return s.followsYou, err
+}
+
+func (u *userResolver) Blobs(args pageArgs) ([]*blobResolver, error) {
+	if err := args.check(); err != nil {
+		return nil, err
+	}
+	return u.q.queryBlobs(graphqlBlobColumns+" WHERE b.ID_user = ? ORDER BY b.added_date DESC LIMIT ? OFFSET ?", u.user.ID, args.First, args.Offset)
+}
+
+func (u *userResolver) Followers(args pageArgs) ([]*userResolver, error) {
+	if err := args.check(); err != nil {
+		return nil, err
+	}
+	return u.q.queryUsers(`SELECT u.ID, u.username, IFNULL(u.description, '') FROM follows f JOIN users u ON f.ID_user_follower = u.ID
+		WHERE f.ID_user_followed = ? ORDER BY f.ID DESC LIMIT ? OFFSET ?`, u.user.ID, args.First, args.Offset)
+}
+
+func (u *userResolver) Following(args pageArgs) ([]*userResolver, error) {
+	if err := args.check(); err != nil {
+		return nil, err
+	}
+	return u.q.queryUsers(`SELECT u.ID, u.username, IFNULL(u.description, '') FROM follows f JOIN users u ON f.ID_user_followed = u.ID
+		WHERE f.ID_user_follower = ? ORDER BY f.ID DESC LIMIT ? OFFSET ?`, u.user.ID, args.First, args.Offset)
+}
+
+//* blob
+type blobResolver struct {
+	q    *graphqlRequest
+	blob Blob
+}
+
+func (b *blobResolver) stats() (blobStats, error) {
+	v, err := b.q.blobStats.load(b.blob.ID)
+	if err != nil {
+		return blobStats{}, b.q.fail(err)
+	}
+	return v.(blobStats), nil
+}
+
+func (b *blobResolver) ID() graphql.ID {
+	return graphql.ID(strconv.Itoa(b.blob.ID))
+}
+
+func (b *blobResolver) Content() string {
+	return b.blob.Content
+}
+
+func (b *blobResolver) AddedDate() graphql.Time {
+	return graphql.Time{Time: b.blob.AddedDate}
+}
+
+func (b *blobResolver) Author() (*userResolver, error) {
+	return b.q.user(b.blob.UserID)
+}
+
+func (b *blobResolver) LikesCount() (int32, error) {
+	s, err := b.stats()
+	return int32(s.likes), err
+}
+
+func (b *blobResolver) Liked() (bool, error) {
+	s, err := b.stats()
+	return s.liked, err
+}
+
+func (b *blobResolver) IsOwner() bool {
+	return b.blob.UserID == b.q.claims.UserID
+}
+
+func (b *blobResolver) Likers(args pageArgs) ([]*userResolver, error) {
+	if err := args.check(); err != nil {
+		return nil, err
+	}
+	return b.q.queryUsers(`SELECT u.ID, u.username, IFNULL(u.description, '') FROM likes l JOIN users u ON l.ID_user = u.ID
+		WHERE l.ID_blob = ? ORDER BY l.ID DESC LIMIT ? OFFSET ?`, b.blob.ID, args.First, args.Offset)
+}
+
+//* cost
+//the cost of a query is the number of objects it can return: every field that returns objects costs
+//one for every object of its parent, a list costs the size of its page (first) for every object of
+//its parent, es: feed(first: 10) { likers(first: 5) { username } } costs 10 + 10*5. The aliases and
+//the fragments are counted every time they are used. The library doesn't export the parsed query,
+//so the document (already validated) is parsed again here
+
+//graphqlSelection is a field, a fragment spread (fragment) or an inline fragment (neither)
+type graphqlSelection struct {
+	field      string
+	fragment   string
+	args       map[string]interface{}
+	selections []graphqlSelection
+}
+
+//graphqlVariable is the value of an argument that is a variable
+type graphqlVariable string
+
+type graphqlOperation struct {
+	kind       string
+	name       string
+	defaults   map[string]interface{}
+	selections []graphqlSelection
+}
+
+type graphqlDocument struct {
+	operations []graphqlOperation
+	fragments  map[string][]graphqlSelection
+}
+
+type graphqlToken struct {
+	//n name, p punctuator, i number, s string
+	kind byte
+	text string
+}
+
+func graphqlTokens(src string) ([]graphqlToken, error) {
+	var tokens []graphqlToken
+	isName := func(c byte, first bool) bool {
+		return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (!first && c >= '0' && c <= '9')
+	}
+	for i := 0; i < len(src); {
+		c := src[i]
+		start := i
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+			continue
+		case strings.HasPrefix(src[i:], "\ufeff"):
+			i += len("\ufeff")
+			continue
+		case c == '#':
+			for i < len(src) && src[i] != '\n' && src[i] != '\r' {
+				i++
+			}
+			continue
+		case strings.HasPrefix(src[i:], "..."):
+			i += 3
+			tokens = append(tokens, graphqlToken{'p', "..."})
+		case strings.IndexByte("!$()=:@[]{}|&", c) >= 0:
+			i++
+			tokens = append(tokens, graphqlToken{'p', src[start:i]})
+		case isName(c, true):
+			for i < len(src) && isName(src[i], false) {
+				i++
+			}
+			tokens = append(tokens, graphqlToken{'n', src[start:i]})
+		case c == '-' || (c >= '0' && c <= '9'):
+			for i++; i < len(src) && (src[i] >= '0' && src[i] <= '9' || strings.IndexByte(".eE+-", src[i]) >= 0); i++ {
+			}
+			tokens = append(tokens, graphqlToken{'i', src[start:i]})
+		case strings.HasPrefix(src[i:], `"""`):
+			//a block string ends at the first """ not escaped with a backslash
+			for i += 3; ; i++ {
+				if i+3 > len(src) {
+					return nil, errors.New("unterminated string")
+				}
+				if strings.HasPrefix(src[i:], `\"""`) {
+					i += 3
+				} else if strings.HasPrefix(src[i:], `"""`) {
+					break
+				}
+			}
+			i += 3
+			tokens = append(tokens, graphqlToken{'s', src[start:i]})
+		case c == '"':
+			for i++; i < len(src) && src[i] != '"'; i++ {
+				if src[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(src) {
+				return nil, errors.New("unterminated string")
+			}
+			i++
+			tokens = append(tokens, graphqlToken{'s', src[start:i]})
+		default:
+			return nil, fmt.Errorf("unexpected character %q", c)
+		}
+	}
+	return tokens, nil
+}
+
+type graphqlParser struct {
+	tokens []graphqlToken
+	pos    int
+}
+
+//peek is true if the next token is the punctuator or the name
+func (p *graphqlParser) peek(text string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind != 's' && p.tokens[p.pos].text == text
+}
+
+func (p *graphqlParser) next() (graphqlToken, error) {
+	if p.pos >= len(p.tokens) {
+		return graphqlToken{}, errors.New("unexpected end of the query")
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *graphqlParser) expect(text string) error {
+	if !p.peek(text) {
+		return fmt.Errorf("expected %s", text)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *graphqlParser) name() (string, error) {
+	t, err := p.next()
+	if err == nil && t.kind != 'n' {
+		err = fmt.Errorf("expected a name instead of %s", t.text)
+	}
+	return t.text, err
+}
+
+func parseGraphqlDocument(src string) (graphqlDocument, error) {
+	tokens, err := graphqlTokens(src)
+	if err != nil {
+		return graphqlDocument{}, err
+	}
+	p := &graphqlParser{tokens: tokens}
+	doc := graphqlDocument{fragments: make(map[string][]graphqlSelection)}
+	for p.pos < len(p.tokens) {
+		if p.peek("fragment") {
+			p.pos++
+			name, err := p.name()
+			if err != nil {
+				return graphqlDocument{}, err
+			}
+			if err = p.expect("on"); err != nil {
+				return graphqlDocument{}, err
+			}
+			if _, err = p.name(); err != nil {
+				return graphqlDocument{}, err
+			}
+			if err = p.directives(); err != nil {
+				return graphqlDocument{}, err
+			}
+			if doc.fragments[name], err = p.selectionSet(); err != nil {
+				return graphqlDocument{}, err
+			}
+			continue
+		}
+
+		//the shorthand { ... } is a query without name and variables
+		op := graphqlOperation{kind: "query", defaults: make(map[string]interface{})}
+		if !p.peek("{") {
+			if op.kind, err = p.name(); err != nil {
+				return graphqlDocument{}, err
+			}
+			if p.pos < len(p.tokens) && p.tokens[p.pos].kind == 'n' {
+				op.name, _ = p.name()
+			}
+			if p.peek("(") {
+				if err = p.variableDefinitions(op.defaults); err != nil {
+					return graphqlDocument{}, err
+				}
+			}
+			if err = p.directives(); err != nil {
+				return graphqlDocument{}, err
+			}
+		}
+		if op.selections, err = p.selectionSet(); err != nil {
+			return graphqlDocument{}, err
+		}
+		doc.operations = append(doc.operations, op)
+	}
+	return doc, nil
+}
+
+//variableDefinitions saves the defaults of the variables, es: ($first: Int = 10, $id: ID!)
+func (p *graphqlParser) variableDefinitions(defaults map[string]interface{}) error {
+	p.pos++
+	for !p.peek(")") {
+		if err := p.expect("$"); err != nil {
+			return err
+		}
+		name, err := p.name()
+		if err != nil {
+			return err
+		}
+		if err = p.expect(":"); err != nil {
+			return err
+		}
+		if err = p.skipType(); err != nil {
+			return err
+		}
+		if p.peek("=") {
+			p.pos++
+			if defaults[name], err = p.value(); err != nil {
+				return err
+			}
+		}
+		if err = p.directives(); err != nil {
+			return err
+		}
+	}
+	return p.expect(")")
+}
+
+func (p *graphqlParser) skipType() error {
+	if p.peek("[") {
+		p.pos++
+		if err := p.skipType(); err != nil {
+			return err
+		}
+		if err := p.expect("]"); err != nil {
+			return err
+		}
+	} else if _, err := p.name(); err != nil {
+		return err
+	}
+	if p.peek("!") {
+		p.pos++
+	}
+	return nil
+}
+
+//directives skips the directives, @skip and @include can only lower the cost
+func (p *graphqlParser) directives() error {
+	for p.peek("@") {
+		p.pos++
+		if _, err := p.name(); err != nil {
+			return err
+		}
+		if p.peek("(") {
+			if _, err := p.arguments(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (p *graphqlParser) arguments() (map[string]interface{}, error) {
+	p.pos++
+	args := make(map[string]interface{})
+	for !p.peek(")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err = p.expect(":"); err != nil {
+			return nil, err
+		}
+		if args[name], err = p.value(); err != nil {
+			return nil, err
+		}
+	}
+	return args, p.expect(")")
+}
+
+//value returns the numbers as int64 or float64, the variables as graphqlVariable and the rest as the text
+func (p *graphqlParser) value() (interface{}, error) {
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case t.kind == 'i':
+		if n, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			return n, nil
+		}
+		return strconv.ParseFloat(t.text, 64)
+	case t.kind == 's' || t.kind == 'n':
+		return t.text, nil
+	case t.text == "$":
+		name, err := p.name()
+		return graphqlVariable(name), err
+	case t.text == "[":
+		var list []interface{}
+		for !p.peek("]") {
+			v, err := p.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, v)
+		}
+		return list, p.expect("]")
+	case t.text == "{":
+		object := make(map[string]interface{})
+		for !p.peek("}") {
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err = p.expect(":"); err != nil {
+				return nil, err
+			}
+			if object[name], err = p.value(); err != nil {
+				return nil, err
+			}
+		}
+		return object, p.expect("}")
+	}
+	return nil, fmt.Errorf("unexpected %s", t.text)
+}
+
+func (p *graphqlParser) selectionSet() ([]graphqlSelection, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var selections []graphqlSelection
+	for !p.peek("}") {
+		s, err := p.selection()
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, s)
+	}
+	return selections, p.expect("}")
+}
+
+func (p *graphqlParser) selection() (graphqlSelection, error) {
+	var s graphqlSelection
+	var err error
+	if p.peek("...") {
+		p.pos++
+		//a spread is ...Name, an inline fragment is ... on Type { } or ... { }
+		if !p.peek("on") && p.pos < len(p.tokens) && p.tokens[p.pos].kind == 'n' {
+			s.fragment, _ = p.name()
+			return s, p.directives()
+		}
+		if p.peek("on") {
+			p.pos++
+			if _, err = p.name(); err != nil {
+				return s, err
+			}
+		}
+		if err = p.directives(); err != nil {
+			return s, err
+		}
+		s.selections, err = p.selectionSet()
+		return s, err
+	}
+
+	//the alias is not needed, every alias is a selection of its own
+	if s.field, err = p.name(); err != nil {
+		return s, err
+	}
+	if p.peek(":") {
+		p.pos++
+		if s.field, err = p.name(); err != nil {
+			return s, err
+		}
+	}
+	if p.peek("(") {
+		if s.args, err = p.arguments(); err != nil {
+			return s, err
+		}
+	}
+	if err = p.directives(); err != nil {
+		return s, err
+	}
+	if p.peek("{") {
+		s.selections, err = p.selectionSet()
+	}
+	return s, err
+}
+
+//graphqlQueryCost returns the objects that the operation of the query can return
+func graphqlQueryCost(query, operationName string, variables map[string]interface{}) (int, error) {
+	doc, err := parseGraphqlDocument(query)
+	if err != nil {
+		return 0, fmt.Errorf("the cost of the query can't be computed: %v", err)
+	}
+	var op *graphqlOperation
+	for i := range doc.operations {
+		if doc.operations[i].name == operationName || (operationName == "" && len(doc.operations) == 1) {
+			op = &doc.operations[i]
+		}
+	}
+	schema := graphqlSchema.ASTSchema()
+	if op == nil || schema.EntryPoints[op.kind] == nil {
+		//the operation doesn't exist, Exec answers with the error
+		return 0, nil
+	}
+	root, ok := schema.EntryPoints[op.kind].(*types.ObjectTypeDefinition)
+	if !ok {
+		return 0, nil
+	}
+
+	c := graphqlCost{fragments: doc.fragments, variables: variables, defaults: op.defaults, spreading: make(map[string]bool)}
+	c.walk(op.selections, root, 1)
+	return int(c.total), nil
+}
+
+type graphqlCost struct {
+	fragments map[string][]graphqlSelection
+	variables map[string]interface{}
+	defaults  map[string]interface{}
+	//the fragments being walked, the validation refuses the cycles but they must not hang the walk
+	spreading map[string]bool
+	total     int64
+}
+
+func (c *graphqlCost) walk(selections []graphqlSelection, parent *types.ObjectTypeDefinition, objects int64) {
+	for _, s := range selections {
+		//once over the limit the exact cost doesn't matter
+		if c.total > graphqlMaxObjects {
+			return
+		}
+		switch {
+		case s.fragment != "":
+			if !c.spreading[s.fragment] {
+				c.spreading[s.fragment] = true
+				c.walk(c.fragments[s.fragment], parent, objects)
+				delete(c.spreading, s.fragment)
+			}
+		case s.field == "":
+			c.walk(s.selections, parent, objects)
+		default:
+			//__typename and the introspection aren't in the fields and don't read the database
+			field := parent.Fields.Get(s.field)
+			if field == nil {
+				continue
+			}
+			t, size := unwrapNonNull(field.Type), int64(1)
+			if list, ok := t.(*types.List); ok {
+				t, size = unwrapNonNull(list.OfType), c.pageSize(s.args, field)
+			}
+			if object, ok := t.(*types.ObjectTypeDefinition); ok {
+				c.total += objects * size
+				c.walk(s.selections, object, objects*size)
+			}
+		}
+	}
+}
+
+func unwrapNonNull(t types.Type) types.Type {
+	if nonNull, ok := t.(*types.NonNull); ok {
+		return nonNull.OfType
+	}
+	return t
+}
+
+//pageSize is the argument first of the list, from the query, the variables or the defaults. The pages
+//out of the limits are refused by the resolvers without reading anything
+func (c *graphqlCost) pageSize(args map[string]interface{}, field *types.FieldDefinition) int64 {
+	first, ok := args["first"]
+	if variable, isVariable := first.(graphqlVariable); isVariable {
+		if first, ok = c.variables[string(variable)]; !ok {
+			first, ok = c.defaults[string(variable)]
+		}
+	}
+	if !ok {
+		if def := field.Arguments.Get("first"); def != nil && def.Default != nil {
+			first = def.Default.Deserialize(nil)
+		}
+	}
+
+	var size int64 = graphqlMaxPage
+	switch n := first.(type) {
+	case int64:
+		size = n
+	case int32:
+		size = int64(n)
+	case float64:
+		size = int64(n)
+	}
+	if size < 1 || size > graphqlMaxPage {
+		return 0
+	}
+	return size
+}
+
+//* graphql's handler
+//the answer follows the graphql spec ({data, errors}) instead of the blobber's envelope
+func graphqlHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	claims, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	var params struct {
+		Query         string                 `json:"query"`
+		OperationName string                 `json:"operationName"`
+		Variables     map[string]interface{} `json:"variables"`
+	}
+	if err = json.NewDecoder(r.Body).Decode(&params); err != nil {
+		returnError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if len(params.Query) > graphqlMaxQueryLength {
+		returnError(w, http.StatusBadRequest, fmt.Sprintf("The query is longer than %d characters", graphqlMaxQueryLength))
+		return
+	}
+
+	var response *graphql.Response
+	//the invalid queries are answered by Exec with the errors of the validation
+	if errs := graphqlSchema.ValidateWithVariables(params.Query, params.Variables); len(errs) == 0 {
+		cost, err := graphqlQueryCost(params.Query, params.OperationName, params.Variables)
+		if err != nil {
+			response = &graphql.Response{Errors: []*graphqlerrors.QueryError{{Message: err.Error()}}}
+		} else if cost > graphqlMaxObjects {
+			response = &graphql.Response{Errors: []*graphqlerrors.QueryError{{
+				Message: fmt.Sprintf("the query can return %d objects, more than %d: ask for smaller pages", cost, graphqlMaxObjects),
+			}}}
+		}
+	}
+	if response == nil {
+		ctx := context.WithValue(r.Context(), graphqlContextKey{}, newGraphqlRequest(claims, w.Header().Get(requestIDHeader)))
+		response = graphqlSchema.Exec(ctx, params.Query, params.OperationName, params.Variables)
+	}
+
+	body, err := json.Marshal(response)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "graphql response encoding failed: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(body)
+}
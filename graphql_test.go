@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestGraphqlQueryCost(t *testing.T) {
+	tests := []struct {
+		name, query, operation string
+		variables              map[string]interface{}
+		want                   int
+	}{
+		{"object", `{ me { id username } }`, "", nil, 1},
+		{"scalars only", `mutation { deleteBlob(id: 1) }`, "", nil, 0},
+		{"default page", `{ feed { id } }`, "", nil, 20},
+		{"nested lists", `{ feed(first: 10) { author { id } likers(first: 5) { username } } }`, "", nil, 10 + 10 + 10*5},
+		{"aliases", `{ a: feed(first: 10) { id } b: feed(first: 10) { id } me { id } }`, "", nil, 21},
+		{"variable", `query Feed($n: Int) { feed(first: $n) { id } }`, "", map[string]interface{}{"n": float64(3)}, 3},
+		{"default of the variable", `query Feed($n: Int = 7) { feed(first: $n) { id } }`, "", nil, 7},
+		{"fragment", `{ me { ...blobs } } fragment blobs on User { blobs(first: 10) { author { username } } }`, "", nil, 1 + 10 + 10},
+		{"fragment used twice", `{ me { ...f ...f } } fragment f on User { followers(first: 4) { id } }`, "", nil, 1 + 4 + 4},
+		{"inline fragment", `{ me { ... on User { followers(first: 2) { id } } } }`, "", nil, 3},
+		{"mutation", `mutation { postBlob(content: "ciao") { author { username } } }`, "", nil, 2},
+		{"operation name", `query A { me { id } } query B { feed(first: 2) { id } }`, "B", nil, 2},
+		{"page out of the limits", `{ feed(first: 1000) { id } }`, "", nil, 0},
+		{"typename", `{ __typename me { __typename } }`, "", nil, 1},
+		{"strings and comments", "{ searchUsers(query: \"} {\", first: 3) { id } # feed { id }\n}", "", nil, 3},
+		{"block string", `{ searchUsers(query: """a \""" { b""", first: 4) { id } }`, "", nil, 4},
+		{"over the limit", `{ feed(first: 50) { likers(first: 50) { followers(first: 50) { id } } } }`, "", nil, graphqlMaxObjects + 1},
+	}
+	for _, tt := range tests {
+		got, err := graphqlQueryCost(tt.query, tt.operation, tt.variables)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		//the walk stops after the limit
+		if tt.want > graphqlMaxObjects && got > graphqlMaxObjects {
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%s: cost %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+type graphqlTestResponse struct {
+	Data   json.RawMessage `json:"data"`
+	Errors []struct {
+		Message string `json:"message"`
+	} `json:"errors"`
+}
+
+//postGraphql sends the query with the token in the Authorization header, like the apps do
+func postGraphql(t *testing.T, token, query string) (int, graphqlTestResponse) {
+	t.Helper()
+	body, err := json.Marshal(map[string]string{"query": query})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", graphqlAPI.String(), bytes.NewReader(body))
+	r.Header.Set("Authorization", "Bearer "+token)
+	w := httptest.NewRecorder()
+	newRouter().ServeHTTP(w, r)
+
+	var response graphqlTestResponse
+	if w.Code == http.StatusOK {
+		if err = json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatalf("invalid response %s: %v", w.Body.String(), err)
+		}
+	}
+	return w.Code, response
+}
+
+func wantGraphqlError(t *testing.T, what string, response graphqlTestResponse, message string) {
+	t.Helper()
+	if len(response.Errors) == 0 || !strings.Contains(response.Errors[0].Message, message) {
+		t.Errorf("%s: errors %+v, want %q", what, response.Errors, message)
+	}
+}
+
+func TestGraphqlLimits(t *testing.T) {
+	user := newTestUser(t)
+	token := sessionToken(t, user)
+
+	_, response := postGraphql(t, token, `{ me { username } }`)
+	if len(response.Errors) != 0 || !strings.Contains(string(response.Data), user.Username) {
+		t.Fatalf("query of me: %s %+v", response.Data, response.Errors)
+	}
+
+	//the query is refused before running it, there is no partial data
+	_, response = postGraphql(t, token, `{ feed(first: 50) { likers(first: 50) { username } } }`)
+	wantGraphqlError(t, "too expensive", response, "ask for smaller pages")
+	if len(response.Data) != 0 && string(response.Data) != "null" {
+		t.Errorf("data of a refused query: %s", response.Data)
+	}
+	_, response = postGraphql(t, token, `{ a: feed(first: 50) { id } b: feed(first: 50) { id } c: feed(first: 50) { id }
+		d: feed(first: 50) { id } e: feed(first: 50) { id } f: feed(first: 50) { id } g: feed(first: 50) { id }
+		h: feed(first: 50) { id } i: feed(first: 50) { id } j: feed(first: 50) { id } k: feed(first: 50) { id } }`)
+	wantGraphqlError(t, "too many aliases", response, "ask for smaller pages")
+
+	deep := "{ me { " + strings.Repeat("following(first: 1) { ", graphqlMaxDepth) + "id" + strings.Repeat(" }", graphqlMaxDepth) + " } }"
+	_, response = postGraphql(t, token, deep)
+	wantGraphqlError(t, "too deep", response, "exceeds max depth")
+
+	if code, _ := postGraphql(t, token, "{ me { "+strings.Repeat("id ", graphqlMaxQueryLength/3)+"} }"); code != http.StatusBadRequest {
+		t.Errorf("too long: status %d, want 400", code)
+	}
+	_, response = postGraphql(t, token, `{ feed(first: 51) { id } }`)
+	wantGraphqlError(t, "page too big", response, "first must be between")
+}
+
+func TestGraphqlWriteScope(t *testing.T) {
+	user := newTestUser(t)
+	app, _, err := user.AddOAuthApp(newOAuthApp{Name: "graphql app", RedirectURIs: []string{testRedirectURI}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := authorizeTestApp(t, user, app, "read")
+	write := authorizeTestApp(t, user, app, "read write")
+
+	//the read scope can query but not change anything
+	if _, response := postGraphql(t, read.AccessToken, `{ me { id } }`); len(response.Errors) != 0 {
+		t.Errorf("query with the read scope: %+v", response.Errors)
+	}
+	_, response := postGraphql(t, read.AccessToken, `mutation { postBlob(content: "from the app") { id } }`)
+	wantGraphqlError(t, "mutation with the read scope", response, "write scope")
+	if blobs, err := user.GetBlobs(false, 0); err != nil || len(blobs) != 0 {
+		t.Errorf("blobs after the refused mutation %+v, %v, want none", blobs, err)
+	}
+
+	for what, token := range map[string]string{"write scope": write.AccessToken, "session": sessionToken(t, user)} {
+		_, response = postGraphql(t, token, `mutation { postBlob(content: "from the app") { id isOwner } }`)
+		if len(response.Errors) != 0 || !strings.Contains(string(response.Data), `"isOwner":true`) {
+			t.Errorf("mutation with the %s: %s %+v", what, response.Data, response.Errors)
+		}
+	}
+}
+
+func TestGraphqlBatching(t *testing.T) {
+	viewer := newTestUser(t)
+	for i := 0; i < 3; i++ {
+		followed := newTestUser(t)
+		if err := viewer.Follow(followed.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := AddBlob(followed.ID, "blob to batch"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//the fetches of the counters are counted with the ids they load
+	q := newGraphqlRequest(CustomClaims{UserID: viewer.ID}, "test")
+	var mu sync.Mutex
+	var fetches [][]int
+	fetch := q.userStats.fetch
+	q.userStats.fetch = func(ids []int) (map[int]interface{}, error) {
+		mu.Lock()
+		fetches = append(fetches, ids)
+		mu.Unlock()
+		return fetch(ids)
+	}
+
+	ctx := context.WithValue(context.Background(), graphqlContextKey{}, q)
+	response := graphqlSchema.Exec(ctx, `{ me { following(first: 10) { username followersCount likesCount follows } } }`, "", nil)
+	if len(response.Errors) != 0 {
+		t.Fatal(response.Errors)
+	}
+	var data struct {
+		Me struct {
+			Following []struct {
+				FollowersCount int  `json:"followersCount"`
+				Follows        bool `json:"follows"`
+			} `json:"following"`
+		} `json:"me"`
+	}
+	if err := json.Unmarshal(response.Data, &data); err != nil {
+		t.Fatal(err)
+	}
+	if len(data.Me.Following) != 3 {
+		t.Fatalf("following %+v, want 3 users", data.Me.Following)
+	}
+	for _, u := range data.Me.Following {
+		if u.FollowersCount != 1 || !u.Follows {
+			t.Errorf("followed user %+v, want 1 follower, the viewer", u)
+		}
+	}
+	if len(fetches) != 1 || len(fetches[0]) != 3 {
+		t.Errorf("fetches of the counters %v, want 1 for the 3 users", fetches)
+	}
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+
+	blobberpb "github.com/vano2903/blobber/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+//grpc api for the internal services (proto/blobber.proto), it runs next to the http server and
+//uses the same domain functions. The calls carry the jwt in the "authorization: Bearer" metadata,
+//the access tokens of the oauth apps are limited by the scopes like on the http api
+type GRPCConfig struct {
+	//address to listen on, es: :9090
+	Address  string `yaml:"address"`
+	Disabled bool   `yaml:"disabled"`
+}
+
+const defaultGRPCAddress = ":9090"
+
+//the scope needed by the oauth apps for every method
+var grpcMethodScopes = map[string]string{
+	"/blobber.v1.Users/GetUser":             "read",
+	"/blobber.v1.Users/SearchUsers":         "read",
+	"/blobber.v1.Blobs/GetBlob":             "read",
+	"/blobber.v1.Blobs/ListUserBlobs":       "read",
+	"/blobber.v1.Blobs/CreateBlob":          "write",
+	"/blobber.v1.Blobs/UpdateBlob":          "write",
+	"/blobber.v1.Blobs/DeleteBlob":          "write",
+	"/blobber.v1.Blobs/LikeBlob":            "write",
+	"/blobber.v1.Blobs/UnlikeBlob":          "write",
+	"/blobber.v1.Timeline/GetFeed":          "read",
+	"/blobber.v1.SocialGraph/Follow":        "write",
+	"/blobber.v1.SocialGraph/Unfollow":      "write",
+	"/blobber.v1.SocialGraph/ListFollowers": "read",
+	"/blobber.v1.SocialGraph/ListFollowing": "read",
+}
+
+type grpcClaimsKey struct{}
+
+//grpcAuthInterceptor checks the token of the call like checkJWT does for the http requests
+func grpcAuthInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	var token string
+	for _, auth := range md.Get("authorization") {
+		if strings.HasPrefix(auth, "Bearer ") {
+			token = strings.TrimPrefix(auth, "Bearer ")
+		}
+	}
+	if token == "" {
+		return nil, status.Error(codes.Unauthenticated, "missing bearer token")
+	}
+
+	claims, err := ParseToken(token)
+	if err != nil || claims.Purpose != "" {
+		return nil, status.Error(codes.Unauthenticated, "invalid token")
+	}
+
+	if claims.GrantID != 0 {
+		needed, ok := grpcMethodScopes[info.FullMethod]
+		if !ok {
+			return nil, status.Error(codes.PermissionDenied, "method not available to apps")
+		}
+		if err = checkGrantScope(claims, needed); err != nil {
+			return nil, grpcError(err)
+		}
+	}
+
+	version, err := QuerySessionVersion(claims.UserID)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, grpcError(err)
+	}
+	if err == sql.ErrNoRows || version != claims.SessionVersion {
+		return nil, status.Error(codes.Unauthenticated, "session revoked, login again")
+	}
+
+	log.Println("grpc", info.FullMethod)
+	return handler(context.WithValue(ctx, grpcClaimsKey{}, claims), req)
+}
+
+func grpcClaims(ctx context.Context) CustomClaims {
+	return ctx.Value(grpcClaimsKey{}).(CustomClaims)
+}
+
+//grpcError maps the domain errors to the grpc codes, the internal errors are only logged
+func grpcError(err error) error {
+	msg := err.Error()
+	switch {
+	case errors.Is(err, errBadRequest):
+		return status.Error(codes.InvalidArgument, msg)
+	case errors.Is(err, errForbidden):
+		return status.Error(codes.PermissionDenied, msg)
+	case errors.Is(err, errConflict):
+		return status.Error(codes.AlreadyExists, msg)
+	case errors.Is(err, sql.ErrNoRows):
+		return status.Error(codes.NotFound, "not found")
+	}
+	log.Printf("grpc internal error: %v", err)
+	return status.Error(codes.Internal, "internal server error")
+}
+
+func grpcPage(page *blobberpb.Page) (int, int, error) {
+	limit, offset := int(page.GetLimit()), int(page.GetOffset())
+	if limit == 0 {
+		limit = 20
+	}
+	if limit < 0 || limit > 100 {
+		return 0, 0, status.Error(codes.InvalidArgument, "limit must be between 1 and 100")
+	}
+	if offset < 0 {
+		return 0, 0, status.Error(codes.InvalidArgument, "offset can't be negative")
+	}
+	return limit, offset, nil
+}
+
+func toGRPCUser(u User) *blobberpb.User {
+	return &blobberpb.User{
+		Id:          int64(u.ID),
+		Username:    u.Username,
+		Description: u.Description,
+		Likes:       int64(u.LikesCount),
+		Followers:   int64(u.FollowersCount),
+		Following:   int64(u.FollowingCount),
+		Follows:     u.Follows,
+		FollowsYou:  u.FollowsYou,
+	}
+}
+
+func toGRPCUsers(users []User) *blobberpb.UserList {
+	list := &blobberpb.UserList{}
+	for _, u := range users {
+		list.Users = append(list.Users, toGRPCUser(u))
+	}
+	return list
+}
+
+func toGRPCBlob(b Blob) *blobberpb.Blob {
+	return &blobberpb.Blob{
+		Id:        int64(b.ID),
+		UserId:    int64(b.UserID),
+		Username:  b.Username,
+		Content:   b.Content,
+		AddedDate: timestamppb.New(b.AddedDate),
+		Likes:     int64(b.LikesCounts),
+		Liked:     b.Liked,
+		IsOwner:   b.IsOwner,
+	}
+}
+
+func toGRPCBlobs(blobs []Blob) *blobberpb.BlobList {
+	list := &blobberpb.BlobList{}
+	for _, b := range blobs {
+		list.Blobs = append(list.Blobs, toGRPCBlob(b))
+	}
+	return list
+}
+
+//grpcUser returns the user with the follows fields relative to the requester, NotFound if missing
+func grpcUser(id, requesterID int) (User, error) {
+	user, err := QueryUserByID(id, requesterID)
+	if err != nil {
+		return User{}, grpcError(err)
+	}
+	return user, nil
+}
+
+func grpcBlob(id, requesterID int) (Blob, error) {
+	blob, err := QueryBlobByID(id, requesterID)
+	if err != nil {
+		return Blob{}, status.Error(codes.NotFound, "blob not found")
+	}
+	return blob, nil
+}
+
+//* users
+type grpcUsersServer struct {
+	blobberpb.UnimplementedUsersServer
+}
+
+func (grpcUsersServer) GetUser(ctx context.Context, req *blobberpb.GetUserRequest) (*blobberpb.User, error) {
+	claims := grpcClaims(ctx)
+	id := int(req.GetId())
+	if id == 0 {
+		id = claims.UserID
+	}
+	user, err := grpcUser(id, claims.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return toGRPCUser(user), nil
+}
+
+func (grpcUsersServer) SearchUsers(ctx context.Context, req *blobberpb.SearchUsersRequest) (*blobberpb.UserList, error) {
+	if strings.TrimSpace(req.GetQuery()) == "" {
+		return nil, status.Error(codes.InvalidArgument, "the query is required")
+	}
+	users, err := QueryUsersBySubstring(req.GetQuery(), grpcClaims(ctx).UserID)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return toGRPCUsers(users), nil
+}
+
+//* blobs
+type grpcBlobsServer struct {
+	blobberpb.UnimplementedBlobsServer
+}
+
+func (grpcBlobsServer) GetBlob(ctx context.Context, req *blobberpb.GetBlobRequest) (*blobberpb.Blob, error) {
+	blob, err := grpcBlob(int(req.GetId()), grpcClaims(ctx).UserID)
+	if err != nil {
+		return nil, err
+	}
+	return toGRPCBlob(blob), nil
+}
+
+func (grpcBlobsServer) ListUserBlobs(ctx context.Context, req *blobberpb.ListUserBlobsRequest) (*blobberpb.BlobList, error) {
+	claims := grpcClaims(ctx)
+	user, err := grpcUser(int(req.GetUserId()), claims.UserID)
+	if err != nil {
+		return nil, err
+	}
+	blobs, err := user.GetBlobs(true, claims.UserID)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return toGRPCBlobs(blobs), nil
+}
+
+func (grpcBlobsServer) CreateBlob(ctx context.Context, req *blobberpb.CreateBlobRequest) (*blobberpb.Blob, error) {
+	claims := grpcClaims(ctx)
+	id, err := AddBlob(claims.UserID, req.GetContent())
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	blob, err := grpcBlob(id, claims.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return toGRPCBlob(blob), nil
+}
+
+//grpcOwnBlob returns the blob if the user of the call is its owner
+func grpcOwnBlob(ctx context.Context, id int64) (Blob, error) {
+	claims := grpcClaims(ctx)
+	blob, err := grpcBlob(int(id), claims.UserID)
+	if err != nil {
+		return Blob{}, err
+	}
+	if blob.UserID != claims.UserID {
+		return Blob{}, status.Error(codes.PermissionDenied, "only the owner can change the blob")
+	}
+	return blob, nil
+}
+
+func (grpcBlobsServer) UpdateBlob(ctx context.Context, req *blobberpb.UpdateBlobRequest) (*blobberpb.Blob, error) {
+	blob, err := grpcOwnBlob(ctx, req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	content := strings.Trim(req.GetContent(), " ")
+	if content != blob.Content {
+		if err = blob.Modify(content); err != nil {
+			return nil, grpcError(err)
+		}
+		blob.Content = content
+	}
+	return toGRPCBlob(blob), nil
+}
+
+func (grpcBlobsServer) DeleteBlob(ctx context.Context, req *blobberpb.BlobRequest) (*blobberpb.Empty, error) {
+	blob, err := grpcOwnBlob(ctx, req.GetId())
+	if err != nil {
+		return nil, err
+	}
+	if err = blob.Delete(); err != nil {
+		return nil, grpcError(err)
+	}
+	return &blobberpb.Empty{}, nil
+}
+
+func (grpcBlobsServer) LikeBlob(ctx context.Context, req *blobberpb.BlobRequest) (*blobberpb.Empty, error) {
+	claims := grpcClaims(ctx)
+	blob, err := grpcBlob(int(req.GetId()), claims.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if err = blob.Like(claims.UserID); err != nil {
+		return nil, grpcError(err)
+	}
+	return &blobberpb.Empty{}, nil
+}
+
+func (grpcBlobsServer) UnlikeBlob(ctx context.Context, req *blobberpb.BlobRequest) (*blobberpb.Empty, error) {
+	claims := grpcClaims(ctx)
+	blob, err := grpcBlob(int(req.GetId()), claims.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if err = blob.Unlike(claims.UserID); err != nil {
+		return nil, grpcError(err)
+	}
+	return &blobberpb.Empty{}, nil
+}
+
+//* timeline
+type grpcTimelineServer struct {
+	blobberpb.UnimplementedTimelineServer
+}
+
+func (grpcTimelineServer) GetFeed(ctx context.Context, req *blobberpb.FeedRequest) (*blobberpb.BlobList, error) {
+	limit, offset, err := grpcPage(req.GetPage())
+	if err != nil {
+		return nil, err
+	}
+	user, err := grpcUser(grpcClaims(ctx).UserID, 0)
+	if err != nil {
+		return nil, err
+	}
+	blobs, err := user.GetOverview()
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	//the overview isn't paginated by the query
+	if offset > len(blobs) {
+		offset = len(blobs)
+	}
+	blobs = blobs[offset:]
+	if len(blobs) > limit {
+		blobs = blobs[:limit]
+	}
+	return toGRPCBlobs(blobs), nil
+}
+
+//* social graph
+type grpcSocialGraphServer struct {
+	blobberpb.UnimplementedSocialGraphServer
+}
+
+func (grpcSocialGraphServer) Follow(ctx context.Context, req *blobberpb.FollowRequest) (*blobberpb.Empty, error) {
+	if _, err := grpcUser(int(req.GetUserId()), 0); err != nil {
+		return nil, err
+	}
+	me := User{ID: grpcClaims(ctx).UserID}
+	if err := me.Follow(int(req.GetUserId())); err != nil {
+		return nil, grpcError(err)
+	}
+	return &blobberpb.Empty{}, nil
+}
+
+func (grpcSocialGraphServer) Unfollow(ctx context.Context, req *blobberpb.FollowRequest) (*blobberpb.Empty, error) {
+	me := User{ID: grpcClaims(ctx).UserID}
+	if err := me.Unfollow(int(req.GetUserId())); err != nil {
+		return nil, grpcError(err)
+	}
+	return &blobberpb.Empty{}, nil
+}
+
+func (grpcSocialGraphServer) ListFollowers(ctx context.Context, req *blobberpb.ListFollowsRequest) (*blobberpb.UserList, error) {
+	limit, offset, err := grpcPage(req.GetPage())
+	if err != nil {
+		return nil, err
+	}
+	claims := grpcClaims(ctx)
+	user, err := grpcUser(int(req.GetUserId()), claims.UserID)
+	if err != nil {
+		return nil, err
+	}
+	followers, _, err := user.GetFollowers(claims.UserID, limit, offset)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return toGRPCUsers(followers), nil
+}
+
+func (grpcSocialGraphServer) ListFollowing(ctx context.Context, req *blobberpb.ListFollowsRequest) (*blobberpb.UserList, error) {
+	limit, offset, err := grpcPage(req.GetPage())
+	if err != nil {
+		return nil, err
+	}
+	claims := grpcClaims(ctx)
+	user, err := grpcUser(int(req.GetUserId()), claims.UserID)
+	if err != nil {
+		return nil, err
+	}
+	followings, _, err := user.GetFollowings(claims.UserID, limit, offset)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+	return toGRPCUsers(followings), nil
+}
+
+//NewGRPCServer returns the grpc server with all the services registered
+func NewGRPCServer() *grpc.Server {
+	server := grpc.NewServer(grpc.UnaryInterceptor(grpcAuthInterceptor))
+	blobberpb.RegisterUsersServer(server, grpcUsersServer{})
+	blobberpb.RegisterBlobsServer(server, grpcBlobsServer{})
+	blobberpb.RegisterTimelineServer(server, grpcTimelineServer{})
+	blobberpb.RegisterSocialGraphServer(server, grpcSocialGraphServer{})
+	return server
+}
+
+//serveGRPC listens on the address of the config, it only returns on errors
+func serveGRPC(c GRPCConfig) error {
+	address := c.Address
+	if address == "" {
+		address = defaultGRPCAddress
+	}
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return fmt.Errorf("grpc listen on %s failed: %v", address, err)
+	}
+	log.Printf("grpc api listening on %s", address)
+	return NewGRPCServer().Serve(listener)
+}
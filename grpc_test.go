@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	blobberpb "github.com/vano2903/blobber/proto"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+//newGRPCTestConn serves the grpc api in memory and returns a connection to it
+func newGRPCTestConn(t *testing.T) *grpc.ClientConn {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	server := NewGRPCServer()
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.DialContext(context.Background(), "bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+//withToken returns the context of a call authenticated with the token
+func withToken(token string) context.Context {
+	if token == "" {
+		return context.Background()
+	}
+	return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+}
+
+func sessionToken(t *testing.T, user User) string {
+	t.Helper()
+	token, err := NewJWT(user.Username, user.ID, user.SessionVersion, time.Now().Add(time.Hour).Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func wantCode(t *testing.T, what string, err error, code codes.Code) {
+	t.Helper()
+	if status.Code(err) != code {
+		t.Errorf("%s: got %v, want %s", what, err, code)
+	}
+}
+
+func TestGRPCAuth(t *testing.T) {
+	user := newTestUser(t)
+	blobs := blobberpb.NewBlobsClient(newGRPCTestConn(t))
+	timeline := blobberpb.NewTimelineClient(newGRPCTestConn(t))
+	create := &blobberpb.CreateBlobRequest{Content: "grpc auth"}
+
+	_, err := blobs.CreateBlob(withToken(""), create)
+	wantCode(t, "call without token", err, codes.Unauthenticated)
+	_, err = blobs.CreateBlob(withToken("not a jwt"), create)
+	wantCode(t, "call with an invalid token", err, codes.Unauthenticated)
+
+	//the token of a session stops working when the sessions are revoked
+	session := sessionToken(t, user)
+	if _, err = blobs.CreateBlob(withToken(session), create); err != nil {
+		t.Fatalf("call with the session: %v", err)
+	}
+	if err = user.RevokeSessions(); err != nil {
+		t.Fatal(err)
+	}
+	_, err = blobs.CreateBlob(withToken(session), create)
+	wantCode(t, "call with a revoked session", err, codes.Unauthenticated)
+
+	//an app authorized only to read can't write
+	app, _, err := user.AddOAuthApp(newOAuthApp{Name: "grpc app", RedirectURIs: []string{testRedirectURI}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := authorizeTestApp(t, user, app, "read")
+	_, err = blobs.CreateBlob(withToken(read.AccessToken), create)
+	wantCode(t, "write with the read scope", err, codes.PermissionDenied)
+	if _, err = timeline.GetFeed(withToken(read.AccessToken), &blobberpb.FeedRequest{}); err != nil {
+		t.Errorf("read with the read scope: %v", err)
+	}
+
+	//the access tokens of a revoked grant are refused even before they expire
+	grants, err := user.GetOAuthGrants()
+	if err != nil || len(grants) != 1 {
+		t.Fatalf("grants %+v, %v, want 1", grants, err)
+	}
+	if err = user.RevokeOAuthGrant(grants[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	_, err = timeline.GetFeed(withToken(read.AccessToken), &blobberpb.FeedRequest{})
+	wantCode(t, "read with a revoked grant", err, codes.PermissionDenied)
+}
+
+func TestGRPCBlobsAndFeed(t *testing.T) {
+	author := newTestUser(t)
+	reader := newTestUser(t)
+	conn := newGRPCTestConn(t)
+	blobs := blobberpb.NewBlobsClient(conn)
+	timeline := blobberpb.NewTimelineClient(conn)
+	authorCtx := withToken(sessionToken(t, author))
+	readerCtx := withToken(sessionToken(t, reader))
+
+	_, err := blobs.CreateBlob(authorCtx, &blobberpb.CreateBlobRequest{Content: "  "})
+	wantCode(t, "empty blob", err, codes.InvalidArgument)
+
+	db, err := connectToDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var created []*blobberpb.Blob
+	for i, content := range []string{"first grpc blob", "second grpc blob", "third grpc blob"} {
+		blob, err := blobs.CreateBlob(authorCtx, &blobberpb.CreateBlobRequest{Content: content})
+		if err != nil {
+			t.Fatalf("creation of %q: %v", content, err)
+		}
+		if blob.GetContent() != content || blob.GetUserId() != int64(author.ID) || !blob.GetIsOwner() {
+			t.Errorf("created blob %+v, want %q of the author", blob, content)
+		}
+		created = append(created, blob)
+		//the feed is ordered by the date that has a precision of a second
+		if _, err = db.Exec("UPDATE blobs SET added_date = ? WHERE ID = ?", time.Now().Add(time.Duration(i-3)*time.Minute), blob.GetId()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//the feed has only the blobs of the followed users
+	feed, err := timeline.GetFeed(readerCtx, &blobberpb.FeedRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(feed.GetBlobs()) != 0 {
+		t.Errorf("feed of a user without followings: %d blobs", len(feed.GetBlobs()))
+	}
+	if err = reader.Follow(author.ID); err != nil {
+		t.Fatal(err)
+	}
+	feed, err = timeline.GetFeed(readerCtx, &blobberpb.FeedRequest{Page: &blobberpb.Page{Limit: 2, Offset: 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := feed.GetBlobs()
+	if len(got) != 2 || got[0].GetId() != created[1].GetId() || got[1].GetId() != created[0].GetId() {
+		t.Errorf("second page of the feed %+v, want the second and first blob", got)
+	}
+	for _, blob := range got {
+		if blob.GetIsOwner() {
+			t.Errorf("blob %d of the feed marked as owned by the reader", blob.GetId())
+		}
+	}
+
+	_, err = timeline.GetFeed(readerCtx, &blobberpb.FeedRequest{Page: &blobberpb.Page{Limit: 101}})
+	wantCode(t, "page too big", err, codes.InvalidArgument)
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+//import of the blobs of another account: a blobber export (exports.go) or a twitter/x archive, the zip or
+//only its data/tweets.js since the media make the whole archive huge. The blobs keep their original date,
+//the ones already imported are skipped so an import can be repeated. Every item is reported while the
+//import goes on, by the endpoint as a line of ndjson and by the command as a line of text
+const (
+	importFormatBlobber = "blobber"
+	importFormatTwitter = "twitter"
+
+	importStatusImported  = "imported"
+	importStatusDuplicate = "duplicate"
+	importStatusSkipped   = "skipped"
+	importStatusFailed    = "failed"
+
+	//biggest archive accepted by the endpoint, the command reads any file
+	importMaxUploadSize = 100 << 20
+	//most data read from the files of a zip once uncompressed, a small zip can expand to gigabytes
+	importMaxUncompressedSize = 512 << 20
+)
+
+//ImportItem is the result of a blob of the archive
+type ImportItem struct {
+	//es: blob 12 or tweet 1050118621198921728
+	Item   string `json:"item"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	BlobID int    `json:"blob_id,omitempty"`
+}
+
+type ImportReport struct {
+	Format     string `json:"format"`
+	Total      int    `json:"total"`
+	Imported   int    `json:"imported"`
+	Duplicates int    `json:"duplicates"`
+	Skipped    int    `json:"skipped"`
+	Failed     int    `json:"failed"`
+}
+
+//importEntry is a blob read from the archive, skip is the reason to not import it
+type importEntry struct {
+	item      string
+	content   string
+	addedDate time.Time
+	skip      string
+}
+
+//importSource is the archive once read, the oldest blobs first
+type importSource struct {
+	format  string
+	entries []importEntry
+}
+
+//the tweet of the archive, the newer archives wrap it in {"tweet": {...}}
+type twitterTweet struct {
+	ID        string `json:"id_str"`
+	FullText  string `json:"full_text"`
+	CreatedAt string `json:"created_at"`
+	Retweeted bool   `json:"retweeted"`
+	Entities  struct {
+		URLs []struct {
+			URL         string `json:"url"`
+			ExpandedURL string `json:"expanded_url"`
+		} `json:"urls"`
+	} `json:"entities"`
+}
+
+//* archives
+
+//readImportArchive finds the format of the archive and reads its blobs
+func readImportArchive(archive []byte) (importSource, error) {
+	trimmed := bytes.TrimSpace(archive)
+	//tweets.js alone
+	if bytes.HasPrefix(trimmed, []byte("window.YTD.")) {
+		entries, err := parseTweetsJS(trimmed)
+		if err != nil {
+			return importSource{}, err
+		}
+		return importSource{format: importFormatTwitter, entries: sortImportEntries(entries)}, nil
+	}
+
+	files, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		return importSource{}, fmt.Errorf("%w: the archive is not a zip or a tweets.js file", errBadRequest)
+	}
+	byName := make(map[string]*zip.File)
+	for _, f := range files.File {
+		byName[f.Name] = f
+	}
+	//what can still be read from the files of the zip
+	remaining := int64(importMaxUncompressedSize)
+
+	if f, ok := byName["manifest.json"]; ok {
+		var manifest exportManifest
+		if err = readZipJSON(f, &remaining, &manifest); errors.Is(err, errBadRequest) {
+			return importSource{}, err
+		}
+		if err != nil || manifest.Format != exportFormat {
+			return importSource{}, fmt.Errorf("%w: manifest.json is not of a blobber export", errBadRequest)
+		}
+		if manifest.Version > exportVersion {
+			return importSource{}, fmt.Errorf("%w: the export version %d is newer than this blobber", errBadRequest, manifest.Version)
+		}
+		f, ok := byName["blobs.json"]
+		if !ok {
+			return importSource{}, fmt.Errorf("%w: blobs.json is missing from the export", errBadRequest)
+		}
+		var blobs []exportBlob
+		if err = readZipJSON(f, &remaining, &blobs); errors.Is(err, errBadRequest) {
+			return importSource{}, err
+		}
+		if err != nil {
+			return importSource{}, fmt.Errorf("%w: invalid blobs.json, %v", errBadRequest, err)
+		}
+		entries := make([]importEntry, 0, len(blobs))
+		for _, blob := range blobs {
+			entries = append(entries, importEntry{item: fmt.Sprintf("blob %d", blob.ID), content: blob.Content, addedDate: blob.AddedDate})
+		}
+		return importSource{format: importFormatBlobber, entries: sortImportEntries(entries)}, nil
+	}
+
+	//the tweets are in data/tweets.js (data/tweet.js in the older archives), split in parts when they are many.
+	//The archive zipped again by the user has a folder around data
+	var entries []importEntry
+	found := false
+	for _, f := range files.File {
+		name := path.Base(f.Name)
+		if path.Base(path.Dir(f.Name)) != "data" || !(name == "tweets.js" || name == "tweet.js" || strings.HasPrefix(name, "tweets-part")) {
+			continue
+		}
+		found = true
+		content, err := readZipFile(f, &remaining)
+		if err != nil {
+			return importSource{}, err
+		}
+		part, err := parseTweetsJS(content)
+		if err != nil {
+			return importSource{}, err
+		}
+		entries = append(entries, part...)
+	}
+	if !found {
+		return importSource{}, fmt.Errorf("%w: unknown archive, expected a blobber export or a twitter archive", errBadRequest)
+	}
+	return importSource{format: importFormatTwitter, entries: sortImportEntries(entries)}, nil
+}
+
+//readZipFile reads a file of the zip taking its size from remaining, the archive is refused when
+//its files are bigger than importMaxUncompressedSize
+func readZipFile(f *zip.File, remaining *int64) ([]byte, error) {
+	tooBig := fmt.Errorf("%w: the archive is bigger than %d MB once uncompressed", errBadRequest, importMaxUncompressedSize>>20)
+	if f.UncompressedSize64 > uint64(*remaining) {
+		return nil, tooBig
+	}
+	rc, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid file %s in the zip", errBadRequest, f.Name)
+	}
+	defer rc.Close()
+	//the size in the header is written by who made the zip, the reader stops after the limit anyway
+	content, err := ioutil.ReadAll(io.LimitReader(rc, *remaining+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: invalid file %s in the zip", errBadRequest, f.Name)
+	}
+	if int64(len(content)) > *remaining {
+		return nil, tooBig
+	}
+	*remaining -= int64(len(content))
+	return content, nil
+}
+
+func readZipJSON(f *zip.File, remaining *int64, v interface{}) error {
+	content, err := readZipFile(f, remaining)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+//parseTweetsJS reads a file like: window.YTD.tweets.part0 = [{"tweet": {...}}, ...]
+func parseTweetsJS(content []byte) ([]importEntry, error) {
+	start := bytes.IndexByte(content, '[')
+	if start < 0 {
+		return nil, fmt.Errorf("%w: invalid tweets file", errBadRequest)
+	}
+	var raw []json.RawMessage
+	if err := json.Unmarshal(content[start:], &raw); err != nil {
+		return nil, fmt.Errorf("%w: invalid tweets file, %v", errBadRequest, err)
+	}
+
+	entries := make([]importEntry, 0, len(raw))
+	for i, r := range raw {
+		var wrapped struct {
+			Tweet *twitterTweet `json:"tweet"`
+		}
+		var tweet twitterTweet
+		if json.Unmarshal(r, &wrapped) == nil && wrapped.Tweet != nil {
+			tweet = *wrapped.Tweet
+		} else if err := json.Unmarshal(r, &tweet); err != nil {
+			entries = append(entries, importEntry{item: fmt.Sprintf("tweet #%d", i+1), skip: "invalid tweet: " + err.Error()})
+			continue
+		}
+
+		entry := importEntry{item: "tweet " + tweet.ID}
+		date, err := time.Parse(time.RubyDate, tweet.CreatedAt)
+		if err != nil {
+			entry.skip = "invalid date " + tweet.CreatedAt
+			entries = append(entries, entry)
+			continue
+		}
+		entry.addedDate = date
+		//the archive escapes the text like html and shortens the links with t.co
+		text := html.UnescapeString(tweet.FullText)
+		for _, u := range tweet.Entities.URLs {
+			if u.URL != "" && u.ExpandedURL != "" {
+				text = strings.Replace(text, u.URL, u.ExpandedURL, -1)
+			}
+		}
+		entry.content = text
+		if tweet.Retweeted || strings.HasPrefix(text, "RT @") {
+			entry.skip = "retweet"
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+//sortImportEntries puts the oldest first, so the ids of the imported blobs follow their dates
+func sortImportEntries(entries []importEntry) []importEntry {
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].addedDate.Before(entries[j].addedDate)
+	})
+	return entries
+}
+
+//* import
+
+//ImportArchive adds the blobs of the archive to the user, progress is called after every item.
+//The errors of a single blob are in its item and don't stop the import
+func (u User) ImportArchive(archive importSource, progress func(ImportItem)) ImportReport {
+	report := ImportReport{Format: archive.format, Total: len(archive.entries)}
+	for _, entry := range archive.entries {
+		item := ImportItem{Item: entry.item}
+		if entry.skip != "" {
+			item.Status, item.Error = importStatusSkipped, entry.skip
+			report.Skipped++
+		} else {
+			id, err := ImportBlob(u.ID, entry.content, entry.addedDate)
+			switch {
+			case errors.Is(err, errBadRequest):
+				item.Status, item.Error = importStatusSkipped, strings.TrimPrefix(err.Error(), "bad request: ")
+				report.Skipped++
+			case err != nil:
+				//the item is sent to the client, the error can have the details of the database
+				log.Printf("import of %s for user %d failed: %v", entry.item, u.ID, err)
+				item.Status, item.Error = importStatusFailed, "the blob could not be saved"
+				report.Failed++
+			case id == 0:
+				item.Status = importStatusDuplicate
+				report.Duplicates++
+			default:
+				item.Status, item.BlobID = importStatusImported, id
+				report.Imported++
+			}
+		}
+		if progress != nil {
+			progress(item)
+		}
+	}
+	return report
+}
+
+//* handler
+
+//importHandler takes the archive in the "archive" field of a multipart form and answers with a line
+//of ndjson for every item, the last line is the report: {"report": {...}}
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, importMaxUploadSize)
+	invalid := fmt.Sprintf("Invalid archive, expected a file of at most %d MB in the archive field", importMaxUploadSize>>20)
+	file, _, err := r.FormFile("archive")
+	if err != nil {
+		returnError(w, http.StatusBadRequest, invalid)
+		return
+	}
+	defer file.Close()
+	content, err := ioutil.ReadAll(file)
+	if err != nil {
+		returnError(w, http.StatusBadRequest, invalid)
+		return
+	}
+	//the archive is read before the stream starts, so its errors are normal responses
+	archive, err := readImportArchive(content)
+	if err != nil {
+		returnDomainError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	encoder := json.NewEncoder(w)
+
+	user := User{ID: jwtContent.UserID}
+	report := user.ImportArchive(archive, func(item ImportItem) {
+		encoder.Encode(item)
+		if flusher != nil {
+			flusher.Flush()
+		}
+	})
+	encoder.Encode(map[string]ImportReport{"report": report})
+}
+
+//* command
+
+//runImportCommand is blobber import -user <username> <archive>, it returns the exit code
+func runImportCommand(args []string, in io.Reader, out io.Writer) int {
+	flags := newCommandFlags("import", out)
+	username := flags.String("user", "", "username of the account that receives the blobs")
+	quiet := flags.Bool("quiet", false, "print only the report, not every item")
+	if !parseCommand(flags, args, 1) {
+		return 2
+	}
+	if *username == "" {
+		flags.Usage()
+		return 2
+	}
+
+	id, err := ResolveUsername(*username)
+	if err != nil {
+		fmt.Fprintf(out, "user %s not found: %v\n", *username, err)
+		return 1
+	}
+	content, err := ioutil.ReadFile(flags.Arg(0))
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+	archive, err := readImportArchive(content)
+	if err != nil {
+		fmt.Fprintln(out, err)
+		return 1
+	}
+
+	user := User{ID: id}
+	report := user.ImportArchive(archive, func(item ImportItem) {
+		if *quiet && item.Status != importStatusFailed {
+			return
+		}
+		line := item.Item + ": " + item.Status
+		if item.BlobID != 0 {
+			line += fmt.Sprintf(" (blob %d)", item.BlobID)
+		}
+		if item.Error != "" {
+			line += ", " + item.Error
+		}
+		fmt.Fprintln(out, line)
+	})
+	fmt.Fprintf(out, "%s archive: %d blobs, %d imported, %d duplicates, %d skipped, %d failed\n",
+		report.Format, report.Total, report.Imported, report.Duplicates, report.Skipped, report.Failed)
+	if report.Failed > 0 {
+		return 1
+	}
+	return 0
+}
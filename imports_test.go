@@ -0,0 +1,113 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"hash/crc32"
+	"io"
+	"strings"
+	"testing"
+)
+
+//zipFiles writes a zip with the files, a name ending with "!" is stored with a forged size of 1 TB
+func zipFiles(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		var w io.Writer
+		var err error
+		if strings.HasSuffix(name, "!") {
+			w, err = zw.CreateRaw(&zip.FileHeader{
+				Name:               strings.TrimSuffix(name, "!"),
+				Method:             zip.Store,
+				CRC32:              crc32.ChecksumIEEE([]byte(content)),
+				CompressedSize64:   uint64(len(content)),
+				UncompressedSize64: 1 << 40,
+			})
+		} else {
+			w, err = zw.Create(name)
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err = w.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestReadImportArchive(t *testing.T) {
+	manifest := `{"format": "blobber-export", "version": 1}`
+	blobs := `[{"id": 2, "content": "second", "added_date": "2022-09-02T12:00:00Z"},
+		{"id": 1, "content": "first", "added_date": "2022-09-01T12:00:00Z"}]`
+	tweets := `window.YTD.tweets.part0 = [{"tweet": {"id_str": "7", "full_text": "ciao &amp; https://t.co/x",
+		"created_at": "Wed Oct 10 20:19:24 +0000 2018", "entities": {"urls": [{"url": "https://t.co/x", "expanded_url": "https://go.dev"}]}}}]`
+
+	archive, err := readImportArchive(zipFiles(t, map[string]string{"manifest.json": manifest, "blobs.json": blobs}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if archive.format != importFormatBlobber || len(archive.entries) != 2 || archive.entries[0].content != "first" {
+		t.Errorf("blobber export read as %+v, want 2 blobs, the oldest first", archive)
+	}
+
+	archive, err = readImportArchive(zipFiles(t, map[string]string{"twitter/data/tweets.js": tweets}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if archive.format != importFormatTwitter || len(archive.entries) != 1 || archive.entries[0].content != "ciao & https://go.dev" {
+		t.Errorf("twitter archive read as %+v, want the tweet with the expanded link", archive)
+	}
+
+	tests := []struct {
+		name    string
+		archive []byte
+		msg     string
+	}{
+		{"not a zip", []byte("plain text"), "not a zip"},
+		{"unknown zip", zipFiles(t, map[string]string{"notes.txt": "ciao"}), "unknown archive"},
+		{"export without blobs", zipFiles(t, map[string]string{"manifest.json": manifest}), "missing"},
+		{"newer export", zipFiles(t, map[string]string{"manifest.json": `{"format": "blobber-export", "version": 99}`, "blobs.json": blobs}), "newer"},
+		{"blobs declared bigger than the limit", zipFiles(t, map[string]string{"manifest.json": manifest, "blobs.json!": blobs}), "bigger"},
+		{"tweets declared bigger than the limit", zipFiles(t, map[string]string{"data/tweets.js!": tweets}), "bigger"},
+	}
+	for _, tt := range tests {
+		if _, err = readImportArchive(tt.archive); !errors.Is(err, errBadRequest) || !strings.Contains(err.Error(), tt.msg) {
+			t.Errorf("%s: got %v, want a bad request about %q", tt.name, err, tt.msg)
+		}
+	}
+}
+
+func TestReadZipFileLimit(t *testing.T) {
+	archive := zipFiles(t, map[string]string{"a": "0123456789", "b": "0123456789"})
+	files, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	byName := map[string]*zip.File{}
+	for _, f := range files.File {
+		byName[f.Name] = f
+	}
+
+	//the files share the limit
+	remaining := int64(15)
+	if _, err = readZipFile(byName["a"], &remaining); err != nil || remaining != 5 {
+		t.Fatalf("first file: %v, %d remaining, want 5", err, remaining)
+	}
+	if _, err = readZipFile(byName["b"], &remaining); !errors.Is(err, errBadRequest) || !strings.Contains(err.Error(), "bigger") {
+		t.Errorf("second file over the limit: got %v, want a bad request", err)
+	}
+
+	//the size in the header can be smaller than the content
+	byName["a"].UncompressedSize64 = 1
+	remaining = 5
+	if _, err = readZipFile(byName["a"], &remaining); !errors.Is(err, errBadRequest) {
+		t.Errorf("file with a forged size: got %v, want a bad request", err)
+	}
+}
@@ -2,21 +2,37 @@ package main
 
 import (
 	"errors"
+	"net/http"
 	"time"
 
 	"github.com/dgrijalva/jwt-go"
 )
 
 type CustomClaims struct {
-	Username string `json:"username,omitempty"`
-	UserID   int    `json:"ID,omitempty"`
+	Username       string `json:"username,omitempty"`
+	UserID         int    `json:"ID,omitempty"`
+	SessionVersion int    `json:"session_version,omitempty"`
+	//tokens with a purpose are not sessions (es: "2fa" for the login waiting for the second factor)
+	Purpose string `json:"purpose,omitempty"`
+	//state of an oidc login, only for that purpose
+	Ceremony string `json:"ceremony,omitempty"`
+	//access tokens issued to the oauth apps, limited to the scopes of the grant
+	Scope   string `json:"scope,omitempty"`
+	GrantID int    `json:"grant_id,omitempty"`
 	jwt.StandardClaims
 }
 
-func NewCustomClaims(username string, userID int, expiration int64) CustomClaims {
+//how long a session lasts after the login
+const sessionDuration = time.Hour * time.Duration(2)
+
+//how long the user has to insert the second factor after the password
+const secondFactorDuration = time.Minute * time.Duration(5)
+
+func NewCustomClaims(username string, userID, sessionVersion int, expiration int64) CustomClaims {
 	token := CustomClaims{
-		Username: username,
-		UserID:   userID,
+		Username:       username,
+		UserID:         userID,
+		SessionVersion: sessionVersion,
 		StandardClaims: jwt.StandardClaims{
 			ExpiresAt: expiration,
 			Issuer:    "blobber",
@@ -33,11 +49,35 @@ func NewSignedToken(claim CustomClaims) (string, error) {
 	return token.SignedString([]byte(conf.Secret))
 }
 
-func NewJWT(username string, userID int, expiration int64) (string, error) {
-	claims := NewCustomClaims(username, userID, expiration)
+func NewJWT(username string, userID, sessionVersion int, expiration int64) (string, error) {
+	claims := NewCustomClaims(username, userID, sessionVersion, expiration)
 	return NewSignedToken(claims)
 }
 
+//newSession creates the jwt of the user and sets it as cookie and as Authorization header
+func newSession(w http.ResponseWriter, r *http.Request, user User) (string, error) {
+	//create a jwt with the info and the expiration time
+	expiration := time.Now().Add(sessionDuration)
+	token, err := NewJWT(user.Username, user.ID, user.SessionVersion, expiration.Unix())
+	if err != nil {
+		return "", err
+	}
+
+	//set the jwt even as a cookie, the scripts of the pages don't need to read it
+	cookie := &http.Cookie{
+		Name:     "JWT",
+		Value:    token,
+		Path:     "/",
+		Expires:  expiration,
+		HttpOnly: true,
+	}
+	setCookie(w, r, cookie)
+
+	//and as a header
+	w.Header().Add("Authorization", "Bearer "+token)
+	return token, nil
+}
+
 func ParseToken(t string) (CustomClaims, error) {
 	token, err := jwt.ParseWithClaims(
 		t,
@@ -60,3 +100,24 @@ func ParseToken(t string) (CustomClaims, error) {
 	}
 	return *claims, nil
 }
+
+//newSecondFactorToken sets the cookie that proves that the password of the user was correct,
+//it's exchanged for a session once the second factor is verified
+func newSecondFactorToken(w http.ResponseWriter, r *http.Request, user User) error {
+	expiration := time.Now().Add(secondFactorDuration)
+	claims := NewCustomClaims(user.Username, user.ID, user.SessionVersion, expiration.Unix())
+	claims.Purpose = "2fa"
+	token, err := NewSignedToken(claims)
+	if err != nil {
+		return err
+	}
+
+	setCookie(w, r, &http.Cookie{
+		Name:     "2FA",
+		Value:    token,
+		Path:     "/login",
+		Expires:  expiration,
+		HttpOnly: true,
+	})
+	return nil
+}
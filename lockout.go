@@ -0,0 +1,259 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+//failed logins: after a few failures every attempt has to wait more, after too many the
+//account (or the ip) is locked for a while
+const (
+	//only the failures of the last minutes are counted
+	loginFailuresWindow = time.Minute * time.Duration(15)
+	//failures allowed before the delays start, then the delay doubles at every failure
+	loginDelayAfter = 3
+	loginMaxDelay   = time.Minute
+	//failures that lock the account or the ip
+	accountLockoutFailures = 10
+	ipLockoutFailures      = 30
+	lockoutDuration        = time.Minute * time.Duration(15)
+
+	//the device cookie identifies the browser to notice the logins from new devices
+	deviceCookieDuration = time.Hour * 24 * 365
+)
+
+//LoginAttempt is an entry of the login history of the user
+type LoginAttempt struct {
+	Time      time.Time `json:"time"`
+	IP        string    `json:"ip"`
+	UserAgent string    `json:"user_agent"`
+	//password, 2fa, passkey or oidc
+	Method    string `json:"method"`
+	Success   bool   `json:"success"`
+	NewDevice bool   `json:"new_device"`
+}
+
+//loginDelay returns how long the next attempt has to wait given the failures and the time of the last one
+func loginDelay(failures int, last time.Time, lockAt int, now time.Time) time.Duration {
+	var wait time.Duration
+	switch {
+	case failures >= lockAt:
+		wait = lockoutDuration
+	case failures >= loginDelayAfter:
+		wait = time.Second * time.Duration(math.Pow(2, float64(failures-loginDelayAfter)))
+		if wait > loginMaxDelay {
+			wait = loginMaxDelay
+		}
+	default:
+		return 0
+	}
+
+	wait = last.Add(wait).Sub(now)
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+//loginWait returns how long the client has to wait before trying to login again on the account,
+//the failures of the account are counted since its last successful login
+func loginWait(userID int, ip string, now time.Time) (time.Duration, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	since := now.Add(-loginFailuresWindow)
+	var failures int
+	var last sql.NullTime
+	var wait time.Duration
+
+	err = db.QueryRow("SELECT COUNT(*), MAX(added_date) FROM login_attempts WHERE ip = ? AND NOT success AND added_date > ?", ip, since).Scan(&failures, &last)
+	if err != nil {
+		return 0, err
+	}
+	if last.Valid {
+		wait = loginDelay(failures, last.Time, ipLockoutFailures, now)
+	}
+
+	if userID == 0 {
+		return wait, nil
+	}
+	err = db.QueryRow(`SELECT COUNT(*), MAX(added_date) FROM login_attempts WHERE ID_user = ? AND NOT success AND added_date > ?
+		AND added_date > IFNULL((SELECT MAX(added_date) FROM login_attempts WHERE ID_user = ? AND success), '1970-01-01')`,
+		userID, since, userID).Scan(&failures, &last)
+	if err != nil {
+		return 0, err
+	}
+	if last.Valid {
+		if accountWait := loginDelay(failures, last.Time, accountLockoutFailures, now); accountWait > wait {
+			wait = accountWait
+		}
+	}
+	return wait, nil
+}
+
+func recordLoginAttempt(userID int, username string, r *http.Request, method string, success, newDevice bool) error {
+	db, err := connectToDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var id sql.NullInt64
+	if userID != 0 {
+		id = sql.NullInt64{Int64: int64(userID), Valid: true}
+	}
+	userAgent := r.UserAgent()
+	if len(userAgent) > 255 {
+		userAgent = userAgent[:255]
+	}
+	_, err = db.Exec("INSERT INTO login_attempts (ID_user, username, ip, user_agent, method, success, new_device, added_date) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		id, username, rateLimiter.clientIP(r), userAgent, method, success, newDevice, time.Now())
+	return err
+}
+
+//throttleLogin answers 429 if the client has to wait before trying again, it returns false in that case
+func throttleLogin(w http.ResponseWriter, r *http.Request, userID int) bool {
+	wait, err := loginWait(userID, rateLimiter.clientIP(r), time.Now())
+	if err != nil {
+		//the login works even if the attempts can't be read
+		log.Printf("login throttle check failed: %v", err)
+		return true
+	}
+	if wait > 0 {
+		seconds := int(math.Ceil(wait.Seconds()))
+		w.Header().Set("Retry-After", strconv.Itoa(seconds))
+		returnError(w, http.StatusTooManyRequests, fmt.Sprintf("Too many failed attempts, try again in %d seconds", seconds))
+		return false
+	}
+	return true
+}
+
+//failLogin records a failed attempt, the unknown usernames are recorded too to limit the ip
+func failLogin(r *http.Request, userID int, username, method string) {
+	if err := recordLoginAttempt(userID, username, r, method, false, false); err != nil {
+		log.Printf("failed login not recorded: %v", err)
+	}
+}
+
+//knownDevice checks the device of the request and registers it, it returns false the first time the
+//user logs in from the device, a user without devices (first login) has no new devices
+func knownDevice(w http.ResponseWriter, r *http.Request, userID int) (bool, error) {
+	device := ""
+	if cookie, err := r.Cookie("DEVICE"); err == nil {
+		device = cookie.Value
+	}
+	if device == "" {
+		var err error
+		if device, err = randomToken(); err != nil {
+			return false, err
+		}
+	}
+	setCookie(w, r, &http.Cookie{
+		Name:     "DEVICE",
+		Value:    device,
+		Path:     "/",
+		Expires:  time.Now().Add(deviceCookieDuration),
+		HttpOnly: true,
+	})
+
+	db, err := connectToDB()
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	var known, total int
+	err = db.QueryRow("SELECT IFNULL(SUM(device = ?), 0), COUNT(*) FROM known_devices WHERE ID_user = ?", hashToken(device), userID).Scan(&known, &total)
+	if err != nil {
+		return false, err
+	}
+	if known > 0 {
+		_, err = db.Exec("UPDATE known_devices SET last_used = NOW() WHERE ID_user = ? AND device = ?", userID, hashToken(device))
+		return true, err
+	}
+
+	_, err = db.Exec("INSERT INTO known_devices (ID_user, device) VALUES (?, ?)", userID, hashToken(device))
+	return total == 0, err
+}
+
+//completeLogin creates the session of the user and records the login, the user gets an email
+//when the login comes from a new device
+func completeLogin(w http.ResponseWriter, r *http.Request, user User, method string) error {
+	if _, err := newSession(w, r, user); err != nil {
+		return err
+	}
+
+	known, err := knownDevice(w, r, user.ID)
+	if err != nil {
+		log.Printf("device check of user %d failed: %v", user.ID, err)
+		known = true
+	}
+	if err = recordLoginAttempt(user.ID, user.Username, r, method, true, !known); err != nil {
+		log.Printf("login of user %d not recorded: %v", user.ID, err)
+	}
+
+	if !known && user.Email != "" && user.EmailVerified {
+		body := fmt.Sprintf("Ciao %s,\nè stato effettuato un accesso al tuo account da un nuovo dispositivo:\n\nData: %s\nIP: %s\nBrowser: %s\n\nSe non sei stato tu cambia subito la password dalle impostazioni.",
+			user.Username, time.Now().Format("02/01/2006 15:04"), rateLimiter.clientIP(r), r.UserAgent())
+		if err = mailer.Send(user.Email, "Nuovo accesso al tuo account blobber", body); err != nil {
+			log.Printf("new device email to user %d not sent: %v", user.ID, err)
+		}
+	}
+	return nil
+}
+
+func (u User) GetLoginHistory(limit int) ([]LoginAttempt, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return []LoginAttempt{}, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT added_date, ip, user_agent, method, success, new_device FROM login_attempts WHERE ID_user = ? ORDER BY added_date DESC LIMIT ?", u.ID, limit)
+	if err != nil {
+		return []LoginAttempt{}, err
+	}
+	defer rows.Close()
+
+	var attempts []LoginAttempt
+	for rows.Next() {
+		var a LoginAttempt
+		if err = rows.Scan(&a.Time, &a.IP, &a.UserAgent, &a.Method, &a.Success, &a.NewDevice); err != nil {
+			return []LoginAttempt{}, err
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+//* login history's handlers
+func loginHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	user, err := QueryUserByID(jwtContent.UserID, 0)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	attempts, err := user.GetLoginHistory(50)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+	attemptsJson, _ := json.Marshal(attempts)
+	returnSuccessJson(w, http.StatusOK, "Login history found", "logins", attemptsJson)
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoginDelay(t *testing.T) {
+	last := time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		failures int
+		elapsed  time.Duration
+		want     time.Duration
+	}{
+		{0, 0, 0},
+		{loginDelayAfter - 1, 0, 0},
+		//the delay doubles at every failure
+		{loginDelayAfter, 0, time.Second},
+		{loginDelayAfter + 1, 0, 2 * time.Second},
+		{loginDelayAfter + 2, 0, 4 * time.Second},
+		{loginDelayAfter + 5, 0, 32 * time.Second},
+		{accountLockoutFailures - 1, 0, loginMaxDelay},
+		//the time passed since the last failure is subtracted
+		{loginDelayAfter + 2, 3 * time.Second, time.Second},
+		{loginDelayAfter + 2, 5 * time.Second, 0},
+		//lockout
+		{accountLockoutFailures, 0, lockoutDuration},
+		{accountLockoutFailures + 5, time.Minute, lockoutDuration - time.Minute},
+		{accountLockoutFailures, lockoutDuration + time.Second, 0},
+	}
+	for _, tt := range tests {
+		if got := loginDelay(tt.failures, last, accountLockoutFailures, last.Add(tt.elapsed)); got != tt.want {
+			t.Errorf("%d failures, %s after the last: %s, want %s", tt.failures, tt.elapsed, got, tt.want)
+		}
+	}
+	//the ip is locked after more failures than an account
+	if got := loginDelay(accountLockoutFailures, last, ipLockoutFailures, last); got != loginMaxDelay {
+		t.Errorf("ip with %d failures: %s, want %s", accountLockoutFailures, got, loginMaxDelay)
+	}
+}
+
+//loginRequest is a login from the ip, with the device cookie if not empty
+func loginRequest(ip, device string) *http.Request {
+	r := httptest.NewRequest("POST", login.String(), nil)
+	r.RemoteAddr = ip + ":1234"
+	if device != "" {
+		r.AddCookie(&http.Cookie{Name: "DEVICE", Value: device})
+	}
+	return r
+}
+
+//testIP returns a random ip, so the failures of the other runs on the same database aren't counted
+func testIP(t *testing.T) string {
+	t.Helper()
+	b := make([]byte, 3)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("10.%d.%d.%d", b[0], b[1], b[2])
+}
+
+func TestLoginLockout(t *testing.T) {
+	user := newTestUser(t)
+	verifyTestEmail(t, &user, user.Username+"@example.com")
+	mails := useTestMailer(t)
+	ip := testIP(t)
+
+	wait := func(userID int, ip string) time.Duration {
+		t.Helper()
+		wait, err := loginWait(userID, ip, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return wait
+	}
+
+	for i := 0; i < loginDelayAfter; i++ {
+		failLogin(loginRequest(ip, ""), user.ID, user.Username, "password")
+	}
+	//the dates are saved with a precision of a second
+	if got := wait(user.ID, ip); got <= 0 || got > 2*time.Second {
+		t.Errorf("wait after %d failures: %s, want about a second", loginDelayAfter, got)
+	}
+	for i := loginDelayAfter; i < accountLockoutFailures; i++ {
+		failLogin(loginRequest(ip, ""), user.ID, user.Username, "password")
+	}
+	if got := wait(user.ID, ip); got < lockoutDuration-2*time.Second {
+		t.Errorf("wait after %d failures: %s, want the lockout", accountLockoutFailures, got)
+	}
+	//the account is locked from every ip, the ip isn't locked for the other accounts yet
+	if got := wait(user.ID, testIP(t)); got < lockoutDuration-2*time.Second {
+		t.Errorf("wait of the account from another ip: %s, want the lockout", got)
+	}
+	if got := wait(0, ip); got < loginMaxDelay-2*time.Second || got > loginMaxDelay+time.Second {
+		t.Errorf("wait of the ip for another account: %s, want the max delay", got)
+	}
+
+	//a successful login resets the failures of the account, the first device isn't new
+	w := httptest.NewRecorder()
+	if err := completeLogin(w, loginRequest(testIP(t), ""), user, "passkey"); err != nil {
+		t.Fatal(err)
+	}
+	if got := wait(user.ID, testIP(t)); got != 0 {
+		t.Errorf("wait after a successful login: %s, want 0", got)
+	}
+	var device string
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.Name == "DEVICE" {
+			device = cookie.Value
+		}
+	}
+	if device == "" {
+		t.Fatal("device cookie not set")
+	}
+
+	//the known device doesn't send the email, a new one does
+	if err := completeLogin(httptest.NewRecorder(), loginRequest(testIP(t), device), user, "password"); err != nil {
+		t.Fatal(err)
+	}
+	if sent := mails.sent(); len(sent) != 0 {
+		t.Fatalf("emails after the logins from the known device: %+v, want none", sent)
+	}
+	if err := completeLogin(httptest.NewRecorder(), loginRequest(testIP(t), ""), user, "password"); err != nil {
+		t.Fatal(err)
+	}
+	if sent := mails.sent(); len(sent) != 1 || sent[0].to != user.Email || !strings.Contains(sent[0].body, "nuovo dispositivo") {
+		t.Errorf("emails after the login from a new device: %+v, want 1 to %s", sent, user.Email)
+	}
+
+	history, err := user.GetLoginHistory(20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the attempts of the same second have no order
+	var successes, newDevices int
+	for _, attempt := range history {
+		if attempt.Success {
+			successes++
+		}
+		if attempt.NewDevice {
+			newDevices++
+		}
+	}
+	if len(history) != accountLockoutFailures+3 || successes != 3 || newDevices != 1 {
+		t.Errorf("login history %+v, want %d attempts, 3 successful and 1 from a new device", history, accountLockoutFailures+3)
+	}
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Mailer sends the emails to the users (verification links, password resets, ...)
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+type MailerConfig struct {
+	//smtp, file or log (default)
+	Type     string `yaml:"type"`
+	Host     string `yaml:"host"`
+	Port     string `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	From     string `yaml:"from"`
+	//file where the file mailer appends the emails
+	Path string `yaml:"path"`
+}
+
+//the mailer used by the handlers, created in main
+var mailer Mailer
+
+//SMTPMailer sends the emails with an smtp server, the auth is used only if the username is set
+type SMTPMailer struct {
+	Host     string
+	Port     string
+	Username string
+	Password string
+	From     string
+}
+
+func (m SMTPMailer) Send(to, subject, body string) error {
+	var auth smtp.Auth
+	if m.Username != "" {
+		auth = smtp.PlainAuth("", m.Username, m.Password, m.Host)
+	}
+	return smtp.SendMail(m.Host+":"+m.Port, auth, m.From, []string{to}, buildMessage(m.From, to, subject, body))
+}
+
+//FileMailer appends the emails to a file, useful for local development and tests
+type FileMailer struct {
+	Path string
+	From string
+
+	mu sync.Mutex
+}
+
+func (m *FileMailer) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	f, err := os.OpenFile(m.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = f.Write(append(buildMessage(m.From, to, subject, body), []byte("\r\n\r\n")...))
+	return err
+}
+
+//LogMailer only logs that an email would have been sent, the body is never logged since it contains
+//the tokens of the links (password resets, ...). To read the emails in development use the file mailer
+type LogMailer struct{}
+
+func (LogMailer) Send(to, subject, body string) error {
+	log.Printf("mail to %s, subject %q not sent, no mailer configured", to, subject)
+	return nil
+}
+
+func buildMessage(from, to, subject, body string) []byte {
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=\"utf-8\"\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+	return []byte(msg.String())
+}
+
+//NewMailer creates the mailer described by the config, without a type the emails are not sent
+func NewMailer(c MailerConfig) (Mailer, error) {
+	from := c.From
+	if from == "" {
+		from = "blobber@localhost"
+	}
+
+	switch c.Type {
+	case "smtp":
+		if c.Host == "" {
+			return nil, fmt.Errorf("the smtp mailer needs an host")
+		}
+		port := c.Port
+		if port == "" {
+			port = "587"
+		}
+		return SMTPMailer{Host: c.Host, Port: port, Username: c.Username, Password: c.Password, From: from}, nil
+	case "file":
+		if c.Path == "" {
+			return nil, fmt.Errorf("the file mailer needs a path")
+		}
+		return &FileMailer{Path: c.Path, From: from}, nil
+	case "", "log":
+		return LogMailer{}, nil
+	}
+	return nil, fmt.Errorf("unknown mailer type %s", c.Type)
+}
@@ -1,25 +1,35 @@
 package main
 
 import (
-	"crypto/sha256"
+	"database/sql"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
 	"strconv"
-	"time"
+	"strings"
 
 	"github.com/gorilla/mux"
 )
 
 type Post struct {
-	Username string `json:"username,omitempty"`
-	Password string `json:"password,omitempty"`
-	Content  string `json:"content,omitempty"`
+	Username    string `json:"username,omitempty"`
+	Password    string `json:"password,omitempty"`
+	NewPassword string `json:"new_password,omitempty"`
+	Email       string `json:"email,omitempty"`
+	Token       string `json:"token,omitempty"`
+	Code        string `json:"code,omitempty"`
+	Content     string `json:"content,omitempty"`
 }
 
+//computes the trends in background, created in main
+var trendingService *TrendingService
+
 //* middlewares
 //functions in golang can take functions as parameters
 //the middleware function is executed before the handler function, basically it's a wrapper
@@ -29,14 +39,14 @@ type Post struct {
 func JWTAuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// log.Println(r.Method, r.RequestURI)
-		//check if the cookie "JWT" exists
-		_, err := r.Cookie("JWT")
+		//check if the cookie "JWT" (or the Authorization header of the oauth apps) exists
+		_, err := requestToken(r)
 		if err != nil {
 			// OLD: if err is not nil it means that the cookie was not found so we return a 401 unauthorized
 			// returnError(w, http.StatusUnauthorized, "missing 'JWT' cookie")
 
-			//if err is not nil then redirect to login page
-			http.Redirect(w, r, "/login", http.StatusSeeOther)
+			//if err is not nil then redirect to login page, the page comes back here after the login
+			http.Redirect(w, r, "/login?next="+url.QueryEscape(r.RequestURI), http.StatusSeeOther)
 			return
 		} else {
 			next(w, r)
@@ -45,20 +55,47 @@ func JWTAuthMiddleware(next http.HandlerFunc) http.HandlerFunc {
 }
 
 //* generic's handlers
+//return a script from pages/scripts, only the file name is used so it can't escape the folder
+func scriptsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	name := filepath.Base(mux.Vars(r)["name"])
+	if filepath.Ext(name) != ".js" {
+		returnError(w, http.StatusNotFound, "Script not found")
+		return
+	}
+
+	script, err := ioutil.ReadFile(filepath.Join("pages", "scripts", name))
+	if err != nil {
+		returnError(w, http.StatusNotFound, "Script not found")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/javascript")
+	w.Write(script)
+}
+
 //return the login html page
 func loginPage(w http.ResponseWriter, r *http.Request) {
 	log.Println(r.Method, r.RequestURI)
-	//read the file
-	page, err := ioutil.ReadFile("pages/login.html")
+	//the single sign-on button is shown only if an identity provider is configured
+	data := struct {
+		OIDC     bool
+		OIDCName string
+	}{}
+	if oidcLogin != nil {
+		data.OIDC = true
+		data.OIDCName = oidcLogin.Name()
+	}
+
+	tmpl, err := template.ParseFiles("pages/login.html")
 	if err != nil {
-		//check for possible errors, if so return 503
-		returnError(w, http.StatusServiceUnavailable, "error, reason: "+err.Error())
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
 		return
 	}
 
-	//set the content type and write the file
+	//set the content type and write the page
 	w.Header().Set("Content-Type", "text/html")
-	w.Write(page)
+	tmpl.Execute(w, data)
 }
 
 func loginHandler(w http.ResponseWriter, r *http.Request) {
@@ -68,55 +105,205 @@ func loginHandler(w http.ResponseWriter, r *http.Request) {
 	err := json.NewDecoder(r.Body).Decode(&post)
 	if err != nil {
 		//check for errors, if so return 400
-		returnError(w, http.StatusBadRequest, "Invalid json, "+err.Error())
+		returnError(w, http.StatusBadRequest, "Invalid json")
 		return
 	}
 
-	//hash the password with sha256
-	hashedPassword := sha256.Sum256([]byte(post.Password))
 	user, err := QueryUserByUsername(post.Username, 0)
+	if err == sql.ErrNoRows {
+		//the attempts on unknown usernames count for the ip
+		if throttleLogin(w, r, 0) {
+			failLogin(r, 0, post.Username, "password")
+			returnError(w, http.StatusUnauthorized, "Invalid credentials")
+		}
+		return
+	}
 	if err != nil {
 		//internal server error
 		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
 		return
 	}
-	if user.Password == fmt.Sprintf("%x", hashedPassword) {
-		//create a jwt with the info and the expiration time
-		token, err := NewJWT(user.Username, user.ID, time.Now().Add(time.Hour*time.Duration(2)).Unix())
-		if err != nil {
-			returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+
+	//after too many failures the password is not even checked
+	if !throttleLogin(w, r, user.ID) {
+		return
+	}
+	if user.Password == hashPassword(post.Password) {
+		//with the two factor authentication the session is created only after the code is verified
+		if user.TOTPEnabled {
+			err = newSecondFactorToken(w, r, user)
+			if err != nil {
+				returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+				return
+			}
+			returnSuccessJson(w, http.StatusOK, "Second factor required", "two_factor", []byte("true"))
 			return
 		}
 
-		//set the jwt even as a cookie
-		cookie := &http.Cookie{
-			Name:     "JWT",
-			Value:    token,
-			Path:     "/",
-			Expires:  time.Now().Add(time.Hour * time.Duration(2)),
-			HttpOnly: false,
+		//set the jwt as cookie and header
+		err := completeLogin(w, r, user, "password")
+		if err != nil {
+			returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+			return
 		}
 
 		user.Password = "-hidden-"
 		userJson, _ := json.Marshal(user)
-
-		http.SetCookie(w, cookie)
-		//and as a header
-		w.Header().Add("Authorization", "Bearer "+token)
 		returnSuccessJson(w, http.StatusOK, "Successfully logged in", "user", userJson)
 		return
 	}
 	//return unauthorized
+	failLogin(r, user.ID, user.Username, "password")
 	returnError(w, http.StatusUnauthorized, "Invalid credentials")
 }
 
+//logoutHandler deletes the session cookie, the scripts of the pages can't do it since it's HttpOnly
+func logoutHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	setCookie(w, r, &http.Cookie{Name: "JWT", Value: "", Path: "/", MaxAge: -1, HttpOnly: true})
+	returnSuccess(w, http.StatusOK, "Successfully logged out")
+}
+
+func forgotPasswordPage(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	//read the file
+	page, err := ioutil.ReadFile("pages/forgot.html")
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	//set the content type and write the file
+	w.Header().Set("Content-Type", "text/html")
+	w.Write(page)
+}
+
+func forgotPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	var post Post
+	err := json.NewDecoder(r.Body).Decode(&post)
+	if err != nil {
+		returnError(w, http.StatusBadRequest, "Invalid json")
+		return
+	}
+
+	//the response is the same whether the user exists or not, so it can't be used to find the accounts
+	const msg = "if the account exists and has a verified email a reset link has been sent"
+	user, token, err := RequestPasswordReset(post.Username)
+	if err == sql.ErrNoRows {
+		returnSuccess(w, http.StatusOK, msg)
+		return
+	}
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	link := publicURL(resetPassword.String() + "?token=" + token)
+	err = mailer.Send(user.Email, "Reimposta la tua password di blobber", "Ciao "+user.Username+",\napri questo link per scegliere una nuova password:\n"+link+"\n\nIl link scade tra un'ora, se non hai chiesto tu il reset ignora questa email.")
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	returnSuccess(w, http.StatusOK, msg)
+}
+
+func resetPasswordPage(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	//read the file
+	page, err := ioutil.ReadFile("pages/reset.html")
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	//set the content type and write the file
+	w.Header().Set("Content-Type", "text/html")
+	w.Write(page)
+}
+
+func resetPasswordHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	var post Post
+	err := json.NewDecoder(r.Body).Decode(&post)
+	if err != nil {
+		returnError(w, http.StatusBadRequest, "Invalid json")
+		return
+	}
+
+	err = ResetPassword(post.Token, post.NewPassword)
+	if err != nil {
+		returnDomainError(w, err)
+		return
+	}
+
+	returnSuccess(w, http.StatusOK, "password changed successfully, you can now login")
+}
+
+//second step of the login for the users with the two factor authentication,
+//the 2FA cookie set by the login proves that the password was correct
+func secondFactorHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	cookie, err := r.Cookie("2FA")
+	if err != nil {
+		returnError(w, http.StatusUnauthorized, "Login expired, insert again username and password")
+		return
+	}
+
+	claims, err := ParseToken(cookie.Value)
+	if err != nil || claims.Purpose != "2fa" {
+		returnError(w, http.StatusUnauthorized, "Login expired, insert again username and password")
+		return
+	}
+
+	var post Post
+	err = json.NewDecoder(r.Body).Decode(&post)
+	if err != nil {
+		returnError(w, http.StatusBadRequest, "Invalid json")
+		return
+	}
+
+	user, err := QueryUserByID(claims.UserID, 0)
+	if err != nil || user.SessionVersion != claims.SessionVersion {
+		returnError(w, http.StatusUnauthorized, "Login expired, insert again username and password")
+		return
+	}
+
+	if !throttleLogin(w, r, user.ID) {
+		return
+	}
+
+	ok, err := user.VerifySecondFactor(post.Code)
+	if err != nil {
+		returnDomainError(w, err)
+		return
+	}
+	if !ok {
+		failLogin(r, user.ID, user.Username, "2fa")
+		returnError(w, http.StatusUnauthorized, "Invalid code")
+		return
+	}
+
+	//the 2FA cookie is not needed anymore
+	setCookie(w, r, &http.Cookie{Name: "2FA", Value: "", Path: "/login", MaxAge: -1, HttpOnly: true})
+	err = completeLogin(w, r, user, "2fa")
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	user.Password = "-hidden-"
+	userJson, _ := json.Marshal(user)
+	returnSuccessJson(w, http.StatusOK, "Successfully logged in", "user", userJson)
+}
+
 func registerPage(w http.ResponseWriter, r *http.Request) {
 	log.Println(r.Method, r.RequestURI)
 	//read the file
 	page, err := ioutil.ReadFile("pages/register.html")
 	if err != nil {
-		//check for possible errors, if so return 503
-		returnError(w, http.StatusServiceUnavailable, "error, reason: "+err.Error())
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
 		return
 	}
 
@@ -132,15 +319,14 @@ func registerHandler(w http.ResponseWriter, r *http.Request) {
 	err := json.NewDecoder(r.Body).Decode(&post)
 	if err != nil {
 		//check for errors, if so return 400
-		returnError(w, http.StatusBadRequest, "Invalid json, "+err.Error())
+		returnError(w, http.StatusBadRequest, "Invalid json")
 		return
 	}
 
 	//hash the password with sha256
-	hashedPassword := fmt.Sprintf("%x", sha256.Sum256([]byte(post.Password)))
-	err = AddUser(post.Username, hashedPassword, "")
+	err = AddUser(post.Username, hashPassword(post.Password), "")
 	if err != nil {
-		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		returnDomainError(w, err)
 		return
 	}
 
@@ -156,7 +342,7 @@ func homePage(w http.ResponseWriter, r *http.Request) {
 
 	user, err := QueryUserByID(jwtContent.UserID, 0)
 	if err != nil {
-		returnError(w, http.StatusBadRequest, "User not found, error: "+err.Error())
+		returnDomainError(w, err)
 		return
 	}
 
@@ -172,7 +358,7 @@ func homePage(w http.ResponseWriter, r *http.Request) {
 
 	tmpl, err := template.ParseFiles("pages/home.html")
 	if err != nil {
-		returnError(w, http.StatusServiceUnavailable, "Internal server error: "+err.Error())
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
 		return
 	}
 
@@ -184,8 +370,7 @@ func searchPageHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println(r.Method, r.RequestURI)
 	page, err := ioutil.ReadFile("pages/search.html")
 	if err != nil {
-		//check for possible errors, if so return 503
-		returnError(w, http.StatusServiceUnavailable, "error, reason: "+err.Error())
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
 		return
 	}
 
@@ -244,7 +429,7 @@ func userPageHandler(w http.ResponseWriter, r *http.Request) {
 
 	tmpl, err := template.ParseFiles("pages/user.html")
 	if err != nil {
-		returnError(w, http.StatusServiceUnavailable, "Internal server error: "+err.Error())
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
 		return
 	}
 
@@ -252,6 +437,333 @@ func userPageHandler(w http.ResponseWriter, r *http.Request) {
 	tmpl.Execute(w, data)
 }
 
+//return the cached trends of a window (?window=24h), the default window is 24h
+func trendingHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	window := r.URL.Query().Get("window")
+	if window == "" {
+		window = "24h"
+	}
+
+	if !trendingService.HasWindow(window) {
+		returnError(w, http.StatusBadRequest, "Unknown window "+window)
+		return
+	}
+
+	trends, ok := trendingService.Get(window)
+	if !ok {
+		//the first refresh is still running
+		returnError(w, http.StatusServiceUnavailable, "Trends not computed yet, retry later")
+		return
+	}
+
+	trendsJSON, _ := json.Marshal(trends)
+	returnSuccessJson(w, http.StatusOK, "Successfully retrieved trends", "trending", trendsJSON)
+}
+
+//* settings's handlers
+func settingsPageHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	user, err := QueryUserByID(jwtContent.UserID, 0)
+	if err != nil {
+		returnDomainError(w, err)
+		return
+	}
+
+	data := struct {
+		ID            int
+		Username      string
+		Email         string
+		EmailVerified bool
+		TwoFactor     bool
+		HasPassword   bool
+		OIDC          bool
+		OIDCName      string
+		OIDCLinked    bool
+		WebhookAdmin  bool
+		Federation    string
+	}{
+		ID:            user.ID,
+		Username:      user.Username,
+		Email:         user.Email,
+		EmailVerified: user.EmailVerified,
+		TwoFactor:     user.TOTPEnabled,
+		HasPassword:   user.Password != "",
+		WebhookAdmin:  isWebhookAdmin(user.ID),
+	}
+
+	//the handle the users of the other servers use to follow the user
+	if federation != nil {
+		data.Federation = user.Username + "@" + federation.host
+	}
+
+	if oidcLogin != nil {
+		data.OIDC = true
+		data.OIDCName = oidcLogin.Name()
+		identities, err := user.GetOIDCIdentities()
+		if err != nil {
+			returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+			return
+		}
+		for _, i := range identities {
+			if i.Issuer == oidcLogin.config.Issuer {
+				data.OIDCLinked = true
+			}
+		}
+	}
+
+	tmpl, err := template.ParseFiles("pages/settings.html")
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	tmpl.Execute(w, data)
+}
+
+func changeUsernameHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	var post Post
+	err = json.NewDecoder(r.Body).Decode(&post)
+	if err != nil {
+		returnError(w, http.StatusBadRequest, "Invalid json")
+		return
+	}
+
+	user, err := QueryUserByID(jwtContent.UserID, 0)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	err = user.ChangeUsername(post.Username)
+	if err != nil {
+		returnDomainError(w, err)
+		return
+	}
+
+	//the username is saved in the jwt so a new one is needed
+	_, err = newSession(w, r, user)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	returnSuccess(w, http.StatusOK, "username changed successfully")
+}
+
+func changePasswordHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	var post Post
+	err = json.NewDecoder(r.Body).Decode(&post)
+	if err != nil {
+		returnError(w, http.StatusBadRequest, "Invalid json")
+		return
+	}
+
+	user, err := QueryUserByID(jwtContent.UserID, 0)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	err = user.ChangePassword(post.Password, post.NewPassword)
+	if err == errWrongPassword {
+		returnError(w, http.StatusUnauthorized, "The current password is wrong")
+		return
+	}
+	if err != nil {
+		returnDomainError(w, err)
+		return
+	}
+
+	//all the other sessions are revoked, the current one gets a new jwt
+	_, err = newSession(w, r, user)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	returnSuccess(w, http.StatusOK, "password changed successfully, the other sessions have been logged out")
+}
+
+func changeEmailHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	var post Post
+	err = json.NewDecoder(r.Body).Decode(&post)
+	if err != nil {
+		returnError(w, http.StatusBadRequest, "Invalid json")
+		return
+	}
+
+	user, err := QueryUserByID(jwtContent.UserID, 0)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	token, err := user.SetEmail(post.Email)
+	if err != nil {
+		returnDomainError(w, err)
+		return
+	}
+
+	link := publicURL(strings.Replace(verifyEmail.String(), "{token}", token, 1))
+	err = mailer.Send(user.Email, "Verifica la tua email su blobber", "Ciao "+user.Username+",\napri questo link per verificare la tua email:\n"+link+"\n\nIl link scade tra 24 ore.")
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	returnSuccess(w, http.StatusOK, "email saved, open the link sent to verify it")
+}
+
+func verifyEmailHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	_, err := VerifyEmail(mux.Vars(r)["token"])
+	if err != nil {
+		returnError(w, http.StatusBadRequest, "Invalid or expired verification link")
+		return
+	}
+
+	http.Redirect(w, r, settingsPage.String(), http.StatusSeeOther)
+}
+
+func enrollTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	user, err := QueryUserByID(jwtContent.UserID, 0)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	secret, err := user.BeginTOTPEnrollment()
+	if err != nil {
+		returnDomainError(w, err)
+		return
+	}
+
+	enrollment, _ := json.Marshal(map[string]string{
+		"secret": secret,
+		"uri":    totpURI(secret, user.Username),
+	})
+	returnSuccessJson(w, http.StatusOK, "scan the qr code and confirm with a code", "totp", enrollment)
+}
+
+func confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	var post Post
+	err = json.NewDecoder(r.Body).Decode(&post)
+	if err != nil {
+		returnError(w, http.StatusBadRequest, "Invalid json")
+		return
+	}
+
+	user, err := QueryUserByID(jwtContent.UserID, 0)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	codes, err := user.ConfirmTOTP(post.Code)
+	if err != nil {
+		returnDomainError(w, err)
+		return
+	}
+
+	codesJSON, _ := json.Marshal(codes)
+	returnSuccessJson(w, http.StatusOK, "two factor authentication enabled, save the recovery codes", "recovery_codes", codesJSON)
+}
+
+//disabling the two factor authentication needs both the password and a code, the accounts created
+//with a passkey have no password so for them the code is enough
+func disableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	var post Post
+	err = json.NewDecoder(r.Body).Decode(&post)
+	if err != nil {
+		returnError(w, http.StatusBadRequest, "Invalid json")
+		return
+	}
+
+	user, err := QueryUserByID(jwtContent.UserID, 0)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	if user.Password != "" && hashPassword(post.Password) != user.Password {
+		returnError(w, http.StatusUnauthorized, "The password is wrong")
+		return
+	}
+
+	ok, err := user.VerifySecondFactor(post.Code)
+	if err != nil {
+		returnDomainError(w, err)
+		return
+	}
+	if !ok {
+		returnError(w, http.StatusUnauthorized, "Invalid code")
+		return
+	}
+
+	err = user.DisableTOTP()
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	returnSuccess(w, http.StatusOK, "two factor authentication disabled")
+}
+
+//redirect to the page of the user, old usernames are redirected until their alias expires
+func userByUsernameHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	id, err := ResolveUsername(mux.Vars(r)["username"])
+	if err != nil {
+		returnError(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	http.Redirect(w, r, strings.Replace(getUserPage.String(), "{id}", strconv.Itoa(id), 1), http.StatusMovedPermanently)
+}
+
 //* user's handlers
 func getUserBlobsHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println(r.Method, r.RequestURI)
@@ -282,6 +794,76 @@ func getUserBlobsHandler(w http.ResponseWriter, r *http.Request) {
 	returnSuccessJson(w, http.StatusOK, "Successfully retrieved blobs", "blobs", blobsJson)
 }
 
+func getUserFollowersHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		returnError(w, http.StatusBadRequest, "Invalid user id")
+		return
+	}
+
+	limit, offset, err := getPagination(r)
+	if err != nil {
+		returnError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	user, err := QueryUserByID(id, jwtContent.UserID)
+	if err != nil {
+		returnError(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	followers, hasMore, err := user.GetFollowers(jwtContent.UserID, limit, offset)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	followersJSON, _ := json.Marshal(followers)
+	returnSuccessPage(w, http.StatusOK, "Successfully retrieved followers", "users", followersJSON, hasMore)
+}
+
+func getUserFollowingHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		returnError(w, http.StatusBadRequest, "Invalid user id")
+		return
+	}
+
+	limit, offset, err := getPagination(r)
+	if err != nil {
+		returnError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	user, err := QueryUserByID(id, jwtContent.UserID)
+	if err != nil {
+		returnError(w, http.StatusNotFound, "User not found")
+		return
+	}
+
+	followings, hasMore, err := user.GetFollowings(jwtContent.UserID, limit, offset)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	followingsJSON, _ := json.Marshal(followings)
+	returnSuccessPage(w, http.StatusOK, "Successfully retrieved followings", "users", followingsJSON, hasMore)
+}
+
 func modifyUserHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println(r.Method, r.RequestURI)
 	jwtContent, err := checkJWT(w, r)
@@ -292,7 +874,7 @@ func modifyUserHandler(w http.ResponseWriter, r *http.Request) {
 	var post Post
 	err = json.NewDecoder(r.Body).Decode(&post)
 	if err != nil {
-		returnError(w, http.StatusBadRequest, "Invalid json, "+err.Error())
+		returnError(w, http.StatusBadRequest, "Invalid json")
 		return
 	}
 
@@ -393,6 +975,39 @@ func searchUsersHandler(w http.ResponseWriter, r *http.Request) {
 	returnSuccessJson(w, http.StatusOK, "Successfully retrieved users", "users", usersJSON)
 }
 
+func recommendedUsersHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	//the number of suggestions can be changed with the limit query parameter (?limit=10)
+	limit := 5
+	if l := r.URL.Query().Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 || limit > 50 {
+			returnError(w, http.StatusBadRequest, "Invalid limit, must be between 1 and 50")
+			return
+		}
+	}
+
+	user, err := QueryUserByID(jwtContent.UserID, 0)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	recommendations, err := user.GetRecommendations(limit)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	recommendationsJSON, _ := json.Marshal(recommendations)
+	returnSuccessJson(w, http.StatusOK, "Successfully retrieved recommendations", "users", recommendationsJSON)
+}
+
 func followUserHandler(w http.ResponseWriter, r *http.Request) {
 	log.Println(r.Method, r.RequestURI)
 	jwtContent, err := checkJWT(w, r)
@@ -414,7 +1029,7 @@ func followUserHandler(w http.ResponseWriter, r *http.Request) {
 
 	err = user.Follow(id)
 	if err != nil {
-		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		returnDomainError(w, err)
 		return
 	}
 
@@ -478,13 +1093,13 @@ func addBlobHandler(w http.ResponseWriter, r *http.Request) {
 	var post Post
 	err = json.NewDecoder(r.Body).Decode(&post)
 	if err != nil {
-		returnError(w, http.StatusBadRequest, "Invalid request body: "+err.Error())
+		returnError(w, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 
-	err = AddBlob(jwtContent.UserID, post.Content)
+	_, err = AddBlob(jwtContent.UserID, post.Content)
 	if err != nil {
-		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		returnDomainError(w, err)
 		return
 	}
 
@@ -501,7 +1116,7 @@ func modifyBlobHandler(w http.ResponseWriter, r *http.Request) {
 	var post Post
 	err = json.NewDecoder(r.Body).Decode(&post)
 	if err != nil {
-		returnError(w, http.StatusBadRequest, "Invalid request body: "+err.Error())
+		returnError(w, http.StatusBadRequest, "Invalid request body")
 		return
 	}
 
@@ -524,7 +1139,7 @@ func modifyBlobHandler(w http.ResponseWriter, r *http.Request) {
 
 	err = blob.Modify(post.Content)
 	if err != nil {
-		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		returnDomainError(w, err)
 		return
 	}
 
@@ -649,7 +1264,110 @@ func toggleLikeBlobHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
+	//blobber <command> manages the instance from the command line (cli.go), without a command it runs the server
+	if len(os.Args) > 1 && os.Args[1] != "serve" {
+		if commandNeedsDB(os.Args[1:]) {
+			loadConfig()
+			migrateDB()
+		}
+		os.Exit(runCommand(os.Args[1:], os.Stdin, os.Stdout))
+	}
+	loadConfig()
+	migrateDB()
+	serve()
+}
+
+//serve starts the background services and the http server
+func serve() {
+	var err error
+	//the links sent by email are built from the base url
+	if _, err = parseBaseURL(conf.BaseURL); err != nil {
+		log.Fatalf("base url configuration is invalid, set BASE_URL: %s", err.Error())
+	}
+
+	trendingService, err = NewTrendingServiceFromConfig(conf.Trending, realClock{})
+	if err != nil {
+		log.Fatalf("trending configuration is invalid: %s", err.Error())
+	}
+	go trendingService.Run()
+
+	mailer, err = NewMailer(conf.Mailer)
+	if err != nil {
+		log.Fatalf("mailer configuration is invalid: %s", err.Error())
+	}
+
+	webAuthn, err = NewWebAuthn(conf.WebAuthn)
+	if err != nil {
+		log.Fatalf("webauthn configuration is invalid: %s", err.Error())
+	}
+
+	rateLimiter, err = NewRateLimiterFromConfig(conf.RateLimit, realClock{})
+	if err != nil {
+		log.Fatalf("rate limit configuration is invalid: %s", err.Error())
+	}
+	go rateLimiter.RunCleanup()
+
+	oidcLogin, err = NewOIDCLogin(conf.OIDC)
+	if err != nil {
+		log.Fatalf("oidc configuration is invalid: %s", err.Error())
+	}
+
+	webhookDispatcher, err = NewWebhookDispatcher(conf.Webhooks)
+	if err != nil {
+		log.Fatalf("webhooks configuration is invalid: %s", err.Error())
+	}
+	go webhookDispatcher.Run()
+	subscribeWebhooks(eventBus)
+
+	federation, err = NewFederation(conf.Federation, conf.BaseURL)
+	if err != nil {
+		log.Fatalf("federation configuration is invalid: %s", err.Error())
+	}
+	if federation != nil {
+		go federation.Run()
+		subscribeFederation(eventBus)
+	}
+
+	exportWorker = NewExportWorker()
+	go exportWorker.Run()
+	subscribeExports(eventBus)
+
+	//the subscribers are added above, the events start flowing with the server
+	go eventBus.Run()
+	outboxRelay = NewOutboxRelay(eventBus)
+	go outboxRelay.Run()
+
+	r := newRouter()
+
+	//*openapi, the document must describe every route of the router, the contract tests check the responses
+	spec, err := loadOpenAPISpec()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, problem := range spec.checkRoutes(r) {
+		log.Printf("openapi: %s", problem)
+	}
+
+	//*start the servers
+	if !conf.GRPC.Disabled {
+		go func() {
+			log.Fatal(serveGRPC(conf.GRPC))
+		}()
+	}
+	log.Fatal(http.ListenAndServe(":8080", RequestIDMiddleware(r)))
+}
+
+//newRouter registers the pages and the api, the services they use are created by serve
+func newRouter() *mux.Router {
 	r := mux.NewRouter()
+	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		returnError(w, http.StatusNotFound, "Page not found")
+	})
+	r.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		returnError(w, http.StatusMethodNotAllowed, "Method not allowed")
+	})
+	//every state changing request of the pages must carry the csrf token
+	r.Use(CSRFMiddleware)
 
 	//*generics
 	r.HandleFunc("/images/blob", func(w http.ResponseWriter, r *http.Request) {
@@ -659,42 +1377,122 @@ func main() {
 			returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
 			return
 		}
+		//the headers must be set before the status, after it they are ignored
+		w.Header().Set("Content-Type", "image/png")
 		w.WriteHeader(http.StatusOK)
-		w.Header().Set("Content-Type", "application/octet-stream")
 		w.Write(fileBytes)
 	}).Methods("GET")
+	r.HandleFunc(scripts.String(), scriptsHandler).Methods("GET")
+	r.HandleFunc(openAPI.String(), openAPIHandler).Methods("GET")
 	//pages
 	r.HandleFunc(login.String(), loginPage).Methods("GET")
 	r.HandleFunc(register.String(), registerPage).Methods("GET")
+	r.HandleFunc(forgotPassword.String(), forgotPasswordPage).Methods("GET")
+	r.HandleFunc(resetPassword.String(), resetPasswordPage).Methods("GET")
 	//this just means that the homepage is available only if the client has a jwt cookie
 	r.HandleFunc(home.String(), JWTAuthMiddleware(homePage)).Methods("GET")
 	r.HandleFunc(searchPage.String(), JWTAuthMiddleware(searchPageHandler)).Methods("GET")
 
 	r.HandleFunc(getUserPage.String(), JWTAuthMiddleware(userPageHandler)).Methods("GET") //JWTAuthMiddleware(getUserPageHandler)
+	r.HandleFunc(userByUsername.String(), JWTAuthMiddleware(userByUsernameHandler)).Methods("GET")
+	r.HandleFunc(settingsPage.String(), JWTAuthMiddleware(settingsPageHandler)).Methods("GET")
 
 	//api
-	r.HandleFunc(login.String(), loginHandler).Methods("POST")
-	r.HandleFunc(register.String(), registerHandler).Methods("POST")
-	r.HandleFunc(overview.String(), JWTAuthMiddleware(overviewHandler)).Methods("GET")
+	r.HandleFunc(login.String(), rateLimiter.Limit("login", loginHandler)).Methods("POST")
+	r.HandleFunc(logout.String(), logoutHandler).Methods("POST")
+	r.HandleFunc(loginSecondFactor.String(), rateLimiter.Limit("login", secondFactorHandler)).Methods("POST")
+	r.HandleFunc(register.String(), rateLimiter.Limit("register", registerHandler)).Methods("POST")
+	r.HandleFunc(forgotPassword.String(), rateLimiter.Limit("password_reset", forgotPasswordHandler)).Methods("POST")
+	r.HandleFunc(resetPassword.String(), rateLimiter.Limit("password_reset", resetPasswordHandler)).Methods("POST")
+	r.HandleFunc(overview.String(), legacyRoute(v2Feed, JWTAuthMiddleware(overviewHandler))).Methods("GET")
+	r.HandleFunc(trending.String(), legacyRoute(v2Trending, trendingHandler)).Methods("GET")
+
+	//*api v2, the legacy api routes below keep working and point to their v2 successor
+	registerAPIV2(r)
+	r.HandleFunc(graphqlAPI.String(), rateLimiter.Limit("graphql", graphqlHandler)).Methods("POST")
 
 	//*users (all api)
-	r.HandleFunc(getUser.String(), JWTAuthMiddleware(getUserHandler)).Methods("GET")
-	r.HandleFunc(getUserBlobs.String(), JWTAuthMiddleware(getUserBlobsHandler)).Methods("GET")
-	r.HandleFunc(searchUsers.String(), JWTAuthMiddleware(searchUsersHandler)).Methods("GET")
-	r.HandleFunc(followUser.String(), JWTAuthMiddleware(followUserHandler)).Methods("GET")
-	r.HandleFunc(unfollowUser.String(), JWTAuthMiddleware(unfollowUserHandler)).Methods("GET")
-	r.HandleFunc(modifyUser.String(), JWTAuthMiddleware(modifyUserHandler)).Methods("POST")
-	r.HandleFunc(deleteUser.String(), JWTAuthMiddleware(deleteUserHandler)).Methods("GET")
+	//must be registered before getUser, otherwise "recommended" would be matched as an {id}
+	r.HandleFunc(recommended.String(), legacyRoute(v2Recommended, JWTAuthMiddleware(recommendedUsersHandler))).Methods("GET")
+	r.HandleFunc(getUser.String(), legacyRoute(v2User, JWTAuthMiddleware(getUserHandler))).Methods("GET")
+	r.HandleFunc(getUserBlobs.String(), legacyRoute(v2UserBlobs, JWTAuthMiddleware(getUserBlobsHandler))).Methods("GET")
+	r.HandleFunc(getFollowers.String(), legacyRoute(v2UserFollowers, JWTAuthMiddleware(getUserFollowersHandler))).Methods("GET")
+	r.HandleFunc(userFeedRSS.String(), rateLimiter.Limit("feed", userFeedHandler)).Methods("GET")
+	r.HandleFunc(userFeedAtom.String(), rateLimiter.Limit("feed", userFeedHandler)).Methods("GET")
+	r.HandleFunc(tagFeedRSS.String(), rateLimiter.Limit("feed", tagFeedHandler)).Methods("GET")
+	r.HandleFunc(tagFeedAtom.String(), rateLimiter.Limit("feed", tagFeedHandler)).Methods("GET")
+	r.HandleFunc(getFollowing.String(), legacyRoute(v2UserFollowing, JWTAuthMiddleware(getUserFollowingHandler))).Methods("GET")
+	r.HandleFunc(searchUsers.String(), legacyRoute(v2Users, JWTAuthMiddleware(searchUsersHandler))).Methods("GET")
+	r.HandleFunc(followUser.String(), legacyRoute(v2UserFollowersMe, JWTAuthMiddleware(rateLimiter.Limit("follow", followUserHandler)))).Methods("POST")
+	r.HandleFunc(unfollowUser.String(), legacyRoute(v2UserFollowersMe, JWTAuthMiddleware(rateLimiter.Limit("follow", unfollowUserHandler)))).Methods("POST")
+	r.HandleFunc(modifyUser.String(), legacyRoute(v2Me, JWTAuthMiddleware(modifyUserHandler))).Methods("POST")
+	r.HandleFunc(deleteUser.String(), legacyRoute(v2Me, JWTAuthMiddleware(deleteUserHandler))).Methods("POST")
+
+	//*settings (all api)
+	r.HandleFunc(changeUsername.String(), JWTAuthMiddleware(rateLimiter.Limit("settings_change", changeUsernameHandler))).Methods("POST")
+	r.HandleFunc(changePassword.String(), JWTAuthMiddleware(rateLimiter.Limit("settings_change", changePasswordHandler))).Methods("POST")
+	r.HandleFunc(changeEmail.String(), JWTAuthMiddleware(rateLimiter.Limit("settings_change", changeEmailHandler))).Methods("POST")
+	r.HandleFunc(verifyEmail.String(), verifyEmailHandler).Methods("GET")
+	r.HandleFunc(enrollTOTP.String(), JWTAuthMiddleware(enrollTOTPHandler)).Methods("POST")
+	r.HandleFunc(confirmTOTP.String(), JWTAuthMiddleware(rateLimiter.Limit("settings_change", confirmTOTPHandler))).Methods("POST")
+	r.HandleFunc(disableTOTP.String(), JWTAuthMiddleware(rateLimiter.Limit("settings_change", disableTOTPHandler))).Methods("POST")
+	r.HandleFunc(getPasskeys.String(), JWTAuthMiddleware(getPasskeysHandler)).Methods("GET")
+	r.HandleFunc(deletePasskey.String(), JWTAuthMiddleware(deletePasskeyHandler)).Methods("POST")
+	r.HandleFunc(loginHistory.String(), JWTAuthMiddleware(loginHistoryHandler)).Methods("GET")
+	r.HandleFunc(unlinkOIDC.String(), JWTAuthMiddleware(unlinkOIDCHandler)).Methods("POST")
+	r.HandleFunc(getOAuthApps.String(), JWTAuthMiddleware(getOAuthAppsHandler)).Methods("GET")
+	r.HandleFunc(getOAuthApps.String(), JWTAuthMiddleware(addOAuthAppHandler)).Methods("POST")
+	r.HandleFunc(deleteOAuthApp.String(), JWTAuthMiddleware(deleteOAuthAppHandler)).Methods("POST")
+	r.HandleFunc(getOAuthGrants.String(), JWTAuthMiddleware(getOAuthGrantsHandler)).Methods("GET")
+	r.HandleFunc(revokeOAuthGrant.String(), JWTAuthMiddleware(revokeOAuthGrantHandler)).Methods("POST")
+	r.HandleFunc(getWebhooks.String(), JWTAuthMiddleware(getWebhooksHandler)).Methods("GET")
+	r.HandleFunc(getWebhooks.String(), JWTAuthMiddleware(rateLimiter.Limit("settings_change", addWebhookHandler))).Methods("POST")
+	r.HandleFunc(deleteWebhook.String(), JWTAuthMiddleware(deleteWebhookHandler)).Methods("POST")
+	r.HandleFunc(testWebhook.String(), JWTAuthMiddleware(rateLimiter.Limit("settings_change", testWebhookHandler))).Methods("POST")
+	r.HandleFunc(getWebhookDeliveries.String(), JWTAuthMiddleware(getWebhookDeliveriesHandler)).Methods("GET")
+	r.HandleFunc(getExports.String(), JWTAuthMiddleware(getExportsHandler)).Methods("GET")
+	r.HandleFunc(getExports.String(), JWTAuthMiddleware(rateLimiter.Limit("settings_change", requestExportHandler))).Methods("POST")
+	r.HandleFunc(downloadExport.String(), downloadExportHandler).Methods("GET")
+	r.HandleFunc(importArchive.String(), JWTAuthMiddleware(rateLimiter.Limit("import", importHandler))).Methods("POST")
+	r.HandleFunc(remoteFollowings.String(), JWTAuthMiddleware(getRemoteFollowingsHandler)).Methods("GET")
+	r.HandleFunc(remoteFollowings.String(), JWTAuthMiddleware(rateLimiter.Limit("follow", followRemoteHandler))).Methods("POST")
+	r.HandleFunc(unfollowRemote.String(), JWTAuthMiddleware(rateLimiter.Limit("follow", unfollowRemoteHandler))).Methods("POST")
+	r.HandleFunc(remoteFollowers.String(), JWTAuthMiddleware(getRemoteFollowersHandler)).Methods("GET")
+
+	//*activitypub, the remote servers sign the requests instead of using the jwt
+	r.HandleFunc(webFinger.String(), webFingerHandler).Methods("GET")
+	r.HandleFunc(activityActor.String(), apActorHandler).Methods("GET")
+	r.HandleFunc(activityInbox.String(), rateLimiter.Limit("activitypub_inbox", apInboxHandler)).Methods("POST")
+	r.HandleFunc(activityOutbox.String(), apOutboxHandler).Methods("GET")
+	r.HandleFunc(activityFollowers.String(), apFollowersHandler).Methods("GET")
+	r.HandleFunc(activityFollowing.String(), apFollowingHandler).Methods("GET")
+	r.HandleFunc(activityNote.String(), apNoteHandler).Methods("GET")
+
+	//*oauth2 authorization server
+	r.HandleFunc(oauthAuthorize.String(), JWTAuthMiddleware(authorizePageHandler)).Methods("GET")
+	r.HandleFunc(oauthAuthorize.String(), JWTAuthMiddleware(authorizeHandler)).Methods("POST")
+	r.HandleFunc(oauthToken.String(), rateLimiter.Limit("oauth_token", tokenHandler)).Methods("POST")
+
+	//*single sign-on
+	r.HandleFunc(loginOIDC.String(), oidcLoginHandler).Methods("GET")
+	r.HandleFunc(oidcCallback.String(), oidcCallbackHandler).Methods("GET")
+
+	//*passkeys
+	r.HandleFunc(beginPasskeyRegistration.String(), JWTAuthMiddleware(beginPasskeyRegistrationHandler)).Methods("POST")
+	r.HandleFunc(finishPasskeyRegistration.String(), JWTAuthMiddleware(finishPasskeyRegistrationHandler)).Methods("POST")
+	r.HandleFunc(beginPasskeySignup.String(), rateLimiter.Limit("register", beginPasskeySignupHandler)).Methods("POST")
+	r.HandleFunc(finishPasskeySignup.String(), finishPasskeySignupHandler).Methods("POST")
+	r.HandleFunc(beginPasskeyLogin.String(), beginPasskeyLoginHandler).Methods("POST")
+	r.HandleFunc(finishPasskeyLogin.String(), rateLimiter.Limit("login", finishPasskeyLoginHandler)).Methods("POST")
 
 	//*blobs (all pi)
-	r.HandleFunc(getBlob.String(), getBlobHandler).Methods("GET")
-	r.HandleFunc(addBlob.String(), JWTAuthMiddleware(addBlobHandler)).Methods("POST")
-	r.HandleFunc(modifyBlob.String(), JWTAuthMiddleware(modifyBlobHandler)).Methods("POST")
-	r.HandleFunc(deleteBlob.String(), JWTAuthMiddleware(deleteBlobHandler)).Methods("GET")
-	r.HandleFunc(addLikeBlob.String(), JWTAuthMiddleware(addLikeBlobHandler)).Methods("GET")
-	r.HandleFunc(removeLikeBlob.String(), JWTAuthMiddleware(removeLikeBlobHandler)).Methods("GET")
-	r.HandleFunc(toggleLikeBlob.String(), JWTAuthMiddleware(toggleLikeBlobHandler)).Methods("GET")
-
-	//*start the server
-	log.Fatal(http.ListenAndServe(":8080", r))
+	r.HandleFunc(getBlob.String(), legacyRoute(v2Blob, getBlobHandler)).Methods("GET")
+	r.HandleFunc(addBlob.String(), legacyRoute(v2Blobs, JWTAuthMiddleware(rateLimiter.Limit("blob_write", addBlobHandler)))).Methods("POST")
+	r.HandleFunc(modifyBlob.String(), legacyRoute(v2Blob, JWTAuthMiddleware(rateLimiter.Limit("blob_write", modifyBlobHandler)))).Methods("POST")
+	r.HandleFunc(deleteBlob.String(), legacyRoute(v2Blob, JWTAuthMiddleware(rateLimiter.Limit("blob_write", deleteBlobHandler)))).Methods("POST")
+	r.HandleFunc(addLikeBlob.String(), legacyRoute(v2BlobLikesMe, JWTAuthMiddleware(rateLimiter.Limit("like", addLikeBlobHandler)))).Methods("POST")
+	r.HandleFunc(removeLikeBlob.String(), legacyRoute(v2BlobLikesMe, JWTAuthMiddleware(rateLimiter.Limit("like", removeLikeBlobHandler)))).Methods("POST")
+	r.HandleFunc(toggleLikeBlob.String(), legacyRoute(v2BlobLikesMe, JWTAuthMiddleware(rateLimiter.Limit("like", toggleLikeBlobHandler)))).Methods("POST")
+
+	return r
 }
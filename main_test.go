@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+	"testing"
+)
+
+//the tests that need the database run only when DATABASE_HOST is set, es: with the db of docker compose
+//DATABASE_HOST=127.0.0.1 DATABASE_PORT=3306 DATABASE_USER=root DATABASE_PASSWORD=root DATABASE_NAME=blobber go test ./...
+//They create their own users with random usernames, so they can run on a database already in use
+func TestMain(m *testing.M) {
+	conf.Secret = "blobber test secret"
+	var err error
+	//the defaults of the relying party are localhost and http://localhost:8080
+	if webAuthn, err = NewWebAuthn(WebAuthnConfig{}); err != nil {
+		log.Fatal(err)
+	}
+	if rateLimiter, err = NewRateLimiterFromConfig(RateLimitConfig{Backend: "memory"}, realClock{}); err != nil {
+		log.Fatal(err)
+	}
+	os.Exit(m.Run())
+}
+
+var migrateOnce sync.Once
+
+//requireDB skips the test without a database, otherwise it runs the migrations once
+func requireDB(t *testing.T) {
+	t.Helper()
+	if os.Getenv("DATABASE_HOST") == "" {
+		t.Skip("DATABASE_HOST not set, the test needs the database")
+	}
+	migrateOnce.Do(migrateDB)
+}
+
+//newTestUser creates a user with a random username and the password "password"
+func newTestUser(t *testing.T) User {
+	t.Helper()
+	requireDB(t)
+	token, err := randomToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	username := "t_" + token[:16]
+	if err = AddUser(username, hashPassword("password"), ""); err != nil {
+		t.Fatalf("creation of the user %s failed: %v", username, err)
+	}
+	user, err := QueryUserByUsername(username, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user
+}
+
+type testMail struct {
+	to, subject, body string
+}
+
+//testMailer keeps the emails instead of sending them
+type testMailer struct {
+	mu    sync.Mutex
+	mails []testMail
+}
+
+func (m *testMailer) Send(to, subject, body string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.mails = append(m.mails, testMail{to, subject, body})
+	return nil
+}
+
+func (m *testMailer) sent() []testMail {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]testMail(nil), m.mails...)
+}
+
+//useTestMailer replaces the mailer for the test
+func useTestMailer(t *testing.T) *testMailer {
+	m := &testMailer{}
+	previous := mailer
+	mailer = m
+	t.Cleanup(func() { mailer = previous })
+	return m
+}
@@ -0,0 +1,995 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//blobber as oauth2 authorization server: the users register apps, the apps get an authorization
+//code with pkce and exchange it for an access token, a jwt limited to the scopes of the grant
+
+//how long the tokens issued to the apps last
+const (
+	oauthCodeDuration        = time.Minute * time.Duration(5)
+	oauthAccessTokenDuration = time.Hour
+)
+
+//the scopes an app can ask for and the description shown in the consent screen
+var oauthScopes = map[string]string{
+	"read":  "Leggere il tuo profilo, i tuoi blob e la tua home",
+	"write": "Pubblicare, modificare ed eliminare blob, mettere like e seguire utenti per conto tuo",
+}
+
+//the routes an access token can call with the scope needed, the routes not listed here
+//(settings, account deletion, ...) are reserved to the sessions of the user
+var oauthRouteScopes = map[string]string{
+	"GET " + overview.String():        "read",
+	"GET " + getUser.String():         "read",
+	"GET " + getUserBlobs.String():    "read",
+	"GET " + getFollowers.String():    "read",
+	"GET " + getFollowing.String():    "read",
+	"GET " + searchUsers.String():     "read",
+	"GET " + recommended.String():     "read",
+	"POST " + addBlob.String():        "write",
+	"POST " + modifyBlob.String():     "write",
+	"POST " + deleteBlob.String():     "write",
+	"POST " + addLikeBlob.String():    "write",
+	"POST " + removeLikeBlob.String(): "write",
+	"POST " + toggleLikeBlob.String(): "write",
+	"POST " + followUser.String():     "write",
+	"POST " + unfollowUser.String():   "write",
+	"POST " + modifyUser.String():     "write",
+
+	"GET " + v2Me.V2():                 "read",
+	"GET " + v2Users.V2():              "read",
+	"GET " + v2Recommended.V2():        "read",
+	"GET " + v2User.V2():               "read",
+	"GET " + v2UserBlobs.V2():          "read",
+	"GET " + v2UserFollowers.V2():      "read",
+	"GET " + v2UserFollowing.V2():      "read",
+	"GET " + v2Feed.V2():               "read",
+	"GET " + v2Blob.V2():               "read",
+	"PUT " + v2Me.V2():                 "write",
+	"POST " + v2UserFollowersMe.V2():   "write",
+	"DELETE " + v2UserFollowersMe.V2(): "write",
+	"POST " + v2Blobs.V2():             "write",
+	"PUT " + v2Blob.V2():               "write",
+	"DELETE " + v2Blob.V2():            "write",
+	"POST " + v2BlobLikesMe.V2():       "write",
+	"DELETE " + v2BlobLikesMe.V2():     "write",
+
+	//the mutations check the write scope themselves
+	"POST " + graphqlAPI.String(): "read",
+}
+
+//OAuthApp is a third-party app registered by a user, public apps (es: cli, single page apps)
+//have no secret and rely only on pkce
+type OAuthApp struct {
+	ID           int       `json:"id"`
+	OwnerID      int       `json:"owner_id"`
+	Name         string    `json:"name"`
+	ClientID     string    `json:"client_id"`
+	Confidential bool      `json:"confidential"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	CreatedAt    time.Time `json:"created_at"`
+	secretHash   string
+}
+
+//OAuthGrant is the consent of a user to an app
+type OAuthGrant struct {
+	ID        int       `json:"id"`
+	AppID     int       `json:"app_id"`
+	AppName   string    `json:"app_name"`
+	Scope     string    `json:"scope"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+//the answer of the token endpoint as described in RFC 6749
+type oauthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	Scope        string `json:"scope"`
+}
+
+//the parameters of the authorization request, sent again by the consent page with the answer of the user
+type oauthAuthorizeRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+	Approve             bool   `json:"approve"`
+}
+
+type newOAuthApp struct {
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	Confidential bool     `json:"confidential"`
+}
+
+//oauthError is an error of the protocol, sent to the app in the redirect or in the token response
+type oauthError struct {
+	Code        string
+	Description string
+}
+
+func (e oauthError) Error() string {
+	return e.Code + ": " + e.Description
+}
+
+//normalizeScope checks the scopes and returns them sorted and without duplicates, read is the default
+func normalizeScope(scope string) (string, error) {
+	requested := map[string]bool{}
+	for _, s := range strings.Fields(scope) {
+		if _, ok := oauthScopes[s]; !ok {
+			return "", oauthError{"invalid_scope", "unknown scope " + s}
+		}
+		requested[s] = true
+	}
+	if len(requested) == 0 {
+		requested["read"] = true
+	}
+
+	var scopes []string
+	for _, s := range []string{"read", "write"} {
+		if requested[s] {
+			scopes = append(scopes, s)
+		}
+	}
+	return strings.Join(scopes, " "), nil
+}
+
+func scopeAllows(scope, needed string) bool {
+	for _, s := range strings.Fields(scope) {
+		if s == needed {
+			return true
+		}
+	}
+	return false
+}
+
+//checkAccessTokenScope checks that the grant of the token allows the route and that it wasn't revoked
+func checkAccessTokenScope(r *http.Request, claims CustomClaims) error {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return fmt.Errorf("%w: route not available to apps", errForbidden)
+	}
+	path, err := route.GetPathTemplate()
+	if err != nil {
+		return err
+	}
+	needed, ok := oauthRouteScopes[r.Method+" "+path]
+	if !ok {
+		return fmt.Errorf("%w: route not available to apps", errForbidden)
+	}
+	return checkGrantScope(claims, needed)
+}
+
+//checkGrantScope checks that the grant of the token has the scope and that it wasn't revoked
+func checkGrantScope(claims CustomClaims, needed string) error {
+	if !scopeAllows(claims.Scope, needed) {
+		return fmt.Errorf("%w: the token needs the %s scope", errForbidden, needed)
+	}
+
+	db, err := connectToDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var revoked bool
+	err = db.QueryRow("SELECT revoked FROM oauth_grants WHERE ID = ? AND ID_user = ?", claims.GrantID, claims.UserID).Scan(&revoked)
+	if err == sql.ErrNoRows || revoked {
+		return fmt.Errorf("%w: the grant was revoked", errForbidden)
+	}
+	return err
+}
+
+//generateClientID returns a random id for a new app, shorter than the tokens since it's public
+func generateClientID() (string, error) {
+	token, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+	return token[:32], nil
+}
+
+//validRedirectURI accepts https uris and http only for localhost, used by the native apps
+func validRedirectURI(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || u.Fragment != "" || u.Host == "" {
+		return false
+	}
+	if u.Scheme == "https" {
+		return true
+	}
+	host := u.Hostname()
+	return u.Scheme == "http" && (host == "localhost" || host == "127.0.0.1" || host == "::1")
+}
+
+//AddOAuthApp registers a new app of the user, the secret of confidential apps is returned only now
+func (u User) AddOAuthApp(a newOAuthApp) (OAuthApp, string, error) {
+	a.Name = strings.TrimSpace(a.Name)
+	if a.Name == "" || len(a.Name) > 64 {
+		return OAuthApp{}, "", fmt.Errorf("%w: the name must be 1 to 64 characters", errBadRequest)
+	}
+	if len(a.RedirectURIs) == 0 {
+		return OAuthApp{}, "", fmt.Errorf("%w: at least a redirect uri is needed", errBadRequest)
+	}
+	for _, uri := range a.RedirectURIs {
+		if !validRedirectURI(uri) {
+			return OAuthApp{}, "", fmt.Errorf("%w: invalid redirect uri %s, use https or http://localhost", errBadRequest, uri)
+		}
+	}
+
+	clientID, err := generateClientID()
+	if err != nil {
+		return OAuthApp{}, "", fmt.Errorf("internal server error: %v", err)
+	}
+	var secret string
+	var secretHash sql.NullString
+	if a.Confidential {
+		if secret, err = randomToken(); err != nil {
+			return OAuthApp{}, "", fmt.Errorf("internal server error: %v", err)
+		}
+		secretHash = sql.NullString{String: hashToken(secret), Valid: true}
+	}
+
+	db, err := connectToDB()
+	if err != nil {
+		return OAuthApp{}, "", fmt.Errorf("internal server error: %v", err)
+	}
+	defer db.Close()
+
+	res, err := db.Exec("INSERT INTO oauth_apps (ID_user, name, client_id, client_secret, redirect_uris) VALUES (?, ?, ?, ?, ?)",
+		u.ID, a.Name, clientID, secretHash, strings.Join(a.RedirectURIs, "\n"))
+	if err != nil {
+		return OAuthApp{}, "", fmt.Errorf("internal server error: %v", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return OAuthApp{}, "", fmt.Errorf("internal server error: %v", err)
+	}
+
+	app := OAuthApp{
+		ID:           int(id),
+		OwnerID:      u.ID,
+		Name:         a.Name,
+		ClientID:     clientID,
+		Confidential: a.Confidential,
+		RedirectURIs: a.RedirectURIs,
+		CreatedAt:    time.Now(),
+	}
+	return app, secret, nil
+}
+
+const oauthAppColumnsQuery = "SELECT ID, ID_user, name, client_id, IFNULL(client_secret, ''), redirect_uris, created_at FROM oauth_apps"
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+func scanOAuthApp(row rowScanner) (OAuthApp, error) {
+	var a OAuthApp
+	var uris string
+	err := row.Scan(&a.ID, &a.OwnerID, &a.Name, &a.ClientID, &a.secretHash, &uris, &a.CreatedAt)
+	if err != nil {
+		return OAuthApp{}, err
+	}
+	a.Confidential = a.secretHash != ""
+	a.RedirectURIs = strings.Split(uris, "\n")
+	return a, nil
+}
+
+func QueryOAuthAppByClientID(clientID string) (OAuthApp, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return OAuthApp{}, err
+	}
+	defer db.Close()
+
+	return scanOAuthApp(db.QueryRow(oauthAppColumnsQuery+" WHERE client_id = ?", clientID))
+}
+
+func (u User) GetOAuthApps() ([]OAuthApp, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return []OAuthApp{}, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(oauthAppColumnsQuery+" WHERE ID_user = ? ORDER BY created_at", u.ID)
+	if err != nil {
+		return []OAuthApp{}, err
+	}
+	defer rows.Close()
+
+	var apps []OAuthApp
+	for rows.Next() {
+		a, err := scanOAuthApp(rows)
+		if err != nil {
+			return []OAuthApp{}, err
+		}
+		apps = append(apps, a)
+	}
+	return apps, rows.Err()
+}
+
+//DeleteOAuthApp removes the app of the user with all its grants, the tokens stop working
+func (u User) DeleteOAuthApp(id int) error {
+	db, err := connectToDB()
+	if err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM oauth_apps WHERE ID = ? AND ID_user = ?", id, u.ID)
+	if err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%w: app not found", errBadRequest)
+	}
+	if _, err = tx.Exec("DELETE FROM oauth_codes WHERE ID_grant IN (SELECT ID FROM oauth_grants WHERE ID_app = ?)", id); err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	if _, err = tx.Exec("DELETE FROM oauth_refresh_tokens WHERE ID_grant IN (SELECT ID FROM oauth_grants WHERE ID_app = ?)", id); err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	if _, err = tx.Exec("DELETE FROM oauth_grants WHERE ID_app = ?", id); err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	return nil
+}
+
+//checkSecret authenticates confidential apps, public apps must not send a secret
+func (a OAuthApp) checkSecret(secret string) bool {
+	if !a.Confidential {
+		return secret == ""
+	}
+	return subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(a.secretHash)) == 1
+}
+
+func (a OAuthApp) hasRedirectURI(uri string) bool {
+	for _, registered := range a.RedirectURIs {
+		if registered == uri {
+			return true
+		}
+	}
+	return false
+}
+
+//Authorize saves the consent of the user and returns the authorization code for the app,
+//the grant of the app is reused so the user sees every app only once
+func (u User) Authorize(app OAuthApp, scope, redirectURI, codeChallenge string) (string, error) {
+	code, err := randomToken()
+	if err != nil {
+		return "", err
+	}
+
+	db, err := connectToDB()
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var grantID int64
+	err = tx.QueryRow("SELECT ID FROM oauth_grants WHERE ID_app = ? AND ID_user = ? FOR UPDATE", app.ID, u.ID).Scan(&grantID)
+	switch err {
+	case sql.ErrNoRows:
+		res, err := tx.Exec("INSERT INTO oauth_grants (ID_app, ID_user, scope) VALUES (?, ?, ?)", app.ID, u.ID, scope)
+		if err != nil {
+			return "", err
+		}
+		if grantID, err = res.LastInsertId(); err != nil {
+			return "", err
+		}
+	case nil:
+		_, err = tx.Exec("UPDATE oauth_grants SET scope = ?, revoked = FALSE, created_at = NOW() WHERE ID = ?", scope, grantID)
+		if err != nil {
+			return "", err
+		}
+	default:
+		return "", err
+	}
+
+	_, err = tx.Exec("INSERT INTO oauth_codes (ID_grant, code, redirect_uri, code_challenge, scope, expires_at) VALUES (?, ?, ?, ?, ?, ?)",
+		grantID, hashToken(code), redirectURI, codeChallenge, scope, time.Now().Add(oauthCodeDuration))
+	if err != nil {
+		return "", err
+	}
+	return code, tx.Commit()
+}
+
+//issueOAuthTokens creates the access token and the next refresh token of the family, an empty family starts
+//a new one so every authorization of the app (es: on two devices) keeps its own refresh token
+func issueOAuthTokens(tx *sql.Tx, grantID, userID int, scope, family string) (oauthTokenResponse, error) {
+	var username string
+	var sessionVersion int
+	err := tx.QueryRow("SELECT username, session_version FROM users WHERE ID = ?", userID).Scan(&username, &sessionVersion)
+	if err != nil {
+		return oauthTokenResponse{}, err
+	}
+
+	claims := NewCustomClaims(username, userID, sessionVersion, time.Now().Add(oauthAccessTokenDuration).Unix())
+	claims.Scope = scope
+	claims.GrantID = grantID
+	accessToken, err := NewSignedToken(claims)
+	if err != nil {
+		return oauthTokenResponse{}, err
+	}
+
+	refreshToken, err := randomToken()
+	if err != nil {
+		return oauthTokenResponse{}, err
+	}
+	if family == "" {
+		if family, err = randomToken(); err != nil {
+			return oauthTokenResponse{}, err
+		}
+	}
+	_, err = tx.Exec("INSERT INTO oauth_refresh_tokens (ID_grant, family, token, scope) VALUES (?, ?, ?, ?)", grantID, family, hashToken(refreshToken), scope)
+	if err != nil {
+		return oauthTokenResponse{}, err
+	}
+
+	return oauthTokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(oauthAccessTokenDuration.Seconds()),
+		RefreshToken: refreshToken,
+		Scope:        scope,
+	}, nil
+}
+
+//ExchangeOAuthCode redeems the code of the app, a code used twice revokes the grant since it was probably stolen
+func ExchangeOAuthCode(app OAuthApp, code, redirectURI, verifier string) (oauthTokenResponse, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return oauthTokenResponse{}, err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return oauthTokenResponse{}, err
+	}
+	defer tx.Rollback()
+
+	var codeID, grantID, userID, appID int
+	var savedRedirect, challenge, scope string
+	var used, revoked bool
+	var expiresAt time.Time
+	err = tx.QueryRow(`SELECT c.ID, c.ID_grant, c.redirect_uri, c.code_challenge, c.scope, c.expires_at, c.used, g.ID_user, g.ID_app, g.revoked
+		FROM oauth_codes c JOIN oauth_grants g ON g.ID = c.ID_grant WHERE c.code = ? FOR UPDATE`, hashToken(code)).
+		Scan(&codeID, &grantID, &savedRedirect, &challenge, &scope, &expiresAt, &used, &userID, &appID, &revoked)
+	if err == sql.ErrNoRows {
+		return oauthTokenResponse{}, oauthError{"invalid_grant", "unknown code"}
+	}
+	if err != nil {
+		return oauthTokenResponse{}, err
+	}
+
+	if used {
+		if err = revokeGrant(tx, grantID); err != nil {
+			return oauthTokenResponse{}, err
+		}
+		if err = tx.Commit(); err != nil {
+			return oauthTokenResponse{}, err
+		}
+		return oauthTokenResponse{}, oauthError{"invalid_grant", "code already used"}
+	}
+	if appID != app.ID || revoked || time.Now().After(expiresAt) {
+		return oauthTokenResponse{}, oauthError{"invalid_grant", "invalid or expired code"}
+	}
+	if savedRedirect != redirectURI {
+		return oauthTokenResponse{}, oauthError{"invalid_grant", "redirect_uri doesn't match"}
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	if subtle.ConstantTimeCompare([]byte(base64.RawURLEncoding.EncodeToString(sum[:])), []byte(challenge)) != 1 {
+		return oauthTokenResponse{}, oauthError{"invalid_grant", "invalid code_verifier"}
+	}
+
+	if _, err = tx.Exec("UPDATE oauth_codes SET used = TRUE WHERE ID = ?", codeID); err != nil {
+		return oauthTokenResponse{}, err
+	}
+	response, err := issueOAuthTokens(tx, grantID, userID, scope, "")
+	if err != nil {
+		return oauthTokenResponse{}, err
+	}
+	return response, tx.Commit()
+}
+
+//RefreshOAuthToken rotates the refresh token of the app and returns a new access token. A token used twice
+//was probably stolen, the whole family is revoked so neither the thief nor the app can use it anymore
+func RefreshOAuthToken(app OAuthApp, refreshToken string) (oauthTokenResponse, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return oauthTokenResponse{}, err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return oauthTokenResponse{}, err
+	}
+	defer tx.Rollback()
+
+	var tokenID, grantID, userID int
+	var family, scope string
+	var used bool
+	err = tx.QueryRow(`SELECT t.ID, t.family, t.scope, t.used, g.ID, g.ID_user FROM oauth_refresh_tokens t
+		JOIN oauth_grants g ON g.ID = t.ID_grant WHERE t.token = ? AND g.ID_app = ? AND NOT g.revoked FOR UPDATE`,
+		hashToken(refreshToken), app.ID).Scan(&tokenID, &family, &scope, &used, &grantID, &userID)
+	if err == sql.ErrNoRows {
+		return oauthTokenResponse{}, oauthError{"invalid_grant", "invalid refresh token"}
+	}
+	if err != nil {
+		return oauthTokenResponse{}, err
+	}
+
+	if used {
+		if _, err = tx.Exec("DELETE FROM oauth_refresh_tokens WHERE family = ?", family); err != nil {
+			return oauthTokenResponse{}, err
+		}
+		if err = tx.Commit(); err != nil {
+			return oauthTokenResponse{}, err
+		}
+		return oauthTokenResponse{}, oauthError{"invalid_grant", "refresh token already used"}
+	}
+
+	//only the last used token of the family is kept to notice its reuse
+	if _, err = tx.Exec("DELETE FROM oauth_refresh_tokens WHERE family = ? AND used", family); err != nil {
+		return oauthTokenResponse{}, err
+	}
+	if _, err = tx.Exec("UPDATE oauth_refresh_tokens SET used = TRUE WHERE ID = ?", tokenID); err != nil {
+		return oauthTokenResponse{}, err
+	}
+	response, err := issueOAuthTokens(tx, grantID, userID, scope, family)
+	if err != nil {
+		return oauthTokenResponse{}, err
+	}
+	return response, tx.Commit()
+}
+
+func (u User) GetOAuthGrants() ([]OAuthGrant, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return []OAuthGrant{}, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`SELECT g.ID, g.ID_app, a.name, g.scope, g.created_at FROM oauth_grants g
+		JOIN oauth_apps a ON a.ID = g.ID_app WHERE g.ID_user = ? AND NOT g.revoked ORDER BY g.created_at DESC`, u.ID)
+	if err != nil {
+		return []OAuthGrant{}, err
+	}
+	defer rows.Close()
+
+	var grants []OAuthGrant
+	for rows.Next() {
+		var g OAuthGrant
+		if err = rows.Scan(&g.ID, &g.AppID, &g.AppName, &g.Scope, &g.CreatedAt); err != nil {
+			return []OAuthGrant{}, err
+		}
+		grants = append(grants, g)
+	}
+	return grants, rows.Err()
+}
+
+//revokeGrant revokes the grant and deletes all its refresh tokens
+func revokeGrant(tx *sql.Tx, grantID int) error {
+	if _, err := tx.Exec("UPDATE oauth_grants SET revoked = TRUE WHERE ID = ?", grantID); err != nil {
+		return err
+	}
+	_, err := tx.Exec("DELETE FROM oauth_refresh_tokens WHERE ID_grant = ?", grantID)
+	return err
+}
+
+//RevokeOAuthGrant revokes the access of the app, its access and refresh tokens stop working
+func (u User) RevokeOAuthGrant(id int) error {
+	db, err := connectToDB()
+	if err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	defer tx.Rollback()
+
+	var grantID int
+	err = tx.QueryRow("SELECT ID FROM oauth_grants WHERE ID = ? AND ID_user = ? AND NOT revoked FOR UPDATE", id, u.ID).Scan(&grantID)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w: grant not found", errBadRequest)
+	}
+	if err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	if err = revokeGrant(tx, grantID); err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	return nil
+}
+
+//parseAuthorizeRequest checks the client and the redirect uri, the errors before the redirect uri
+//is known are shown to the user, the others are sent to the app
+func parseAuthorizeRequest(req oauthAuthorizeRequest) (OAuthApp, string, error) {
+	app, err := QueryOAuthAppByClientID(req.ClientID)
+	if err == sql.ErrNoRows {
+		return OAuthApp{}, "", fmt.Errorf("%w: unknown app", errBadRequest)
+	}
+	if err != nil {
+		return OAuthApp{}, "", fmt.Errorf("internal server error: %v", err)
+	}
+
+	//the redirect uri can be omitted only if the app registered just one
+	redirectURI := req.RedirectURI
+	if redirectURI == "" && len(app.RedirectURIs) == 1 {
+		redirectURI = app.RedirectURIs[0]
+	}
+	if !app.hasRedirectURI(redirectURI) {
+		return OAuthApp{}, "", fmt.Errorf("%w: the redirect uri is not registered for the app", errBadRequest)
+	}
+	return app, redirectURI, nil
+}
+
+//validateAuthorizeRequest checks the protocol parameters, pkce is required for every app
+func validateAuthorizeRequest(req oauthAuthorizeRequest) (string, error) {
+	if req.ResponseType != "code" {
+		return "", oauthError{"unsupported_response_type", "only the code response type is supported"}
+	}
+	if req.CodeChallenge == "" || req.CodeChallengeMethod != "S256" {
+		return "", oauthError{"invalid_request", "pkce with the S256 method is required"}
+	}
+	return normalizeScope(req.Scope)
+}
+
+//oauthRedirect builds the uri of the app with the parameters of the answer
+func oauthRedirect(redirectURI string, params url.Values) string {
+	u, _ := url.Parse(redirectURI)
+	query := u.Query()
+	for k, v := range params {
+		query[k] = v
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+func oauthErrorRedirect(redirectURI, state string, err oauthError) string {
+	params := url.Values{"error": {err.Code}, "error_description": {err.Description}}
+	if state != "" {
+		params.Set("state", state)
+	}
+	return oauthRedirect(redirectURI, params)
+}
+
+//the token endpoint answers with the json described by the rfc instead of the blobber's one
+func returnOAuthJson(w http.ResponseWriter, code int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(data)
+}
+
+func returnOAuthError(w http.ResponseWriter, code int, err oauthError) {
+	returnOAuthJson(w, code, map[string]string{"error": err.Code, "error_description": err.Description})
+}
+
+//* oauth's handlers
+//the consent screen, shown to the logged user when an app asks for the authorization
+func authorizePageHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	query := r.URL.Query()
+	req := oauthAuthorizeRequest{
+		ResponseType:        query.Get("response_type"),
+		ClientID:            query.Get("client_id"),
+		RedirectURI:         query.Get("redirect_uri"),
+		Scope:               query.Get("scope"),
+		State:               query.Get("state"),
+		CodeChallenge:       query.Get("code_challenge"),
+		CodeChallengeMethod: query.Get("code_challenge_method"),
+	}
+
+	app, redirectURI, err := parseAuthorizeRequest(req)
+	if err != nil {
+		returnDomainError(w, err)
+		return
+	}
+	scope, err := validateAuthorizeRequest(req)
+	if err != nil {
+		http.Redirect(w, r, oauthErrorRedirect(redirectURI, req.State, err.(oauthError)), http.StatusFound)
+		return
+	}
+
+	var scopes []string
+	for _, s := range strings.Fields(scope) {
+		scopes = append(scopes, oauthScopes[s])
+	}
+	data := struct {
+		Username string
+		AppName  string
+		Scopes   []string
+	}{
+		Username: jwtContent.Username,
+		AppName:  app.Name,
+		Scopes:   scopes,
+	}
+
+	tmpl, err := template.ParseFiles("pages/authorize.html")
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	//the consent screen must not be shown inside a frame of another site
+	w.Header().Set("X-Frame-Options", "DENY")
+	tmpl.Execute(w, data)
+}
+
+//authorizeHandler receives the answer of the user and returns where the browser must be redirected
+func authorizeHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	var req oauthAuthorizeRequest
+	if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+		returnError(w, http.StatusBadRequest, "Invalid json")
+		return
+	}
+
+	app, redirectURI, err := parseAuthorizeRequest(req)
+	if err != nil {
+		returnDomainError(w, err)
+		return
+	}
+
+	redirect := ""
+	scope, err := validateAuthorizeRequest(req)
+	switch {
+	case err != nil:
+		redirect = oauthErrorRedirect(redirectURI, req.State, err.(oauthError))
+	case !req.Approve:
+		redirect = oauthErrorRedirect(redirectURI, req.State, oauthError{"access_denied", "the user denied the access"})
+	default:
+		user, err := QueryUserByID(jwtContent.UserID, 0)
+		if err != nil {
+			returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+			return
+		}
+		code, err := user.Authorize(app, scope, redirectURI, req.CodeChallenge)
+		if err != nil {
+			returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+			return
+		}
+		params := url.Values{"code": {code}}
+		if req.State != "" {
+			params.Set("state", req.State)
+		}
+		redirect = oauthRedirect(redirectURI, params)
+	}
+
+	redirectJson, _ := json.Marshal(redirect)
+	returnSuccessJson(w, http.StatusOK, "Authorization answered", "redirect", redirectJson)
+}
+
+//tokenHandler is the token endpoint of RFC 6749, it reads a form and supports the
+//authorization_code and refresh_token grants
+func tokenHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	if err := r.ParseForm(); err != nil {
+		returnOAuthError(w, http.StatusBadRequest, oauthError{"invalid_request", "invalid form"})
+		return
+	}
+
+	//the client can authenticate with the basic auth or with the form
+	clientID, secret, ok := r.BasicAuth()
+	if !ok {
+		clientID = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+	app, err := QueryOAuthAppByClientID(clientID)
+	if err != nil || !app.checkSecret(secret) {
+		if err != nil && err != sql.ErrNoRows {
+			log.Printf("oauth app lookup failed: %v", err)
+		}
+		returnOAuthError(w, http.StatusUnauthorized, oauthError{"invalid_client", "client authentication failed"})
+		return
+	}
+
+	var response oauthTokenResponse
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		response, err = ExchangeOAuthCode(app, r.PostForm.Get("code"), r.PostForm.Get("redirect_uri"), r.PostForm.Get("code_verifier"))
+	case "refresh_token":
+		response, err = RefreshOAuthToken(app, r.PostForm.Get("refresh_token"))
+	default:
+		err = oauthError{"unsupported_grant_type", "only authorization_code and refresh_token are supported"}
+	}
+
+	if oerr, ok := err.(oauthError); ok {
+		returnOAuthError(w, http.StatusBadRequest, oerr)
+		return
+	}
+	if err != nil {
+		log.Printf("oauth token request failed: %v", err)
+		returnOAuthError(w, http.StatusInternalServerError, oauthError{"server_error", "internal server error"})
+		return
+	}
+	returnOAuthJson(w, http.StatusOK, response)
+}
+
+func getOAuthAppsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	user, err := QueryUserByID(jwtContent.UserID, 0)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	apps, err := user.GetOAuthApps()
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+	appsJson, _ := json.Marshal(apps)
+	returnSuccessJson(w, http.StatusOK, "Apps found", "apps", appsJson)
+}
+
+func addOAuthAppHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	var post newOAuthApp
+	if err = json.NewDecoder(r.Body).Decode(&post); err != nil {
+		returnError(w, http.StatusBadRequest, "Invalid json")
+		return
+	}
+
+	user, err := QueryUserByID(jwtContent.UserID, 0)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	app, secret, err := user.AddOAuthApp(post)
+	if err != nil {
+		returnDomainError(w, err)
+		return
+	}
+
+	//the secret is shown only once, it's saved hashed
+	appJson, _ := json.Marshal(struct {
+		OAuthApp
+		ClientSecret string `json:"client_secret,omitempty"`
+	}{app, secret})
+	returnSuccessJson(w, http.StatusCreated, "App created", "app", appJson)
+}
+
+func deleteOAuthAppHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		returnError(w, http.StatusBadRequest, "Invalid id")
+		return
+	}
+
+	user, err := QueryUserByID(jwtContent.UserID, 0)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	if err = user.DeleteOAuthApp(id); err != nil {
+		returnDomainError(w, err)
+		return
+	}
+	returnSuccess(w, http.StatusOK, "App deleted")
+}
+
+func getOAuthGrantsHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	user, err := QueryUserByID(jwtContent.UserID, 0)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	grants, err := user.GetOAuthGrants()
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+	grantsJson, _ := json.Marshal(grants)
+	returnSuccessJson(w, http.StatusOK, "Grants found", "grants", grantsJson)
+}
+
+func revokeOAuthGrantHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		returnError(w, http.StatusBadRequest, "Invalid id")
+		return
+	}
+
+	user, err := QueryUserByID(jwtContent.UserID, 0)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	if err = user.RevokeOAuthGrant(id); err != nil {
+		returnDomainError(w, err)
+		return
+	}
+	returnSuccess(w, http.StatusOK, "Access revoked")
+}
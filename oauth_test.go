@@ -0,0 +1,92 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"testing"
+)
+
+const testRedirectURI = "http://localhost:3000/callback"
+
+//authorizeTestApp creates an app of the user and returns the tokens of a new authorization
+func authorizeTestApp(t *testing.T, user User, app OAuthApp, scope string) oauthTokenResponse {
+	t.Helper()
+	verifier, err := randomToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	code, err := user.Authorize(app, scope, testRedirectURI, base64.RawURLEncoding.EncodeToString(challenge[:]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tokens, err := ExchangeOAuthCode(app, code, testRedirectURI, verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tokens
+}
+
+func wantInvalidGrant(t *testing.T, what string, err error) {
+	t.Helper()
+	var oauthErr oauthError
+	if !errors.As(err, &oauthErr) || oauthErr.Code != "invalid_grant" {
+		t.Errorf("%s: got %v, want invalid_grant", what, err)
+	}
+}
+
+func TestOAuthRefreshTokenRotation(t *testing.T) {
+	user := newTestUser(t)
+	app, _, err := user.AddOAuthApp(newOAuthApp{Name: "test app", RedirectURIs: []string{testRedirectURI}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//two devices authorize the same app, each keeps its refresh token
+	phone := authorizeTestApp(t, user, app, "read")
+	laptop := authorizeTestApp(t, user, app, "read write")
+
+	rotated, err := RefreshOAuthToken(app, phone.RefreshToken)
+	if err != nil {
+		t.Fatalf("refresh of the first authorization: %v", err)
+	}
+	if rotated.RefreshToken == phone.RefreshToken || rotated.Scope != "read" {
+		t.Errorf("refresh returned %+v, want a new token with the scope read", rotated)
+	}
+	laptopRotated, err := RefreshOAuthToken(app, laptop.RefreshToken)
+	if err != nil {
+		t.Fatalf("refresh of the second authorization: %v", err)
+	}
+	if laptopRotated.Scope != "read write" {
+		t.Errorf("scope %q, want the scope of the authorization", laptopRotated.Scope)
+	}
+
+	//the old token of the phone is reused: the family of the phone is revoked, the laptop keeps working
+	_, err = RefreshOAuthToken(app, phone.RefreshToken)
+	wantInvalidGrant(t, "reuse of a rotated token", err)
+	_, err = RefreshOAuthToken(app, rotated.RefreshToken)
+	wantInvalidGrant(t, "token of a revoked family", err)
+	if laptopRotated, err = RefreshOAuthToken(app, laptopRotated.RefreshToken); err != nil {
+		t.Fatalf("refresh of the other family: %v", err)
+	}
+
+	//another app can't use the token
+	other, _, err := user.AddOAuthApp(newOAuthApp{Name: "other app", RedirectURIs: []string{testRedirectURI}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = RefreshOAuthToken(other, laptopRotated.RefreshToken)
+	wantInvalidGrant(t, "token of another app", err)
+
+	//revoking the grant invalidates every refresh token
+	grants, err := user.GetOAuthGrants()
+	if err != nil || len(grants) != 1 {
+		t.Fatalf("grants %+v, %v, want 1", grants, err)
+	}
+	if err = user.RevokeOAuthGrant(grants[0].ID); err != nil {
+		t.Fatal(err)
+	}
+	_, err = RefreshOAuthToken(app, laptopRotated.RefreshToken)
+	wantInvalidGrant(t, "token of a revoked grant", err)
+}
@@ -0,0 +1,574 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+type OIDCConfig struct {
+	//issuer of the identity provider, the oidc login is disabled when it's empty
+	Issuer       string `yaml:"issuer"`
+	ClientID     string `yaml:"client_id"`
+	ClientSecret string `yaml:"client_secret"`
+	//callback registered on the identity provider, es: https://blobber.example.com/oidc/callback,
+	//it's required so the redirect doesn't depend on the host of the request
+	RedirectURL string `yaml:"redirect_url"`
+	//name of the identity provider shown on the login button
+	Name string `yaml:"name"`
+	//by default the users that log in for the first time get a new account
+	DisableSignup bool `yaml:"disable_signup"`
+}
+
+//the oidc login, nil when no issuer is configured
+var oidcLogin *OIDCLogin
+
+//how long the user has to log in on the identity provider
+const oidcLoginDuration = time.Minute * time.Duration(10)
+
+var usernameInvalidChars = regexp.MustCompile(`[^a-zA-Z0-9_.]`)
+
+//OIDCLogin does the authorization code flow with pkce against the configured issuer
+type OIDCLogin struct {
+	config OIDCConfig
+
+	mu       sync.Mutex
+	provider *oidc.Provider
+}
+
+//OIDCIdentity is an account of the identity provider linked to a blobber user
+type OIDCIdentity struct {
+	Issuer    string
+	Subject   string
+	CreatedAt time.Time
+}
+
+//the claims of the id token used by blobber
+type oidcClaims struct {
+	Subject           string `json:"sub"`
+	Email             string `json:"email"`
+	EmailVerified     bool   `json:"email_verified"`
+	PreferredUsername string `json:"preferred_username"`
+	Nonce             string `json:"nonce"`
+}
+
+//the state of the login is kept in a signed cookie so any replica can handle the callback
+type oidcState struct {
+	State    string `json:"state"`
+	Nonce    string `json:"nonce"`
+	Verifier string `json:"verifier"`
+	//the user that is linking the identity to his account, 0 for a login
+	LinkUserID int `json:"link_user_id,omitempty"`
+}
+
+func NewOIDCLogin(c OIDCConfig) (*OIDCLogin, error) {
+	if c.Issuer == "" {
+		return nil, nil
+	}
+	if c.ClientID == "" {
+		return nil, fmt.Errorf("the oidc login needs a client id")
+	}
+	redirect, err := url.Parse(c.RedirectURL)
+	if err != nil || redirect.Host == "" || (redirect.Scheme != "http" && redirect.Scheme != "https") {
+		return nil, fmt.Errorf("the oidc login needs the absolute redirect url registered on the identity provider, es: https://blobber.example.com%s", oidcCallback.String())
+	}
+	if c.Name == "" {
+		c.Name = "SSO"
+	}
+	return &OIDCLogin{config: c}, nil
+}
+
+func (o *OIDCLogin) Name() string {
+	return o.config.Name
+}
+
+//discover fetches the configuration of the issuer, it's done on the first login so blobber
+//starts even if the identity provider is unreachable
+func (o *OIDCLogin) discover(ctx context.Context) (*oidc.Provider, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if o.provider != nil {
+		return o.provider, nil
+	}
+	provider, err := oidc.NewProvider(ctx, o.config.Issuer)
+	if err != nil {
+		return nil, err
+	}
+	o.provider = provider
+	return provider, nil
+}
+
+func (o *OIDCLogin) oauth2Config(provider *oidc.Provider) oauth2.Config {
+	return oauth2.Config{
+		ClientID:     o.config.ClientID,
+		ClientSecret: o.config.ClientSecret,
+		RedirectURL:  o.config.RedirectURL,
+		Endpoint:     provider.Endpoint(),
+		Scopes:       []string{oidc.ScopeOpenID, "profile", "email"},
+	}
+}
+
+//AuthURL returns the url of the identity provider where the user has to be redirected
+func (o *OIDCLogin) AuthURL(r *http.Request, state oidcState) (string, error) {
+	provider, err := o.discover(r.Context())
+	if err != nil {
+		return "", err
+	}
+	config := o.oauth2Config(provider)
+
+	challenge := sha256.Sum256([]byte(state.Verifier))
+	return config.AuthCodeURL(state.State,
+		oidc.Nonce(state.Nonce),
+		oauth2.SetAuthURLParam("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:])),
+		oauth2.SetAuthURLParam("code_challenge_method", "S256"),
+	), nil
+}
+
+//Exchange redeems the code and returns the verified claims of the id token
+func (o *OIDCLogin) Exchange(r *http.Request, code string, state oidcState) (oidcClaims, error) {
+	provider, err := o.discover(r.Context())
+	if err != nil {
+		return oidcClaims{}, err
+	}
+	config := o.oauth2Config(provider)
+
+	token, err := config.Exchange(r.Context(), code, oauth2.SetAuthURLParam("code_verifier", state.Verifier))
+	if err != nil {
+		return oidcClaims{}, err
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return oidcClaims{}, fmt.Errorf("the identity provider didn't return an id token")
+	}
+	idToken, err := provider.Verifier(&oidc.Config{ClientID: o.config.ClientID}).Verify(r.Context(), rawIDToken)
+	if err != nil {
+		return oidcClaims{}, err
+	}
+
+	var claims oidcClaims
+	if err = idToken.Claims(&claims); err != nil {
+		return oidcClaims{}, err
+	}
+	if claims.Nonce != state.Nonce {
+		return oidcClaims{}, fmt.Errorf("invalid nonce")
+	}
+	return claims, nil
+}
+
+//provisionUsername derives a free username from the claims of the identity provider
+func provisionUsername(claims oidcClaims) (string, error) {
+	base := claims.PreferredUsername
+	if base == "" {
+		base = strings.Split(claims.Email, "@")[0]
+	}
+	base = usernameInvalidChars.ReplaceAllString(base, "")
+	if len(base) > 16 {
+		base = base[:16]
+	}
+	for len(base) < 3 {
+		base += "_"
+	}
+
+	username := base
+	for i := 1; i < 1000; i++ {
+		taken, err := usernameTaken(username, 0)
+		if err != nil {
+			return "", err
+		}
+		if !taken {
+			return username, nil
+		}
+		username = fmt.Sprintf("%s%d", base, i)
+	}
+	return "", fmt.Errorf("can't find a free username for %s", base)
+}
+
+//queryUserByOIDCIdentity returns the id of the user linked to the identity, sql.ErrNoRows if not linked
+func queryUserByOIDCIdentity(issuer, subject string) (int, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var id int
+	err = db.QueryRow("SELECT ID_user FROM oidc_identities WHERE issuer = ? AND subject = ?", issuer, subject).Scan(&id)
+	return id, err
+}
+
+//queryUserByVerifiedEmail returns the id of the user with the email, only if verified on blobber
+func queryUserByVerifiedEmail(email string) (int, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var id int
+	err = db.QueryRow("SELECT ID FROM users WHERE email = ? AND email_verified", email).Scan(&id)
+	return id, err
+}
+
+//LinkOIDCIdentity links the identity to the user, an identity can be linked to only one user
+func (u User) LinkOIDCIdentity(issuer, subject string) error {
+	linked, err := queryUserByOIDCIdentity(issuer, subject)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	if err == nil {
+		if linked == u.ID {
+			return nil
+		}
+		return fmt.Errorf("%w: the account is already linked to another user", errBadRequest)
+	}
+
+	db, err := connectToDB()
+	if err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("INSERT INTO oidc_identities (ID_user, issuer, subject) VALUES (?, ?, ?)", u.ID, issuer, subject)
+	if err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	return nil
+}
+
+func (u User) GetOIDCIdentities() ([]OIDCIdentity, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return []OIDCIdentity{}, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT issuer, subject, created_at FROM oidc_identities WHERE ID_user = ? ORDER BY created_at", u.ID)
+	if err != nil {
+		return []OIDCIdentity{}, err
+	}
+	defer rows.Close()
+
+	var identities []OIDCIdentity
+	for rows.Next() {
+		var i OIDCIdentity
+		if err = rows.Scan(&i.Issuer, &i.Subject, &i.CreatedAt); err != nil {
+			return []OIDCIdentity{}, err
+		}
+		identities = append(identities, i)
+	}
+	return identities, rows.Err()
+}
+
+//UnlinkOIDCIdentities removes the identities of the issuer, a user without password can't
+//remove them unless he has a passkey
+func (u User) UnlinkOIDCIdentities(issuer string) error {
+	db, err := connectToDB()
+	if err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	defer db.Close()
+
+	if u.Password == "" {
+		var count int
+		if err = db.QueryRow("SELECT COUNT(*) FROM webauthn_credentials WHERE ID_user = ?", u.ID).Scan(&count); err != nil {
+			return fmt.Errorf("internal server error: %v", err)
+		}
+		if count == 0 {
+			return fmt.Errorf("%w: set a password before unlinking the account", errBadRequest)
+		}
+	}
+
+	res, err := db.Exec("DELETE FROM oidc_identities WHERE ID_user = ? AND issuer = ?", u.ID, issuer)
+	if err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%w: the account is not linked", errBadRequest)
+	}
+	return nil
+}
+
+//AddOIDCUser creates the user the first time he logs in with the identity provider, without
+//a password like the users created with a passkey
+func AddOIDCUser(issuer string, claims oidcClaims) (User, error) {
+	username, err := provisionUsername(claims)
+	if err != nil {
+		return User{}, err
+	}
+
+	db, err := connectToDB()
+	if err != nil {
+		return User{}, err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	var email sql.NullString
+	if claims.Email != "" {
+		email = sql.NullString{String: claims.Email, Valid: true}
+	}
+	res, err := tx.Exec("INSERT INTO users (username, password, description, email, email_verified) VALUES (?, '', '', ?, ?)",
+		username, email, claims.EmailVerified && claims.Email != "")
+	if isDuplicateEntry(err) {
+		return User{}, fmt.Errorf("%w: the username %s has just been taken, retry", errConflict, username)
+	}
+	if err != nil {
+		return User{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return User{}, err
+	}
+
+	_, err = tx.Exec("INSERT INTO oidc_identities (ID_user, issuer, subject) VALUES (?, ?, ?)", id, issuer, claims.Subject)
+	if err != nil {
+		return User{}, err
+	}
+	if err = tx.Commit(); err != nil {
+		return User{}, err
+	}
+	return QueryUserByID(int(id), 0)
+}
+
+//resolveOIDCUser returns the user of the identity: the linked one, the one with the same verified
+//email (the identity is linked to him) or a new one
+func (o *OIDCLogin) resolveOIDCUser(claims oidcClaims) (User, error) {
+	id, err := queryUserByOIDCIdentity(o.config.Issuer, claims.Subject)
+	if err == nil {
+		return QueryUserByID(id, 0)
+	}
+	if err != sql.ErrNoRows {
+		return User{}, fmt.Errorf("internal server error: %v", err)
+	}
+
+	//the email is trusted only if both blobber and the identity provider verified it
+	if claims.Email != "" && claims.EmailVerified {
+		id, err = queryUserByVerifiedEmail(claims.Email)
+		if err != nil && err != sql.ErrNoRows {
+			return User{}, fmt.Errorf("internal server error: %v", err)
+		}
+		if err == nil {
+			user, err := QueryUserByID(id, 0)
+			if err != nil {
+				return User{}, fmt.Errorf("internal server error: %v", err)
+			}
+			return user, user.LinkOIDCIdentity(o.config.Issuer, claims.Subject)
+		}
+	}
+
+	if o.config.DisableSignup {
+		return User{}, fmt.Errorf("%w: no blobber account is linked to this identity", errBadRequest)
+	}
+	user, err := AddOIDCUser(o.config.Issuer, claims)
+	if err != nil {
+		return User{}, fmt.Errorf("internal server error: %v", err)
+	}
+	return user, nil
+}
+
+func setOIDCStateCookie(w http.ResponseWriter, r *http.Request, state oidcState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	expiration := time.Now().Add(oidcLoginDuration)
+	claims := NewCustomClaims("", 0, 0, expiration.Unix())
+	claims.Purpose = "oidc"
+	claims.Ceremony = base64.RawURLEncoding.EncodeToString(data)
+	token, err := NewSignedToken(claims)
+	if err != nil {
+		return err
+	}
+
+	//lax so the cookie is sent on the redirect back from the identity provider
+	setCookie(w, r, &http.Cookie{
+		Name:     "OIDC",
+		Value:    token,
+		Path:     "/oidc",
+		Expires:  expiration,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
+
+//readOIDCStateCookie returns the state of the login and deletes the cookie
+func readOIDCStateCookie(w http.ResponseWriter, r *http.Request) (oidcState, error) {
+	cookie, err := r.Cookie("OIDC")
+	if err != nil {
+		return oidcState{}, err
+	}
+	setCookie(w, r, &http.Cookie{Name: "OIDC", Value: "", Path: "/oidc", MaxAge: -1, HttpOnly: true})
+
+	claims, err := ParseToken(cookie.Value)
+	if err != nil {
+		return oidcState{}, err
+	}
+	if claims.Purpose != "oidc" {
+		return oidcState{}, fmt.Errorf("wrong purpose")
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(claims.Ceremony)
+	if err != nil {
+		return oidcState{}, err
+	}
+	var state oidcState
+	err = json.Unmarshal(data, &state)
+	return state, err
+}
+
+//the callback is a browser navigation so the errors are shown by the login page
+func redirectOIDCError(w http.ResponseWriter, r *http.Request, msg string) {
+	http.Redirect(w, r, login.String()+"?oidc_error="+url.QueryEscape(msg), http.StatusFound)
+}
+
+//* oidc's handlers
+//oidcLoginHandler redirects to the identity provider, with ?link=true the identity is linked to the logged user
+func oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	if oidcLogin == nil {
+		returnError(w, http.StatusNotFound, "Single sign-on is not enabled")
+		return
+	}
+
+	var state oidcState
+	if r.URL.Query().Get("link") == "true" {
+		jwtContent, err := checkJWT(w, r)
+		if err != nil {
+			return
+		}
+		state.LinkUserID = jwtContent.UserID
+	}
+
+	var err error
+	for _, v := range []*string{&state.State, &state.Nonce, &state.Verifier} {
+		if *v, err = randomToken(); err != nil {
+			returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+			return
+		}
+	}
+
+	authURL, err := oidcLogin.AuthURL(r, state)
+	if err != nil {
+		log.Printf("oidc discovery failed: %v", err)
+		redirectOIDCError(w, r, "Identity provider unreachable")
+		return
+	}
+
+	if err = setOIDCStateCookie(w, r, state); err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+	http.Redirect(w, r, authURL, http.StatusFound)
+}
+
+func oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	if oidcLogin == nil {
+		returnError(w, http.StatusNotFound, "Single sign-on is not enabled")
+		return
+	}
+
+	state, err := readOIDCStateCookie(w, r)
+	if err != nil {
+		redirectOIDCError(w, r, "Login expired, try again")
+		return
+	}
+	if r.URL.Query().Get("state") != state.State {
+		redirectOIDCError(w, r, "Invalid state, try again")
+		return
+	}
+	if e := r.URL.Query().Get("error"); e != "" {
+		redirectOIDCError(w, r, "Login refused by the identity provider: "+e)
+		return
+	}
+
+	claims, err := oidcLogin.Exchange(r, r.URL.Query().Get("code"), state)
+	if err != nil {
+		log.Printf("oidc code exchange failed: %v", err)
+		redirectOIDCError(w, r, "Login with the identity provider failed")
+		return
+	}
+
+	//linking from the settings, the user is already logged in
+	if state.LinkUserID != 0 {
+		user, err := QueryUserByID(state.LinkUserID, 0)
+		if err == nil {
+			err = user.LinkOIDCIdentity(oidcLogin.config.Issuer, claims.Subject)
+		}
+		if err != nil {
+			http.Redirect(w, r, settingsPage.String()+"?oidc_error="+url.QueryEscape(err.Error()), http.StatusFound)
+			return
+		}
+		http.Redirect(w, r, settingsPage.String(), http.StatusFound)
+		return
+	}
+
+	user, err := oidcLogin.resolveOIDCUser(claims)
+	if err != nil {
+		log.Printf("oidc login failed: %v", err)
+		redirectOIDCError(w, r, strings.TrimPrefix(err.Error(), "bad request: "))
+		return
+	}
+
+	//the two factor authentication of blobber is still required
+	if user.TOTPEnabled {
+		if err = newSecondFactorToken(w, r, user); err != nil {
+			redirectOIDCError(w, r, "Internal server error")
+			return
+		}
+		http.Redirect(w, r, login.String()+"?oidc=two_factor", http.StatusFound)
+		return
+	}
+
+	if err = completeLogin(w, r, user, "oidc"); err != nil {
+		redirectOIDCError(w, r, "Internal server error")
+		return
+	}
+	http.Redirect(w, r, fmt.Sprintf("%s?oidc=success&id=%d", login.String(), user.ID), http.StatusFound)
+}
+
+func unlinkOIDCHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+	if oidcLogin == nil {
+		returnError(w, http.StatusNotFound, "Single sign-on is not enabled")
+		return
+	}
+
+	user, err := QueryUserByID(jwtContent.UserID, 0)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	if err = user.UnlinkOIDCIdentities(oidcLogin.config.Issuer); err != nil {
+		returnDomainError(w, err)
+		return
+	}
+	returnSuccess(w, http.StatusOK, "Account unlinked")
+}
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const testOIDCClientID = "blobber"
+
+//mockOIDCProvider is an identity provider that signs the id tokens with the claims chosen by the test
+type mockOIDCProvider struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+
+	mu    sync.Mutex
+	codes map[string]mockOIDCCode
+}
+
+type mockOIDCCode struct {
+	challenge string
+	claims    jwt.MapClaims
+}
+
+//useMockOIDC starts the provider and configures the oidc login against it
+func useMockOIDC(t *testing.T, disableSignup bool) *mockOIDCProvider {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &mockOIDCProvider{key: key, codes: make(map[string]mockOIDCCode)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"issuer":                                p.URL,
+			"authorization_endpoint":                p.URL + "/authorize",
+			"token_endpoint":                        p.URL + "/token",
+			"jwks_uri":                              p.URL + "/jwks",
+			"response_types_supported":              []string{"code"},
+			"subject_types_supported":               []string{"public"},
+			"id_token_signing_alg_values_supported": []string{"RS256"},
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+			"kty": "RSA",
+			"alg": "RS256",
+			"use": "sig",
+			"kid": "test",
+			"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+			"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+		}}})
+	})
+	mux.HandleFunc("/token", p.tokenHandler)
+	p.Server = httptest.NewServer(mux)
+
+	previous := oidcLogin
+	oidcLogin, err = NewOIDCLogin(OIDCConfig{
+		Issuer:        p.URL,
+		ClientID:      testOIDCClientID,
+		RedirectURL:   "http://localhost:8080" + oidcCallback.String(),
+		DisableSignup: disableSignup,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		oidcLogin = previous
+		p.Close()
+	})
+	return p
+}
+
+//the code is redeemed once and only with the verifier of the pkce challenge
+func (p *mockOIDCProvider) tokenHandler(w http.ResponseWriter, r *http.Request) {
+	p.mu.Lock()
+	code, ok := p.codes[r.FormValue("code")]
+	delete(p.codes, r.FormValue("code"))
+	p.mu.Unlock()
+
+	verifier := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	if !ok || base64.RawURLEncoding.EncodeToString(verifier[:]) != code.challenge {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"error": "invalid_grant"}`))
+		return
+	}
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, code.claims)
+	token.Header["kid"] = "test"
+	idToken, err := token.SignedString(p.key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{"access_token": "access", "token_type": "Bearer", "expires_in": 3600, "id_token": idToken})
+}
+
+//authorize plays the user logging in on the provider, it returns the query of the redirect to the callback.
+//The nonce of the request is added to the claims unless they have one
+func (p *mockOIDCProvider) authorize(t *testing.T, authURL string, claims jwt.MapClaims) url.Values {
+	t.Helper()
+	u, err := url.Parse(authURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	query := u.Query()
+	if u.Path != "/authorize" || query.Get("client_id") != testOIDCClientID || query.Get("redirect_uri") != "http://localhost:8080"+oidcCallback.String() {
+		t.Fatalf("wrong authorization request %s", authURL)
+	}
+
+	full := jwt.MapClaims{
+		"iss": p.URL,
+		"aud": testOIDCClientID,
+		"iat": time.Now().Unix(),
+		"exp": time.Now().Add(time.Hour).Unix(),
+	}
+	if _, ok := claims["nonce"]; !ok {
+		full["nonce"] = query.Get("nonce")
+	}
+	for k, v := range claims {
+		full[k] = v
+	}
+
+	code, err := randomToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.mu.Lock()
+	p.codes[code] = mockOIDCCode{challenge: query.Get("code_challenge"), claims: full}
+	p.mu.Unlock()
+	return url.Values{"code": {code}, "state": {query.Get("state")}}
+}
+
+//startOIDCLogin returns the url of the provider and the cookie with the state of the login
+func startOIDCLogin(t *testing.T, session *http.Cookie) (string, *http.Cookie) {
+	t.Helper()
+	target := loginOIDC.String()
+	r := httptest.NewRequest("GET", target, nil)
+	if session != nil {
+		r = httptest.NewRequest("GET", target+"?link=true", nil)
+		r.AddCookie(session)
+	}
+	w := httptest.NewRecorder()
+	oidcLoginHandler(w, r)
+	if w.Code != http.StatusFound {
+		t.Fatalf("login: status %d: %s", w.Code, w.Body.String())
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "OIDC" {
+			return w.Header().Get("Location"), c
+		}
+	}
+	t.Fatal("the login didn't set the state cookie")
+	return "", nil
+}
+
+//finishOIDCLogin calls the callback and returns where the browser is redirected
+func finishOIDCLogin(t *testing.T, cookie *http.Cookie, query url.Values) *url.URL {
+	t.Helper()
+	r := httptest.NewRequest("GET", oidcCallback.String()+"?"+query.Encode(), nil)
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	oidcCallbackHandler(w, r)
+	location, err := url.Parse(w.Header().Get("Location"))
+	if w.Code != http.StatusFound || err != nil {
+		t.Fatalf("callback: status %d: %s", w.Code, w.Body.String())
+	}
+	return location
+}
+
+//loginAs does the whole login and returns the id of the logged user, 0 and the error shown if it failed
+func (p *mockOIDCProvider) loginAs(t *testing.T, claims jwt.MapClaims) (int, string) {
+	t.Helper()
+	authURL, cookie := startOIDCLogin(t, nil)
+	location := finishOIDCLogin(t, cookie, p.authorize(t, authURL, claims))
+	if e := location.Query().Get("oidc_error"); e != "" {
+		return 0, e
+	}
+	if location.Query().Get("oidc") != "success" {
+		t.Fatalf("unexpected redirect %s", location)
+	}
+	id, err := strconv.Atoi(location.Query().Get("id"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id, ""
+}
+
+func randomSubject(t *testing.T) string {
+	t.Helper()
+	token, err := randomToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token[:24]
+}
+
+func TestNewOIDCLogin(t *testing.T) {
+	if o, err := NewOIDCLogin(OIDCConfig{}); o != nil || err != nil {
+		t.Errorf("without issuer got %v, %v, want the login disabled", o, err)
+	}
+	for _, redirect := range []string{"", oidcCallback.String(), "localhost:8080/oidc/callback", "ftp://blobber.example.com/oidc/callback"} {
+		if _, err := NewOIDCLogin(OIDCConfig{Issuer: "https://sso.example.com", ClientID: "blobber", RedirectURL: redirect}); err == nil {
+			t.Errorf("redirect url %q accepted", redirect)
+		}
+	}
+	if _, err := NewOIDCLogin(OIDCConfig{Issuer: "https://sso.example.com", ClientID: "blobber", RedirectURL: "https://blobber.example.com/oidc/callback"}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestOIDCCallbackState(t *testing.T) {
+	p := useMockOIDC(t, false)
+
+	authURL, cookie := startOIDCLogin(t, nil)
+	query := p.authorize(t, authURL, jwt.MapClaims{"sub": randomSubject(t)})
+	query.Set("state", "forged")
+	if e := finishOIDCLogin(t, cookie, query).Query().Get("oidc_error"); e != "Invalid state, try again" {
+		t.Errorf("callback with another state: error %q", e)
+	}
+
+	//without the cookie of the login the state can't be checked
+	authURL, _ = startOIDCLogin(t, nil)
+	query = p.authorize(t, authURL, jwt.MapClaims{"sub": randomSubject(t)})
+	if e := finishOIDCLogin(t, &http.Cookie{Name: "OIDC", Value: "invalid"}, query).Query().Get("oidc_error"); e != "Login expired, try again" {
+		t.Errorf("callback without the state cookie: error %q", e)
+	}
+}
+
+func TestOIDCNonce(t *testing.T) {
+	requireDB(t)
+	p := useMockOIDC(t, false)
+	if id, e := p.loginAs(t, jwt.MapClaims{"sub": randomSubject(t), "nonce": "replayed"}); id != 0 || e != "Login with the identity provider failed" {
+		t.Errorf("id token with another nonce: user %d, error %q", id, e)
+	}
+	if id, e := p.loginAs(t, jwt.MapClaims{"sub": randomSubject(t)}); id == 0 {
+		t.Errorf("login with the right nonce failed: %s", e)
+	}
+}
+
+func TestOIDCAccountLinking(t *testing.T) {
+	requireDB(t)
+	p := useMockOIDC(t, false)
+	useTestMailer(t)
+	owner := newTestUser(t)
+	verifyTestEmail(t, &owner, owner.Username+"@example.com")
+
+	//an email the provider didn't verify doesn't give access to the account with that email
+	id, e := p.loginAs(t, jwt.MapClaims{"sub": randomSubject(t), "email": owner.Email, "email_verified": false, "preferred_username": owner.Username})
+	if id == 0 || id == owner.ID {
+		t.Fatalf("login with an unverified email: user %d (owner %d), error %q", id, owner.ID, e)
+	}
+	created, err := QueryUserByID(id, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if created.EmailVerified || created.Username == owner.Username {
+		t.Errorf("the new user took the verified email or the username of the owner: %+v", created)
+	}
+
+	//a verified email links the identity to the account
+	subject := randomSubject(t)
+	if id, e = p.loginAs(t, jwt.MapClaims{"sub": subject, "email": owner.Email, "email_verified": true}); id != owner.ID {
+		t.Fatalf("login with the verified email: user %d, want %d, error %q", id, owner.ID, e)
+	}
+	//then the identity is enough, even when the email changes
+	if id, e = p.loginAs(t, jwt.MapClaims{"sub": subject, "email": "changed@example.com", "email_verified": true}); id != owner.ID {
+		t.Errorf("login of the linked identity: user %d, want %d, error %q", id, owner.ID, e)
+	}
+}
+
+func TestOIDCLinkFromSettings(t *testing.T) {
+	requireDB(t)
+	p := useMockOIDC(t, true)
+	user := newTestUser(t)
+	subject := randomSubject(t)
+
+	//with the signup disabled an unknown identity can't log in
+	if id, e := p.loginAs(t, jwt.MapClaims{"sub": subject}); id != 0 || e == "" {
+		t.Fatalf("login of an unknown identity: user %d, error %q", id, e)
+	}
+
+	token, err := NewJWT(user.Username, user.ID, user.SessionVersion, time.Now().Add(time.Hour).Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	authURL, cookie := startOIDCLogin(t, &http.Cookie{Name: "JWT", Value: token})
+	location := finishOIDCLogin(t, cookie, p.authorize(t, authURL, jwt.MapClaims{"sub": subject}))
+	if location.Path != settingsPage.String() || location.Query().Get("oidc_error") != "" {
+		t.Fatalf("link redirected to %s", location)
+	}
+
+	identities, err := user.GetOIDCIdentities()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(identities) != 1 || identities[0].Issuer != p.URL || identities[0].Subject != subject {
+		t.Errorf("identities %+v, want the subject %s of %s", identities, subject, p.URL)
+	}
+	if id, e := p.loginAs(t, jwt.MapClaims{"sub": subject}); id != user.ID {
+		t.Errorf("login after the link: user %d, want %d, error %q", id, user.ID, e)
+	}
+}
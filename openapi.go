@@ -0,0 +1,261 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+//the openapi document describes every route of newRouter, it's served at /openapi.json.
+//The server logs at startup the routes that don't match the document, the contract tests
+//(openapi_test.go) fail on them and on the responses that don't match their schema
+//go:embed openapi.json
+var openAPIDocument []byte
+
+//only the parts of openapi needed to check the responses
+type openAPISchema struct {
+	Ref        string                    `json:"$ref"`
+	Type       string                    `json:"type"`
+	Nullable   bool                      `json:"nullable"`
+	Enum       []interface{}             `json:"enum"`
+	Required   []string                  `json:"required"`
+	Properties map[string]*openAPISchema `json:"properties"`
+	Items      *openAPISchema            `json:"items"`
+	AllOf      []*openAPISchema          `json:"allOf"`
+	OneOf      []*openAPISchema          `json:"oneOf"`
+}
+
+type openAPIMediaType struct {
+	Schema *openAPISchema `json:"schema"`
+}
+
+type openAPIResponse struct {
+	Ref     string                      `json:"$ref"`
+	Content map[string]openAPIMediaType `json:"content"`
+}
+
+type openAPIOperation struct {
+	Responses map[string]openAPIResponse `json:"responses"`
+}
+
+type openAPISpec struct {
+	//path -> lowercase method -> operation
+	Paths      map[string]map[string]openAPIOperation `json:"paths"`
+	Components struct {
+		Schemas   map[string]*openAPISchema  `json:"schemas"`
+		Responses map[string]openAPIResponse `json:"responses"`
+	} `json:"components"`
+}
+
+//the mux templates have the regex of the variables ({id:[0-9]+}), openapi only the name
+var muxVariableRegex = regexp.MustCompile(`\{(\w+):[^}]+\}`)
+
+func openAPIPath(template string) string {
+	return muxVariableRegex.ReplaceAllString(template, "{$1}")
+}
+
+func loadOpenAPISpec() (*openAPISpec, error) {
+	var spec openAPISpec
+	if err := json.Unmarshal(openAPIDocument, &spec); err != nil {
+		return nil, fmt.Errorf("invalid openapi document: %v", err)
+	}
+	return &spec, nil
+}
+
+func (s *openAPISpec) resolve(schema *openAPISchema) *openAPISchema {
+	for schema != nil && schema.Ref != "" {
+		schema = s.Components.Schemas[strings.TrimPrefix(schema.Ref, "#/components/schemas/")]
+	}
+	return schema
+}
+
+//response returns the documented response of the operation for the status, the default one otherwise
+func (s *openAPISpec) response(op openAPIOperation, status int) (openAPIResponse, bool) {
+	response, ok := op.Responses[strconv.Itoa(status)]
+	if !ok {
+		response, ok = op.Responses["default"]
+	}
+	if ok && response.Ref != "" {
+		response, ok = s.Components.Responses[strings.TrimPrefix(response.Ref, "#/components/responses/")]
+	}
+	return response, ok
+}
+
+//validate checks a decoded json value against the schema, at is the position in the body for the errors
+func (s *openAPISpec) validate(schema *openAPISchema, value interface{}, at string) error {
+	schema = s.resolve(schema)
+	if schema == nil {
+		return nil
+	}
+
+	for _, sub := range schema.AllOf {
+		if err := s.validate(sub, value, at); err != nil {
+			return err
+		}
+	}
+	if len(schema.OneOf) > 0 {
+		matches := 0
+		for _, sub := range schema.OneOf {
+			if s.validate(sub, value, at) == nil {
+				matches++
+			}
+		}
+		if matches != 1 {
+			return fmt.Errorf("%s matches %d of the oneOf schemas instead of 1", at, matches)
+		}
+	}
+
+	if value == nil {
+		if schema.Type == "" || schema.Nullable {
+			return nil
+		}
+		return fmt.Errorf("%s is null, expected %s", at, schema.Type)
+	}
+
+	if len(schema.Enum) > 0 {
+		allowed := false
+		for _, e := range schema.Enum {
+			if e == value {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("%s is %v, not one of %v", at, value, schema.Enum)
+		}
+	}
+
+	ok := true
+	switch schema.Type {
+	case "object":
+		var object map[string]interface{}
+		if object, ok = value.(map[string]interface{}); !ok {
+			break
+		}
+		for _, name := range schema.Required {
+			if _, found := object[name]; !found {
+				return fmt.Errorf("%s.%s is required", at, name)
+			}
+		}
+		//sorted so the same body always reports the same error
+		names := make([]string, 0, len(schema.Properties))
+		for name := range schema.Properties {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			if v, found := object[name]; found {
+				if err := s.validate(schema.Properties[name], v, at+"."+name); err != nil {
+					return err
+				}
+			}
+		}
+	case "array":
+		var array []interface{}
+		if array, ok = value.([]interface{}); !ok {
+			break
+		}
+		for i, item := range array {
+			if err := s.validate(schema.Items, item, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		_, ok = value.(string)
+	case "integer":
+		var n float64
+		n, ok = value.(float64)
+		ok = ok && n == math.Trunc(n)
+	case "number":
+		_, ok = value.(float64)
+	case "boolean":
+		_, ok = value.(bool)
+	}
+	if !ok {
+		return fmt.Errorf("%s is %T, expected %s", at, value, schema.Type)
+	}
+	return nil
+}
+
+//checkResponse checks the status and the body of a response of the route
+func (s *openAPISpec) checkResponse(method, template string, status int, contentType string, body []byte) error {
+	op, ok := s.Paths[openAPIPath(template)][strings.ToLower(method)]
+	if !ok {
+		return fmt.Errorf("route not documented")
+	}
+	response, ok := s.response(op, status)
+	if !ok {
+		return fmt.Errorf("status %d not documented", status)
+	}
+	if len(response.Content) == 0 {
+		if len(body) > 0 && status != http.StatusNoContent && (status < 300 || status >= 400) {
+			return fmt.Errorf("status %d documented without body but the response has one", status)
+		}
+		return nil
+	}
+
+	mediaType := strings.TrimSpace(strings.Split(contentType, ";")[0])
+	content, ok := response.Content[mediaType]
+	if !ok {
+		return fmt.Errorf("content type %q not documented for status %d", mediaType, status)
+	}
+	if content.Schema == nil || mediaType != "application/json" {
+		return nil
+	}
+
+	var value interface{}
+	if err := json.Unmarshal(body, &value); err != nil {
+		return fmt.Errorf("invalid json body: %v", err)
+	}
+	return s.validate(content.Schema, value, "body")
+}
+
+//checkRoutes compares the routes of the router with the document, it returns the differences
+func (s *openAPISpec) checkRoutes(r *mux.Router) []string {
+	registered := make(map[string]bool)
+	var problems []string
+	r.Walk(func(route *mux.Route, router *mux.Router, ancestors []*mux.Route) error {
+		template, err := route.GetPathTemplate()
+		if err != nil {
+			return nil
+		}
+		//the subrouters have no methods, their routes are walked too
+		methods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		path := openAPIPath(template)
+		for _, method := range methods {
+			registered[method+" "+path] = true
+			if _, ok := s.Paths[path][strings.ToLower(method)]; !ok {
+				problems = append(problems, fmt.Sprintf("%s %s is registered but not documented", method, path))
+			}
+		}
+		return nil
+	})
+
+	for path, operations := range s.Paths {
+		for method := range operations {
+			if !registered[strings.ToUpper(method)+" "+path] {
+				problems = append(problems, fmt.Sprintf("%s %s is documented but not registered", strings.ToUpper(method), path))
+			}
+		}
+	}
+	sort.Strings(problems)
+	return problems
+}
+
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(openAPIDocument)
+}
@@ -0,0 +1,572 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+	"github.com/gorilla/mux"
+)
+
+//contractClient sends the requests to the router like a browser of the logged user and
+//fails the test when a response doesn't match the openapi document
+type contractClient struct {
+	t      *testing.T
+	spec   *openAPISpec
+	router *mux.Router
+	//the cookies set by the responses are sent with the next requests, like a browser does
+	cookies map[string]*http.Cookie
+	//the failed logins are counted by ip, every client has its own
+	ip string
+	//the operations of the document called by the client ("GET /users/{id}")
+	called map[string]bool
+}
+
+func newContractClient(t *testing.T) *contractClient {
+	t.Helper()
+	spec, err := loadOpenAPISpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &contractClient{
+		t:       t,
+		spec:    spec,
+		router:  newRouter(),
+		cookies: map[string]*http.Cookie{csrfCookieName: {Name: csrfCookieName, Value: "contract"}},
+		ip:      testIP(t),
+		called:  make(map[string]bool),
+	}
+}
+
+//login uses the session of the user for the next requests
+func (c *contractClient) login(user User) {
+	c.t.Helper()
+	token, err := NewJWT(user.Username, user.ID, user.SessionVersion, time.Now().Add(time.Hour).Unix())
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.cookies["JWT"] = &http.Cookie{Name: "JWT", Value: token}
+}
+
+func (c *contractClient) request(method, path, body string) *http.Request {
+	r := httptest.NewRequest(method, path, strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	return r
+}
+
+func (c *contractClient) do(method, path, body string) *httptest.ResponseRecorder {
+	c.t.Helper()
+	return c.send(c.request(method, path, body))
+}
+
+//send sends a request prepared by the test, es: with another content type
+func (c *contractClient) send(r *http.Request) *httptest.ResponseRecorder {
+	c.t.Helper()
+	r.RemoteAddr = c.ip + ":1234"
+	r.Header.Set(csrfHeaderName, "contract")
+	for _, cookie := range c.cookies {
+		r.AddCookie(cookie)
+	}
+
+	var match mux.RouteMatch
+	if !c.router.Match(r, &match) || match.Route == nil {
+		c.t.Fatalf("%s %s doesn't match any route", r.Method, r.URL)
+	}
+	template, err := match.Route.GetPathTemplate()
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.called[r.Method+" "+openAPIPath(template)] = true
+
+	w := httptest.NewRecorder()
+	RequestIDMiddleware(c.router).ServeHTTP(w, r)
+	for _, cookie := range w.Result().Cookies() {
+		if cookie.MaxAge < 0 || cookie.Value == "" {
+			delete(c.cookies, cookie.Name)
+		} else {
+			c.cookies[cookie.Name] = cookie
+		}
+	}
+	if err = c.spec.checkResponse(r.Method, template, w.Code, w.Header().Get("Content-Type"), w.Body.Bytes()); err != nil {
+		c.t.Errorf("%s %s (%d) doesn't match the document: %v\n%s", r.Method, r.URL, w.Code, err, w.Body.String())
+	}
+	return w
+}
+
+//expect sends the request and checks the status too
+func (c *contractClient) expect(method, path, body string, status int) *httptest.ResponseRecorder {
+	c.t.Helper()
+	return c.expectSent(c.request(method, path, body), status)
+}
+
+func (c *contractClient) expectSent(r *http.Request, status int) *httptest.ResponseRecorder {
+	c.t.Helper()
+	w := c.send(r)
+	if w.Code != status {
+		c.t.Errorf("%s %s: status %d, want %d: %s", r.Method, r.URL, w.Code, status, w.Body.String())
+	}
+	return w
+}
+
+//decode reads the field of the data of a response, es: the "blob" of {"blob": {...}}
+func (c *contractClient) decode(w *httptest.ResponseRecorder, field string, v interface{}) {
+	c.t.Helper()
+	var body map[string]json.RawMessage
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		c.t.Fatalf("invalid body %s: %v", w.Body.String(), err)
+	}
+	if err := json.Unmarshal(body[field], v); err != nil {
+		c.t.Fatalf("no %s in %s: %v", field, w.Body.String(), err)
+	}
+}
+
+//uncalled returns the operations of the document the client never called
+func (c *contractClient) uncalled() []string {
+	var missing []string
+	for path, operations := range c.spec.Paths {
+		for method := range operations {
+			if operation := strings.ToUpper(method) + " " + path; !c.called[operation] {
+				missing = append(missing, operation)
+			}
+		}
+	}
+	sort.Strings(missing)
+	return missing
+}
+
+func TestOpenAPIRoutes(t *testing.T) {
+	spec, err := loadOpenAPISpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, problem := range spec.checkRoutes(newRouter()) {
+		t.Error(problem)
+	}
+}
+
+func TestOpenAPICheckResponse(t *testing.T) {
+	spec, err := loadOpenAPISpec()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ok := `{"code": 200, "error": false, "msg": "ok", "blob": {"id": 1, "user_id": 2, "username": "gopher", "content": "ciao",
+		"added_date": "2022-09-01T12:00:00Z", "likes": 0, "liked": false, "is_owner": true}}`
+	if err = spec.checkResponse("GET", getBlob.String(), 200, "application/json", []byte(ok)); err != nil {
+		t.Errorf("valid response refused: %v", err)
+	}
+
+	tests := []struct {
+		name, template, contentType, body string
+		status                            int
+	}{
+		{"undocumented route", "/nowhere", "application/json", ok, 200},
+		{"wrong type", getBlob.String(), "application/json", `{"code": 200, "error": false, "msg": "ok", "blob": {"id": "1"}}`, 200},
+		{"missing required field", getBlob.String(), "application/json", `{"code": 200, "error": false, "blob": {"id": 1}}`, 200},
+		{"wrong content type", getBlob.String(), "text/html", ok, 200},
+		{"invalid json", getBlob.String(), "application/json", `{"code": 200`, 200},
+	}
+	for _, tt := range tests {
+		if err = spec.checkResponse("GET", tt.template, tt.status, tt.contentType, []byte(tt.body)); err == nil {
+			t.Errorf("%s: the response was accepted", tt.name)
+		}
+	}
+}
+
+func TestOpenAPIContract(t *testing.T) {
+	user := newTestUser(t)
+	other := newTestUser(t)
+	conf.BaseURL = "https://blobber.example.com"
+	c := newContractClient(t)
+
+	previous := trendingService
+	trendingService = newTestTrendingService(&fakeClock{now: time.Now()}, nil, nil)
+	trendingService.RefreshAll()
+	t.Cleanup(func() { trendingService = previous })
+
+	//without a session the api v2 answers 401, the legacy routes redirect to the login
+	c.expect("GET", openAPI.String(), "", 200)
+	c.expect("GET", "/images/blob", "", 200)
+	c.expect("GET", "/scripts/csrf.js", "", 200)
+	c.expect("GET", "/scripts/missing.js", "", 404)
+	c.expect("GET", login.String(), "", 200)
+	c.expect("GET", register.String(), "", 200)
+	c.expect("POST", login.String(), `{"username": "`+user.Username+`", "password": "wrong"}`, 401)
+	c.expect("GET", home.String(), "", 303)
+	c.expect("GET", getPasskeys.String(), "", 303)
+	c.expect("GET", v2Me.V2(), "", 401)
+	c.expect("GET", fmt.Sprintf("/users/%d/feed.rss", other.ID), "", 200)
+	c.expect("GET", fmt.Sprintf("/users/%d/feed.atom", other.ID), "", 200)
+	c.expect("GET", "/tags/golang/feed.rss", "", 200)
+	c.expect("GET", "/tags/golang/feed.atom", "", 200)
+	c.expect("GET", trending.String()+"?window=1h", "", 200)
+	c.expect("GET", trending.String()+"?window=1y", "", 400)
+
+	c.login(user)
+	otherPath := fmt.Sprintf("/users/%d", other.ID)
+
+	//pages
+	c.expect("GET", home.String(), "", 200)
+	c.expect("GET", searchPage.String(), "", 200)
+	c.expect("GET", settingsPage.String(), "", 200)
+	c.expect("GET", fmt.Sprintf("/users/page/%d", other.ID), "", 200)
+	c.expect("GET", "/u/"+other.Username, "", 301)
+
+	//users
+	c.expect("GET", overview.String(), "", 200)
+	c.expect("GET", otherPath, "", 200)
+	c.expect("GET", "/users/999999999", "", 404)
+	c.expect("GET", otherPath+"/blobs", "", 200)
+	c.expect("POST", otherPath+"/follow", "", 200)
+	c.expect("GET", otherPath+"/followers", "", 200)
+	c.expect("GET", fmt.Sprintf("/users/%d/following", user.ID), "", 200)
+	c.expect("POST", otherPath+"/unfollow", "", 200)
+	c.expect("GET", "/users/search/"+other.Username[:6], "", 200)
+	c.expect("GET", recommended.String(), "", 200)
+	c.expect("POST", modifyUser.String(), `{"content": "legacy description"}`, 200)
+
+	//blobs
+	w := c.expect("POST", v2Blobs.V2(), `{"content": "contract #test"}`, 201)
+	var created Blob
+	c.decode(w, "blob", &created)
+	blobPath := fmt.Sprintf("/blob/%d", created.ID)
+	c.expect("POST", addBlob.String(), `{"content": "legacy route"}`, 200)
+	c.expect("POST", addBlob.String(), `{"content": " "}`, 400)
+	c.expect("GET", blobPath, "", 200)
+	c.expect("GET", "/blob/999999999", "", 404)
+	c.expect("POST", blobPath+"/modify", `{"content": "contract #test edited"}`, 200)
+	c.expect("POST", blobPath+"/like/add", "", 200)
+	c.expect("POST", blobPath+"/like/remove", "", 200)
+	c.expect("POST", blobPath+"/like/toggle", "", 200)
+
+	//api v2
+	c.expect("GET", v2Me.V2(), "", 200)
+	c.expect("PUT", v2Me.V2(), `{"description": "api v2 description"}`, 200)
+	c.expect("GET", v2Users.V2()+"?q="+other.Username[:6], "", 200)
+	c.expect("GET", v2Users.V2(), "", 400)
+	c.expect("GET", v2Recommended.V2(), "", 200)
+	c.expect("GET", v2Feed.V2(), "", 200)
+	c.expect("GET", v2Trending.V2()+"?window=1h", "", 200)
+	c.expect("GET", apiV2.String()+otherPath, "", 200)
+	c.expect("GET", apiV2.String()+otherPath+"/blobs", "", 200)
+	c.expect("GET", apiV2.String()+otherPath+"/followers", "", 200)
+	c.expect("GET", apiV2.String()+otherPath+"/following", "", 200)
+	c.expect("POST", apiV2.String()+otherPath+"/followers/me", "", 204)
+	c.expect("DELETE", apiV2.String()+otherPath+"/followers/me", "", 204)
+	v2BlobPath := v2Blob.V2Path(strconv.Itoa(created.ID))
+	c.expect("GET", v2BlobPath, "", 200)
+	c.expect("PUT", v2BlobPath, `{"content": "contract #test"}`, 200)
+	c.expect("POST", v2BlobPath+"/likes/me", "", 204)
+	c.expect("DELETE", v2BlobPath+"/likes/me", "", 204)
+	w = c.expect("POST", v2Blobs.V2(), `{"content": "to delete"}`, 201)
+	var deleted Blob
+	c.decode(w, "blob", &deleted)
+	c.expect("DELETE", v2Blob.V2Path(strconv.Itoa(deleted.ID)), "", 204)
+	c.expect("POST", graphqlAPI.String(), `{"query": "{ me { username } }"}`, 200)
+
+	//settings
+	c.expect("GET", getPasskeys.String(), "", 200)
+	c.expect("GET", loginHistory.String(), "", 200)
+	contractOAuth(t, c)
+	contractWebhooks(t, c)
+	contractExports(t, c, other)
+	c.login(user)
+	contractFederation(t, c, user, created.ID)
+	contractOIDC(t, c)
+	contractPasskeys(t, c, user)
+
+	c.expect("POST", blobPath+"/delete", "", 200)
+	c.expect("GET", blobPath, "", 404)
+
+	contractAccount(t, c)
+
+	for _, operation := range c.uncalled() {
+		t.Errorf("%s is documented but the contract test never calls it", operation)
+	}
+}
+
+//contractOAuth authorizes an app of the logged user and exchanges the code for the tokens
+func contractOAuth(t *testing.T, c *contractClient) {
+	c.expect("GET", getOAuthApps.String(), "", 200)
+	c.expect("POST", getOAuthApps.String(), `{"name": ""}`, 400)
+	w := c.expect("POST", getOAuthApps.String(), `{"name": "contract", "redirect_uris": ["`+testRedirectURI+`"]}`, 201)
+	var app OAuthApp
+	c.decode(w, "app", &app)
+
+	verifier, err := randomToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256([]byte(verifier))
+	req := oauthAuthorizeRequest{ResponseType: "code", ClientID: app.ClientID, RedirectURI: testRedirectURI, Scope: "read",
+		State: "contract", CodeChallenge: base64.RawURLEncoding.EncodeToString(sum[:]), CodeChallengeMethod: "S256", Approve: true}
+	query := url.Values{"response_type": {req.ResponseType}, "client_id": {req.ClientID}, "redirect_uri": {req.RedirectURI}, "scope": {req.Scope},
+		"state": {req.State}, "code_challenge": {req.CodeChallenge}, "code_challenge_method": {req.CodeChallengeMethod}}
+	c.expect("GET", oauthAuthorize.String()+"?"+query.Encode(), "", 200)
+	answer, err := json.Marshal(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = c.expect("POST", oauthAuthorize.String(), string(answer), 200)
+	var redirect string
+	c.decode(w, "redirect", &redirect)
+	location, err := url.Parse(redirect)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token := func(form url.Values, status int) {
+		t.Helper()
+		r := httptest.NewRequest("POST", oauthToken.String(), strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		c.expectSent(r, status)
+	}
+	token(url.Values{"grant_type": {"password"}, "client_id": {app.ClientID}}, 400)
+	token(url.Values{"grant_type": {"authorization_code"}, "client_id": {"unknown"}}, 401)
+	token(url.Values{"grant_type": {"authorization_code"}, "client_id": {app.ClientID}, "code": {location.Query().Get("code")},
+		"redirect_uri": {testRedirectURI}, "code_verifier": {verifier}}, 200)
+
+	w = c.expect("GET", getOAuthGrants.String(), "", 200)
+	var grants []OAuthGrant
+	c.decode(w, "grants", &grants)
+	if len(grants) != 1 {
+		t.Fatalf("grants %+v, want the one of the app", grants)
+	}
+	c.expect("POST", fmt.Sprintf("/settings/grants/%d/revoke", grants[0].ID), "", 200)
+	c.expect("POST", fmt.Sprintf("/settings/apps/%d/delete", app.ID), "", 200)
+}
+
+//contractWebhooks registers a webhook of the logged user and sends it the test delivery
+func contractWebhooks(t *testing.T, c *contractClient) {
+	previous := webhookDispatcher
+	webhookDispatcher = newTestDispatcher(t, true)
+	t.Cleanup(func() { webhookDispatcher = previous })
+	rec := newWebhookReceiver(t)
+
+	w := c.expect("POST", getWebhooks.String(), `{"url": "`+rec.URL+`", "events": ["`+EventBlobCreated+`"]}`, 201)
+	var webhook struct {
+		ID     int    `json:"id"`
+		Secret string `json:"secret"`
+	}
+	c.decode(w, "webhook", &webhook)
+	rec.secret = webhook.Secret
+	c.expect("GET", getWebhooks.String(), "", 200)
+	c.expect("POST", fmt.Sprintf("/settings/webhooks/%d/test", webhook.ID), "", 200)
+	if received, invalid := rec.count(); received != 1 || invalid != 0 {
+		t.Errorf("test delivery: %d received and %d invalid, want 1 valid", received, invalid)
+	}
+	c.expect("GET", fmt.Sprintf("/settings/webhooks/%d/deliveries", webhook.ID), "", 200)
+	c.expect("POST", fmt.Sprintf("/settings/webhooks/%d/delete", webhook.ID), "", 200)
+	c.expect("GET", fmt.Sprintf("/settings/webhooks/%d/deliveries", webhook.ID), "", 400)
+}
+
+//contractExports exports the data of the logged user and imports the archive in the account of the other user
+func contractExports(t *testing.T, c *contractClient, other User) {
+	c.expect("POST", getExports.String(), "", 202)
+	c.expect("POST", getExports.String(), "", 409)
+	buildAllExports(t, NewExportWorker())
+	w := c.expect("GET", getExports.String(), "", 200)
+	var exports []Export
+	c.decode(w, "exports", &exports)
+	if len(exports) != 1 || exports[0].DownloadURL == "" {
+		t.Fatalf("exports %+v, want 1 ready", exports)
+	}
+	archive := c.expect("GET", exports[0].DownloadURL, "", 200).Body.Bytes()
+	c.expect("GET", strings.Replace(downloadExport.String(), "{token}", "missing", 1), "", 404)
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("archive", "export.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	part.Write(archive)
+	if err = form.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c.login(other)
+	r := httptest.NewRequest("POST", importArchive.String(), &body)
+	r.Header.Set("Content-Type", form.FormDataContentType())
+	c.expectSent(r, 200)
+}
+
+//contractFederation serves the actor of the user to a remote server, which follows it and is followed back
+func contractFederation(t *testing.T, c *contractClient, user User, blobID int) {
+	local := newAPInstance(t)
+	remote := newAPInstance(t)
+	useFederation(t, local)
+	bob := newTestUser(t)
+
+	c.expect("GET", webFinger.String()+"?resource=acct:"+user.Username+"@"+local.fed.host, "", 200)
+	c.expect("GET", webFinger.String()+"?resource=acct:"+user.Username+"@elsewhere.example", "", 404)
+	c.expect("GET", activityActor.Path(user.ID), "", 200)
+	c.expect("GET", activityOutbox.Path(user.ID), "", 200)
+	c.expect("GET", activityFollowers.Path(user.ID), "", 200)
+	c.expect("GET", activityFollowing.Path(user.ID), "", 200)
+	c.expect("GET", activityNote.Path(blobID), "", 200)
+
+	//bob of the remote server follows the user
+	key, _, err := userKey(bob.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	follow, err := json.Marshal(remote.fed.followActivity(bob.ID, RemoteActor{ID: 1, ActorID: local.fed.actorURL(user.ID)}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := httptest.NewRequest("POST", activityInbox.Path(user.ID), bytes.NewReader(follow))
+	r.Header.Set("Content-Type", ldContentType)
+	signAt(t, r, remote.fed.keyID(bob.ID), key, follow, time.Now())
+	c.expectSent(r, 202)
+	r = httptest.NewRequest("POST", activityInbox.Path(user.ID), bytes.NewReader(follow))
+	r.Header.Set("Content-Type", ldContentType)
+	c.expectSent(r, 401)
+	w := c.expect("GET", remoteFollowers.String(), "", 200)
+	var followers []RemoteActor
+	c.decode(w, "followers", &followers)
+	if len(followers) != 1 || followers[0].ActorID != remote.fed.actorURL(bob.ID) {
+		t.Errorf("remote followers %+v, want bob", followers)
+	}
+
+	//the user follows bob back
+	w = c.expect("POST", remoteFollowings.String(), `{"handle": "`+bob.Username+"@"+remote.fed.host+`"}`, 200)
+	var following RemoteFollowing
+	c.decode(w, "following", &following)
+	c.expect("GET", remoteFollowings.String(), "", 200)
+	c.expect("POST", fmt.Sprintf("/settings/federation/following/%d/delete", following.ID), "", 200)
+	c.expect("POST", fmt.Sprintf("/settings/federation/following/%d/delete", following.ID), "", 400)
+}
+
+//contractOIDC links an identity of the provider to the logged user and unlinks it
+func contractOIDC(t *testing.T, c *contractClient) {
+	p := useMockOIDC(t, false)
+	w := c.expect("GET", loginOIDC.String()+"?link=true", "", 302)
+	query := p.authorize(t, w.Header().Get("Location"), jwt.MapClaims{"sub": randomSubject(t)})
+	w = c.expect("GET", oidcCallback.String()+"?"+query.Encode(), "", 302)
+	if location := w.Header().Get("Location"); !strings.HasPrefix(location, settingsPage.String()) || strings.Contains(location, "oidc_error") {
+		t.Errorf("link redirected to %s", location)
+	}
+	c.expect("POST", unlinkOIDC.String(), "", 200)
+}
+
+//contractPasskeys registers a passkey of the user, logs in with it and signs up a new account with another one
+func contractPasskeys(t *testing.T, c *contractClient, user User) {
+	a := newSoftAuthenticator(t)
+	challenge, handle, _ := ceremonyOptions(t, c.expect("POST", beginPasskeyRegistration.String(), "", 200))
+	c.expect("POST", finishPasskeyRegistration.String(), string(a.create(t, challenge, handle)), 201)
+
+	a.signCount = 1
+	challenge, _, _ = ceremonyOptions(t, c.expect("POST", beginPasskeyLogin.String(), "", 200))
+	if w := c.expect("POST", finishPasskeyLogin.String(), string(a.get(t, challenge)), 200); !strings.Contains(w.Body.String(), user.Username) {
+		t.Errorf("passkey login: %s, want the user", w.Body.String())
+	}
+	w := c.expect("GET", getPasskeys.String(), "", 200)
+	var passkeys []Passkey
+	c.decode(w, "passkeys", &passkeys)
+	if len(passkeys) != 1 {
+		t.Fatalf("passkeys %+v, want the one registered", passkeys)
+	}
+	c.expect("POST", fmt.Sprintf("/settings/passkeys/%d/delete", passkeys[0].ID), "", 200)
+
+	token, err := randomToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge, handle, _ = ceremonyOptions(t, c.expect("POST", beginPasskeySignup.String(), `{"username": "t_`+token[:16]+`"}`, 200))
+	c.expect("POST", finishPasskeySignup.String(), string(newSoftAuthenticator(t).create(t, challenge, handle)), 201)
+}
+
+//mailedToken returns the token of the link after prefix in the last email sent
+func mailedToken(t *testing.T, m *testMailer, prefix string) string {
+	t.Helper()
+	sent := m.sent()
+	if len(sent) == 0 {
+		t.Fatal("no email sent")
+	}
+	body := sent[len(sent)-1].body
+	i := strings.Index(body, prefix)
+	if i < 0 {
+		t.Fatalf("no link %s in the email:\n%s", prefix, body)
+	}
+	return strings.Fields(body[i+len(prefix):])[0]
+}
+
+//contractAccount goes through the life of a new account: email, password reset, two factor
+//authentication, username and deletion
+func contractAccount(t *testing.T, c *contractClient) {
+	mails := useTestMailer(t)
+	token, err := randomToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	username := "t_" + token[:16]
+	c.expect("POST", register.String(), `{"username": "`+username+`", "password": "password"}`, 201)
+	c.expect("POST", register.String(), `{"username": "`+username+`", "password": "password"}`, 409)
+	c.expect("POST", login.String(), `{"username": "`+username+`", "password": "password"}`, 200)
+
+	verify := strings.Replace(verifyEmail.String(), "{token}", "", 1)
+	c.expect("POST", changeEmail.String(), `{"email": "`+username+`@example.com"}`, 200)
+	c.expect("GET", verify+mailedToken(t, mails, verify), "", 303)
+	c.expect("GET", verify+"invalid", "", 400)
+
+	//the reset revokes the sessions
+	c.expect("GET", forgotPassword.String(), "", 200)
+	c.expect("POST", forgotPassword.String(), `{"username": "`+username+`"}`, 200)
+	reset := mailedToken(t, mails, resetPassword.String()+"?token=")
+	c.expect("GET", resetPassword.String()+"?token="+reset, "", 200)
+	c.expect("POST", resetPassword.String(), `{"token": "`+reset+`", "new_password": "reset"}`, 200)
+	c.expect("GET", v2Me.V2(), "", 401)
+	c.expect("POST", login.String(), `{"username": "`+username+`", "password": "reset"}`, 200)
+	c.expect("POST", changePassword.String(), `{"password": "wrong", "new_password": "password"}`, 401)
+	c.expect("POST", changePassword.String(), `{"password": "reset", "new_password": "password"}`, 200)
+
+	//with the two factor authentication the login needs a code, here a recovery code
+	w := c.expect("POST", enrollTOTP.String(), "", 200)
+	var enrollment struct {
+		Secret string `json:"secret"`
+	}
+	c.decode(w, "totp", &enrollment)
+	code, err := hotp(enrollment.Secret, uint64(totpCounter(time.Now())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = c.expect("POST", confirmTOTP.String(), `{"code": "`+code+`"}`, 200)
+	var recovery []string
+	c.decode(w, "recovery_codes", &recovery)
+	if len(recovery) < 2 {
+		t.Fatalf("recovery codes %v, want at least 2", recovery)
+	}
+	c.expect("POST", logout.String(), "", 200)
+	c.expect("GET", home.String(), "", 303)
+	c.expect("POST", login.String(), `{"username": "`+username+`", "password": "password"}`, 200)
+	c.expect("GET", home.String(), "", 303)
+	c.expect("POST", loginSecondFactor.String(), `{"code": "000000"}`, 401)
+	c.expect("POST", loginSecondFactor.String(), `{"code": "`+recovery[0]+`"}`, 200)
+	c.expect("POST", disableTOTP.String(), `{"password": "password", "code": "`+recovery[1]+`"}`, 200)
+
+	//the old username keeps pointing to the user
+	renamed := "r_" + token[16:32]
+	c.expect("POST", changeUsername.String(), `{"username": "`+renamed+`"}`, 200)
+	c.expect("GET", "/u/"+username, "", 301)
+	c.expect("GET", v2Me.V2(), "", 200)
+
+	c.expect("POST", deleteUser.String(), "", 200)
+
+	//the api v2 deletes the account too, the old usernames stay reserved for a while
+	username = "t_" + token[32:48]
+	c.expect("POST", register.String(), `{"username": "`+username+`", "password": "password"}`, 201)
+	c.expect("POST", login.String(), `{"username": "`+username+`", "password": "password"}`, 200)
+	c.expect("DELETE", v2Me.V2(), "", 204)
+	c.expect("GET", v2Me.V2(), "", 401)
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+//transactional outbox: the domain functions save the event in the same transaction of the change,
+//so an event is never lost if the process dies after the commit. The relay reads the outbox, publishes
+//the events on the bus and marks them; the replicas take the GET_LOCK of the relay before every
+//batch so only one of them relays at a time. The delivery is at least once: an event published right
+//before a crash or whose subscribers failed is published again, the subscribers must tolerate duplicates.
+//A failed entry is retried with backoff and holds back the next ones, so the subscribers see the events
+//in order, until outboxMaxAttempts; then it's given up, marked as published with its last error
+type OutboxRelay struct {
+	bus      *EventBus
+	interval time.Duration
+	wake     chan struct{}
+
+	lastCleanup time.Time
+}
+
+const (
+	outboxBatchSize = 100
+	//the published events are kept for debugging, then deleted
+	outboxRetention       = time.Hour * time.Duration(24*7)
+	outboxCleanupInterval = time.Hour
+	//the retries of a failed entry wait 1s, 2s, 4s, ... about 2 minutes in total before it's given up
+	outboxMaxAttempts = 8
+	outboxRetryBase   = time.Second
+)
+
+var outboxRelay *OutboxRelay
+
+//the lock names are global to the mariadb server, the database name avoids clashes with other instances
+func outboxLockName() string {
+	return os.Getenv("DATABASE_NAME") + ".outbox_relay"
+}
+
+func NewOutboxRelay(bus *EventBus) *OutboxRelay {
+	return &OutboxRelay{
+		bus:      bus,
+		interval: time.Second,
+		wake:     make(chan struct{}, 1),
+	}
+}
+
+//writeOutbox saves the event in the transaction of the change
+func writeOutbox(tx *sql.Tx, e Event) error {
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO outbox (event, payload, created_at) VALUES (?, ?, ?)", e.EventName(), payload, time.Now())
+	return err
+}
+
+//writeWithEvent runs the query in a transaction and, if it changed some rows, saves in the outbox
+//the event returned by newEvent. The relay is woken after the commit
+func writeWithEvent(db *sql.DB, newEvent func(res sql.Result) (Event, error), query string, args ...interface{}) (sql.Result, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	//nothing changed, nothing happened
+	if n, _ := res.RowsAffected(); n == 0 {
+		return res, nil
+	}
+
+	e, err := newEvent(res)
+	if err != nil {
+		return nil, err
+	}
+	if err = writeOutbox(tx, e); err != nil {
+		return nil, err
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, err
+	}
+	outboxRelay.Wake()
+	return res, nil
+}
+
+//decodeOutboxEvent rebuilds the event saved by writeOutbox, the subscribers assert the value types
+func decodeOutboxEvent(name string, payload []byte) (Event, error) {
+	switch name {
+	case EventBlobCreated:
+		var event BlobCreated
+		err := json.Unmarshal(payload, &event)
+		return event, err
+	case EventBlobModified:
+		var event BlobModified
+		err := json.Unmarshal(payload, &event)
+		return event, err
+	case EventBlobDeleted:
+		var event BlobDeleted
+		err := json.Unmarshal(payload, &event)
+		return event, err
+	case EventBlobLiked:
+		var event BlobLiked
+		err := json.Unmarshal(payload, &event)
+		return event, err
+	case EventBlobUnliked:
+		var event BlobUnliked
+		err := json.Unmarshal(payload, &event)
+		return event, err
+	case EventUserFollowed:
+		var event UserFollowed
+		err := json.Unmarshal(payload, &event)
+		return event, err
+	case EventUserUnfollowed:
+		var event UserUnfollowed
+		err := json.Unmarshal(payload, &event)
+		return event, err
+	case EventUserDeleted:
+		var event UserDeleted
+		err := json.Unmarshal(payload, &event)
+		return event, err
+	}
+	return nil, fmt.Errorf("unknown event %s", name)
+}
+
+//Wake makes the relay read the outbox now instead of waiting for the next tick
+func (o *OutboxRelay) Wake() {
+	if o == nil {
+		return
+	}
+	select {
+	case o.wake <- struct{}{}:
+	default:
+	}
+}
+
+//Run relays the outbox every o.interval or when woken, it never returns so it should be called in a goroutine
+func (o *OutboxRelay) Run() {
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+	for {
+		for {
+			relayed, err := o.relayBatch()
+			if err != nil {
+				log.Printf("outbox: relay failed: %v", err)
+			}
+			//a full batch means there can be more
+			if err != nil || relayed < outboxBatchSize {
+				break
+			}
+		}
+		if time.Since(o.lastCleanup) > outboxCleanupInterval {
+			o.cleanup()
+		}
+		select {
+		case <-ticker.C:
+		case <-o.wake:
+		}
+	}
+}
+
+//outboxBackoff is the wait before publishing again an entry that failed attempts times
+func outboxBackoff(attempts int) time.Duration {
+	return outboxRetryBase << uint(attempts-1)
+}
+
+//relayBatch publishes the oldest events not published yet, it returns how many were published.
+//It does nothing if another replica holds the lock
+func (o *OutboxRelay) relayBatch() (int, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	//the lock belongs to the connection, if the replica dies mariadb releases it
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	var locked sql.NullInt64
+	if err = conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 0)", outboxLockName()).Scan(&locked); err != nil {
+		return 0, err
+	}
+	if !locked.Valid || locked.Int64 != 1 {
+		return 0, nil
+	}
+	defer func() {
+		var released sql.NullInt64
+		if err := conn.QueryRowContext(ctx, "SELECT RELEASE_LOCK(?)", outboxLockName()).Scan(&released); err != nil {
+			log.Printf("outbox: lock release failed: %v", err)
+		}
+	}()
+
+	rows, err := conn.QueryContext(ctx, `SELECT ID, event, payload, attempts, retry_at FROM outbox
+		WHERE published_at IS NULL ORDER BY ID LIMIT ?`, outboxBatchSize)
+	if err != nil {
+		return 0, err
+	}
+	type outboxEntry struct {
+		id       int64
+		event    string
+		payload  []byte
+		attempts int
+		retryAt  sql.NullTime
+	}
+	var entries []outboxEntry
+	for rows.Next() {
+		var entry outboxEntry
+		if err = rows.Scan(&entry.id, &entry.event, &entry.payload, &entry.attempts, &entry.retryAt); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		entries = append(entries, entry)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	//in order and marked one by one, a crash publishes again at most one event
+	for i, entry := range entries {
+		//the backoff of a failed entry holds back the next ones
+		if entry.retryAt.Valid && entry.retryAt.Time.After(time.Now()) {
+			return i, nil
+		}
+
+		e, err := decodeOutboxEvent(entry.event, entry.payload)
+		if err != nil {
+			//it would block the outbox forever, it's marked and skipped
+			log.Printf("outbox: entry %d skipped: %v", entry.id, err)
+		} else if err = o.bus.Publish(e); err != nil {
+			attempts := entry.attempts + 1
+			if attempts < outboxMaxAttempts {
+				log.Printf("outbox: entry %d (%s) failed, attempt %d: %v", entry.id, entry.event, attempts, err)
+				_, err = conn.ExecContext(ctx, "UPDATE outbox SET attempts = ?, last_error = ?, retry_at = ? WHERE ID = ?",
+					attempts, err.Error(), time.Now().Add(outboxBackoff(attempts)), entry.id)
+				return i, err
+			}
+			log.Printf("outbox: entry %d (%s) given up after %d attempts: %v", entry.id, entry.event, attempts, err)
+			_, err = conn.ExecContext(ctx, "UPDATE outbox SET attempts = ?, last_error = ?, published_at = ? WHERE ID = ?",
+				attempts, err.Error(), time.Now(), entry.id)
+			if err != nil {
+				return i, err
+			}
+			continue
+		}
+		if _, err = conn.ExecContext(ctx, "UPDATE outbox SET published_at = ? WHERE ID = ?", time.Now(), entry.id); err != nil {
+			return i, err
+		}
+	}
+	return len(entries), nil
+}
+
+//cleanup deletes the events published more than outboxRetention ago
+func (o *OutboxRelay) cleanup() {
+	o.lastCleanup = time.Now()
+
+	db, err := connectToDB()
+	if err != nil {
+		log.Printf("outbox: cleanup failed: %v", err)
+		return
+	}
+	defer db.Close()
+
+	if _, err = db.Exec("DELETE FROM outbox WHERE published_at < ?", time.Now().Add(-outboxRetention)); err != nil {
+		log.Printf("outbox: cleanup failed: %v", err)
+	}
+}
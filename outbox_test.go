@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"testing"
+	"time"
+)
+
+//drainOutbox relays until the outbox is empty or held back by a failed entry
+func drainOutbox(t *testing.T, relay *OutboxRelay) {
+	t.Helper()
+	for {
+		relayed, err := relay.relayBatch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if relayed < outboxBatchSize {
+			return
+		}
+	}
+}
+
+type outboxState struct {
+	attempts  int
+	lastError sql.NullString
+	published bool
+}
+
+//outboxEntryOf returns the state of the entry of the blob.created event of the blob
+func outboxEntryOf(t *testing.T, db *sql.DB, blobID int) (int64, outboxState) {
+	t.Helper()
+	rows, err := db.Query("SELECT ID, payload, attempts, last_error, published_at IS NOT NULL FROM outbox WHERE event = ? ORDER BY ID DESC LIMIT 50", EventBlobCreated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var payload []byte
+		var state outboxState
+		if err = rows.Scan(&id, &payload, &state.attempts, &state.lastError, &state.published); err != nil {
+			t.Fatal(err)
+		}
+		if e, err := decodeOutboxEvent(EventBlobCreated, payload); err == nil && e.(BlobCreated).BlobID == blobID {
+			return id, state
+		}
+	}
+	t.Fatalf("no outbox entry for blob %d", blobID)
+	return 0, outboxState{}
+}
+
+//retryNow skips the backoff of the entry
+func retryNow(t *testing.T, db *sql.DB, entryID int64) {
+	t.Helper()
+	if _, err := db.Exec("UPDATE outbox SET retry_at = ? WHERE ID = ?", time.Now().Add(-time.Second), entryID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOutboxRetry(t *testing.T) {
+	user := newTestUser(t)
+	db, err := connectToDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	//the subscriber fails twice for the first blob, then accepts it
+	var first, second int
+	calls := map[int]int{}
+	bus := NewEventBus(1)
+	bus.Subscribe(EventBlobCreated, func(e Event) error {
+		created := e.(BlobCreated)
+		calls[created.BlobID]++
+		if created.BlobID == first && calls[first] <= 2 {
+			return errors.New("subscriber down")
+		}
+		return nil
+	})
+	relay := NewOutboxRelay(bus)
+	drainOutbox(t, relay)
+
+	if first, err = AddBlob(user.ID, "outbox retry"); err != nil {
+		t.Fatal(err)
+	}
+	if second, err = AddBlob(user.ID, "outbox after the retry"); err != nil {
+		t.Fatal(err)
+	}
+	drainOutbox(t, relay)
+	entryID, state := outboxEntryOf(t, db, first)
+	if state.published || state.attempts != 1 || state.lastError.String != "subscriber down" {
+		t.Fatalf("failed entry %+v, want unpublished after 1 attempt", state)
+	}
+	//the next event waits so the subscribers see them in order
+	if calls[second] != 0 {
+		t.Error("the event after the failed one was published first")
+	}
+
+	//the backoff isn't over, nothing happens
+	drainOutbox(t, relay)
+	if calls[first] != 1 {
+		t.Errorf("the entry was published %d times before the backoff passed", calls[first])
+	}
+
+	retryNow(t, db, entryID)
+	drainOutbox(t, relay)
+	retryNow(t, db, entryID)
+	drainOutbox(t, relay)
+	if _, state = outboxEntryOf(t, db, first); !state.published || state.attempts != 2 || calls[first] != 3 {
+		t.Errorf("entry %+v published %d times, want published at the third time", state, calls[first])
+	}
+	if calls[second] != 1 {
+		t.Errorf("the next event was published %d times, want 1", calls[second])
+	}
+}
+
+func TestOutboxGiveUp(t *testing.T) {
+	user := newTestUser(t)
+	db, err := connectToDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var blobID, calls int
+	bus := NewEventBus(1)
+	bus.Subscribe(EventBlobCreated, func(e Event) error {
+		if e.(BlobCreated).BlobID != blobID {
+			return nil
+		}
+		calls++
+		return errors.New("broken subscriber")
+	})
+	relay := NewOutboxRelay(bus)
+	drainOutbox(t, relay)
+
+	if blobID, err = AddBlob(user.ID, "outbox give up"); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < outboxMaxAttempts+2; i++ {
+		drainOutbox(t, relay)
+		entryID, _ := outboxEntryOf(t, db, blobID)
+		retryNow(t, db, entryID)
+	}
+
+	//after the last attempt the entry stops holding back the others
+	_, state := outboxEntryOf(t, db, blobID)
+	if !state.published || state.attempts != outboxMaxAttempts || calls != outboxMaxAttempts || state.lastError.String == "" {
+		t.Errorf("entry %+v published %d times, want given up after %d attempts", state, calls, outboxMaxAttempts)
+	}
+}
+
+func TestOutboxBackoff(t *testing.T) {
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}
+	for i, wait := range want {
+		if got := outboxBackoff(i + 1); got != wait {
+			t.Errorf("backoff after %d attempts: %s, want %s", i+1, got, wait)
+		}
+	}
+}
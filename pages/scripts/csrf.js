@@ -0,0 +1,27 @@
+"use strict"
+
+//the server checks that the state changing requests carry the CSRF cookie in the X-CSRF-Token header,
+//fetch is wrapped so every request of the pages to blobber adds it
+(function () {
+    const originalFetch = window.fetch;
+
+    function csrfToken() {
+        let match = document.cookie.match(/(?:^|;\s*)CSRF=([^;]*)/);
+        return match ? match[1] : "";
+    }
+
+    function sameOrigin(resource) {
+        let url = new URL(resource instanceof Request ? resource.url : resource, window.location.href);
+        return url.origin == window.location.origin;
+    }
+
+    window.fetch = function (resource, options) {
+        options = options || {};
+        let method = (options.method || (resource instanceof Request ? resource.method : "GET")).toUpperCase();
+        if (!["GET", "HEAD", "OPTIONS"].includes(method) && sameOrigin(resource)) {
+            options.headers = new Headers(options.headers || {});
+            options.headers.set("X-CSRF-Token", csrfToken());
+        }
+        return originalFetch(resource, options);
+    };
+})();
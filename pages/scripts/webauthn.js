@@ -0,0 +1,84 @@
+"use strict"
+
+//the server sends the binary fields encoded in base64url, the browser api wants ArrayBuffers
+function base64urlToBuffer(value) {
+    let base64 = value.replace(/-/g, "+").replace(/_/g, "/");
+    while (base64.length % 4 != 0) {
+        base64 += "=";
+    }
+    return Uint8Array.from(atob(base64), c => c.charCodeAt(0)).buffer;
+}
+
+function bufferToBase64url(buffer) {
+    let binary = "";
+    new Uint8Array(buffer).forEach(b => binary += String.fromCharCode(b));
+    return btoa(binary).replace(/\+/g, "-").replace(/\//g, "_").replace(/=/g, "");
+}
+
+function passkeysSupported() {
+    return window.PublicKeyCredential !== undefined;
+}
+
+async function postJSONPasskey(url, data) {
+    let response = await fetch(url, {
+        method: 'POST',
+        headers: {
+            'Content-Type': 'application/json'
+        },
+        body: JSON.stringify(data)
+    });
+    return await response.json();
+}
+
+//registration ceremony: begin on the server, create the credential with the authenticator and finish on the server
+async function createPasskey(beginUrl, finishUrl, data, name) {
+    let begin = await postJSONPasskey(beginUrl, data);
+    if (begin.error) {
+        return begin;
+    }
+
+    let options = begin.options.publicKey;
+    options.challenge = base64urlToBuffer(options.challenge);
+    options.user.id = base64urlToBuffer(options.user.id);
+    if (options.excludeCredentials) {
+        options.excludeCredentials.forEach(c => c.id = base64urlToBuffer(c.id));
+    }
+
+    let credential = await navigator.credentials.create({ publicKey: options });
+    return await postJSONPasskey(finishUrl + "?name=" + encodeURIComponent(name), {
+        id: credential.id,
+        rawId: bufferToBase64url(credential.rawId),
+        type: credential.type,
+        response: {
+            attestationObject: bufferToBase64url(credential.response.attestationObject),
+            clientDataJSON: bufferToBase64url(credential.response.clientDataJSON),
+        },
+    });
+}
+
+//assertion ceremony: the authenticator chooses the account, the server answers like the password login
+async function loginWithPasskey() {
+    let begin = await postJSONPasskey('/webauthn/login/begin', {});
+    if (begin.error) {
+        return begin;
+    }
+
+    let options = begin.options.publicKey;
+    options.challenge = base64urlToBuffer(options.challenge);
+    if (options.allowCredentials) {
+        options.allowCredentials.forEach(c => c.id = base64urlToBuffer(c.id));
+    }
+
+    let assertion = await navigator.credentials.get({ publicKey: options });
+    return await postJSONPasskey('/webauthn/login/finish', {
+        id: assertion.id,
+        rawId: bufferToBase64url(assertion.rawId),
+        type: assertion.type,
+        response: {
+            authenticatorData: bufferToBase64url(assertion.response.authenticatorData),
+            clientDataJSON: bufferToBase64url(assertion.response.clientDataJSON),
+            signature: bufferToBase64url(assertion.response.signature),
+            userHandle: assertion.response.userHandle ? bufferToBase64url(assertion.response.userHandle) : null,
+        },
+    });
+}
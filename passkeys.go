@@ -0,0 +1,663 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/gorilla/mux"
+)
+
+type WebAuthnConfig struct {
+	//domain of the instance, es: blobber.example.com
+	RPID string `yaml:"rp_id"`
+	//origin the browser uses to reach blobber, es: https://blobber.example.com
+	Origin string `yaml:"origin"`
+}
+
+//the webauthn relying party, created in main
+var webAuthn *webauthn.WebAuthn
+
+//how long the user has to complete a registration or an assertion
+const webAuthnCeremonyDuration = time.Minute * time.Duration(5)
+
+//Passkey is a webauthn credential of a user as shown in the settings
+type Passkey struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	CreatedAt time.Time `json:"created_at"`
+	LastUsed  time.Time `json:"last_used"`
+}
+
+//passkeyUser adapts the user to the webauthn.User interface, the id of the user for the
+//authenticators is a random handle so it doesn't leak the id of the account
+type passkeyUser struct {
+	User
+	handle      []byte
+	credentials []webauthn.Credential
+}
+
+func (u passkeyUser) WebAuthnID() []byte {
+	return u.handle
+}
+
+func (u passkeyUser) WebAuthnName() string {
+	return u.Username
+}
+
+func (u passkeyUser) WebAuthnDisplayName() string {
+	return u.Username
+}
+
+func (u passkeyUser) WebAuthnIcon() string {
+	return ""
+}
+
+func (u passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+	return u.credentials
+}
+
+func NewWebAuthn(c WebAuthnConfig) (*webauthn.WebAuthn, error) {
+	rpID := c.RPID
+	if rpID == "" {
+		rpID = "localhost"
+	}
+	origin := c.Origin
+	if origin == "" {
+		origin = "http://localhost:8080"
+	}
+
+	return webauthn.New(&webauthn.Config{
+		RPDisplayName: "Blobber",
+		RPID:          rpID,
+		RPOrigin:      origin,
+	})
+}
+
+//loadPasskeyUser loads the handle and the credentials of the user, the handle is created the first time
+func loadPasskeyUser(user User) (passkeyUser, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return passkeyUser{}, err
+	}
+	defer db.Close()
+
+	p := passkeyUser{User: user}
+	var handle sql.NullString
+	err = db.QueryRow("SELECT webauthn_handle FROM users WHERE ID = ?", user.ID).Scan(&handle)
+	if err != nil {
+		return passkeyUser{}, err
+	}
+
+	if !handle.Valid {
+		handle.String, err = randomToken()
+		if err != nil {
+			return passkeyUser{}, err
+		}
+		_, err = db.Exec("UPDATE users SET webauthn_handle = ? WHERE ID = ?", handle.String, user.ID)
+		if err != nil {
+			return passkeyUser{}, err
+		}
+	}
+	p.handle = []byte(handle.String)
+
+	rows, err := db.Query("SELECT credential_id, public_key, attestation_type, aaguid, sign_count FROM webauthn_credentials WHERE ID_user = ?", user.ID)
+	if err != nil {
+		return passkeyUser{}, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var c webauthn.Credential
+		err = rows.Scan(&c.ID, &c.PublicKey, &c.AttestationType, &c.Authenticator.AAGUID, &c.Authenticator.SignCount)
+		if err != nil {
+			return passkeyUser{}, err
+		}
+		p.credentials = append(p.credentials, c)
+	}
+	return p, rows.Err()
+}
+
+//queryPasskeyUserByHandle is used by the discoverable login, the authenticator returns the handle of the user
+func queryPasskeyUserByHandle(handle []byte) (passkeyUser, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return passkeyUser{}, err
+	}
+	defer db.Close()
+
+	var id int
+	err = db.QueryRow("SELECT ID FROM users WHERE webauthn_handle = ?", string(handle)).Scan(&id)
+	if err != nil {
+		return passkeyUser{}, err
+	}
+
+	user, err := QueryUserByID(id, 0)
+	if err != nil {
+		return passkeyUser{}, err
+	}
+	return loadPasskeyUser(user)
+}
+
+func addPasskey(tx *sql.Tx, userID int, name string, c *webauthn.Credential) error {
+	_, err := tx.Exec("INSERT INTO webauthn_credentials (ID_user, name, credential_id, public_key, attestation_type, aaguid, sign_count) VALUES (?, ?, ?, ?, ?, ?, ?)",
+		userID, name, c.ID, c.PublicKey, c.AttestationType, c.Authenticator.AAGUID, c.Authenticator.SignCount)
+	return err
+}
+
+//AddPasskey saves a new credential of the user
+func (u User) AddPasskey(name string, c *webauthn.Credential) error {
+	db, err := connectToDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if err = addPasskey(tx, u.ID, name, c); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+//AddPasskeyUser creates a user without a password, the passkey is the only way to login
+func AddPasskeyUser(username, handle, name string, c *webauthn.Credential) (User, error) {
+	taken, err := usernameTaken(username, 0)
+	if err != nil {
+		return User{}, err
+	}
+	if taken {
+		return User{}, fmt.Errorf("%w: user already exists", errConflict)
+	}
+
+	db, err := connectToDB()
+	if err != nil {
+		return User{}, err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return User{}, err
+	}
+	defer tx.Rollback()
+
+	//the empty password never matches the hash of a password so the password login is disabled
+	res, err := tx.Exec("INSERT INTO users (username, password, description, webauthn_handle) VALUES (?, '', '', ?)", username, handle)
+	if isDuplicateEntry(err) {
+		return User{}, fmt.Errorf("%w: user already exists", errConflict)
+	}
+	if err != nil {
+		return User{}, err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return User{}, err
+	}
+
+	if err = addPasskey(tx, int(id), name, c); err != nil {
+		return User{}, err
+	}
+	if err = tx.Commit(); err != nil {
+		return User{}, err
+	}
+	return QueryUserByID(int(id), 0)
+}
+
+//updatePasskeyUsage saves the new signature counter of the credential
+func updatePasskeyUsage(credentialID []byte, signCount uint32) error {
+	db, err := connectToDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec("UPDATE webauthn_credentials SET sign_count = ?, last_used = NOW() WHERE credential_id = ?", signCount, credentialID)
+	return err
+}
+
+func (u User) GetPasskeys() ([]Passkey, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return []Passkey{}, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT ID, name, created_at, IFNULL(last_used, created_at) FROM webauthn_credentials WHERE ID_user = ? ORDER BY created_at", u.ID)
+	if err != nil {
+		return []Passkey{}, err
+	}
+	defer rows.Close()
+
+	var passkeys []Passkey
+	for rows.Next() {
+		var p Passkey
+		if err = rows.Scan(&p.ID, &p.Name, &p.CreatedAt, &p.LastUsed); err != nil {
+			return []Passkey{}, err
+		}
+		passkeys = append(passkeys, p)
+	}
+	return passkeys, rows.Err()
+}
+
+func (u User) DeletePasskey(id int) error {
+	db, err := connectToDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	//a user without password can't remove the last passkey, the account would be locked out
+	if u.Password == "" {
+		var count int
+		if err = db.QueryRow("SELECT COUNT(*) FROM webauthn_credentials WHERE ID_user = ?", u.ID).Scan(&count); err != nil {
+			return err
+		}
+		if count <= 1 {
+			return fmt.Errorf("%w: the last passkey of an account without password can't be removed", errBadRequest)
+		}
+	}
+
+	res, err := db.Exec("DELETE FROM webauthn_credentials WHERE ID = ? AND ID_user = ?", id, u.ID)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%w: passkey not found", errBadRequest)
+	}
+	return nil
+}
+
+//the session data of the ceremony is kept in the database and the cookie has only a random token,
+//the row is deleted when the ceremony is finished so the same challenge can't be answered twice
+type webAuthnCeremony struct {
+	Session webauthn.SessionData `json:"session"`
+	//only for the registration of a new account
+	Username string `json:"username,omitempty"`
+	Handle   string `json:"handle,omitempty"`
+}
+
+func setCeremonyCookie(w http.ResponseWriter, r *http.Request, purpose string, ceremony webAuthnCeremony) error {
+	data, err := json.Marshal(ceremony)
+	if err != nil {
+		return err
+	}
+	token, err := randomToken()
+	if err != nil {
+		return err
+	}
+
+	db, err := connectToDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	//the ceremonies never finished are removed when a new one starts
+	if _, err = db.Exec("DELETE FROM webauthn_ceremonies WHERE expires_at < NOW()"); err != nil {
+		return err
+	}
+	expiration := time.Now().Add(webAuthnCeremonyDuration)
+	_, err = db.Exec("INSERT INTO webauthn_ceremonies (token, purpose, data, expires_at) VALUES (?, ?, ?, ?)", hashToken(token), purpose, string(data), expiration)
+	if err != nil {
+		return err
+	}
+
+	setCookie(w, r, &http.Cookie{
+		Name:     "WEBAUTHN",
+		Value:    token,
+		Path:     "/webauthn",
+		Expires:  expiration,
+		HttpOnly: true,
+	})
+	return nil
+}
+
+//readCeremonyCookie returns the ceremony started with the given purpose, the cookie and the ceremony are deleted
+func readCeremonyCookie(w http.ResponseWriter, r *http.Request, purpose string) (webAuthnCeremony, error) {
+	cookie, err := r.Cookie("WEBAUTHN")
+	if err != nil {
+		return webAuthnCeremony{}, err
+	}
+	setCookie(w, r, &http.Cookie{Name: "WEBAUTHN", Value: "", Path: "/webauthn", MaxAge: -1, HttpOnly: true})
+
+	db, err := connectToDB()
+	if err != nil {
+		return webAuthnCeremony{}, err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return webAuthnCeremony{}, err
+	}
+	defer tx.Rollback()
+
+	//the row is locked so concurrent requests with the same cookie can't both finish the ceremony
+	var id int
+	var data string
+	err = tx.QueryRow("SELECT ID, data FROM webauthn_ceremonies WHERE token = ? AND purpose = ? AND expires_at > NOW() FOR UPDATE", hashToken(cookie.Value), purpose).Scan(&id, &data)
+	if err == sql.ErrNoRows {
+		return webAuthnCeremony{}, fmt.Errorf("ceremony not found or expired")
+	}
+	if err != nil {
+		return webAuthnCeremony{}, err
+	}
+	if _, err = tx.Exec("DELETE FROM webauthn_ceremonies WHERE ID = ?", id); err != nil {
+		return webAuthnCeremony{}, err
+	}
+	if err = tx.Commit(); err != nil {
+		return webAuthnCeremony{}, err
+	}
+
+	var ceremony webAuthnCeremony
+	err = json.Unmarshal([]byte(data), &ceremony)
+	return ceremony, err
+}
+
+//the name of a new passkey is given as query parameter since the body is the authenticator response
+func passkeyName(r *http.Request) string {
+	name := strings.TrimSpace(r.URL.Query().Get("name"))
+	if name == "" {
+		name = "Passkey"
+	}
+	if len(name) > 64 {
+		name = name[:64]
+	}
+	return name
+}
+
+//* passkeys's handlers
+//registration of a passkey for the logged user
+func beginPasskeyRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	user, err := QueryUserByID(jwtContent.UserID, 0)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	pUser, err := loadPasskeyUser(user)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	//the credentials already registered are excluded so the same authenticator isn't registered twice
+	var exclude []protocol.CredentialDescriptor
+	for _, c := range pUser.credentials {
+		exclude = append(exclude, c.Descriptor())
+	}
+
+	options, session, err := webAuthn.BeginRegistration(pUser,
+		webauthn.WithExclusions(exclude),
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementPreferred))
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	err = setCeremonyCookie(w, r, "webauthn-register", webAuthnCeremony{Session: *session})
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	optionsJSON, _ := json.Marshal(options)
+	returnSuccessJson(w, http.StatusOK, "registration started", "options", optionsJSON)
+}
+
+func finishPasskeyRegistrationHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	ceremony, err := readCeremonyCookie(w, r, "webauthn-register")
+	if err != nil {
+		returnError(w, http.StatusBadRequest, "Registration expired, try again")
+		return
+	}
+
+	user, err := QueryUserByID(jwtContent.UserID, 0)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	pUser, err := loadPasskeyUser(user)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	credential, err := webAuthn.FinishRegistration(pUser, ceremony.Session, r)
+	if err != nil {
+		log.Printf("[%s] passkey refused: %v", w.Header().Get(requestIDHeader), err)
+		returnError(w, http.StatusBadRequest, "Invalid passkey")
+		return
+	}
+
+	err = user.AddPasskey(passkeyName(r), credential)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	returnSuccess(w, http.StatusCreated, "passkey added successfully")
+}
+
+//registration of a new account without password
+func beginPasskeySignupHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	var post Post
+	err := json.NewDecoder(r.Body).Decode(&post)
+	if err != nil {
+		returnError(w, http.StatusBadRequest, "Invalid json")
+		return
+	}
+
+	post.Username = strings.TrimSpace(post.Username)
+	if !usernameRegex.MatchString(post.Username) {
+		returnError(w, http.StatusBadRequest, "the username must be 3 to 20 letters, numbers, dots or underscores")
+		return
+	}
+
+	taken, err := usernameTaken(post.Username, 0)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+	if taken {
+		returnError(w, http.StatusConflict, "user already exists")
+		return
+	}
+
+	//the user is created only when the ceremony is completed
+	handle, err := randomToken()
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+	pUser := passkeyUser{User: User{Username: post.Username}, handle: []byte(handle)}
+
+	options, session, err := webAuthn.BeginRegistration(pUser,
+		webauthn.WithResidentKeyRequirement(protocol.ResidentKeyRequirementRequired))
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	err = setCeremonyCookie(w, r, "webauthn-signup", webAuthnCeremony{Session: *session, Username: post.Username, Handle: handle})
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	optionsJSON, _ := json.Marshal(options)
+	returnSuccessJson(w, http.StatusOK, "registration started", "options", optionsJSON)
+}
+
+func finishPasskeySignupHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	ceremony, err := readCeremonyCookie(w, r, "webauthn-signup")
+	if err != nil {
+		returnError(w, http.StatusBadRequest, "Registration expired, try again")
+		return
+	}
+
+	pUser := passkeyUser{User: User{Username: ceremony.Username}, handle: []byte(ceremony.Handle)}
+	credential, err := webAuthn.FinishRegistration(pUser, ceremony.Session, r)
+	if err != nil {
+		log.Printf("[%s] passkey refused: %v", w.Header().Get(requestIDHeader), err)
+		returnError(w, http.StatusBadRequest, "Invalid passkey")
+		return
+	}
+
+	_, err = AddPasskeyUser(ceremony.Username, ceremony.Handle, passkeyName(r), credential)
+	if err != nil {
+		returnDomainError(w, err)
+		return
+	}
+
+	returnSuccess(w, http.StatusCreated, "successfully registered, you can now login with your passkey")
+}
+
+//passwordless login, the authenticator chooses the account (discoverable credentials)
+func beginPasskeyLoginHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	options, session, err := webAuthn.BeginDiscoverableLogin()
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	err = setCeremonyCookie(w, r, "webauthn-login", webAuthnCeremony{Session: *session})
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	optionsJSON, _ := json.Marshal(options)
+	returnSuccessJson(w, http.StatusOK, "login started", "options", optionsJSON)
+}
+
+func finishPasskeyLoginHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	ceremony, err := readCeremonyCookie(w, r, "webauthn-login")
+	if err != nil {
+		returnError(w, http.StatusBadRequest, "Login expired, try again")
+		return
+	}
+
+	parsed, err := protocol.ParseCredentialRequestResponse(r)
+	if err != nil {
+		log.Printf("[%s] passkey response refused: %v", w.Header().Get(requestIDHeader), err)
+		returnError(w, http.StatusBadRequest, "Invalid passkey response")
+		return
+	}
+
+	var user User
+	credential, err := webAuthn.ValidateDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+		pUser, err := queryPasskeyUserByHandle(userHandle)
+		user = pUser.User
+		return pUser, err
+	}, ceremony.Session, parsed)
+	if err != nil {
+		returnError(w, http.StatusUnauthorized, "Invalid credentials")
+		return
+	}
+
+	//a counter that didn't increase means another copy of the key was used, the stored counter isn't updated
+	//so the passkey keeps being refused until the user removes it
+	if credential.Authenticator.CloneWarning {
+		log.Printf("passkey of user %d may be cloned, the signature counter didn't increase, login refused", user.ID)
+		returnError(w, http.StatusUnauthorized, "This passkey may have been cloned, use another login method and remove it")
+		return
+	}
+	err = updatePasskeyUsage(credential.ID, credential.Authenticator.SignCount)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	//same session of the password login
+	err = completeLogin(w, r, user, "passkey")
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	user.Password = "-hidden-"
+	userJson, _ := json.Marshal(user)
+	returnSuccessJson(w, http.StatusOK, "Successfully logged in", "user", userJson)
+}
+
+func getPasskeysHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	user, err := QueryUserByID(jwtContent.UserID, 0)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	passkeys, err := user.GetPasskeys()
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	passkeysJSON, _ := json.Marshal(passkeys)
+	returnSuccessJson(w, http.StatusOK, "Successfully retrieved passkeys", "passkeys", passkeysJSON)
+}
+
+func deletePasskeyHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		returnError(w, http.StatusBadRequest, "Invalid passkey id")
+		return
+	}
+
+	user, err := QueryUserByID(jwtContent.UserID, 0)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	err = user.DeletePasskey(id)
+	if err != nil {
+		returnDomainError(w, err)
+		return
+	}
+
+	returnSuccess(w, http.StatusOK, "passkey removed successfully")
+}
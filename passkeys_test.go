@@ -0,0 +1,250 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+)
+
+const testOrigin = "http://localhost:8080"
+
+//softAuthenticator is a passkey kept in memory that answers the ceremonies like the browser would
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	handle       []byte
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := make([]byte, 32)
+	if _, err = rand.Read(id); err != nil {
+		t.Fatal(err)
+	}
+	return &softAuthenticator{key: key, credentialID: id}
+}
+
+func (a *softAuthenticator) authData(flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte("localhost"))
+	data := append([]byte{}, rpIDHash[:]...)
+	data = append(data, flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[len(data)-4:], a.signCount)
+	return data
+}
+
+func clientData(t *testing.T, ceremony, challenge string) []byte {
+	t.Helper()
+	data, err := json.Marshal(map[string]string{"type": ceremony, "challenge": challenge, "origin": testOrigin})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+//create returns the body of the finish request with an attestation of type none
+func (a *softAuthenticator) create(t *testing.T, challenge string, handle []byte) []byte {
+	t.Helper()
+	a.handle = handle
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{KeyType: int64(webauthncose.EllipticKey), Algorithm: int64(webauthncose.AlgES256)},
+		Curve:         1,
+		XCoord:        a.key.X.FillBytes(make([]byte, 32)),
+		YCoord:        a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//user present, user verified and attested credential data
+	authData := a.authData(0x45)
+	authData = append(authData, make([]byte, 16)...)
+	authData = append(authData, byte(len(a.credentialID)>>8), byte(len(a.credentialID)))
+	authData = append(authData, a.credentialID...)
+	authData = append(authData, publicKey...)
+
+	attestation, err := webauthncbor.Marshal(map[string]interface{}{"fmt": "none", "attStmt": map[string]interface{}{}, "authData": authData})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a.credential(t, map[string]string{
+		"clientDataJSON":    base64.RawURLEncoding.EncodeToString(clientData(t, "webauthn.create", challenge)),
+		"attestationObject": base64.RawURLEncoding.EncodeToString(attestation),
+	})
+}
+
+//get returns the body of the finish request with the assertion signed with the counter of the authenticator
+func (a *softAuthenticator) get(t *testing.T, challenge string) []byte {
+	t.Helper()
+	authData := a.authData(0x05)
+	client := clientData(t, "webauthn.get", challenge)
+	clientHash := sha256.Sum256(client)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a.credential(t, map[string]string{
+		"clientDataJSON":    base64.RawURLEncoding.EncodeToString(client),
+		"authenticatorData": base64.RawURLEncoding.EncodeToString(authData),
+		"signature":         base64.RawURLEncoding.EncodeToString(signature),
+		"userHandle":        base64.RawURLEncoding.EncodeToString(a.handle),
+	})
+}
+
+func (a *softAuthenticator) credential(t *testing.T, response map[string]string) []byte {
+	t.Helper()
+	id := base64.RawURLEncoding.EncodeToString(a.credentialID)
+	body, err := json.Marshal(map[string]interface{}{"id": id, "rawId": id, "type": "public-key", "response": response})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+//beginCeremony calls the begin handler and returns the options for the authenticator and the cookie of the ceremony
+func beginCeremony(t *testing.T, handler http.HandlerFunc, body string) (challenge string, handle []byte, cookie *http.Cookie) {
+	t.Helper()
+	w := httptest.NewRecorder()
+	handler(w, httptest.NewRequest("POST", "/webauthn", strings.NewReader(body)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("begin of the ceremony: status %d: %s", w.Code, w.Body.String())
+	}
+	return ceremonyOptions(t, w)
+}
+
+//ceremonyOptions reads the answer of a begin handler
+func ceremonyOptions(t *testing.T, w *httptest.ResponseRecorder) (challenge string, handle []byte, cookie *http.Cookie) {
+	t.Helper()
+	var resp struct {
+		Options struct {
+			PublicKey struct {
+				Challenge []byte `json:"challenge"`
+				User      struct {
+					ID []byte `json:"id"`
+				} `json:"user"`
+			} `json:"publicKey"`
+		} `json:"options"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range w.Result().Cookies() {
+		if c.Name == "WEBAUTHN" {
+			cookie = c
+		}
+	}
+	if cookie == nil || len(resp.Options.PublicKey.Challenge) == 0 {
+		t.Fatalf("no challenge or ceremony cookie: %s", w.Body.String())
+	}
+	//the client data has the challenge in base64url
+	return base64.RawURLEncoding.EncodeToString(resp.Options.PublicKey.Challenge), resp.Options.PublicKey.User.ID, cookie
+}
+
+func finishCeremony(handler http.HandlerFunc, cookie *http.Cookie, body []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/webauthn", bytes.NewReader(body))
+	r.AddCookie(cookie)
+	w := httptest.NewRecorder()
+	handler(w, r)
+	return w
+}
+
+//signupWithPasskey registers a new account with the authenticator
+func signupWithPasskey(t *testing.T, a *softAuthenticator) string {
+	t.Helper()
+	requireDB(t)
+	token, err := randomToken()
+	if err != nil {
+		t.Fatal(err)
+	}
+	username := "t_" + token[:16]
+
+	challenge, handle, cookie := beginCeremony(t, beginPasskeySignupHandler, `{"username": "`+username+`"}`)
+	body := a.create(t, challenge, handle)
+	if w := finishCeremony(finishPasskeySignupHandler, cookie, body); w.Code != http.StatusCreated {
+		t.Fatalf("signup: status %d: %s", w.Code, w.Body.String())
+	}
+	//the same response can't create the account again
+	if w := finishCeremony(finishPasskeySignupHandler, cookie, body); w.Code != http.StatusBadRequest {
+		t.Errorf("replayed signup: status %d, want 400: %s", w.Code, w.Body.String())
+	}
+	return username
+}
+
+func TestPasskeyLogin(t *testing.T) {
+	a := newSoftAuthenticator(t)
+	username := signupWithPasskey(t, a)
+
+	a.signCount = 1
+	challenge, _, cookie := beginCeremony(t, beginPasskeyLoginHandler, "")
+	body := a.get(t, challenge)
+	w := finishCeremony(finishPasskeyLoginHandler, cookie, body)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), username) {
+		t.Fatalf("login: status %d: %s", w.Code, w.Body.String())
+	}
+	session := false
+	for _, c := range w.Result().Cookies() {
+		session = session || (c.Name == "JWT" && c.Value != "")
+	}
+	if !session {
+		t.Error("the login didn't set the session cookie")
+	}
+
+	//the captured assertion and cookie can't be used again
+	if w = finishCeremony(finishPasskeyLoginHandler, cookie, body); w.Code != http.StatusBadRequest {
+		t.Errorf("replayed login: status %d, want 400: %s", w.Code, w.Body.String())
+	}
+
+	//the assertion is bound to the challenge of its ceremony
+	_, _, other := beginCeremony(t, beginPasskeyLoginHandler, "")
+	if w = finishCeremony(finishPasskeyLoginHandler, other, body); w.Code != http.StatusUnauthorized {
+		t.Errorf("assertion of another ceremony: status %d, want 401: %s", w.Code, w.Body.String())
+	}
+
+	//a ceremony of another purpose can't be finished as a login
+	challenge, _, signup := beginCeremony(t, beginPasskeySignupHandler, `{"username": "t_unused_`+username[2:8]+`"}`)
+	if w = finishCeremony(finishPasskeyLoginHandler, signup, a.get(t, challenge)); w.Code != http.StatusBadRequest {
+		t.Errorf("login with the signup ceremony: status %d, want 400: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestPasskeyCloneWarning(t *testing.T) {
+	a := newSoftAuthenticator(t)
+	signupWithPasskey(t, a)
+
+	a.signCount = 5
+	challenge, _, cookie := beginCeremony(t, beginPasskeyLoginHandler, "")
+	if w := finishCeremony(finishPasskeyLoginHandler, cookie, a.get(t, challenge)); w.Code != http.StatusOK {
+		t.Fatalf("login: status %d: %s", w.Code, w.Body.String())
+	}
+
+	//a copy of the key with an older counter
+	a.signCount = 3
+	challenge, _, cookie = beginCeremony(t, beginPasskeyLoginHandler, "")
+	if w := finishCeremony(finishPasskeyLoginHandler, cookie, a.get(t, challenge)); w.Code != http.StatusUnauthorized {
+		t.Errorf("login with a lower counter: status %d, want 401: %s", w.Code, w.Body.String())
+	}
+
+	//the refused login didn't lower the stored counter, the copy keeps being refused
+	a.signCount = 4
+	challenge, _, cookie = beginCeremony(t, beginPasskeyLoginHandler, "")
+	if w := finishCeremony(finishPasskeyLoginHandler, cookie, a.get(t, challenge)); w.Code != http.StatusUnauthorized {
+		t.Errorf("second login of the copy: status %d, want 401: %s", w.Code, w.Body.String())
+	}
+}
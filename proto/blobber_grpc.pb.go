@@ -0,0 +1,727 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.2.0
+// - protoc             (unknown)
+// source: proto/blobber.proto
+
+package blobberpb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+// UsersClient is the client API for Users service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type UsersClient interface {
+	GetUser(ctx context.Context, in *GetUserRequest, opts ...grpc.CallOption) (*User, error)
+	SearchUsers(ctx context.Context, in *SearchUsersRequest, opts ...grpc.CallOption) (*UserList, error)
+}
+
+type usersClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewUsersClient(cc grpc.ClientConnInterface) UsersClient {
+	return &usersClient{cc}
+}
+
+func (c *usersClient) GetUser(ctx context.Context, in *GetUserRequest, opts ...grpc.CallOption) (*User, error) {
+	out := new(User)
+	err := c.cc.Invoke(ctx, "/blobber.v1.Users/GetUser", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *usersClient) SearchUsers(ctx context.Context, in *SearchUsersRequest, opts ...grpc.CallOption) (*UserList, error) {
+	out := new(UserList)
+	err := c.cc.Invoke(ctx, "/blobber.v1.Users/SearchUsers", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// UsersServer is the server API for Users service.
+// All implementations must embed UnimplementedUsersServer
+// for forward compatibility
+type UsersServer interface {
+	GetUser(context.Context, *GetUserRequest) (*User, error)
+	SearchUsers(context.Context, *SearchUsersRequest) (*UserList, error)
+	mustEmbedUnimplementedUsersServer()
+}
+
+// UnimplementedUsersServer must be embedded to have forward compatible implementations.
+type UnimplementedUsersServer struct {
+}
+
+func (UnimplementedUsersServer) GetUser(context.Context, *GetUserRequest) (*User, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetUser not implemented")
+}
+func (UnimplementedUsersServer) SearchUsers(context.Context, *SearchUsersRequest) (*UserList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method SearchUsers not implemented")
+}
+func (UnimplementedUsersServer) mustEmbedUnimplementedUsersServer() {}
+
+// UnsafeUsersServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to UsersServer will
+// result in compilation errors.
+type UnsafeUsersServer interface {
+	mustEmbedUnimplementedUsersServer()
+}
+
+func RegisterUsersServer(s grpc.ServiceRegistrar, srv UsersServer) {
+	s.RegisterService(&Users_ServiceDesc, srv)
+}
+
+func _Users_GetUser_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetUserRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UsersServer).GetUser(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/blobber.v1.Users/GetUser",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UsersServer).GetUser(ctx, req.(*GetUserRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Users_SearchUsers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SearchUsersRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(UsersServer).SearchUsers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/blobber.v1.Users/SearchUsers",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(UsersServer).SearchUsers(ctx, req.(*SearchUsersRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Users_ServiceDesc is the grpc.ServiceDesc for Users service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Users_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "blobber.v1.Users",
+	HandlerType: (*UsersServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetUser",
+			Handler:    _Users_GetUser_Handler,
+		},
+		{
+			MethodName: "SearchUsers",
+			Handler:    _Users_SearchUsers_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "proto/blobber.proto",
+}
+
+// BlobsClient is the client API for Blobs service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type BlobsClient interface {
+	GetBlob(ctx context.Context, in *GetBlobRequest, opts ...grpc.CallOption) (*Blob, error)
+	ListUserBlobs(ctx context.Context, in *ListUserBlobsRequest, opts ...grpc.CallOption) (*BlobList, error)
+	CreateBlob(ctx context.Context, in *CreateBlobRequest, opts ...grpc.CallOption) (*Blob, error)
+	// only the owner can update or delete the blob
+	UpdateBlob(ctx context.Context, in *UpdateBlobRequest, opts ...grpc.CallOption) (*Blob, error)
+	DeleteBlob(ctx context.Context, in *BlobRequest, opts ...grpc.CallOption) (*Empty, error)
+	LikeBlob(ctx context.Context, in *BlobRequest, opts ...grpc.CallOption) (*Empty, error)
+	UnlikeBlob(ctx context.Context, in *BlobRequest, opts ...grpc.CallOption) (*Empty, error)
+}
+
+type blobsClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewBlobsClient(cc grpc.ClientConnInterface) BlobsClient {
+	return &blobsClient{cc}
+}
+
+func (c *blobsClient) GetBlob(ctx context.Context, in *GetBlobRequest, opts ...grpc.CallOption) (*Blob, error) {
+	out := new(Blob)
+	err := c.cc.Invoke(ctx, "/blobber.v1.Blobs/GetBlob", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *blobsClient) ListUserBlobs(ctx context.Context, in *ListUserBlobsRequest, opts ...grpc.CallOption) (*BlobList, error) {
+	out := new(BlobList)
+	err := c.cc.Invoke(ctx, "/blobber.v1.Blobs/ListUserBlobs", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *blobsClient) CreateBlob(ctx context.Context, in *CreateBlobRequest, opts ...grpc.CallOption) (*Blob, error) {
+	out := new(Blob)
+	err := c.cc.Invoke(ctx, "/blobber.v1.Blobs/CreateBlob", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *blobsClient) UpdateBlob(ctx context.Context, in *UpdateBlobRequest, opts ...grpc.CallOption) (*Blob, error) {
+	out := new(Blob)
+	err := c.cc.Invoke(ctx, "/blobber.v1.Blobs/UpdateBlob", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *blobsClient) DeleteBlob(ctx context.Context, in *BlobRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, "/blobber.v1.Blobs/DeleteBlob", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *blobsClient) LikeBlob(ctx context.Context, in *BlobRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, "/blobber.v1.Blobs/LikeBlob", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *blobsClient) UnlikeBlob(ctx context.Context, in *BlobRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, "/blobber.v1.Blobs/UnlikeBlob", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// BlobsServer is the server API for Blobs service.
+// All implementations must embed UnimplementedBlobsServer
+// for forward compatibility
+type BlobsServer interface {
+	GetBlob(context.Context, *GetBlobRequest) (*Blob, error)
+	ListUserBlobs(context.Context, *ListUserBlobsRequest) (*BlobList, error)
+	CreateBlob(context.Context, *CreateBlobRequest) (*Blob, error)
+	// only the owner can update or delete the blob
+	UpdateBlob(context.Context, *UpdateBlobRequest) (*Blob, error)
+	DeleteBlob(context.Context, *BlobRequest) (*Empty, error)
+	LikeBlob(context.Context, *BlobRequest) (*Empty, error)
+	UnlikeBlob(context.Context, *BlobRequest) (*Empty, error)
+	mustEmbedUnimplementedBlobsServer()
+}
+
+// UnimplementedBlobsServer must be embedded to have forward compatible implementations.
+type UnimplementedBlobsServer struct {
+}
+
+func (UnimplementedBlobsServer) GetBlob(context.Context, *GetBlobRequest) (*Blob, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetBlob not implemented")
+}
+func (UnimplementedBlobsServer) ListUserBlobs(context.Context, *ListUserBlobsRequest) (*BlobList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListUserBlobs not implemented")
+}
+func (UnimplementedBlobsServer) CreateBlob(context.Context, *CreateBlobRequest) (*Blob, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CreateBlob not implemented")
+}
+func (UnimplementedBlobsServer) UpdateBlob(context.Context, *UpdateBlobRequest) (*Blob, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UpdateBlob not implemented")
+}
+func (UnimplementedBlobsServer) DeleteBlob(context.Context, *BlobRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method DeleteBlob not implemented")
+}
+func (UnimplementedBlobsServer) LikeBlob(context.Context, *BlobRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method LikeBlob not implemented")
+}
+func (UnimplementedBlobsServer) UnlikeBlob(context.Context, *BlobRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method UnlikeBlob not implemented")
+}
+func (UnimplementedBlobsServer) mustEmbedUnimplementedBlobsServer() {}
+
+// UnsafeBlobsServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to BlobsServer will
+// result in compilation errors.
+type UnsafeBlobsServer interface {
+	mustEmbedUnimplementedBlobsServer()
+}
+
+func RegisterBlobsServer(s grpc.ServiceRegistrar, srv BlobsServer) {
+	s.RegisterService(&Blobs_ServiceDesc, srv)
+}
+
+func _Blobs_GetBlob_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetBlobRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BlobsServer).GetBlob(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/blobber.v1.Blobs/GetBlob",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BlobsServer).GetBlob(ctx, req.(*GetBlobRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Blobs_ListUserBlobs_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListUserBlobsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BlobsServer).ListUserBlobs(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/blobber.v1.Blobs/ListUserBlobs",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BlobsServer).ListUserBlobs(ctx, req.(*ListUserBlobsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Blobs_CreateBlob_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CreateBlobRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BlobsServer).CreateBlob(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/blobber.v1.Blobs/CreateBlob",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BlobsServer).CreateBlob(ctx, req.(*CreateBlobRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Blobs_UpdateBlob_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(UpdateBlobRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BlobsServer).UpdateBlob(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/blobber.v1.Blobs/UpdateBlob",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BlobsServer).UpdateBlob(ctx, req.(*UpdateBlobRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Blobs_DeleteBlob_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlobRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BlobsServer).DeleteBlob(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/blobber.v1.Blobs/DeleteBlob",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BlobsServer).DeleteBlob(ctx, req.(*BlobRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Blobs_LikeBlob_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlobRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BlobsServer).LikeBlob(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/blobber.v1.Blobs/LikeBlob",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BlobsServer).LikeBlob(ctx, req.(*BlobRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Blobs_UnlikeBlob_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlobRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(BlobsServer).UnlikeBlob(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/blobber.v1.Blobs/UnlikeBlob",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(BlobsServer).UnlikeBlob(ctx, req.(*BlobRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Blobs_ServiceDesc is the grpc.ServiceDesc for Blobs service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Blobs_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "blobber.v1.Blobs",
+	HandlerType: (*BlobsServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetBlob",
+			Handler:    _Blobs_GetBlob_Handler,
+		},
+		{
+			MethodName: "ListUserBlobs",
+			Handler:    _Blobs_ListUserBlobs_Handler,
+		},
+		{
+			MethodName: "CreateBlob",
+			Handler:    _Blobs_CreateBlob_Handler,
+		},
+		{
+			MethodName: "UpdateBlob",
+			Handler:    _Blobs_UpdateBlob_Handler,
+		},
+		{
+			MethodName: "DeleteBlob",
+			Handler:    _Blobs_DeleteBlob_Handler,
+		},
+		{
+			MethodName: "LikeBlob",
+			Handler:    _Blobs_LikeBlob_Handler,
+		},
+		{
+			MethodName: "UnlikeBlob",
+			Handler:    _Blobs_UnlikeBlob_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "proto/blobber.proto",
+}
+
+// TimelineClient is the client API for Timeline service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type TimelineClient interface {
+	// blobs of the users followed by the user of the token, newest first
+	GetFeed(ctx context.Context, in *FeedRequest, opts ...grpc.CallOption) (*BlobList, error)
+}
+
+type timelineClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewTimelineClient(cc grpc.ClientConnInterface) TimelineClient {
+	return &timelineClient{cc}
+}
+
+func (c *timelineClient) GetFeed(ctx context.Context, in *FeedRequest, opts ...grpc.CallOption) (*BlobList, error) {
+	out := new(BlobList)
+	err := c.cc.Invoke(ctx, "/blobber.v1.Timeline/GetFeed", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// TimelineServer is the server API for Timeline service.
+// All implementations must embed UnimplementedTimelineServer
+// for forward compatibility
+type TimelineServer interface {
+	// blobs of the users followed by the user of the token, newest first
+	GetFeed(context.Context, *FeedRequest) (*BlobList, error)
+	mustEmbedUnimplementedTimelineServer()
+}
+
+// UnimplementedTimelineServer must be embedded to have forward compatible implementations.
+type UnimplementedTimelineServer struct {
+}
+
+func (UnimplementedTimelineServer) GetFeed(context.Context, *FeedRequest) (*BlobList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetFeed not implemented")
+}
+func (UnimplementedTimelineServer) mustEmbedUnimplementedTimelineServer() {}
+
+// UnsafeTimelineServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to TimelineServer will
+// result in compilation errors.
+type UnsafeTimelineServer interface {
+	mustEmbedUnimplementedTimelineServer()
+}
+
+func RegisterTimelineServer(s grpc.ServiceRegistrar, srv TimelineServer) {
+	s.RegisterService(&Timeline_ServiceDesc, srv)
+}
+
+func _Timeline_GetFeed_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FeedRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(TimelineServer).GetFeed(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/blobber.v1.Timeline/GetFeed",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(TimelineServer).GetFeed(ctx, req.(*FeedRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Timeline_ServiceDesc is the grpc.ServiceDesc for Timeline service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Timeline_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "blobber.v1.Timeline",
+	HandlerType: (*TimelineServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetFeed",
+			Handler:    _Timeline_GetFeed_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "proto/blobber.proto",
+}
+
+// SocialGraphClient is the client API for SocialGraph service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type SocialGraphClient interface {
+	Follow(ctx context.Context, in *FollowRequest, opts ...grpc.CallOption) (*Empty, error)
+	Unfollow(ctx context.Context, in *FollowRequest, opts ...grpc.CallOption) (*Empty, error)
+	ListFollowers(ctx context.Context, in *ListFollowsRequest, opts ...grpc.CallOption) (*UserList, error)
+	ListFollowing(ctx context.Context, in *ListFollowsRequest, opts ...grpc.CallOption) (*UserList, error)
+}
+
+type socialGraphClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewSocialGraphClient(cc grpc.ClientConnInterface) SocialGraphClient {
+	return &socialGraphClient{cc}
+}
+
+func (c *socialGraphClient) Follow(ctx context.Context, in *FollowRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, "/blobber.v1.SocialGraph/Follow", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *socialGraphClient) Unfollow(ctx context.Context, in *FollowRequest, opts ...grpc.CallOption) (*Empty, error) {
+	out := new(Empty)
+	err := c.cc.Invoke(ctx, "/blobber.v1.SocialGraph/Unfollow", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *socialGraphClient) ListFollowers(ctx context.Context, in *ListFollowsRequest, opts ...grpc.CallOption) (*UserList, error) {
+	out := new(UserList)
+	err := c.cc.Invoke(ctx, "/blobber.v1.SocialGraph/ListFollowers", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *socialGraphClient) ListFollowing(ctx context.Context, in *ListFollowsRequest, opts ...grpc.CallOption) (*UserList, error) {
+	out := new(UserList)
+	err := c.cc.Invoke(ctx, "/blobber.v1.SocialGraph/ListFollowing", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// SocialGraphServer is the server API for SocialGraph service.
+// All implementations must embed UnimplementedSocialGraphServer
+// for forward compatibility
+type SocialGraphServer interface {
+	Follow(context.Context, *FollowRequest) (*Empty, error)
+	Unfollow(context.Context, *FollowRequest) (*Empty, error)
+	ListFollowers(context.Context, *ListFollowsRequest) (*UserList, error)
+	ListFollowing(context.Context, *ListFollowsRequest) (*UserList, error)
+	mustEmbedUnimplementedSocialGraphServer()
+}
+
+// UnimplementedSocialGraphServer must be embedded to have forward compatible implementations.
+type UnimplementedSocialGraphServer struct {
+}
+
+func (UnimplementedSocialGraphServer) Follow(context.Context, *FollowRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Follow not implemented")
+}
+func (UnimplementedSocialGraphServer) Unfollow(context.Context, *FollowRequest) (*Empty, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Unfollow not implemented")
+}
+func (UnimplementedSocialGraphServer) ListFollowers(context.Context, *ListFollowsRequest) (*UserList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListFollowers not implemented")
+}
+func (UnimplementedSocialGraphServer) ListFollowing(context.Context, *ListFollowsRequest) (*UserList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListFollowing not implemented")
+}
+func (UnimplementedSocialGraphServer) mustEmbedUnimplementedSocialGraphServer() {}
+
+// UnsafeSocialGraphServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to SocialGraphServer will
+// result in compilation errors.
+type UnsafeSocialGraphServer interface {
+	mustEmbedUnimplementedSocialGraphServer()
+}
+
+func RegisterSocialGraphServer(s grpc.ServiceRegistrar, srv SocialGraphServer) {
+	s.RegisterService(&SocialGraph_ServiceDesc, srv)
+}
+
+func _SocialGraph_Follow_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FollowRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SocialGraphServer).Follow(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/blobber.v1.SocialGraph/Follow",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SocialGraphServer).Follow(ctx, req.(*FollowRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SocialGraph_Unfollow_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FollowRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SocialGraphServer).Unfollow(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/blobber.v1.SocialGraph/Unfollow",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SocialGraphServer).Unfollow(ctx, req.(*FollowRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SocialGraph_ListFollowers_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListFollowsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SocialGraphServer).ListFollowers(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/blobber.v1.SocialGraph/ListFollowers",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SocialGraphServer).ListFollowers(ctx, req.(*ListFollowsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _SocialGraph_ListFollowing_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListFollowsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(SocialGraphServer).ListFollowing(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/blobber.v1.SocialGraph/ListFollowing",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(SocialGraphServer).ListFollowing(ctx, req.(*ListFollowsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// SocialGraph_ServiceDesc is the grpc.ServiceDesc for SocialGraph service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var SocialGraph_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "blobber.v1.SocialGraph",
+	HandlerType: (*SocialGraphServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Follow",
+			Handler:    _SocialGraph_Follow_Handler,
+		},
+		{
+			MethodName: "Unfollow",
+			Handler:    _SocialGraph_Unfollow_Handler,
+		},
+		{
+			MethodName: "ListFollowers",
+			Handler:    _SocialGraph_ListFollowers_Handler,
+		},
+		{
+			MethodName: "ListFollowing",
+			Handler:    _SocialGraph_ListFollowing_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "proto/blobber.proto",
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type RateLimitConfig struct {
+	//memory (single node) or mysql (default, shared by the replicas)
+	Backend string `yaml:"backend"`
+	//addresses or cidrs of the proxies (nginx) whose X-Real-IP header is the ip of the client,
+	//the header of any other peer is ignored since a client that reaches the server directly can write it
+	TrustedProxies []string `yaml:"trusted_proxies"`
+	Disabled       bool     `yaml:"disabled"`
+	//overrides of the default limits, the key is the name of the limit (login, register, ...)
+	Routes map[string]RouteLimitConfig `yaml:"routes"`
+}
+
+//limits written like 10/1m (10 requests every minute), empty means no limit
+type RouteLimitConfig struct {
+	PerIP   string `yaml:"per_ip"`
+	PerUser string `yaml:"per_user"`
+}
+
+//the default limits, the routes that share a name share the buckets too
+var defaultRateLimits = map[string]RouteLimitConfig{
+	"login":             {PerIP: "10/1m"},
+	"register":          {PerIP: "5/1h"},
+	"password_reset":    {PerIP: "5/1h"},
+	"oauth_token":       {PerIP: "30/1m"},
+	"blob_write":        {PerIP: "60/1m", PerUser: "30/1m"},
+	"like":              {PerIP: "120/1m", PerUser: "60/1m"},
+	"follow":            {PerIP: "60/1m", PerUser: "30/1m"},
+	"settings_change":   {PerIP: "30/1m", PerUser: "10/1m"},
+	"graphql":           {PerIP: "120/1m", PerUser: "60/1m"},
+	"activitypub_inbox": {PerIP: "300/1m"},
+	"feed":              {PerIP: "60/1m"},
+	"import":            {PerIP: "10/1h", PerUser: "5/1h"},
+}
+
+//RateLimit is a token bucket: it holds at most Requests tokens and it's refilled completely in Per
+type RateLimit struct {
+	Requests int
+	Per      time.Duration
+}
+
+func (l RateLimit) rate() float64 {
+	return float64(l.Requests) / l.Per.Seconds()
+}
+
+//RateLimitResult is the state of the bucket after a request
+type RateLimitResult struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	//time before the next request is allowed, only when it's not allowed
+	RetryAfter time.Duration
+	//time before the bucket is full again
+	Reset time.Duration
+}
+
+//RateLimitStore keeps the buckets, Take consumes a token of the bucket with the key if available
+type RateLimitStore interface {
+	Take(key string, limit RateLimit, now time.Time) (RateLimitResult, error)
+	//Cleanup removes the buckets not used since before
+	Cleanup(before time.Time) error
+}
+
+//parseRateLimit reads a limit like 10/1m, the period accepts the days like the trending windows
+func parseRateLimit(limit string) (RateLimit, error) {
+	parts := strings.SplitN(strings.TrimSpace(limit), "/", 2)
+	if len(parts) != 2 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %s, use requests/period (es: 10/1m)", limit)
+	}
+	requests, err := strconv.Atoi(parts[0])
+	if err != nil || requests <= 0 {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %s, the requests must be a positive number", limit)
+	}
+	per, err := parseWindow(parts[1])
+	if err != nil {
+		return RateLimit{}, fmt.Errorf("invalid rate limit %s: %v", limit, err)
+	}
+	return RateLimit{Requests: requests, Per: per}, nil
+}
+
+//takeToken refills the bucket for the time passed since the last update and consumes a token,
+//it returns the tokens left in the bucket and the result of the request
+func takeToken(tokens float64, updatedAt time.Time, limit RateLimit, now time.Time) (float64, RateLimitResult) {
+	capacity := float64(limit.Requests)
+	elapsed := now.Sub(updatedAt).Seconds()
+	if elapsed > 0 {
+		tokens = math.Min(capacity, tokens+elapsed*limit.rate())
+	}
+
+	result := RateLimitResult{Limit: limit.Requests}
+	if tokens >= 1 {
+		tokens--
+		result.Allowed = true
+	} else {
+		result.RetryAfter = time.Duration((1 - tokens) / limit.rate() * float64(time.Second))
+	}
+	result.Remaining = int(tokens)
+	result.Reset = time.Duration((capacity - tokens) / limit.rate() * float64(time.Second))
+	return tokens, result
+}
+
+type memoryBucket struct {
+	tokens    float64
+	updatedAt time.Time
+}
+
+//MemoryRateLimitStore keeps the buckets in memory, the limits hold only for a single node
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	return &MemoryRateLimitStore{buckets: make(map[string]*memoryBucket)}
+}
+
+func (s *MemoryRateLimitStore) Take(key string, limit RateLimit, now time.Time) (RateLimitResult, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	bucket, ok := s.buckets[key]
+	if !ok {
+		bucket = &memoryBucket{tokens: float64(limit.Requests), updatedAt: now}
+		s.buckets[key] = bucket
+	}
+
+	var result RateLimitResult
+	bucket.tokens, result = takeToken(bucket.tokens, bucket.updatedAt, limit, now)
+	bucket.updatedAt = now
+	return result, nil
+}
+
+func (s *MemoryRateLimitStore) Cleanup(before time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for key, bucket := range s.buckets {
+		if bucket.updatedAt.Before(before) {
+			delete(s.buckets, key)
+		}
+	}
+	return nil
+}
+
+//MySQLRateLimitStore keeps the buckets in the database so the replicas share them,
+//the row of the bucket is locked while the token is taken
+type MySQLRateLimitStore struct{}
+
+func (MySQLRateLimitStore) Take(key string, limit RateLimit, now time.Time) (RateLimitResult, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	defer tx.Rollback()
+
+	//a new bucket starts full
+	_, err = tx.Exec("INSERT IGNORE INTO rate_limits (bucket, tokens, updated_at) VALUES (?, ?, ?)", key, limit.Requests, now)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+
+	var tokens float64
+	var updatedAt time.Time
+	err = tx.QueryRow("SELECT tokens, updated_at FROM rate_limits WHERE bucket = ? FOR UPDATE", key).Scan(&tokens, &updatedAt)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+
+	tokens, result := takeToken(tokens, updatedAt, limit, now)
+	_, err = tx.Exec("UPDATE rate_limits SET tokens = ?, updated_at = ? WHERE bucket = ?", tokens, now, key)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	return result, tx.Commit()
+}
+
+func (MySQLRateLimitStore) Cleanup(before time.Time) error {
+	db, err := connectToDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec("DELETE FROM rate_limits WHERE updated_at < ?", before)
+	return err
+}
+
+type routeLimits struct {
+	perIP   *RateLimit
+	perUser *RateLimit
+}
+
+//RateLimiter limits the requests of the routes by client ip and by logged user
+type RateLimiter struct {
+	store          RateLimitStore
+	routes         map[string]routeLimits
+	trustedProxies []*net.IPNet
+	disabled       bool
+	clock          Clock
+}
+
+//the rate limiter used by the routes, created in main
+var rateLimiter *RateLimiter
+
+//NewRateLimiterFromConfig creates the rate limiter with the default limits overridden by the config
+func NewRateLimiterFromConfig(c RateLimitConfig, clock Clock) (*RateLimiter, error) {
+	l := &RateLimiter{
+		routes:   make(map[string]routeLimits),
+		disabled: c.Disabled,
+		clock:    clock,
+	}
+
+	for _, proxy := range c.TrustedProxies {
+		network, err := parseProxyNetwork(proxy)
+		if err != nil {
+			return nil, err
+		}
+		l.trustedProxies = append(l.trustedProxies, network)
+	}
+
+	switch c.Backend {
+	case "", "mysql":
+		l.store = MySQLRateLimitStore{}
+	case "memory":
+		l.store = NewMemoryRateLimitStore()
+	default:
+		return nil, fmt.Errorf("unknown rate limit backend %s", c.Backend)
+	}
+
+	configs := make(map[string]RouteLimitConfig)
+	for name, route := range defaultRateLimits {
+		configs[name] = route
+	}
+	for name, route := range c.Routes {
+		configs[name] = route
+	}
+
+	for name, route := range configs {
+		var limits routeLimits
+		if route.PerIP != "" {
+			limit, err := parseRateLimit(route.PerIP)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %v", name, err)
+			}
+			limits.perIP = &limit
+		}
+		if route.PerUser != "" {
+			limit, err := parseRateLimit(route.PerUser)
+			if err != nil {
+				return nil, fmt.Errorf("route %s: %v", name, err)
+			}
+			limits.perUser = &limit
+		}
+		l.routes[name] = limits
+	}
+	return l, nil
+}
+
+//RunCleanup removes every hour the buckets unused for a day, it never returns
+func (l *RateLimiter) RunCleanup() {
+	for {
+		if err := l.store.Cleanup(l.clock.Now().Add(-24 * time.Hour)); err != nil {
+			log.Printf("rate limit cleanup failed: %v", err)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+//parseProxyNetwork reads a trusted proxy, a cidr (es: 172.28.0.0/16) or a single address
+func parseProxyNetwork(proxy string) (*net.IPNet, error) {
+	proxy = strings.TrimSpace(proxy)
+	if !strings.Contains(proxy, "/") {
+		ip := net.ParseIP(proxy)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid trusted proxy %s, use an ip or a cidr", proxy)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, network, err := net.ParseCIDR(proxy)
+	if err != nil {
+		return nil, fmt.Errorf("invalid trusted proxy %s, use an ip or a cidr", proxy)
+	}
+	return network, nil
+}
+
+//clientIP returns the ip of the client, behind nginx the remote address is the one of the proxy
+//so the X-Real-IP header is read, but only when the request comes from a trusted proxy
+func (l *RateLimiter) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	if l.isTrustedProxy(host) {
+		if ip := net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP"))); ip != nil {
+			return ip.String()
+		}
+	}
+	return host
+}
+
+func (l *RateLimiter) isTrustedProxy(host string) bool {
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, network := range l.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+//requestUserID returns the user of the jwt without checking the session, it's only used as key of the bucket
+func requestUserID(r *http.Request) int {
+	token, err := requestToken(r)
+	if err != nil {
+		return 0
+	}
+	claims, err := ParseToken(token)
+	if err != nil || claims.Purpose != "" {
+		return 0
+	}
+	return claims.UserID
+}
+
+func setRateLimitHeaders(w http.ResponseWriter, result RateLimitResult) {
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+	w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+	w.Header().Set("RateLimit-Reset", strconv.Itoa(int(math.Ceil(result.Reset.Seconds()))))
+}
+
+//Limit wraps the handler with the limits of the route, if the store fails the request is let through
+func (l *RateLimiter) Limit(route string, next http.HandlerFunc) http.HandlerFunc {
+	limits, ok := l.routes[route]
+	if l.disabled || !ok {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		now := l.clock.Now()
+
+		type bucket struct {
+			key   string
+			limit *RateLimit
+		}
+		var buckets []bucket
+		if limits.perIP != nil {
+			buckets = append(buckets, bucket{"ip:" + route + ":" + l.clientIP(r), limits.perIP})
+		}
+		if limits.perUser != nil {
+			if userID := requestUserID(r); userID != 0 {
+				buckets = append(buckets, bucket{fmt.Sprintf("user:%s:%d", route, userID), limits.perUser})
+			}
+		}
+
+		//the headers describe the most restrictive bucket
+		var shown *RateLimitResult
+		for _, b := range buckets {
+			result, err := l.store.Take(b.key, *b.limit, now)
+			if err != nil {
+				log.Printf("rate limit of %s failed: %v", b.key, err)
+				continue
+			}
+			if shown == nil || result.Remaining < shown.Remaining || !result.Allowed {
+				shown = &result
+			}
+			if !result.Allowed {
+				break
+			}
+		}
+
+		if shown != nil {
+			setRateLimitHeaders(w, *shown)
+			if !shown.Allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(shown.RetryAfter.Seconds()))))
+				returnError(w, http.StatusTooManyRequests, "Too many requests, try again later")
+				return
+			}
+		}
+		next(w, r)
+	})
+}
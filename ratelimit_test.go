@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTakeToken(t *testing.T) {
+	start := time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+	//2 requests every 10 seconds, a token every 5 seconds
+	limit := RateLimit{Requests: 2, Per: 10 * time.Second}
+
+	tests := []struct {
+		name      string
+		tokens    float64
+		elapsed   time.Duration
+		allowed   bool
+		remaining int
+		retry     time.Duration
+		reset     time.Duration
+	}{
+		{"full bucket", 2, 0, true, 1, 0, 5 * time.Second},
+		{"last token", 1, 0, true, 0, 0, 10 * time.Second},
+		{"empty bucket", 0, 0, false, 0, 5 * time.Second, 10 * time.Second},
+		{"half token refilled", 0, 2500 * time.Millisecond, false, 0, 2500 * time.Millisecond, 7500 * time.Millisecond},
+		{"token refilled", 0, 5 * time.Second, true, 0, 0, 10 * time.Second},
+		{"refill stops at the capacity", 0, time.Hour, true, 1, 0, 5 * time.Second},
+		{"clock gone back", 1, -time.Minute, true, 0, 0, 10 * time.Second},
+	}
+	for _, tt := range tests {
+		tokens, result := takeToken(tt.tokens, start, limit, start.Add(tt.elapsed))
+		if result.Allowed != tt.allowed || result.Remaining != tt.remaining || result.RetryAfter != tt.retry || result.Reset != tt.reset {
+			t.Errorf("%s: %+v (%.2f tokens left), want allowed %t remaining %d retry after %s reset %s",
+				tt.name, result, tokens, tt.allowed, tt.remaining, tt.retry, tt.reset)
+		}
+		if result.Limit != limit.Requests {
+			t.Errorf("%s: limit %d, want %d", tt.name, result.Limit, limit.Requests)
+		}
+	}
+}
+
+func TestMemoryRateLimitStore(t *testing.T) {
+	store := NewMemoryRateLimitStore()
+	now := time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+	limit := RateLimit{Requests: 2, Per: time.Minute}
+
+	take := func(key string, at time.Time) RateLimitResult {
+		result, err := store.Take(key, limit, at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	//a new bucket starts full
+	for i := 0; i < 2; i++ {
+		if result := take("a", now); !result.Allowed || result.Remaining != 1-i {
+			t.Errorf("request %d: %+v, want allowed with %d remaining", i+1, result, 1-i)
+		}
+	}
+	if result := take("a", now); result.Allowed || result.RetryAfter != 30*time.Second {
+		t.Errorf("third request: %+v, want refused for 30s", result)
+	}
+	if result := take("b", now); !result.Allowed {
+		t.Errorf("the buckets are not separated by key: %+v", result)
+	}
+	//the refused requests don't consume the refill
+	if result := take("a", now.Add(30*time.Second)); !result.Allowed {
+		t.Errorf("request after the refill of a token: %+v, want allowed", result)
+	}
+
+	if err := store.Cleanup(now.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := store.buckets["b"]; ok {
+		t.Error("the bucket unused since before the cleanup is still there")
+	}
+	if _, ok := store.buckets["a"]; !ok {
+		t.Error("the bucket used after the cleanup time was removed")
+	}
+}
+
+func newTestRateLimiter(t *testing.T, c RateLimitConfig, clock Clock) *RateLimiter {
+	t.Helper()
+	c.Backend = "memory"
+	l, err := NewRateLimiterFromConfig(c, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+func TestRateLimiterLimit(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)}
+	l := newTestRateLimiter(t, RateLimitConfig{Routes: map[string]RouteLimitConfig{"test": {PerIP: "2/1m"}}}, clock)
+	handler := l.Limit("test", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	send := func(remoteAddr string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler(w, r)
+		return w
+	}
+	wantHeaders := func(w *httptest.ResponseRecorder, status int, remaining, reset string) {
+		t.Helper()
+		if w.Code != status || w.Header().Get("RateLimit-Limit") != "2" || w.Header().Get("RateLimit-Remaining") != remaining ||
+			w.Header().Get("RateLimit-Reset") != reset {
+			t.Errorf("status %d, headers %v, want %d with remaining %s and reset %s", w.Code, w.Header(), status, remaining, reset)
+		}
+	}
+
+	wantHeaders(send("203.0.113.1:1234"), http.StatusNoContent, "1", "30")
+	wantHeaders(send("203.0.113.1:1234"), http.StatusNoContent, "0", "60")
+	w := send("203.0.113.1:1234")
+	wantHeaders(w, http.StatusTooManyRequests, "0", "60")
+	if w.Header().Get("Retry-After") != "30" {
+		t.Errorf("Retry-After %q, want 30", w.Header().Get("Retry-After"))
+	}
+
+	//another client has its own bucket, the first one can send again after the refill
+	wantHeaders(send("203.0.113.2:1234"), http.StatusNoContent, "1", "30")
+	clock.now = clock.now.Add(30 * time.Second)
+	wantHeaders(send("203.0.113.1:1234"), http.StatusNoContent, "0", "60")
+
+	//the routes without limits aren't wrapped
+	w = httptest.NewRecorder()
+	l.Limit("unknown", func(w http.ResponseWriter, r *http.Request) {})(w, httptest.NewRequest("GET", "/", nil))
+	if w.Header().Get("RateLimit-Limit") != "" {
+		t.Error("route without limits has the headers")
+	}
+}
+
+func TestRateLimiterClientIP(t *testing.T) {
+	l := newTestRateLimiter(t, RateLimitConfig{TrustedProxies: []string{"172.28.0.10", "10.1.0.0/16"}}, realClock{})
+	tests := []struct {
+		remoteAddr, realIP, want string
+	}{
+		{"203.0.113.1:1234", "", "203.0.113.1"},
+		//a client connected directly can't choose its ip
+		{"203.0.113.1:1234", "198.51.100.7", "203.0.113.1"},
+		{"172.28.0.11:1234", "198.51.100.7", "172.28.0.11"},
+		{"172.28.0.10:1234", "198.51.100.7", "198.51.100.7"},
+		{"10.1.3.4:1234", "198.51.100.7", "198.51.100.7"},
+		{"[::1]:1234", "198.51.100.7", "::1"},
+		//an invalid header of the proxy is ignored
+		{"172.28.0.10:1234", "not an ip", "172.28.0.10"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.realIP != "" {
+			r.Header.Set("X-Real-IP", tt.realIP)
+		}
+		if got := l.clientIP(r); got != tt.want {
+			t.Errorf("%s with X-Real-IP %q: %s, want %s", tt.remoteAddr, tt.realIP, got, tt.want)
+		}
+	}
+
+	if _, err := NewRateLimiterFromConfig(RateLimitConfig{Backend: "memory", TrustedProxies: []string{"nginx"}}, realClock{}); err == nil {
+		t.Error("invalid trusted proxy accepted")
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+//for how long a password reset link can be used
+const passwordResetWindow = time.Hour
+
+//RequestPasswordReset creates a reset token for the user with the given username or verified email,
+//sql.ErrNoRows is returned if there is no user the email can be sent to. The identifier is an email only
+//if it has a @, that the usernames can't have, so a username equal to the email of another user is not ambiguous
+func RequestPasswordReset(identifier string) (User, string, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return User{}, "", err
+	}
+	defer db.Close()
+
+	identifier = strings.TrimSpace(identifier)
+	column := "username"
+	if strings.Contains(identifier, "@") {
+		column = "email"
+	}
+	user, err := scanUser(db.QueryRow(userColumnsQuery+" WHERE "+column+" = ? AND email_verified", identifier))
+	if err != nil {
+		return User{}, "", err
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return User{}, "", err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return User{}, "", err
+	}
+	defer tx.Rollback()
+
+	//only the last link sent is valid
+	if _, err = tx.Exec("DELETE FROM password_resets WHERE ID_user = ?", user.ID); err != nil {
+		return User{}, "", err
+	}
+	if _, err = tx.Exec("INSERT INTO password_resets (ID_user, token, expires_at) VALUES (?, ?, ?)", user.ID, hashToken(token), time.Now().Add(passwordResetWindow)); err != nil {
+		return User{}, "", err
+	}
+	return user, token, tx.Commit()
+}
+
+//ResetPassword consumes the token and sets the new password, all the sessions of the user are revoked
+func ResetPassword(token, password string) error {
+	if password == "" {
+		return fmt.Errorf("%w: the new password can't be empty", errBadRequest)
+	}
+
+	db, err := connectToDB()
+	if err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	defer tx.Rollback()
+
+	//the row is locked so the same token can't be used twice by concurrent requests
+	var resetID, userID int
+	err = tx.QueryRow("SELECT ID, ID_user FROM password_resets WHERE token = ? AND NOT used AND expires_at > NOW() FOR UPDATE", hashToken(token)).Scan(&resetID, &userID)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w: invalid or expired link", errBadRequest)
+	}
+	if err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+
+	if _, err = tx.Exec("UPDATE password_resets SET used = TRUE WHERE ID = ?", resetID); err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	if _, err = tx.Exec("UPDATE users SET password = ?, session_version = session_version + 1 WHERE ID = ?", hashPassword(password), userID); err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+//verifyTestEmail sets a verified email to the user
+func verifyTestEmail(t *testing.T, user *User, email string) {
+	t.Helper()
+	db, err := connectToDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err = db.Exec("UPDATE users SET email = ?, email_verified = TRUE WHERE ID = ?", email, user.ID); err != nil {
+		t.Fatal(err)
+	}
+	user.Email, user.EmailVerified = email, true
+}
+
+func TestForgotPasswordLinkIgnoresHost(t *testing.T) {
+	user := newTestUser(t)
+	verifyTestEmail(t, &user, user.Username+"@example.com")
+	mails := useTestMailer(t)
+	conf.BaseURL = "https://blobber.example.com"
+
+	r := httptest.NewRequest("POST", forgotPassword.String(), strings.NewReader(`{"username": "`+user.Username+`"}`))
+	r.Host = "evil.example"
+	r.Header.Set("X-Forwarded-Proto", "http")
+	w := httptest.NewRecorder()
+	forgotPasswordHandler(w, r)
+
+	sent := mails.sent()
+	if w.Code != 200 || len(sent) != 1 {
+		t.Fatalf("status %d and %d emails, want 200 and 1: %s", w.Code, len(sent), w.Body.String())
+	}
+	if !strings.Contains(sent[0].body, "https://blobber.example.com"+resetPassword.String()+"?token=") || strings.Contains(sent[0].body, "evil.example") {
+		t.Errorf("the link is not built from the base url:\n%s", sent[0].body)
+	}
+}
+
+func TestRequestPasswordResetIdentifier(t *testing.T) {
+	owner := newTestUser(t)
+	verifyTestEmail(t, &owner, owner.Username+"@example.com")
+	//the email of the other user is the username of the owner
+	other := newTestUser(t)
+	verifyTestEmail(t, &other, owner.Username)
+
+	tests := []struct {
+		identifier string
+		want       int
+	}{
+		{owner.Username, owner.ID},
+		{" " + owner.Username + "@example.com ", owner.ID},
+		{other.Username, other.ID},
+	}
+	for _, tt := range tests {
+		user, _, err := RequestPasswordReset(tt.identifier)
+		if err != nil {
+			t.Errorf("reset of %q failed: %v", tt.identifier, err)
+			continue
+		}
+		if user.ID != tt.want {
+			t.Errorf("reset of %q sent to the user %d, want %d", tt.identifier, user.ID, tt.want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"regexp"
+)
+
+//every json response has the same envelope: code (the http status), msg and error. The errors also
+//have a machine readable error_code and the request_id, the same id is in the X-Request-ID header
+//and in the logs. The details of the internal errors are only logged, the client gets a generic message
+type ErrorCode string
+
+const (
+	CodeBadRequest       ErrorCode = "bad_request"
+	CodeUnauthorized     ErrorCode = "unauthorized"
+	CodeForbidden        ErrorCode = "forbidden"
+	CodeNotFound         ErrorCode = "not_found"
+	CodeMethodNotAllowed ErrorCode = "method_not_allowed"
+	CodeConflict         ErrorCode = "conflict"
+	CodeRateLimited      ErrorCode = "rate_limited"
+	CodeInvalidCSRF      ErrorCode = "invalid_csrf_token"
+	CodeInternal         ErrorCode = "internal_error"
+	CodeUnavailable      ErrorCode = "unavailable"
+)
+
+//the errors of the domain functions caused by the client wrap one of these, es:
+//fmt.Errorf("%w: username already taken", errConflict). Their message starts with the kind of error
+var (
+	errBadRequest = errors.New("bad request")
+	errConflict   = errors.New("conflict")
+	errForbidden  = errors.New("forbidden")
+)
+
+const requestIDHeader = "X-Request-ID"
+
+//the ids coming from nginx are reused, anything else is replaced
+var requestIDRegex = regexp.MustCompile(`^[a-zA-Z0-9_-]{8,64}$`)
+
+//the envelope of the responses, the data is added under a key that depends on the route
+type Response struct {
+	Code      int       `json:"code"`
+	Msg       string    `json:"msg"`
+	Error     bool      `json:"error"`
+	ErrorCode ErrorCode `json:"error_code,omitempty"`
+	RequestID string    `json:"request_id,omitempty"`
+}
+
+func errorCodeForStatus(status int) ErrorCode {
+	switch status {
+	case http.StatusBadRequest:
+		return CodeBadRequest
+	case http.StatusUnauthorized:
+		return CodeUnauthorized
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case http.StatusConflict:
+		return CodeConflict
+	case http.StatusTooManyRequests:
+		return CodeRateLimited
+	case http.StatusServiceUnavailable:
+		return CodeUnavailable
+	}
+	if status >= 500 {
+		return CodeInternal
+	}
+	return CodeBadRequest
+}
+
+//RequestIDMiddleware gives an id to every request, it wraps the whole router so even the
+//requests that don't match a route have it
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !requestIDRegex.MatchString(id) {
+			b := make([]byte, 16)
+			if _, err := rand.Read(b); err != nil {
+				log.Printf("request id generation failed: %v", err)
+			}
+			id = hex.EncodeToString(b)
+		}
+		w.Header().Set(requestIDHeader, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+//writeJson encodes the envelope with the data under key, if key is empty there is no data
+func writeJson(w http.ResponseWriter, envelope Response, key string, data []byte) {
+	writeJsonFields(w, envelope, key, data, nil)
+}
+
+//writeJsonFields is writeJson with more fields next to the data, es: has_more of the pages
+func writeJsonFields(w http.ResponseWriter, envelope Response, key string, data []byte, extra map[string]interface{}) {
+	var body []byte
+	var err error
+	if key == "" {
+		body, err = json.Marshal(envelope)
+	} else {
+		fields := map[string]interface{}{
+			"code":  envelope.Code,
+			"msg":   envelope.Msg,
+			"error": envelope.Error,
+			key:     json.RawMessage(data),
+		}
+		for k, v := range extra {
+			fields[k] = v
+		}
+		if envelope.ErrorCode != "" {
+			fields["error_code"] = envelope.ErrorCode
+			fields["request_id"] = envelope.RequestID
+		}
+		body, err = json.Marshal(fields)
+	}
+	if err != nil {
+		//only invalid data can fail, it's a bug of the handler
+		log.Printf("[%s] response encoding failed: %v", w.Header().Get(requestIDHeader), err)
+		envelope = Response{
+			Code:      http.StatusInternalServerError,
+			Msg:       "Internal server error",
+			Error:     true,
+			ErrorCode: CodeInternal,
+			RequestID: w.Header().Get(requestIDHeader),
+		}
+		body, _ = json.Marshal(envelope)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(envelope.Code)
+	w.Write(body)
+}
+
+func newErrorResponse(w http.ResponseWriter, status int, code ErrorCode, message string) Response {
+	requestID := w.Header().Get(requestIDHeader)
+	if status == http.StatusInternalServerError {
+		log.Printf("[%s] internal server error: %s", requestID, message)
+		message = "Internal server error, if the problem persists report the request id " + requestID
+	}
+	return Response{Code: status, Msg: message, Error: true, ErrorCode: code, RequestID: requestID}
+}
+
+func returnError(w http.ResponseWriter, code int, message string) {
+	returnErrorCode(w, code, errorCodeForStatus(code), message)
+}
+
+//returnErrorCode is returnError with a more specific error code than the one of the status
+func returnErrorCode(w http.ResponseWriter, status int, code ErrorCode, message string) {
+	writeJson(w, newErrorResponse(w, status, code, message), "", nil)
+}
+
+func returnErrorJson(w http.ResponseWriter, code int, message, key string, json []byte) {
+	writeJson(w, newErrorResponse(w, code, errorCodeForStatus(code), message), key, json)
+}
+
+//the domain functions wrap the errors caused by the client in errBadRequest (400), errForbidden (403)
+//or errConflict (409), the missing rows are a 404 while everything else is a 500
+func returnDomainError(w http.ResponseWriter, err error) {
+	msg := err.Error()
+	switch {
+	case errors.Is(err, errBadRequest):
+		returnError(w, http.StatusBadRequest, msg)
+	case errors.Is(err, errForbidden):
+		returnError(w, http.StatusForbidden, msg)
+	case errors.Is(err, errConflict):
+		returnError(w, http.StatusConflict, msg)
+	case errors.Is(err, sql.ErrNoRows):
+		returnError(w, http.StatusNotFound, "Resource not found")
+	default:
+		returnError(w, http.StatusInternalServerError, msg)
+	}
+}
+
+func returnSuccess(w http.ResponseWriter, code int, message string) {
+	writeJson(w, Response{Code: code, Msg: message}, "", nil)
+}
+
+//returnNoContent answers 204 without body, used by the api v2 when there is nothing to return
+func returnNoContent(w http.ResponseWriter) {
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func returnSuccessJson(w http.ResponseWriter, code int, message, key string, json []byte) {
+	writeJson(w, Response{Code: code, Msg: message}, key, json)
+}
+
+//returnSuccessPage is returnSuccessJson for a page of a list, has_more tells if there is a next page
+func returnSuccessPage(w http.ResponseWriter, code int, message, key string, json []byte, hasMore bool) {
+	writeJsonFields(w, Response{Code: code, Msg: message}, key, json, map[string]interface{}{"has_more": hasMore})
+}
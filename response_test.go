@@ -0,0 +1,47 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReturnDomainError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+		msg    string
+	}{
+		{fmt.Errorf("%w: content too long", errBadRequest), http.StatusBadRequest, "content too long"},
+		{fmt.Errorf("%w: the token needs the write scope", errForbidden), http.StatusForbidden, "the token needs the write scope"},
+		{fmt.Errorf("%w: already following", errConflict), http.StatusConflict, "already following"},
+		{fmt.Errorf("query of the user: %w", sql.ErrNoRows), http.StatusNotFound, "Resource not found"},
+		{errors.New("dial tcp 10.0.0.3:3306: connection refused"), http.StatusInternalServerError, "report the request id"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		w := httptest.NewRecorder()
+		RequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			returnDomainError(w, tt.err)
+		})).ServeHTTP(w, r)
+
+		var resp Response
+		if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil {
+			t.Fatal(err)
+		}
+		if w.Code != tt.status || !strings.Contains(resp.Msg, tt.msg) {
+			t.Errorf("%v: status %d msg %q, want %d %q", tt.err, w.Code, resp.Msg, tt.status, tt.msg)
+		}
+		//the internal errors are only logged, the client gets the request id to report
+		if tt.status == http.StatusInternalServerError {
+			if strings.Contains(resp.Msg, "10.0.0.3") || resp.RequestID == "" || !strings.Contains(resp.Msg, resp.RequestID) {
+				t.Errorf("internal error not hidden: %+v", resp)
+			}
+		}
+	}
+}
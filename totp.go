@@ -0,0 +1,263 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+//totp parameters (RFC 6238), the defaults supported by every authenticator app
+const (
+	totpPeriod = 30
+	totpDigits = 6
+	//how many periods before and after the current one are accepted, to tolerate clock drifts
+	totpSkew = 1
+	//issuer shown in the authenticator apps
+	totpIssuer = "Blobber"
+
+	recoveryCodesCount = 10
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+//generateTOTPSecret returns a random 160 bits secret encoded in base32
+func generateTOTPSecret() (string, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return totpEncoding.EncodeToString(b), nil
+}
+
+//hotp computes the code of the counter as described in RFC 4226
+func hotp(secret string, counter uint64) (string, error) {
+	key, err := totpEncoding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, counter)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+
+	//dynamic truncation
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < totpDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", totpDigits, value%mod), nil
+}
+
+//totpCounter returns the counter (number of periods since the unix epoch) of the time
+func totpCounter(t time.Time) int64 {
+	return t.Unix() / totpPeriod
+}
+
+//verifyTOTP checks the code against the periods around now, the matched counter is returned
+//and must be greater than lastCounter so a code can't be used twice
+func verifyTOTP(secret, code string, now time.Time, lastCounter int64) (int64, bool) {
+	code = strings.TrimSpace(code)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+
+	current := totpCounter(now)
+	for counter := current - totpSkew; counter <= current+totpSkew; counter++ {
+		if counter <= lastCounter {
+			continue
+		}
+		expected, err := hotp(secret, uint64(counter))
+		if err != nil {
+			return 0, false
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+//totpURI is the otpauth uri the authenticator apps read from the qr code
+func totpURI(secret, username string) string {
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", totpIssuer)
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", fmt.Sprint(totpDigits))
+	values.Set("period", fmt.Sprint(totpPeriod))
+	label := url.PathEscape(totpIssuer + ":" + username)
+	return "otpauth://totp/" + label + "?" + values.Encode()
+}
+
+//generateRecoveryCodes returns random codes formatted as xxxxx-xxxxx
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodesCount)
+	for i := range codes {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+	return codes, nil
+}
+
+//recovery codes are compared without dashes, spaces and case
+func normalizeRecoveryCode(code string) string {
+	code = strings.ToLower(code)
+	code = strings.ReplaceAll(code, "-", "")
+	return strings.ReplaceAll(code, " ", "")
+}
+
+//BeginTOTPEnrollment saves a new pending secret, it's enabled only after ConfirmTOTP
+func (u *User) BeginTOTPEnrollment() (string, error) {
+	if u.TOTPEnabled {
+		return "", fmt.Errorf("%w: two factor authentication is already enabled", errBadRequest)
+	}
+
+	secret, err := generateTOTPSecret()
+	if err != nil {
+		return "", fmt.Errorf("internal server error: %v", err)
+	}
+
+	db, err := connectToDB()
+	if err != nil {
+		return "", fmt.Errorf("internal server error: %v", err)
+	}
+	defer db.Close()
+
+	_, err = db.Exec("UPDATE users SET totp_secret = ?, totp_enabled = FALSE, totp_last_counter = 0 WHERE ID = ?", secret, u.ID)
+	if err != nil {
+		return "", fmt.Errorf("internal server error: %v", err)
+	}
+	u.TOTPSecret = secret
+	return secret, nil
+}
+
+//ConfirmTOTP enables the pending secret if the code is valid and returns the recovery codes,
+//they are saved hashed so this is the only time they can be shown
+func (u *User) ConfirmTOTP(code string) ([]string, error) {
+	if u.TOTPEnabled {
+		return nil, fmt.Errorf("%w: two factor authentication is already enabled", errBadRequest)
+	}
+	if u.TOTPSecret == "" {
+		return nil, fmt.Errorf("%w: start the enrollment first", errBadRequest)
+	}
+
+	counter, ok := verifyTOTP(u.TOTPSecret, code, time.Now(), 0)
+	if !ok {
+		return nil, fmt.Errorf("%w: invalid code", errBadRequest)
+	}
+
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		return nil, fmt.Errorf("internal server error: %v", err)
+	}
+
+	db, err := connectToDB()
+	if err != nil {
+		return nil, fmt.Errorf("internal server error: %v", err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("internal server error: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("UPDATE users SET totp_enabled = TRUE, totp_last_counter = ? WHERE ID = ?", counter, u.ID); err != nil {
+		return nil, fmt.Errorf("internal server error: %v", err)
+	}
+	if _, err = tx.Exec("DELETE FROM recovery_codes WHERE ID_user = ?", u.ID); err != nil {
+		return nil, fmt.Errorf("internal server error: %v", err)
+	}
+	for _, c := range codes {
+		if _, err = tx.Exec("INSERT INTO recovery_codes (ID_user, code) VALUES (?, ?)", u.ID, hashToken(normalizeRecoveryCode(c))); err != nil {
+			return nil, fmt.Errorf("internal server error: %v", err)
+		}
+	}
+	if err = tx.Commit(); err != nil {
+		return nil, fmt.Errorf("internal server error: %v", err)
+	}
+
+	u.TOTPEnabled = true
+	u.TOTPLastCounter = counter
+	return codes, nil
+}
+
+//VerifySecondFactor accepts a totp code or an unused recovery code, a recovery code can be used only once
+func (u *User) VerifySecondFactor(code string) (bool, error) {
+	if !u.TOTPEnabled {
+		return false, fmt.Errorf("%w: two factor authentication is not enabled", errBadRequest)
+	}
+
+	db, err := connectToDB()
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	if counter, ok := verifyTOTP(u.TOTPSecret, code, time.Now(), u.TOTPLastCounter); ok {
+		//the condition on the last counter prevents the same code from being used by two concurrent logins
+		res, err := db.Exec("UPDATE users SET totp_last_counter = ? WHERE ID = ? AND totp_last_counter < ?", counter, u.ID, counter)
+		if err != nil {
+			return false, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return false, err
+		}
+		u.TOTPLastCounter = counter
+		return n == 1, nil
+	}
+
+	res, err := db.Exec("UPDATE recovery_codes SET used = TRUE WHERE ID_user = ? AND code = ? AND NOT used", u.ID, hashToken(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n == 1, err
+}
+
+//DisableTOTP removes the secret and the recovery codes of the user
+func (u *User) DisableTOTP() error {
+	db, err := connectToDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("UPDATE users SET totp_secret = NULL, totp_enabled = FALSE, totp_last_counter = 0 WHERE ID = ?", u.ID); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("DELETE FROM recovery_codes WHERE ID_user = ?", u.ID); err != nil {
+		return err
+	}
+	if err = tx.Commit(); err != nil {
+		return err
+	}
+
+	u.TOTPEnabled = false
+	u.TOTPSecret = ""
+	return nil
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+//the secret of the test vectors of RFC 4226 and RFC 6238, "12345678901234567890" in base32
+const rfcTOTPSecret = "GEZDGNBVGY3TQOJQGEZDGNBVGY3TQOJQ"
+
+func TestHOTP(t *testing.T) {
+	//RFC 4226, appendix D
+	want := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for counter, code := range want {
+		got, err := hotp(rfcTOTPSecret, uint64(counter))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != code {
+			t.Errorf("hotp of counter %d: %s, want %s", counter, got, code)
+		}
+	}
+	if _, err := hotp("not base32!", 0); err == nil {
+		t.Error("invalid secret accepted")
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	//RFC 6238, appendix B (SHA1), the last 6 of the 8 digits of the vectors
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		now := time.Unix(tt.unix, 0)
+		counter, ok := verifyTOTP(rfcTOTPSecret, tt.code, now, 0)
+		if !ok || counter != tt.unix/totpPeriod {
+			t.Errorf("code %s at %d: counter %d %t, want %d", tt.code, tt.unix, counter, ok, tt.unix/totpPeriod)
+		}
+	}
+
+	now := time.Unix(1234567890, 0)
+	current := totpCounter(now)
+	codeOf := func(counter int64) string {
+		code, err := hotp(rfcTOTPSecret, uint64(counter))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	//the periods within the skew are accepted, the others aren't
+	for offset := int64(-totpSkew - 1); offset <= totpSkew+1; offset++ {
+		counter, ok := verifyTOTP(rfcTOTPSecret, codeOf(current+offset), now, 0)
+		inWindow := offset >= -totpSkew && offset <= totpSkew
+		if ok != inWindow || (ok && counter != current+offset) {
+			t.Errorf("code of the period %+d: counter %d %t, want accepted %t", offset, counter, ok, inWindow)
+		}
+	}
+	if _, ok := verifyTOTP(rfcTOTPSecret, " "+codeOf(current)+"\n", now, 0); !ok {
+		t.Error("code with spaces refused")
+	}
+	if _, ok := verifyTOTP(rfcTOTPSecret, codeOf(current)[:5], now, 0); ok {
+		t.Error("code too short accepted")
+	}
+
+	//a code of a counter already used, or older, is a replay
+	if _, ok := verifyTOTP(rfcTOTPSecret, codeOf(current), now, current); ok {
+		t.Error("code of the last counter accepted again")
+	}
+	if _, ok := verifyTOTP(rfcTOTPSecret, codeOf(current-1), now, current); ok {
+		t.Error("code older than the last counter accepted")
+	}
+	if counter, ok := verifyTOTP(rfcTOTPSecret, codeOf(current+1), now, current); !ok || counter != current+1 {
+		t.Errorf("code of the next period after the last counter: %d %t, want accepted", counter, ok)
+	}
+}
+
+//enableTestTOTP enables the two factor authentication of the user and returns its secret
+func enableTestTOTP(t *testing.T, user *User) string {
+	t.Helper()
+	secret, err := user.BeginTOTPEnrollment()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := hotp(secret, uint64(totpCounter(time.Now())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = user.ConfirmTOTP(code); err != nil {
+		t.Fatal(err)
+	}
+	return secret
+}
+
+func TestDisableTOTPWithoutPassword(t *testing.T) {
+	withPassword := newTestUser(t)
+	passkeyOnly := newTestUser(t)
+	db, err := connectToDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	//the accounts created with a passkey have an empty password
+	if _, err = db.Exec("UPDATE users SET password = '' WHERE ID = ?", passkeyOnly.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	disable := func(user User, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", disableTOTP.String(), strings.NewReader(body))
+		r.AddCookie(&http.Cookie{Name: "JWT", Value: sessionToken(t, user)})
+		w := httptest.NewRecorder()
+		disableTOTPHandler(w, r)
+		return w
+	}
+	//the code of the confirmation can't be used again
+	nextCode := func(secret string) string {
+		code, err := hotp(secret, uint64(totpCounter(time.Now())+1))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+
+	secret := enableTestTOTP(t, &withPassword)
+	if w := disable(withPassword, `{"code": "`+nextCode(secret)+`"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("disable without the password: status %d, want 401: %s", w.Code, w.Body.String())
+	}
+	if w := disable(withPassword, `{"password": "password", "code": "`+nextCode(secret)+`"}`); w.Code != http.StatusOK {
+		t.Errorf("disable with the password: status %d, want 200: %s", w.Code, w.Body.String())
+	}
+
+	secret = enableTestTOTP(t, &passkeyOnly)
+	if w := disable(passkeyOnly, `{"code": "000000"}`); w.Code != http.StatusUnauthorized {
+		t.Errorf("disable of the passkey account with a wrong code: status %d, want 401: %s", w.Code, w.Body.String())
+	}
+	if w := disable(passkeyOnly, `{"code": "`+nextCode(secret)+`"}`); w.Code != http.StatusOK {
+		t.Errorf("disable of the passkey account with the code: status %d, want 200: %s", w.Code, w.Body.String())
+	}
+	if user, err := QueryUserByID(passkeyOnly.ID, 0); err != nil || user.TOTPEnabled {
+		t.Errorf("two factor authentication of the passkey account still enabled: %v", err)
+	}
+}
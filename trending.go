@@ -0,0 +1,380 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+//Clock gives the current time to the trending service, in this way the scoring
+//can be tested with a fake clock instead of the real one
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+//a single like, only the blob and when it was added are needed to compute the velocity
+type likeEvent struct {
+	BlobID    int
+	AddedDate time.Time
+}
+
+type TrendingBlob struct {
+	Blob
+	Score       float64 `json:"score"`
+	WindowLikes int     `json:"window_likes"`
+}
+
+type TrendingTerm struct {
+	Term    string  `json:"term"`
+	Hashtag bool    `json:"hashtag"`
+	Score   float64 `json:"score"`
+	Count   int     `json:"count"`
+}
+
+type Trends struct {
+	Window    string         `json:"window"`
+	UpdatedAt time.Time      `json:"updated_at"`
+	Blobs     []TrendingBlob `json:"blobs"`
+	Terms     []TrendingTerm `json:"terms"`
+}
+
+//TrendingService computes the trends of every window in background and keeps them cached,
+//the handlers only read from the cache
+type TrendingService struct {
+	windows map[string]time.Duration
+	refresh time.Duration
+	limit   int
+	clock   Clock
+
+	//data sources, replaceable to compute the trends without a database
+	fetchLikes func(since time.Time) ([]likeEvent, error)
+	fetchBlobs func(since time.Time) ([]Blob, error)
+	blobByID   func(id int) (Blob, error)
+
+	mu    sync.RWMutex
+	cache map[string]Trends
+}
+
+var (
+	hashtagRegex = regexp.MustCompile(`#[\p{L}\p{N}_]+`)
+	wordRegex    = regexp.MustCompile(`[\p{L}\p{N}_]+`)
+
+	//words too common to be a trend
+	stopWords = map[string]bool{
+		"this": true, "that": true, "with": true, "from": true, "have": true, "what": true, "just": true,
+		"della": true, "delle": true, "dello": true, "degli": true, "sono": true, "come": true, "questo": true,
+		"questa": true, "anche": true, "però": true, "perché": true, "nella": true, "alla": true, "molto": true,
+	}
+)
+
+//the score of an event halves every halfLife (window / trendingHalfLifeDivisor)
+const (
+	trendingHalfLifeDivisor = 4
+	trendingHashtagBoost    = 2
+	trendingMinWordLength   = 4
+)
+
+func NewTrendingService(windows map[string]time.Duration, refresh time.Duration, limit int, clock Clock) *TrendingService {
+	return &TrendingService{
+		windows:    windows,
+		refresh:    refresh,
+		limit:      limit,
+		clock:      clock,
+		fetchLikes: queryLikesSince,
+		fetchBlobs: queryBlobsSince,
+		blobByID: func(id int) (Blob, error) {
+			return QueryBlobByID(id, 0)
+		},
+		cache: make(map[string]Trends),
+	}
+}
+
+//Run refreshes the trends every s.refresh, it never returns so it should be called in a goroutine
+func (s *TrendingService) Run() {
+	s.RefreshAll()
+	ticker := time.NewTicker(s.refresh)
+	defer ticker.Stop()
+	for range ticker.C {
+		s.RefreshAll()
+	}
+}
+
+func (s *TrendingService) RefreshAll() {
+	for name := range s.windows {
+		if err := s.Refresh(name); err != nil {
+			log.Printf("trending: refresh of window %s failed: %v", name, err)
+		}
+	}
+}
+
+//Refresh computes the trends of a single window and stores them in the cache
+func (s *TrendingService) Refresh(name string) error {
+	window, ok := s.windows[name]
+	if !ok {
+		return fmt.Errorf("unknown window %s", name)
+	}
+
+	now := s.clock.Now()
+	since := now.Add(-window)
+
+	likes, err := s.fetchLikes(since)
+	if err != nil {
+		return err
+	}
+
+	blobs, err := s.fetchBlobs(since)
+	if err != nil {
+		return err
+	}
+
+	trends := Trends{
+		Window:    name,
+		UpdatedAt: now,
+		Blobs:     []TrendingBlob{},
+		Terms:     rankTerms(blobs, now, window, s.limit),
+	}
+
+	for _, ranked := range rankBlobs(likes, now, window, s.limit) {
+		blob, err := s.blobByID(ranked.ID)
+		if err != nil {
+			//the blob has been deleted after being liked
+			continue
+		}
+		ranked.Blob = blob
+		trends.Blobs = append(trends.Blobs, ranked)
+	}
+
+	s.mu.Lock()
+	s.cache[name] = trends
+	s.mu.Unlock()
+	return nil
+}
+
+//HasWindow tells if name is one of the configured windows
+func (s *TrendingService) HasWindow(name string) bool {
+	_, ok := s.windows[name]
+	return ok
+}
+
+//Get returns the cached trends of the window, false if the window doesn't exist or wasn't computed yet
+func (s *TrendingService) Get(name string) (Trends, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	trends, ok := s.cache[name]
+	return trends, ok
+}
+
+//decayWeight is the weight of an event happened at t, it's 1 for an event happened now and
+//halves every halfLife, events outside the window weight 0
+func decayWeight(t, now time.Time, window time.Duration) float64 {
+	age := now.Sub(t)
+	if age < 0 {
+		age = 0
+	}
+	if age > window {
+		return 0
+	}
+	halfLife := window / trendingHalfLifeDivisor
+	return math.Pow(0.5, float64(age)/float64(halfLife))
+}
+
+//rankBlobs sorts the liked blobs by like velocity, every like weights by how recent it is,
+//only the ID of the returned blobs is set
+func rankBlobs(likes []likeEvent, now time.Time, window time.Duration, limit int) []TrendingBlob {
+	scores := make(map[int]*TrendingBlob)
+	for _, like := range likes {
+		weight := decayWeight(like.AddedDate, now, window)
+		if weight == 0 {
+			continue
+		}
+		ranked, ok := scores[like.BlobID]
+		if !ok {
+			ranked = &TrendingBlob{Blob: Blob{ID: like.BlobID}}
+			scores[like.BlobID] = ranked
+		}
+		ranked.Score += weight
+		ranked.WindowLikes++
+	}
+
+	ranking := make([]TrendingBlob, 0, len(scores))
+	for _, ranked := range scores {
+		ranking = append(ranking, *ranked)
+	}
+	sort.Slice(ranking, func(i, j int) bool {
+		if ranking[i].Score == ranking[j].Score {
+			return ranking[i].ID > ranking[j].ID
+		}
+		return ranking[i].Score > ranking[j].Score
+	})
+
+	if len(ranking) > limit {
+		ranking = ranking[:limit]
+	}
+	return ranking
+}
+
+//rankTerms extracts the hashtags and the words from the blobs, every occurrence weights by the
+//age of the blob and hashtags weight more than plain words
+func rankTerms(blobs []Blob, now time.Time, window time.Duration, limit int) []TrendingTerm {
+	scores := make(map[string]*TrendingTerm)
+	add := func(term string, hashtag bool, weight float64) {
+		ranked, ok := scores[term]
+		if !ok {
+			ranked = &TrendingTerm{Term: term, Hashtag: hashtag}
+			scores[term] = ranked
+		}
+		ranked.Score += weight
+		ranked.Count++
+	}
+
+	for _, blob := range blobs {
+		weight := decayWeight(blob.AddedDate, now, window)
+		if weight == 0 {
+			continue
+		}
+
+		content := strings.ToLower(blob.Content)
+		//the same term counts once per blob
+		seen := make(map[string]bool)
+		for _, tag := range hashtagRegex.FindAllString(content, -1) {
+			if !seen[tag] {
+				seen[tag] = true
+				add(tag, true, weight*trendingHashtagBoost)
+			}
+		}
+
+		for _, word := range wordRegex.FindAllString(hashtagRegex.ReplaceAllString(content, " "), -1) {
+			if len([]rune(word)) < trendingMinWordLength || stopWords[word] || seen[word] {
+				continue
+			}
+			seen[word] = true
+			add(word, false, weight)
+		}
+	}
+
+	ranking := make([]TrendingTerm, 0, len(scores))
+	for _, ranked := range scores {
+		ranking = append(ranking, *ranked)
+	}
+	sort.Slice(ranking, func(i, j int) bool {
+		if ranking[i].Score == ranking[j].Score {
+			return ranking[i].Term < ranking[j].Term
+		}
+		return ranking[i].Score > ranking[j].Score
+	})
+
+	if len(ranking) > limit {
+		ranking = ranking[:limit]
+	}
+	return ranking
+}
+
+func queryLikesSince(since time.Time) ([]likeEvent, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return []likeEvent{}, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT ID_blob, added_date FROM likes WHERE added_date >= ?", since)
+	if err != nil {
+		return []likeEvent{}, err
+	}
+	defer rows.Close()
+
+	var likes []likeEvent
+	for rows.Next() {
+		var like likeEvent
+		if err := rows.Scan(&like.BlobID, &like.AddedDate); err != nil {
+			return []likeEvent{}, err
+		}
+		likes = append(likes, like)
+	}
+	return likes, rows.Err()
+}
+
+func queryBlobsSince(since time.Time) ([]Blob, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return []Blob{}, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT ID, ID_user, content, added_date FROM blobs WHERE added_date >= ?", since)
+	if err != nil {
+		return []Blob{}, err
+	}
+	defer rows.Close()
+
+	var blobs []Blob
+	for rows.Next() {
+		var blob Blob
+		if err := rows.Scan(&blob.ID, &blob.UserID, &blob.Content, &blob.AddedDate); err != nil {
+			return []Blob{}, err
+		}
+		blobs = append(blobs, blob)
+	}
+	return blobs, rows.Err()
+}
+
+//parseWindow parses a window duration, on top of the time.ParseDuration format it accepts days (7d)
+func parseWindow(window string) (time.Duration, error) {
+	window = strings.TrimSpace(window)
+	if strings.HasSuffix(window, "d") {
+		var days int
+		if _, err := fmt.Sscanf(window, "%dd", &days); err != nil || days <= 0 {
+			return 0, fmt.Errorf("invalid window %s", window)
+		}
+		return time.Duration(days) * 24 * time.Hour, nil
+	}
+
+	d, err := time.ParseDuration(window)
+	if err != nil || d <= 0 {
+		return 0, fmt.Errorf("invalid window %s", window)
+	}
+	return d, nil
+}
+
+//NewTrendingServiceFromConfig creates the trending service applying the defaults
+//(1h, 24h and 7d windows refreshed every minute) to the missing values
+func NewTrendingServiceFromConfig(c TrendingConfig, clock Clock) (*TrendingService, error) {
+	names := c.Windows
+	if len(names) == 0 {
+		names = []string{"1h", "24h", "7d"}
+	}
+
+	windows := make(map[string]time.Duration)
+	for _, name := range names {
+		d, err := parseWindow(name)
+		if err != nil {
+			return nil, err
+		}
+		windows[strings.TrimSpace(name)] = d
+	}
+
+	refresh := time.Minute
+	if c.Refresh != "" {
+		var err error
+		refresh, err = time.ParseDuration(c.Refresh)
+		if err != nil || refresh <= 0 {
+			return nil, fmt.Errorf("invalid trending refresh %s", c.Refresh)
+		}
+	}
+
+	limit := c.Limit
+	if limit <= 0 {
+		limit = 10
+	}
+	return NewTrendingService(windows, refresh, limit, clock), nil
+}
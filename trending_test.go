@@ -0,0 +1,197 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+//newTestTrendingService has a single 1h window and reads the likes and the blobs from the slices
+func newTestTrendingService(clock Clock, likes []likeEvent, blobs []Blob) *TrendingService {
+	s := NewTrendingService(map[string]time.Duration{"1h": time.Hour}, time.Minute, 10, clock)
+	s.fetchLikes = func(since time.Time) ([]likeEvent, error) {
+		return likes, nil
+	}
+	s.fetchBlobs = func(since time.Time) ([]Blob, error) {
+		return blobs, nil
+	}
+	s.blobByID = func(id int) (Blob, error) {
+		for _, blob := range blobs {
+			if blob.ID == id {
+				return blob, nil
+			}
+		}
+		return Blob{}, errors.New("blob not found")
+	}
+	return s
+}
+
+func TestDecayWeight(t *testing.T) {
+	now := time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+	window := 4 * time.Hour
+
+	tests := []struct {
+		name string
+		t    time.Time
+		want float64
+	}{
+		{"now", now, 1},
+		{"one half life ago", now.Add(-time.Hour), 0.5},
+		{"two half lives ago", now.Add(-2 * time.Hour), 0.25},
+		{"in the future", now.Add(time.Minute), 1},
+		{"outside the window", now.Add(-window - time.Second), 0},
+	}
+	for _, tt := range tests {
+		if got := decayWeight(tt.t, now, window); math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: decayWeight = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestTrendingRefreshRanksByVelocity(t *testing.T) {
+	clock := &fakeClock{now: time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)}
+	blobs := []Blob{
+		{ID: 1, Content: "old news", AddedDate: clock.now.Add(-2 * time.Hour)},
+		{ID: 2, Content: "fresh news", AddedDate: clock.now.Add(-10 * time.Minute)},
+	}
+	likes := []likeEvent{
+		//many likes at the start of the window
+		{BlobID: 1, AddedDate: clock.now.Add(-55 * time.Minute)},
+		{BlobID: 1, AddedDate: clock.now.Add(-55 * time.Minute)},
+		{BlobID: 1, AddedDate: clock.now.Add(-50 * time.Minute)},
+		{BlobID: 1, AddedDate: clock.now.Add(-50 * time.Minute)},
+		//fewer but recent likes
+		{BlobID: 2, AddedDate: clock.now.Add(-time.Minute)},
+		{BlobID: 2, AddedDate: clock.now},
+		//liked and then deleted
+		{BlobID: 3, AddedDate: clock.now},
+	}
+	s := newTestTrendingService(clock, likes, blobs)
+
+	var since time.Time
+	fetchLikes := s.fetchLikes
+	s.fetchLikes = func(t time.Time) ([]likeEvent, error) {
+		since = t
+		return fetchLikes(t)
+	}
+
+	if err := s.Refresh("1h"); err != nil {
+		t.Fatal(err)
+	}
+	if want := clock.now.Add(-time.Hour); !since.Equal(want) {
+		t.Errorf("likes fetched since %v, want %v", since, want)
+	}
+
+	trends, ok := s.Get("1h")
+	if !ok {
+		t.Fatal("trends of 1h not cached")
+	}
+	if !trends.UpdatedAt.Equal(clock.now) {
+		t.Errorf("updated at %v, want the time of the clock %v", trends.UpdatedAt, clock.now)
+	}
+	if len(trends.Blobs) != 2 {
+		t.Fatalf("got %d blobs, want 2 (the deleted blob is skipped)", len(trends.Blobs))
+	}
+	if trends.Blobs[0].ID != 2 || trends.Blobs[1].ID != 1 {
+		t.Errorf("ranking %d, %d, want the recent likes first: 2, 1", trends.Blobs[0].ID, trends.Blobs[1].ID)
+	}
+	if trends.Blobs[0].WindowLikes != 2 || trends.Blobs[1].WindowLikes != 4 {
+		t.Errorf("window likes %d, %d, want 2, 4", trends.Blobs[0].WindowLikes, trends.Blobs[1].WindowLikes)
+	}
+	if trends.Blobs[0].Content != "fresh news" {
+		t.Errorf("the blob of the ranking is not loaded: %+v", trends.Blobs[0].Blob)
+	}
+
+	//an hour later every like is outside the window
+	clock.now = clock.now.Add(time.Hour + time.Second)
+	if err := s.Refresh("1h"); err != nil {
+		t.Fatal(err)
+	}
+	trends, _ = s.Get("1h")
+	if len(trends.Blobs) != 0 {
+		t.Errorf("got %d blobs an hour later, want 0", len(trends.Blobs))
+	}
+}
+
+func TestTrendingRefreshErrors(t *testing.T) {
+	s := newTestTrendingService(&fakeClock{now: time.Now()}, nil, nil)
+	if err := s.Refresh("7d"); err == nil {
+		t.Error("refresh of an unknown window succeeded")
+	}
+	if s.HasWindow("7d") || !s.HasWindow("1h") {
+		t.Error("HasWindow doesn't match the configured windows")
+	}
+
+	s.fetchLikes = func(since time.Time) ([]likeEvent, error) {
+		return nil, errors.New("database down")
+	}
+	if err := s.Refresh("1h"); err == nil {
+		t.Error("refresh succeeded with a failing data source")
+	}
+	if _, ok := s.Get("1h"); ok {
+		t.Error("a failed refresh cached the trends")
+	}
+}
+
+func TestRankTerms(t *testing.T) {
+	now := time.Date(2022, 9, 1, 12, 0, 0, 0, time.UTC)
+	blobs := []Blob{
+		{ID: 1, Content: "#Golang golang golang with the gopher", AddedDate: now},
+		{ID: 2, Content: "the gopher likes #golang", AddedDate: now},
+		{ID: 3, Content: "gopher gopher", AddedDate: now.Add(-2 * time.Hour)},
+	}
+	terms := rankTerms(blobs, now, time.Hour, 10)
+
+	byTerm := make(map[string]TrendingTerm)
+	for _, term := range terms {
+		byTerm[term.Term] = term
+	}
+	if len(terms) == 0 || terms[0].Term != "#golang" || !terms[0].Hashtag {
+		t.Fatalf("the boosted hashtag is not the first term: %+v", terms)
+	}
+	if byTerm["#golang"].Count != 2 {
+		t.Errorf("#golang counted %d times, want once per blob: 2", byTerm["#golang"].Count)
+	}
+	//the old blob is outside the window, the repeated word counts once
+	if byTerm["gopher"].Count != 2 {
+		t.Errorf("gopher counted %d times, want 2", byTerm["gopher"].Count)
+	}
+	for _, skipped := range []string{"with", "the"} {
+		if _, ok := byTerm[skipped]; ok {
+			t.Errorf("the stop word or short word %q is a trend", skipped)
+		}
+	}
+	if byTerm["golang"].Count != 1 {
+		t.Errorf("the plain word golang counted %d times, want 1", byTerm["golang"].Count)
+	}
+}
+
+func TestNewTrendingServiceFromConfig(t *testing.T) {
+	s, err := NewTrendingServiceFromConfig(TrendingConfig{}, realClock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, window := range []string{"1h", "24h", "7d"} {
+		if !s.HasWindow(window) {
+			t.Errorf("default window %s missing", window)
+		}
+	}
+	if s.windows["7d"] != 7*24*time.Hour || s.refresh != time.Minute || s.limit != 10 {
+		t.Errorf("wrong defaults: %v, refresh %v, limit %d", s.windows, s.refresh, s.limit)
+	}
+
+	for _, c := range []TrendingConfig{{Windows: []string{"0d"}}, {Windows: []string{"ieri"}}, {Refresh: "-1m"}} {
+		if _, err := NewTrendingServiceFromConfig(c, realClock{}); err == nil {
+			t.Errorf("invalid config %+v accepted", c)
+		}
+	}
+}
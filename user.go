@@ -1,8 +1,17 @@
 package main
 
 import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"errors"
 	"fmt"
+	"log"
+	"net/mail"
+	"regexp"
 	"sort"
+	"strings"
+	"time"
 )
 
 type User struct {
@@ -14,8 +23,25 @@ type User struct {
 	FollowersCount int    `json:"followers"`
 	FollowingCount int    `json:"following"`
 	Follows        bool   `json:"follows"`
+	FollowsYou     bool   `json:"follows_you"`
+	Mutual         bool   `json:"mutual"`
+	//private fields, never sent to the clients
+	Email           string `json:"-"`
+	EmailVerified   bool   `json:"-"`
+	SessionVersion  int    `json:"-"`
+	TOTPSecret      string `json:"-"`
+	TOTPEnabled     bool   `json:"-"`
+	TOTPLastCounter int64  `json:"-"`
 }
 
+//for how long an old username keeps pointing to the user after a change
+const usernameAliasWindow = 30 * 24 * time.Hour
+
+var (
+	usernameRegex    = regexp.MustCompile(`^[a-zA-Z0-9_.]{3,20}$`)
+	errWrongPassword = errors.New("wrong password")
+)
+
 func (u User) ModifyBlob(id int, content string) error {
 	Blob, err := QueryBlobByID(id, u.ID)
 	if err != nil {
@@ -105,7 +131,9 @@ func (u User) Delete() error {
 	}
 	defer db.Close()
 
-	_, err = db.Query("DELETE FROM users WHERE ID = ?", u.ID)
+	_, err = writeWithEvent(db, func(sql.Result) (Event, error) {
+		return UserDeleted{UserID: u.ID, At: time.Now()}, nil
+	}, "DELETE FROM users WHERE ID = ?", u.ID)
 	return err
 }
 
@@ -133,14 +161,30 @@ func (u User) GetOverview() ([]Blob, error) {
 	return blobs, nil
 }
 
+//Follow is idempotent, following an user twice doesn't add a second row
 func (u User) Follow(id int) error {
+	if id == u.ID {
+		return fmt.Errorf("%w: you can't follow yourself", errBadRequest)
+	}
+
 	db, err := connectToDB()
 	if err != nil {
 		return err
 	}
 	defer db.Close()
 
-	_, err = db.Query("INSERT INTO follows (ID_user_follower, ID_user_followed) VALUES (?, ?)", u.ID, id)
+	_, err = writeWithEvent(db, func(sql.Result) (Event, error) {
+		follower, err := queryUsername(db, u.ID)
+		if err != nil {
+			return nil, err
+		}
+		followed, err := queryUsername(db, id)
+		if err != nil {
+			return nil, err
+		}
+		return UserFollowed{FollowerID: u.ID, Follower: follower, FollowedID: id, Followed: followed, At: time.Now()}, nil
+	}, `INSERT INTO follows (ID_user_follower, ID_user_followed) SELECT ?, ? FROM DUAL
+		WHERE NOT EXISTS (SELECT 1 FROM follows WHERE ID_user_follower = ? AND ID_user_followed = ?)`, u.ID, id, u.ID, id)
 	return err
 }
 
@@ -151,60 +195,134 @@ func (u User) Unfollow(id int) error {
 	}
 	defer db.Close()
 
-	_, err = db.Query("DELETE FROM follows WHERE ID_user_follower = ? AND ID_user_followed = ?", u.ID, id)
+	_, err = writeWithEvent(db, func(sql.Result) (Event, error) {
+		return UserUnfollowed{FollowerID: u.ID, FollowedID: id, At: time.Now()}, nil
+	}, "DELETE FROM follows WHERE ID_user_follower = ? AND ID_user_followed = ?", u.ID, id)
 	return err
 }
 
-func (u User) GetFollowers() ([]User, error) {
+//GetFollowers returns a page of the users following u and if there are more pages after it,
+//the follows fields are relative to the requester
+func (u User) GetFollowers(requesterID, limit, offset int) ([]User, bool, error) {
 	db, err := connectToDB()
 	if err != nil {
-		return []User{}, err
+		return []User{}, false, err
 	}
 	defer db.Close()
 
-	rows, err := db.Query("SELECT follower.* FROM follows f inner join users followed on f.ID_user_followed = followed.ID join users follower on f.ID_user_follower = follower.ID WHERE followed.ID = ?", u.ID)
+	//one more row than the page tells if there is a next page
+	rows, err := db.Query("SELECT follower.ID, follower.username, follower.description FROM follows f join users follower on f.ID_user_follower = follower.ID WHERE f.ID_user_followed = ? ORDER BY f.ID DESC LIMIT ? OFFSET ?", u.ID, limit+1, offset)
 	if err != nil {
-		return []User{}, err
+		return []User{}, false, err
 	}
+	return scanUsersPage(rows, requesterID, limit)
+}
+
+//GetFollowings returns a page of the users followed by u and if there are more pages after it,
+//the follows fields are relative to the requester
+func (u User) GetFollowings(requesterID, limit, offset int) ([]User, bool, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return []User{}, false, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query("SELECT followed.ID, followed.username, followed.description FROM follows f join users followed on f.ID_user_followed = followed.ID WHERE f.ID_user_follower = ? ORDER BY f.ID DESC LIMIT ? OFFSET ?", u.ID, limit+1, offset)
+	if err != nil {
+		return []User{}, false, err
+	}
+	return scanUsersPage(rows, requesterID, limit)
+}
+
+//scan the rows (id, username, description) of a followers/followings query read with limit+1,
+//the extra row is dropped and only tells that there is a next page
+func scanUsersPage(rows *sql.Rows, requesterID, limit int) ([]User, bool, error) {
+	defer rows.Close()
+
 	var users []User
+	hasMore := false
 	for rows.Next() {
+		if len(users) == limit {
+			hasMore = true
+			break
+		}
 		var user User
-		err = rows.Scan(&user)
+		err := rows.Scan(&user.ID, &user.Username, &user.Description)
 		if err != nil {
-			return []User{}, err
+			return []User{}, false, err
 		}
 
-		user.Info(u.ID)
+		user.Info(requesterID)
 		user.Password = "-hidden-"
 		users = append(users, user)
 	}
-	return users, nil
+	return users, hasMore, rows.Err()
+}
+
+//a suggested account, the counters explain why it was suggested
+type Recommendation struct {
+	User
+	MutualFollows int `json:"mutual_follows"`
+	Popularity    int `json:"popularity"`
 }
 
-func (u User) GetFollowings() ([]User, error) {
+//weights used to rank the recommendations, a user that already follows you
+//weights more than a single friend in common which weights more than a single like
+const (
+	recommendationMutualWeight     = 3
+	recommendationFollowsYouWeight = 5
+	recommendationLikesWeight      = 1
+)
+
+//GetRecommendations suggests accounts to follow using the follows graph (the users followed by the
+//people u follows and the users that follows u) and the likes received as popularity,
+//u itself, the users already followed and the ones without any of these signals are never suggested.
+//The counters of the profiles are read in the same query
+func (u User) GetRecommendations(limit int) ([]Recommendation, error) {
 	db, err := connectToDB()
 	if err != nil {
-		return []User{}, err
+		return []Recommendation{}, err
 	}
 	defer db.Close()
 
-	rows, err := db.Query("SELECT follower.* FROM follows f inner join users followed on f.ID_user_followed = followed.ID join users follower on f.ID_user_follower = follower.ID WHERE followed.ID = ?", u.ID)
+	rows, err := db.Query(`
+	SELECT c.ID, c.username, c.description, c.mutuals, c.follows_you, c.popularity, c.followers, c.following FROM (
+		SELECT u.ID, u.username, u.description,
+			(SELECT COUNT(*) FROM follows f1 JOIN follows f2 ON f1.ID_user_followed = f2.ID_user_follower
+				WHERE f1.ID_user_follower = ? AND f2.ID_user_followed = u.ID) AS mutuals,
+			(SELECT COUNT(*) FROM follows f WHERE f.ID_user_follower = u.ID AND f.ID_user_followed = ?) AS follows_you,
+			(SELECT COUNT(*) FROM likes l JOIN blobs b ON l.ID_blob = b.ID JOIN users liker ON l.ID_user = liker.ID WHERE b.ID_user = u.ID) AS popularity,
+			(SELECT COUNT(*) FROM follows f WHERE f.ID_user_followed = u.ID) AS followers,
+			(SELECT COUNT(*) FROM follows f WHERE f.ID_user_follower = u.ID) AS following
+		FROM users u
+		WHERE u.ID <> ? AND u.ID NOT IN (SELECT ID_user_followed FROM follows WHERE ID_user_follower = ?)
+	) c
+	WHERE c.mutuals + c.follows_you + c.popularity > 0
+	ORDER BY c.mutuals * ? + c.follows_you * ? + c.popularity * ? DESC, c.ID DESC
+	LIMIT ?`,
+		u.ID, u.ID, u.ID, u.ID,
+		recommendationMutualWeight, recommendationFollowsYouWeight, recommendationLikesWeight,
+		limit)
 	if err != nil {
-		return []User{}, err
+		return []Recommendation{}, err
 	}
-	var users []User
+	defer rows.Close()
+
+	var recommendations []Recommendation
 	for rows.Next() {
-		var user User
-		err = rows.Scan(&user)
+		var r Recommendation
+		var followsYou int
+		err = rows.Scan(&r.ID, &r.Username, &r.Description, &r.MutualFollows, &followsYou, &r.Popularity, &r.FollowersCount, &r.FollowingCount)
 		if err != nil {
-			return []User{}, err
+			return []Recommendation{}, err
 		}
-
-		user.Info(u.ID)
-		user.Password = "-hidden-"
-		users = append(users, user)
+		//u never follows a recommendation, so it can't be mutual
+		r.LikesCount = r.Popularity
+		r.FollowsYou = followsYou > 0
+		r.Password = "-hidden-"
+		recommendations = append(recommendations, r)
 	}
-	return users, nil
+	return recommendations, rows.Err()
 }
 
 func (u *User) Info(requesterID int) error {
@@ -227,10 +345,30 @@ func (u *User) Info(requesterID int) error {
 	}
 
 	//check if the requester is following the user
-	return db.QueryRow("SELECT COUNT(ID_user_followed) FROM follows WHERE ID_user_followed=? AND ID_user_follower=?", u.ID, requesterID).Scan(&u.Follows)
+	if err := db.QueryRow("SELECT COUNT(ID_user_followed) FROM follows WHERE ID_user_followed=? AND ID_user_follower=?", u.ID, requesterID).Scan(&u.Follows); err != nil {
+		return err
+	}
+
+	//check if the user is following the requester
+	if err := db.QueryRow("SELECT COUNT(ID_user_followed) FROM follows WHERE ID_user_followed=? AND ID_user_follower=?", requesterID, u.ID).Scan(&u.FollowsYou); err != nil {
+		return err
+	}
+
+	u.Mutual = u.Follows && u.FollowsYou
+	return nil
 }
 
 //not methods
+//select of all the columns read by scanUser
+const userColumnsQuery = "SELECT id, username, password, description, IFNULL(email, ''), email_verified, session_version, IFNULL(totp_secret, ''), totp_enabled, totp_last_counter FROM users"
+
+func scanUser(row rowScanner) (User, error) {
+	var user User
+	err := row.Scan(&user.ID, &user.Username, &user.Password, &user.Description, &user.Email, &user.EmailVerified, &user.SessionVersion,
+		&user.TOTPSecret, &user.TOTPEnabled, &user.TOTPLastCounter)
+	return user, err
+}
+
 func AddUser(username, password, description string) error {
 	db, err := connectToDB()
 	if err != nil {
@@ -238,12 +376,19 @@ func AddUser(username, password, description string) error {
 	}
 	defer db.Close()
 
-	_, err = QueryUserByUsername(username, 0)
-	if err == nil {
-		return fmt.Errorf("user already exists")
+	taken, err := usernameTaken(username, 0)
+	if err != nil {
+		return err
+	}
+	if taken {
+		return fmt.Errorf("%w: user already exists", errConflict)
 	}
 
-	_, err = db.Query("INSERT INTO users (username, password, description) VALUES (?, ?, ?)", username, password, description)
+	//the unique key stops the users registered at the same time with the same username
+	_, err = db.Exec("INSERT INTO users (username, password, description) VALUES (?, ?, ?)", username, password, description)
+	if isDuplicateEntry(err) {
+		return fmt.Errorf("%w: user already exists", errConflict)
+	}
 	return err
 }
 
@@ -254,8 +399,7 @@ func QueryUserByID(id int, requesterID int) (User, error) {
 	}
 	defer db.Close()
 
-	var user User
-	err = db.QueryRow("SELECT id, username, password, description FROM users WHERE id = ?", id).Scan(&user.ID, &user.Username, &user.Password, &user.Description)
+	user, err := scanUser(db.QueryRow(userColumnsQuery+" WHERE id = ?", id))
 	if err != nil {
 		return User{}, err
 	}
@@ -270,8 +414,7 @@ func QueryUserByUsername(username string, requesterID int) (User, error) {
 	}
 	defer db.Close()
 
-	var user User
-	err = db.QueryRow("SELECT id, username, password, description FROM users WHERE username = ?", username).Scan(&user.ID, &user.Username, &user.Password, &user.Description)
+	user, err := scanUser(db.QueryRow(userColumnsQuery+" WHERE username = ?", username))
 	if err != nil {
 		return User{}, err
 	}
@@ -280,6 +423,32 @@ func QueryUserByUsername(username string, requesterID int) (User, error) {
 	return user, nil
 }
 
+//QueryUsers lists the users from the oldest with their counters, for the admin command
+func QueryUsers(limit, offset int) ([]User, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return []User{}, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(userColumnsQuery+" ORDER BY id LIMIT ? OFFSET ?", limit, offset)
+	if err != nil {
+		return []User{}, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return []User{}, err
+		}
+		user.Info(0)
+		users = append(users, user)
+	}
+	return users, rows.Err()
+}
+
 func QueryUsersBySubstring(usernameSubstring string, requesterID int) ([]User, error) {
 	db, err := connectToDB()
 	if err != nil {
@@ -308,3 +477,259 @@ func QueryUsersBySubstring(usernameSubstring string, requesterID int) ([]User, e
 
 	return users, nil
 }
+
+//usernameTaken checks if the username is used by another user or reserved by an alias that didn't expire yet,
+//the aliases of ownerID are ignored so a user can take back an old username
+func usernameTaken(username string, ownerID int) (bool, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM users WHERE username = ? AND ID <> ?", username, ownerID).Scan(&count)
+	if err != nil || count > 0 {
+		return count > 0, err
+	}
+
+	err = db.QueryRow("SELECT COUNT(*) FROM username_aliases WHERE username = ? AND ID_user <> ? AND expires_at > NOW()", username, ownerID).Scan(&count)
+	return count > 0, err
+}
+
+//ResolveUsername returns the id of the user with the username, old usernames are resolved
+//until their alias expires
+func ResolveUsername(username string) (int, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var id int
+	err = db.QueryRow("SELECT ID FROM users WHERE username = ?", username).Scan(&id)
+	if err == nil {
+		return id, nil
+	}
+	if err != sql.ErrNoRows {
+		return 0, err
+	}
+
+	err = db.QueryRow("SELECT ID_user FROM username_aliases WHERE username = ? AND expires_at > NOW() ORDER BY expires_at DESC LIMIT 1", username).Scan(&id)
+	return id, err
+}
+
+//QuerySessionVersion returns the current session version of the user, jwt with an older version are revoked
+func QuerySessionVersion(userID int) (int, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var version int
+	err = db.QueryRow("SELECT session_version FROM users WHERE ID = ?", userID).Scan(&version)
+	return version, err
+}
+
+//queryUsername returns the current username of the user, the events save it since it can change
+func queryUsername(db *sql.DB, userID int) (string, error) {
+	var username string
+	err := db.QueryRow("SELECT username FROM users WHERE ID = ?", userID).Scan(&username)
+	return username, err
+}
+
+//account settings
+//ChangeUsername renames the user, the old username becomes an alias for usernameAliasWindow
+func (u *User) ChangeUsername(username string) error {
+	username = strings.TrimSpace(username)
+	if !usernameRegex.MatchString(username) {
+		return fmt.Errorf("%w: the username must be 3 to 20 letters, numbers, dots or underscores", errBadRequest)
+	}
+	if username == u.Username {
+		return fmt.Errorf("%w: nothing to change", errBadRequest)
+	}
+
+	taken, err := usernameTaken(username, u.ID)
+	if err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	if taken {
+		return fmt.Errorf("%w: username already taken", errConflict)
+	}
+
+	db, err := connectToDB()
+	if err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	defer tx.Rollback()
+
+	//if the user is taking back an old username the alias is not needed anymore
+	if _, err = tx.Exec("DELETE FROM username_aliases WHERE ID_user = ? AND username = ?", u.ID, username); err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	if _, err = tx.Exec("INSERT INTO username_aliases (ID_user, username, expires_at) VALUES (?, ?, ?)", u.ID, u.Username, time.Now().Add(usernameAliasWindow)); err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	//usernameTaken is checked again by the unique key, another user could have taken the username meanwhile
+	if _, err = tx.Exec("UPDATE users SET username = ? WHERE ID = ?", username, u.ID); isDuplicateEntry(err) {
+		return fmt.Errorf("%w: username already taken", errConflict)
+	} else if err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+
+	u.Username = username
+	return nil
+}
+
+//ChangePassword sets the new password if the current one is correct and revokes all the sessions of the user,
+//errWrongPassword is returned if the current password doesn't match
+func (u *User) ChangePassword(current, password string) error {
+	//the users registered with a passkey don't have a current password
+	if u.Password != "" && hashPassword(current) != u.Password {
+		return errWrongPassword
+	}
+	if password == "" {
+		return fmt.Errorf("%w: the new password can't be empty", errBadRequest)
+	}
+	return u.SetPassword(password)
+}
+
+//SetPassword sets the new password and revokes all the sessions of the user
+func (u *User) SetPassword(password string) error {
+	db, err := connectToDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	hashed := hashPassword(password)
+	_, err = db.Exec("UPDATE users SET password = ?, session_version = session_version + 1 WHERE ID = ?", hashed, u.ID)
+	if err != nil {
+		return err
+	}
+	u.Password = hashed
+	u.SessionVersion++
+	return nil
+}
+
+//RevokeSessions invalidates all the jwt issued to the user until now
+func (u *User) RevokeSessions() error {
+	db, err := connectToDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec("UPDATE users SET session_version = session_version + 1 WHERE ID = ?", u.ID)
+	if err != nil {
+		return err
+	}
+	u.SessionVersion++
+	return nil
+}
+
+//for how long the email verification link can be used
+const emailVerificationWindow = 24 * time.Hour
+
+//SetEmail saves the (not verified) email of the user and returns the token used to verify it
+func (u *User) SetEmail(email string) (string, error) {
+	address, err := mail.ParseAddress(strings.TrimSpace(email))
+	if err != nil {
+		return "", fmt.Errorf("%w: invalid email", errBadRequest)
+	}
+	email = address.Address
+
+	db, err := connectToDB()
+	if err != nil {
+		return "", fmt.Errorf("internal server error: %v", err)
+	}
+	defer db.Close()
+
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM users WHERE email = ? AND email_verified AND ID <> ?", email, u.ID).Scan(&count)
+	if err != nil {
+		return "", fmt.Errorf("internal server error: %v", err)
+	}
+	if count > 0 {
+		return "", fmt.Errorf("%w: email already used by another account", errConflict)
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		return "", fmt.Errorf("internal server error: %v", err)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", fmt.Errorf("internal server error: %v", err)
+	}
+	defer tx.Rollback()
+
+	if _, err = tx.Exec("UPDATE users SET email = ?, email_verified = FALSE WHERE ID = ?", email, u.ID); err != nil {
+		return "", fmt.Errorf("internal server error: %v", err)
+	}
+	//only the last verification link is valid
+	if _, err = tx.Exec("DELETE FROM email_verifications WHERE ID_user = ?", u.ID); err != nil {
+		return "", fmt.Errorf("internal server error: %v", err)
+	}
+	if _, err = tx.Exec("INSERT INTO email_verifications (ID_user, email, token, expires_at) VALUES (?, ?, ?, ?)", u.ID, email, hashToken(token), time.Now().Add(emailVerificationWindow)); err != nil {
+		return "", fmt.Errorf("internal server error: %v", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return "", fmt.Errorf("internal server error: %v", err)
+	}
+
+	u.Email = email
+	u.EmailVerified = false
+	return token, nil
+}
+
+//VerifyEmail marks as verified the email the token was issued for, it returns the id of the user
+func VerifyEmail(token string) (int, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	var userID int
+	var email string
+	err = db.QueryRow("SELECT ID_user, email FROM email_verifications WHERE token = ? AND expires_at > NOW()", hashToken(token)).Scan(&userID, &email)
+	if err != nil {
+		return 0, fmt.Errorf("invalid or expired token")
+	}
+
+	//the email could have been changed after the link was sent
+	res, err := db.Exec("UPDATE users SET email_verified = TRUE WHERE ID = ? AND email = ?", userID, email)
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return 0, fmt.Errorf("invalid or expired token")
+	}
+
+	_, err = db.Exec("DELETE FROM email_verifications WHERE ID_user = ?", userID)
+	if err != nil {
+		log.Println("cleanup of email verifications failed:", err)
+	}
+	return userID, nil
+}
+
+//randomToken generates a random hex token of 32 bytes
+func randomToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -1,14 +1,57 @@
 package main
 
 import (
+	"crypto/sha256"
 	"database/sql"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"github.com/go-sql-driver/mysql"
 )
 
+//ER_DUP_ENTRY of mysql and mariadb
+const mysqlDuplicateEntry = 1062
+
+var errAddressNotAllowed = errors.New("the url resolves to a private address")
+
+//newOutgoingClient returns the client for the requests to the urls chosen by the users (webhooks,
+//remote servers), without allowPrivate it refuses the loopback and private addresses. The redirects
+//are not followed, the other server must answer directly
+func newOutgoingClient(timeout time.Duration, allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout}
+	if !allowPrivate {
+		//checked on the resolved address so a public hostname can't point to the internal network
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+				ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+				return errAddressNotAllowed
+			}
+			return nil
+		}
+	}
+
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: &http.Transport{DialContext: dialer.DialContext},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
 func connectToDB() (*sql.DB, error) {
 	db, err := sql.Open("mysql", fmt.Sprintf("%s:%s@tcp(%s:%s)/%s?parseTime=true&charset=utf8mb4", os.Getenv("DATABASE_USER"), os.Getenv("DATABASE_PASSWORD"), os.Getenv("DATABASE_HOST"), os.Getenv("DATABASE_PORT"), os.Getenv("DATABASE_NAME")))
 	if err != nil {
@@ -17,41 +60,128 @@ func connectToDB() (*sql.DB, error) {
 	return db, nil
 }
 
-func returnError(w http.ResponseWriter, code int, message string) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	fmt.Fprintf(w, `{"code": %d, "msg":"%s", "error": true}`, code, message)
+//parseBaseURL checks the public url of the config: only the scheme and the host, es: https://blobber.example.com
+func parseBaseURL(base string) (*url.URL, error) {
+	u, err := url.Parse(base)
+	if err != nil || u.Host == "" || (u.Scheme != "https" && u.Scheme != "http") || (u.Path != "" && u.Path != "/") {
+		return nil, fmt.Errorf("invalid base url %q, es: https://blobber.example.com", base)
+	}
+	return u, nil
+}
+
+//publicURL is the absolute url of path on the public url of the config
+func publicURL(path string) string {
+	return strings.TrimSuffix(conf.BaseURL, "/") + path
+}
+
+//baseURL returns the scheme and host the client used to reach blobber, it can be set by the client
+//so it's only used for the cookie options, the links use publicURL
+func baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	//nginx sets the original scheme
+	if proto := r.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + r.Host
+}
+
+//setCookie applies the options shared by all the cookies: Secure when the client uses https and
+//SameSite lax, so the cookies are not sent by the requests that other sites start, unless the cookie sets another mode
+func setCookie(w http.ResponseWriter, r *http.Request, cookie *http.Cookie) {
+	cookie.Secure = strings.HasPrefix(baseURL(r), "https://")
+	if cookie.SameSite == 0 {
+		cookie.SameSite = http.SameSiteLaxMode
+	}
+	http.SetCookie(w, cookie)
 }
 
-func returnErrorJson(w http.ResponseWriter, code int, message, key string, json []byte) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	fmt.Fprintf(w, `{"code": %d, "msg":"%s", "error": true, "%s": %s}`, code, message, key, json)
+//passwords are saved as the hex of their sha256
+func hashPassword(password string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(password)))
 }
 
-func returnSuccess(w http.ResponseWriter, code int, message string) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	fmt.Fprintf(w, `{"code": %d, "msg":"%s", "error": false}`, code, message)
+//isDuplicateEntry tells if the error is the violation of a unique key
+func isDuplicateEntry(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	return errors.As(err, &mysqlErr) && mysqlErr.Number == mysqlDuplicateEntry
 }
 
-func returnSuccessJson(w http.ResponseWriter, code int, message, key string, json []byte) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(code)
-	fmt.Fprintf(w, `{"code": %d, "msg":"%s", "error": false, "%s": %s}`, code, message, key, json)
+//tokens sent to the users (email verification, password reset, ...) are saved hashed
+//so a leak of the database doesn't leak usable tokens
+func hashToken(token string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(token)))
 }
 
 func checkJWT(w http.ResponseWriter, r *http.Request) (CustomClaims, error) {
-	jwt, err := r.Cookie("JWT")
+	token, err := requestToken(r)
 	if err != nil {
 		returnError(w, http.StatusUnauthorized, "No JWT cookie found")
 		return CustomClaims{}, err
 	}
 
-	jwtContent, err := ParseToken(jwt.Value)
-	if err != nil {
+	jwtContent, err := ParseToken(token)
+	if err != nil || jwtContent.Purpose != "" {
 		returnError(w, http.StatusUnauthorized, "Invalid JWT")
+		return CustomClaims{}, fmt.Errorf("invalid jwt")
+	}
+
+	//the tokens of the oauth apps can call only the routes allowed by their scopes
+	if jwtContent.GrantID != 0 {
+		if err = checkAccessTokenScope(r, jwtContent); err != nil {
+			returnDomainError(w, err)
+			return CustomClaims{}, err
+		}
+	}
+
+	//the jwt is revoked if the session version of the user changed after it was issued (es: password changed)
+	version, err := QuerySessionVersion(jwtContent.UserID)
+	if err != nil && err != sql.ErrNoRows {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
 		return CustomClaims{}, err
 	}
+	if err == sql.ErrNoRows || version != jwtContent.SessionVersion {
+		returnError(w, http.StatusUnauthorized, "Session revoked, login again")
+		return CustomClaims{}, fmt.Errorf("session revoked")
+	}
 	return jwtContent, nil
 }
+
+//requestToken returns the jwt of the request, the Authorization header is used by the oauth apps
+//and the cookie by the browser
+func requestToken(r *http.Request) (string, error) {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer "), nil
+	}
+	cookie, err := r.Cookie("JWT")
+	if err != nil {
+		return "", err
+	}
+	return cookie.Value, nil
+}
+
+//the last page that can be asked, it keeps the offset far from overflowing
+const maxPage = 10000
+
+//read the pagination from the query parameters (?page=1&limit=20), page starts from 1
+//and returns the limit and the offset to use in the sql query
+func getPagination(r *http.Request) (int, int, error) {
+	page, limit := 1, 20
+	var err error
+	if p := r.URL.Query().Get("page"); p != "" {
+		page, err = strconv.Atoi(p)
+		if err != nil || page < 1 || page > maxPage {
+			return 0, 0, fmt.Errorf("invalid page, must be between 1 and %d", maxPage)
+		}
+	}
+
+	if l := r.URL.Query().Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > 100 {
+			return 0, 0, fmt.Errorf("invalid limit, must be between 1 and 100")
+		}
+	}
+	return limit, (page - 1) * limit, nil
+}
@@ -0,0 +1,874 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+//outgoing webhooks: the users register urls subscribed to some events, every event is saved as a
+//delivery for each subscribed webhook and the dispatcher sends them in background. The body is signed
+//with the secret of the webhook: X-Blobber-Signature is "sha256=" + the hex of the hmac-sha256 of
+//X-Blobber-Timestamp + "." + body. The failed deliveries are retried with exponential backoff
+type WebhookConfig struct {
+	//ids of the admin users, they can register global webhooks receiving the events of every user.
+	//The ids are used instead of the usernames since a username can be taken again after a deletion
+	Admins []int `yaml:"admins"`
+	//timeout of a single delivery, es: 10s
+	Timeout string `yaml:"timeout"`
+	//how many times a delivery is tried before giving up
+	MaxAttempts int `yaml:"max_attempts"`
+	//allows the urls resolving to loopback and private addresses, meant for development and tests
+	AllowPrivate bool `yaml:"allow_private"`
+}
+
+//the events a webhook can subscribe to and the description shown in the settings
+var webhookEvents = map[string]string{
+	EventBlobCreated:  "Un nuovo blob è stato pubblicato",
+	EventBlobLiked:    "Un blob ha ricevuto un like",
+	EventUserFollowed: "Un utente ha iniziato a seguire un altro utente",
+}
+
+//the event of the test deliveries, it's sent once and never retried
+const webhookPingEvent = "ping"
+
+const (
+	webhookStatusPending   = "pending"
+	webhookStatusSucceeded = "succeeded"
+	webhookStatusFailed    = "failed"
+)
+
+const (
+	maxWebhooksPerUser = 10
+	//the first retry is after webhookRetryBase, then the wait doubles up to webhookRetryMax
+	webhookRetryBase = time.Second * time.Duration(30)
+	webhookRetryMax  = time.Hour * time.Duration(6)
+	//a claimed delivery not updated within this time (es: the replica died) is sent again
+	webhookClaimDuration = time.Minute * time.Duration(2)
+	webhookBatchSize     = 20
+)
+
+//Webhook is an url registered by a user, the secret is saved in clear since it's needed to sign
+type Webhook struct {
+	ID        int       `json:"id"`
+	OwnerID   int       `json:"owner_id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Global    bool      `json:"global"`
+	CreatedAt time.Time `json:"created_at"`
+	secret    string
+}
+
+//WebhookDelivery is an event sent (or to send) to a webhook, the last attempt is the one saved
+type WebhookDelivery struct {
+	ID            int        `json:"id"`
+	WebhookID     int        `json:"webhook_id"`
+	Event         string     `json:"event"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	ResponseCode  int        `json:"response_code"`
+	Error         string     `json:"error"`
+	CreatedAt     time.Time  `json:"created_at"`
+	NextAttemptAt *time.Time `json:"next_attempt_at"`
+	DeliveredAt   *time.Time `json:"delivered_at"`
+}
+
+type newWebhook struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+	Global bool     `json:"global"`
+}
+
+//the body of every delivery, the id is the same for all the webhooks receiving the event
+type webhookPayload struct {
+	ID        string      `json:"id"`
+	Event     string      `json:"event"`
+	CreatedAt time.Time   `json:"created_at"`
+	Data      interface{} `json:"data"`
+}
+
+//the users in the payloads, only the public fields
+type webhookUser struct {
+	ID       int    `json:"id"`
+	Username string `json:"username"`
+}
+
+//the blob of the events that don't carry its content (es: blob.liked)
+type webhookBlobRef struct {
+	ID     int `json:"id"`
+	UserID int `json:"user_id"`
+}
+
+func isWebhookAdmin(userID int) bool {
+	for _, admin := range conf.Webhooks.Admins {
+		if admin == userID {
+			return true
+		}
+	}
+	return false
+}
+
+//validWebhookURL accepts http and https urls, the address is checked again by the dispatcher on every delivery
+func validWebhookURL(uri string) bool {
+	u, err := url.Parse(uri)
+	if err != nil || u.Host == "" || u.User != nil || len(uri) > 2048 {
+		return false
+	}
+	return u.Scheme == "https" || u.Scheme == "http"
+}
+
+//normalizeWebhookEvents removes the duplicates and rejects the unknown events
+func normalizeWebhookEvents(events []string) ([]string, error) {
+	var normalized []string
+	seen := make(map[string]bool)
+	for _, event := range events {
+		event = strings.TrimSpace(event)
+		if _, ok := webhookEvents[event]; !ok {
+			return nil, fmt.Errorf("%w: unknown event %s", errBadRequest, event)
+		}
+		if !seen[event] {
+			seen[event] = true
+			normalized = append(normalized, event)
+		}
+	}
+	if len(normalized) == 0 {
+		return nil, fmt.Errorf("%w: at least an event is needed", errBadRequest)
+	}
+	return normalized, nil
+}
+
+func (h Webhook) subscribed(event string) bool {
+	for _, e := range h.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+//AddWebhook registers a new webhook of the user, the secret is returned only now
+func (u User) AddWebhook(h newWebhook) (Webhook, string, error) {
+	h.URL = strings.TrimSpace(h.URL)
+	if !validWebhookURL(h.URL) {
+		return Webhook{}, "", fmt.Errorf("%w: invalid url, use http or https", errBadRequest)
+	}
+	events, err := normalizeWebhookEvents(h.Events)
+	if err != nil {
+		return Webhook{}, "", err
+	}
+	if h.Global && !isWebhookAdmin(u.ID) {
+		return Webhook{}, "", fmt.Errorf("%w: only the admins can register global webhooks", errForbidden)
+	}
+
+	secret, err := randomToken()
+	if err != nil {
+		return Webhook{}, "", fmt.Errorf("internal server error: %v", err)
+	}
+
+	db, err := connectToDB()
+	if err != nil {
+		return Webhook{}, "", fmt.Errorf("internal server error: %v", err)
+	}
+	defer db.Close()
+
+	var count int
+	if err = db.QueryRow("SELECT COUNT(*) FROM webhooks WHERE ID_user = ?", u.ID).Scan(&count); err != nil {
+		return Webhook{}, "", fmt.Errorf("internal server error: %v", err)
+	}
+	if count >= maxWebhooksPerUser {
+		return Webhook{}, "", fmt.Errorf("%w: at most %d webhooks per user", errBadRequest, maxWebhooksPerUser)
+	}
+
+	res, err := db.Exec("INSERT INTO webhooks (ID_user, url, secret, events, global) VALUES (?, ?, ?, ?, ?)",
+		u.ID, h.URL, secret, strings.Join(events, " "), h.Global)
+	if err != nil {
+		return Webhook{}, "", fmt.Errorf("internal server error: %v", err)
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return Webhook{}, "", fmt.Errorf("internal server error: %v", err)
+	}
+
+	webhook := Webhook{
+		ID:        int(id),
+		OwnerID:   u.ID,
+		URL:       h.URL,
+		Events:    events,
+		Global:    h.Global,
+		CreatedAt: time.Now(),
+		secret:    secret,
+	}
+	return webhook, secret, nil
+}
+
+const webhookColumnsQuery = "SELECT ID, ID_user, url, secret, events, global, created_at FROM webhooks"
+
+func scanWebhook(row rowScanner) (Webhook, error) {
+	var h Webhook
+	var events string
+	if err := row.Scan(&h.ID, &h.OwnerID, &h.URL, &h.secret, &events, &h.Global, &h.CreatedAt); err != nil {
+		return Webhook{}, err
+	}
+	h.Events = strings.Fields(events)
+	return h, nil
+}
+
+func (u User) GetWebhooks() ([]Webhook, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return []Webhook{}, err
+	}
+	defer db.Close()
+
+	rows, err := db.Query(webhookColumnsQuery+" WHERE ID_user = ? ORDER BY created_at", u.ID)
+	if err != nil {
+		return []Webhook{}, err
+	}
+	defer rows.Close()
+
+	var webhooks []Webhook
+	for rows.Next() {
+		h, err := scanWebhook(rows)
+		if err != nil {
+			return []Webhook{}, err
+		}
+		webhooks = append(webhooks, h)
+	}
+	return webhooks, rows.Err()
+}
+
+//webhook returns the webhook if it belongs to the user
+func (u User) webhook(id int) (Webhook, error) {
+	db, err := connectToDB()
+	if err != nil {
+		return Webhook{}, fmt.Errorf("internal server error: %v", err)
+	}
+	defer db.Close()
+
+	h, err := scanWebhook(db.QueryRow(webhookColumnsQuery+" WHERE ID = ? AND ID_user = ?", id, u.ID))
+	if err == sql.ErrNoRows {
+		return Webhook{}, fmt.Errorf("%w: webhook not found", errBadRequest)
+	}
+	if err != nil {
+		return Webhook{}, fmt.Errorf("internal server error: %v", err)
+	}
+	return h, nil
+}
+
+//DeleteWebhook removes the webhook of the user with its delivery log, the pending deliveries are dropped
+func (u User) DeleteWebhook(id int) error {
+	db, err := connectToDB()
+	if err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec("DELETE FROM webhooks WHERE ID = ? AND ID_user = ?", id, u.ID)
+	if err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("%w: webhook not found", errBadRequest)
+	}
+	if _, err = tx.Exec("DELETE FROM webhook_deliveries WHERE ID_webhook = ?", id); err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	if err = tx.Commit(); err != nil {
+		return fmt.Errorf("internal server error: %v", err)
+	}
+	return nil
+}
+
+const webhookDeliveryColumnsQuery = `SELECT ID, ID_webhook, event, status, attempts, IFNULL(response_code, 0), IFNULL(error, ''),
+	created_at, next_attempt_at, delivered_at FROM webhook_deliveries`
+
+func scanWebhookDelivery(row rowScanner) (WebhookDelivery, error) {
+	var d WebhookDelivery
+	var next, delivered sql.NullTime
+	err := row.Scan(&d.ID, &d.WebhookID, &d.Event, &d.Status, &d.Attempts, &d.ResponseCode, &d.Error, &d.CreatedAt, &next, &delivered)
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	if d.Status == webhookStatusPending && next.Valid {
+		d.NextAttemptAt = &next.Time
+	}
+	if delivered.Valid {
+		d.DeliveredAt = &delivered.Time
+	}
+	return d, nil
+}
+
+//GetWebhookDeliveries returns the last deliveries of the webhook, newest first
+func (u User) GetWebhookDeliveries(id, limit int) ([]WebhookDelivery, error) {
+	if _, err := u.webhook(id); err != nil {
+		return []WebhookDelivery{}, err
+	}
+
+	db, err := connectToDB()
+	if err != nil {
+		return []WebhookDelivery{}, fmt.Errorf("internal server error: %v", err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query(webhookDeliveryColumnsQuery+" WHERE ID_webhook = ? ORDER BY ID DESC LIMIT ?", id, limit)
+	if err != nil {
+		return []WebhookDelivery{}, fmt.Errorf("internal server error: %v", err)
+	}
+	defer rows.Close()
+
+	var deliveries []WebhookDelivery
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return []WebhookDelivery{}, fmt.Errorf("internal server error: %v", err)
+		}
+		deliveries = append(deliveries, d)
+	}
+	if err = rows.Err(); err != nil {
+		return []WebhookDelivery{}, fmt.Errorf("internal server error: %v", err)
+	}
+	return deliveries, nil
+}
+
+//TestWebhook sends a ping to the webhook right away and returns the result, it's saved in the delivery log
+func (u User) TestWebhook(id int) (WebhookDelivery, error) {
+	if webhookDispatcher == nil {
+		return WebhookDelivery{}, fmt.Errorf("internal server error: the webhook dispatcher is not running")
+	}
+	h, err := u.webhook(id)
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+
+	payload, err := newWebhookPayload(webhookPingEvent, map[string]interface{}{"webhook_id": h.ID})
+	if err != nil {
+		return WebhookDelivery{}, fmt.Errorf("internal server error: %v", err)
+	}
+
+	db, err := connectToDB()
+	if err != nil {
+		return WebhookDelivery{}, fmt.Errorf("internal server error: %v", err)
+	}
+	defer db.Close()
+
+	//claimed from the start so the dispatcher doesn't send it too
+	now := time.Now()
+	res, err := db.Exec(`INSERT INTO webhook_deliveries (ID_webhook, event, payload, status, next_attempt_at, claimed_until)
+		VALUES (?, ?, ?, ?, ?, ?)`, h.ID, webhookPingEvent, payload, webhookStatusPending, now, now.Add(webhookClaimDuration))
+	if err != nil {
+		return WebhookDelivery{}, fmt.Errorf("internal server error: %v", err)
+	}
+	deliveryID, err := res.LastInsertId()
+	if err != nil {
+		return WebhookDelivery{}, fmt.Errorf("internal server error: %v", err)
+	}
+
+	webhookDispatcher.attempt(db, claimedWebhookDelivery{
+		id:      int(deliveryID),
+		event:   webhookPingEvent,
+		payload: payload,
+		url:     h.URL,
+		secret:  h.secret,
+	})
+
+	d, err := scanWebhookDelivery(db.QueryRow(webhookDeliveryColumnsQuery+" WHERE ID = ?", deliveryID))
+	if err != nil {
+		return WebhookDelivery{}, fmt.Errorf("internal server error: %v", err)
+	}
+	return d, nil
+}
+
+func newWebhookPayload(event string, data interface{}) ([]byte, error) {
+	id, err := randomToken()
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(webhookPayload{
+		ID:        id[:32],
+		Event:     event,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	})
+}
+
+//publishWebhookEvent saves a delivery for every webhook subscribed to the event that concerns one of
+//the users (and for the global ones), the dispatcher sends them in background. If they can't be saved
+//the relay publishes the event again
+func publishWebhookEvent(event string, userIDs []int, data interface{}) error {
+	if err := enqueueWebhookEvent(event, userIDs, data); err != nil {
+		return fmt.Errorf("webhooks: %s event not saved: %v", event, err)
+	}
+	webhookDispatcher.Wake()
+	return nil
+}
+
+func enqueueWebhookEvent(event string, userIDs []int, data interface{}) error {
+	db, err := connectToDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	query := webhookColumnsQuery + " WHERE global"
+	args := make([]interface{}, len(userIDs))
+	if len(userIDs) > 0 {
+		query += " OR ID_user IN (?" + strings.Repeat(", ?", len(userIDs)-1) + ")"
+		for i, id := range userIDs {
+			args[i] = id
+		}
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	var webhooks []Webhook
+	for rows.Next() {
+		h, err := scanWebhook(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if h.subscribed(event) {
+			webhooks = append(webhooks, h)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil || len(webhooks) == 0 {
+		return err
+	}
+
+	payload, err := newWebhookPayload(event, data)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	values := make([]string, len(webhooks))
+	args = make([]interface{}, 0, len(webhooks)*5)
+	for i, h := range webhooks {
+		values[i] = "(?, ?, ?, ?, ?)"
+		args = append(args, h.ID, event, payload, webhookStatusPending, now)
+	}
+	_, err = db.Exec("INSERT INTO webhook_deliveries (ID_webhook, event, payload, status, next_attempt_at) VALUES "+
+		strings.Join(values, ", "), args...)
+	return err
+}
+
+//subscribeWebhooks turns the domain events into deliveries, synchronously so the relay marks
+//the event only after the deliveries are saved
+func subscribeWebhooks(bus *EventBus) {
+	bus.Subscribe(EventBlobCreated, func(e Event) error {
+		created := e.(BlobCreated)
+		return publishWebhookEvent(EventBlobCreated, []int{created.UserID}, webhookBlobCreated(created))
+	})
+	bus.Subscribe(EventBlobLiked, func(e Event) error {
+		liked := e.(BlobLiked)
+		return publishWebhookEvent(EventBlobLiked, []int{liked.OwnerID, liked.LikerID}, webhookBlobLiked(liked))
+	})
+	bus.Subscribe(EventUserFollowed, func(e Event) error {
+		followed := e.(UserFollowed)
+		return publishWebhookEvent(EventUserFollowed, []int{followed.FollowerID, followed.FollowedID}, webhookUserFollowed(followed))
+	})
+	bus.Subscribe(EventUserDeleted, func(e Event) error {
+		if err := deleteUserWebhooks(e.(UserDeleted).UserID); err != nil {
+			return fmt.Errorf("webhooks: webhooks of the deleted user not removed: %v", err)
+		}
+		return nil
+	})
+}
+
+//the data of the payloads is built from the event, as the blob was when it happened
+func webhookBlobCreated(e BlobCreated) map[string]interface{} {
+	return map[string]interface{}{
+		"blob": Blob{ID: e.BlobID, UserID: e.UserID, Username: e.Username, Content: e.Content, AddedDate: e.At.UTC()},
+	}
+}
+
+func webhookBlobLiked(e BlobLiked) map[string]interface{} {
+	return map[string]interface{}{
+		"blob": webhookBlobRef{e.BlobID, e.OwnerID},
+		"user": webhookUser{e.LikerID, e.Liker},
+	}
+}
+
+func webhookUserFollowed(e UserFollowed) map[string]interface{} {
+	return map[string]interface{}{
+		"follower": webhookUser{e.FollowerID, e.Follower},
+		"followed": webhookUser{e.FollowedID, e.Followed},
+	}
+}
+
+//deleteUserWebhooks removes the webhooks of the user with their deliveries
+func deleteUserWebhooks(userID int) error {
+	db, err := connectToDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	_, err = db.Exec("DELETE d FROM webhook_deliveries d JOIN webhooks w ON w.ID = d.ID_webhook WHERE w.ID_user = ?", userID)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("DELETE FROM webhooks WHERE ID_user = ?", userID)
+	return err
+}
+
+//* dispatcher
+
+//WebhookDispatcher sends the pending deliveries, the replicas claim the deliveries in the database
+//so every delivery is sent by one of them at a time
+type WebhookDispatcher struct {
+	client      *http.Client
+	maxAttempts int
+	interval    time.Duration
+	wake        chan struct{}
+}
+
+var webhookDispatcher *WebhookDispatcher
+
+//a delivery claimed by the dispatcher with what is needed to send it
+type claimedWebhookDelivery struct {
+	id       int
+	event    string
+	payload  []byte
+	attempts int
+	url      string
+	secret   string
+}
+
+//NewWebhookDispatcher applies the defaults (10s timeout, 8 attempts) to the missing values
+func NewWebhookDispatcher(c WebhookConfig) (*WebhookDispatcher, error) {
+	timeout := time.Second * time.Duration(10)
+	if c.Timeout != "" {
+		var err error
+		timeout, err = time.ParseDuration(c.Timeout)
+		if err != nil || timeout <= 0 {
+			return nil, fmt.Errorf("invalid webhook timeout %s", c.Timeout)
+		}
+	}
+	maxAttempts := c.MaxAttempts
+	if maxAttempts <= 0 {
+		maxAttempts = 8
+	}
+
+	return &WebhookDispatcher{
+		client:      newOutgoingClient(timeout, c.AllowPrivate),
+		maxAttempts: maxAttempts,
+		interval:    time.Second * time.Duration(5),
+		wake:        make(chan struct{}, 1),
+	}, nil
+}
+
+//Wake makes the dispatcher look for deliveries now instead of waiting for the next tick
+func (d *WebhookDispatcher) Wake() {
+	if d == nil {
+		return
+	}
+	select {
+	case d.wake <- struct{}{}:
+	default:
+	}
+}
+
+//Run sends the pending deliveries every d.interval or when woken, it never returns so it should be called in a goroutine
+func (d *WebhookDispatcher) Run() {
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+	for {
+		for {
+			sent, err := d.dispatchBatch()
+			if err != nil {
+				log.Printf("webhooks: dispatch failed: %v", err)
+			}
+			//a full batch means there can be more
+			if err != nil || sent < webhookBatchSize {
+				break
+			}
+		}
+		select {
+		case <-ticker.C:
+		case <-d.wake:
+		}
+	}
+}
+
+//dispatchBatch claims and sends the deliveries due, it returns how many were claimed
+func (d *WebhookDispatcher) dispatchBatch() (int, error) {
+	claim, err := randomToken()
+	if err != nil {
+		return 0, err
+	}
+
+	db, err := connectToDB()
+	if err != nil {
+		return 0, err
+	}
+	defer db.Close()
+
+	now := time.Now()
+	_, err = db.Exec(`UPDATE webhook_deliveries SET claim = ?, claimed_until = ?
+		WHERE status = ? AND next_attempt_at <= ? AND (claimed_until IS NULL OR claimed_until < ?)
+		ORDER BY next_attempt_at LIMIT ?`, claim, now.Add(webhookClaimDuration), webhookStatusPending, now, now, webhookBatchSize)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := db.Query(`SELECT d.ID, d.event, d.payload, d.attempts, w.url, w.secret FROM webhook_deliveries d
+		JOIN webhooks w ON w.ID = d.ID_webhook WHERE d.claim = ?`, claim)
+	if err != nil {
+		return 0, err
+	}
+	var deliveries []claimedWebhookDelivery
+	for rows.Next() {
+		var c claimedWebhookDelivery
+		if err = rows.Scan(&c.id, &c.event, &c.payload, &c.attempts, &c.url, &c.secret); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		deliveries = append(deliveries, c)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	//a slow receiver doesn't hold back the others
+	var wg sync.WaitGroup
+	for _, c := range deliveries {
+		wg.Add(1)
+		go func(c claimedWebhookDelivery) {
+			defer wg.Done()
+			d.attempt(db, c)
+		}(c)
+	}
+	wg.Wait()
+	return len(deliveries), nil
+}
+
+//webhookBackoff is the wait before the next attempt after the failed attempt number attempts
+func webhookBackoff(attempts int) time.Duration {
+	wait := webhookRetryBase
+	for i := 1; i < attempts && wait < webhookRetryMax; i++ {
+		wait *= 2
+	}
+	if wait > webhookRetryMax {
+		wait = webhookRetryMax
+	}
+	return wait
+}
+
+func signWebhookPayload(secret, timestamp string, payload []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+//send posts the payload once, it returns the status code of the receiver (0 if there was no answer)
+func (d *WebhookDispatcher) send(c claimedWebhookDelivery) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), d.client.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, strings.NewReader(string(c.payload)))
+	if err != nil {
+		return 0, err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "Blobber-Webhooks/1.0")
+	req.Header.Set("X-Blobber-Event", c.event)
+	req.Header.Set("X-Blobber-Delivery", strconv.Itoa(c.id))
+	req.Header.Set("X-Blobber-Timestamp", timestamp)
+	req.Header.Set("X-Blobber-Signature", signWebhookPayload(c.secret, timestamp, c.payload))
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	//the body is ignored, read a bit of it so the connection can be reused
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("the receiver answered %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+//attempt sends the claimed delivery and saves the result, scheduling the retry if it failed
+func (d *WebhookDispatcher) attempt(db *sql.DB, c claimedWebhookDelivery) {
+	code, err := d.send(c)
+	attempts := c.attempts + 1
+	now := time.Now()
+
+	status := webhookStatusSucceeded
+	var errorMessage sql.NullString
+	var deliveredAt sql.NullTime
+	nextAttempt := now
+	if err != nil {
+		errorMessage = sql.NullString{String: err.Error(), Valid: true}
+		status = webhookStatusPending
+		nextAttempt = now.Add(webhookBackoff(attempts))
+		if attempts >= d.maxAttempts || c.event == webhookPingEvent {
+			status = webhookStatusFailed
+		}
+	} else {
+		deliveredAt = sql.NullTime{Time: now, Valid: true}
+	}
+	var responseCode sql.NullInt64
+	if code != 0 {
+		responseCode = sql.NullInt64{Int64: int64(code), Valid: true}
+	}
+
+	_, err = db.Exec(`UPDATE webhook_deliveries SET status = ?, attempts = ?, response_code = ?, error = ?,
+		next_attempt_at = ?, delivered_at = ?, claim = NULL, claimed_until = NULL WHERE ID = ?`,
+		status, attempts, responseCode, errorMessage, nextAttempt, deliveredAt, c.id)
+	if err != nil {
+		log.Printf("webhooks: result of delivery %d not saved: %v", c.id, err)
+	}
+}
+
+//* handlers
+
+func getWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	user, err := QueryUserByID(jwtContent.UserID, 0)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	webhooks, err := user.GetWebhooks()
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+	webhooksJson, _ := json.Marshal(webhooks)
+	returnSuccessJson(w, http.StatusOK, "Webhooks found", "webhooks", webhooksJson)
+}
+
+func addWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return
+	}
+
+	var post newWebhook
+	if err = json.NewDecoder(r.Body).Decode(&post); err != nil {
+		returnError(w, http.StatusBadRequest, "Invalid json")
+		return
+	}
+
+	user, err := QueryUserByID(jwtContent.UserID, 0)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return
+	}
+
+	webhook, secret, err := user.AddWebhook(post)
+	if err != nil {
+		returnDomainError(w, err)
+		return
+	}
+
+	//the secret is shown only once
+	webhookJson, _ := json.Marshal(struct {
+		Webhook
+		Secret string `json:"secret"`
+	}{webhook, secret})
+	returnSuccessJson(w, http.StatusCreated, "Webhook created", "webhook", webhookJson)
+}
+
+//webhookRequest reads the user and the id of the webhook of the request
+func webhookRequest(w http.ResponseWriter, r *http.Request) (User, int, bool) {
+	jwtContent, err := checkJWT(w, r)
+	if err != nil {
+		return User{}, 0, false
+	}
+
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		returnError(w, http.StatusBadRequest, "Invalid id")
+		return User{}, 0, false
+	}
+
+	user, err := QueryUserByID(jwtContent.UserID, 0)
+	if err != nil {
+		returnError(w, http.StatusInternalServerError, "Internal server error: "+err.Error())
+		return User{}, 0, false
+	}
+	return user, id, true
+}
+
+func deleteWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	user, id, ok := webhookRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if err := user.DeleteWebhook(id); err != nil {
+		returnDomainError(w, err)
+		return
+	}
+	returnSuccess(w, http.StatusOK, "Webhook deleted")
+}
+
+func testWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	user, id, ok := webhookRequest(w, r)
+	if !ok {
+		return
+	}
+
+	delivery, err := user.TestWebhook(id)
+	if err != nil {
+		returnDomainError(w, err)
+		return
+	}
+	deliveryJson, _ := json.Marshal(delivery)
+	returnSuccessJson(w, http.StatusOK, "Test delivery sent", "delivery", deliveryJson)
+}
+
+func getWebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	log.Println(r.Method, r.RequestURI)
+	user, id, ok := webhookRequest(w, r)
+	if !ok {
+		return
+	}
+
+	deliveries, err := user.GetWebhookDeliveries(id, 50)
+	if err != nil {
+		returnDomainError(w, err)
+		return
+	}
+	deliveriesJson, _ := json.Marshal(deliveries)
+	returnSuccessJson(w, http.StatusOK, "Deliveries found", "deliveries", deliveriesJson)
+}
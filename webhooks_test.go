@@ -0,0 +1,370 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+//webhookReceiver is a local receiver that verifies the signature of the deliveries
+type webhookReceiver struct {
+	*httptest.Server
+	secret string
+
+	mu       sync.Mutex
+	status   int
+	received []webhookPayload
+	invalid  int
+}
+
+func newWebhookReceiver(t *testing.T) *webhookReceiver {
+	rec := &webhookReceiver{status: http.StatusOK}
+	rec.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		rec.mu.Lock()
+		defer rec.mu.Unlock()
+
+		timestamp := r.Header.Get("X-Blobber-Timestamp")
+		sent, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil || time.Since(time.Unix(sent, 0)) > time.Minute ||
+			!hmac.Equal([]byte(r.Header.Get("X-Blobber-Signature")), []byte(rec.signature(timestamp, body))) {
+			rec.invalid++
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		var payload webhookPayload
+		if err = json.Unmarshal(body, &payload); err != nil || payload.Event != r.Header.Get("X-Blobber-Event") {
+			rec.invalid++
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		rec.received = append(rec.received, payload)
+		w.WriteHeader(rec.status)
+	}))
+	t.Cleanup(rec.Close)
+	return rec
+}
+
+//signature follows the documentation of the webhooks instead of calling signWebhookPayload
+func (rec *webhookReceiver) signature(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(rec.secret))
+	mac.Write([]byte(timestamp + "." + string(body)))
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func (rec *webhookReceiver) answer(status int) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	rec.status = status
+}
+
+func (rec *webhookReceiver) count() (received, invalid int) {
+	rec.mu.Lock()
+	defer rec.mu.Unlock()
+	return len(rec.received), rec.invalid
+}
+
+//newTestWebhook registers a webhook of the user to the receiver
+func newTestWebhook(t *testing.T, user User, rec *webhookReceiver) Webhook {
+	t.Helper()
+	h, secret, err := user.AddWebhook(newWebhook{URL: rec.URL, Events: []string{EventBlobCreated}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec.secret = secret
+	return h
+}
+
+func newTestDispatcher(t *testing.T, allowPrivate bool) *WebhookDispatcher {
+	t.Helper()
+	d, err := NewWebhookDispatcher(WebhookConfig{Timeout: "2s", MaxAttempts: 3, AllowPrivate: allowPrivate})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+//dispatchAll sends all the deliveries due, the ones left by the other tests too
+func dispatchAll(t *testing.T, d *WebhookDispatcher) {
+	t.Helper()
+	for {
+		sent, err := d.dispatchBatch()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sent < webhookBatchSize {
+			return
+		}
+	}
+}
+
+//lastDelivery returns the last delivery of the webhook
+func lastDelivery(t *testing.T, user User, h Webhook) WebhookDelivery {
+	t.Helper()
+	deliveries, err := user.GetWebhookDeliveries(h.ID, 1)
+	if err != nil || len(deliveries) != 1 {
+		t.Fatalf("deliveries %+v, %v, want 1", deliveries, err)
+	}
+	return deliveries[0]
+}
+
+//makeDue moves the next attempt of the deliveries of the webhook in the past, as if the backoff passed.
+//The new deliveries need it too since the database can round the time of the first attempt up to the next second
+func makeDue(t *testing.T, h Webhook) {
+	t.Helper()
+	db, err := connectToDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err = db.Exec("UPDATE webhook_deliveries SET next_attempt_at = ? WHERE ID_webhook = ?", time.Now().Add(-time.Minute), h.ID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	want := []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute}
+	for i, wait := range want {
+		if got := webhookBackoff(i + 1); got != wait {
+			t.Errorf("backoff after %d attempts: %s, want %s", i+1, got, wait)
+		}
+	}
+	if got := webhookBackoff(100); got != webhookRetryMax {
+		t.Errorf("backoff after 100 attempts: %s, want the max %s", got, webhookRetryMax)
+	}
+}
+
+func TestWebhookAdmins(t *testing.T) {
+	user := newTestUser(t)
+	previous := conf.Webhooks.Admins
+	t.Cleanup(func() { conf.Webhooks.Admins = previous })
+
+	//the admins are the ids of the users, a user named like an id isn't an admin
+	conf.Webhooks.Admins = []int{user.ID + 1}
+	_, _, err := user.AddWebhook(newWebhook{URL: "https://example.com/hook", Events: []string{EventBlobCreated}, Global: true})
+	if !errors.Is(err, errForbidden) {
+		t.Errorf("global webhook of a user that isn't an admin: %v, want forbidden", err)
+	}
+
+	conf.Webhooks.Admins = []int{user.ID}
+	h, _, err := user.AddWebhook(newWebhook{URL: "https://example.com/hook", Events: []string{EventBlobCreated}, Global: true})
+	if err != nil {
+		t.Fatalf("global webhook of an admin: %v", err)
+	}
+	//removed right away so it doesn't receive the events of the other tests
+	if err = user.DeleteWebhook(h.ID); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebhookDelivery(t *testing.T) {
+	user := newTestUser(t)
+	rec := newWebhookReceiver(t)
+	h := newTestWebhook(t, user, rec)
+	d := newTestDispatcher(t, true)
+
+	//the receiver fails: the delivery is kept for a retry after the backoff
+	rec.answer(http.StatusInternalServerError)
+	if err := enqueueWebhookEvent(EventBlobCreated, []int{user.ID}, map[string]string{"content": "signed"}); err != nil {
+		t.Fatal(err)
+	}
+	makeDue(t, h)
+	dispatchAll(t, d)
+	delivery := lastDelivery(t, user, h)
+	if delivery.Status != webhookStatusPending || delivery.Attempts != 1 || delivery.ResponseCode != http.StatusInternalServerError {
+		t.Fatalf("failed delivery %+v, want pending after 1 attempt", delivery)
+	}
+	if delivery.NextAttemptAt == nil || time.Until(*delivery.NextAttemptAt) < 20*time.Second {
+		t.Errorf("next attempt at %v, want after the backoff of %s", delivery.NextAttemptAt, webhookRetryBase)
+	}
+
+	//not due yet, nothing is sent
+	dispatchAll(t, d)
+	if received, _ := rec.count(); received != 1 {
+		t.Errorf("the delivery was sent %d times before the backoff passed", received)
+	}
+
+	rec.answer(http.StatusOK)
+	makeDue(t, h)
+	dispatchAll(t, d)
+	delivery = lastDelivery(t, user, h)
+	if delivery.Status != webhookStatusSucceeded || delivery.Attempts != 2 || delivery.DeliveredAt == nil {
+		t.Errorf("retried delivery %+v, want succeeded after 2 attempts", delivery)
+	}
+	received, invalid := rec.count()
+	if received != 2 || invalid != 0 {
+		t.Errorf("the receiver got %d deliveries and %d with a wrong signature, want 2 and 0", received, invalid)
+	}
+	if rec.received[0].ID != rec.received[1].ID || rec.received[0].Event != EventBlobCreated {
+		t.Errorf("the retry has a different payload: %+v", rec.received)
+	}
+
+	//the signature depends on the secret: a receiver with another secret refuses the ping, that isn't retried
+	previous := webhookDispatcher
+	webhookDispatcher = d
+	t.Cleanup(func() { webhookDispatcher = previous })
+	rec.secret = "another secret"
+	ping, err := user.TestWebhook(h.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, invalid = rec.count(); invalid != 1 || ping.Status != webhookStatusFailed || ping.ResponseCode != http.StatusUnauthorized {
+		t.Errorf("ping signed with another secret %+v, want refused by the receiver", ping)
+	}
+}
+
+func TestWebhookMaxAttempts(t *testing.T) {
+	user := newTestUser(t)
+	rec := newWebhookReceiver(t)
+	h := newTestWebhook(t, user, rec)
+	d := newTestDispatcher(t, true)
+
+	rec.answer(http.StatusServiceUnavailable)
+	if err := enqueueWebhookEvent(EventBlobCreated, []int{user.ID}, nil); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < d.maxAttempts; i++ {
+		makeDue(t, h)
+		dispatchAll(t, d)
+	}
+	delivery := lastDelivery(t, user, h)
+	if delivery.Status != webhookStatusFailed || delivery.Attempts != d.maxAttempts {
+		t.Errorf("delivery %+v, want failed after %d attempts", delivery, d.maxAttempts)
+	}
+
+	//a failed delivery is never sent again
+	makeDue(t, h)
+	dispatchAll(t, d)
+	if received, _ := rec.count(); received != d.maxAttempts {
+		t.Errorf("the receiver got %d attempts, want %d", received, d.maxAttempts)
+	}
+}
+
+func TestWebhookClaim(t *testing.T) {
+	user := newTestUser(t)
+	rec := newWebhookReceiver(t)
+	h := newTestWebhook(t, user, rec)
+
+	const events = 5
+	for i := 0; i < events; i++ {
+		if err := enqueueWebhookEvent(EventBlobCreated, []int{user.ID}, map[string]int{"n": i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	makeDue(t, h)
+
+	//a delivery claimed by a replica that is still sending it is skipped by the others
+	db, err := connectToDB()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var claimedID int
+	if err = db.QueryRow("SELECT MIN(ID) FROM webhook_deliveries WHERE ID_webhook = ?", h.ID).Scan(&claimedID); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("UPDATE webhook_deliveries SET claim = ?, claimed_until = ? WHERE ID = ?", "other replica", time.Now().Add(time.Minute), claimedID)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//two replicas dispatch at the same time, every delivery is sent once
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func(d *WebhookDispatcher) {
+			defer wg.Done()
+			if _, err := d.dispatchBatch(); err != nil {
+				t.Error(err)
+			}
+		}(newTestDispatcher(t, true))
+	}
+	wg.Wait()
+	if received, _ := rec.count(); received != events-1 {
+		t.Errorf("the receiver got %d deliveries, want %d", received, events-1)
+	}
+
+	//the claim of the replica expired (es: it died while sending), the delivery is sent again
+	if _, err = db.Exec("UPDATE webhook_deliveries SET claimed_until = ? WHERE ID = ?", time.Now().Add(-time.Second), claimedID); err != nil {
+		t.Fatal(err)
+	}
+	dispatchAll(t, newTestDispatcher(t, true))
+	if received, _ := rec.count(); received != events {
+		t.Errorf("the receiver got %d deliveries after the claim expired, want %d", received, events)
+	}
+}
+
+func TestWebhookPrivateAddress(t *testing.T) {
+	user := newTestUser(t)
+	rec := newWebhookReceiver(t)
+	h := newTestWebhook(t, user, rec)
+
+	//without AllowPrivate the dispatcher doesn't connect to the local receiver
+	d := newTestDispatcher(t, false)
+	if err := enqueueWebhookEvent(EventBlobCreated, []int{user.ID}, nil); err != nil {
+		t.Fatal(err)
+	}
+	makeDue(t, h)
+	dispatchAll(t, d)
+	if received, invalid := rec.count(); received+invalid != 0 {
+		t.Errorf("the dispatcher connected to a loopback address %d times", received+invalid)
+	}
+	delivery := lastDelivery(t, user, h)
+	if delivery.Status != webhookStatusPending || delivery.ResponseCode != 0 || delivery.Error == "" {
+		t.Errorf("delivery to a private address %+v, want a failed attempt without response", delivery)
+	}
+	if _, err := d.send(claimedWebhookDelivery{url: rec.URL, payload: []byte("{}")}); !errors.Is(err, errAddressNotAllowed) {
+		t.Errorf("send to %s: %v, want %v", rec.URL, err, errAddressNotAllowed)
+	}
+}
+
+func TestWebhookPayloadFromEvent(t *testing.T) {
+	user := newTestUser(t)
+	rec := newWebhookReceiver(t)
+	h := newTestWebhook(t, user, rec)
+	bus := NewEventBus(1)
+	subscribeWebhooks(bus)
+	relay := NewOutboxRelay(bus)
+
+	id, err := AddBlob(user.ID, "as it was created")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the blob changes before the relay publishes the event, the payload has it as it was created
+	blob, err := QueryBlobByID(id, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = blob.Modify("edited later"); err != nil {
+		t.Fatal(err)
+	}
+	drainOutbox(t, relay)
+	makeDue(t, h)
+	dispatchAll(t, newTestDispatcher(t, true))
+
+	if received, _ := rec.count(); received != 1 {
+		t.Fatalf("the receiver got %d deliveries, want 1", received)
+	}
+	data, err := json.Marshal(rec.received[0].Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var created struct {
+		Blob Blob `json:"blob"`
+	}
+	if err = json.Unmarshal(data, &created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Blob.ID != id || created.Blob.Content != "as it was created" || created.Blob.Username != user.Username {
+		t.Errorf("payload %s, want the blob as it was created", data)
+	}
+}